@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// detectAnomalies checks the new metrics, corrected by the Calibrator,
+// against the baselines of their devices, and stores the anomalies found.
+// The baselines of each device are read once, up to its latest new metric,
+// and are corrected by the Calibrator.
+func (env *Env) detectAnomalies(metrics []report.Metric, cal *report.Calibrator) ([]report.Anomaly, error) {
+	byDevice := map[string][]report.Metric{}
+	for _, m := range metrics {
+		deviceID := m.DeviceID.String()
+		byDevice[deviceID] = append(byDevice[deviceID], m)
+	}
+
+	anomalies := []report.Anomaly{}
+	for _, deviceMetrics := range byDevice {
+		deviceID := deviceMetrics[0].DeviceID
+		falsePositives, err := env.Anomalydb.FalsePositiveReadings(deviceID)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read false positives - detectAnomalies")
+			return nil, err
+		}
+
+		latest := deviceMetrics[0].Timestamp
+		for _, m := range deviceMetrics {
+			if m.Timestamp > latest {
+				latest = m.Timestamp
+			}
+		}
+		// The new metrics are stored, so they are part of the history
+		history, err := env.Metricdb.MetBaseline(
+			deviceID, latest, report.AnomalyBaselineSize+int64(len(deviceMetrics)),
+		)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read baseline - detectAnomalies")
+			return nil, err
+		}
+		cal.Apply(history)
+
+		for _, m := range deviceMetrics {
+			baseline := report.BaselineBefore(history, m.Timestamp, report.AnomalyBaselineSize)
+			anomalies = append(anomalies, report.DetectAnomalies(m, baseline, falsePositives)...)
+		}
+	}
+
+	return env.Anomalydb.CreateAnomalies(anomalies)
+}
+
+// AnomalyReport searches the anomalies in the metrics, using the query-tree
+// in "anomaly", ordered by device and time. If the inventory is also
+// searched, only the anomalies for the matching inventory-items are returned.
+func (env *Env) AnomalyReport(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	query, ok := env.readSearchQuery(w, r, "anomaly")
+	if !ok {
+		return
+	}
+	if query.Explain {
+		env.writeExplanation(w, query, "anomaly")
+		return
+	}
+
+	var invSearchResult []report.Inventory
+	if isInventorySearched(query) {
+		// The page applies to the report's results, so all matching
+		// inventory is fetched.
+		invQuery := *query
+		invQuery.Page = nil
+
+		var err error
+		invSearchResult, _, err = env.Inventorydb.InvAdvSearch(&invQuery)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the search Inventory - AnomalyReport")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	anomalyResult, pageResult, err := env.Anomalydb.AnoAdvSearch(invSearchResult, query)
+	if err != nil {
+		err = errors.Wrap(err, "Did not get anomaly query result - AnomalyReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respObject := ReportResponse{
+		Inventory: invSearchResult,
+		Anomaly:   anomalyResult,
+	}
+
+	var resp interface{} = &respObject
+	if pageResult != nil {
+		resp = &PagedResponse{
+			Total:      pageResult.Total,
+			NextCursor: pageResult.NextCursor,
+			Items:      respObject,
+		}
+	}
+
+	anomalyByte, err := json.Marshal(resp)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal Anomaly results - AnomalyReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(anomalyByte)
+}
+
+// FalsePositiveRequest marks an anomaly as a false positive, or unmarks it.
+type FalsePositiveRequest struct {
+	AnomalyID     string `json:"anomaly_id"`
+	FalsePositive bool   `json:"false_positive"`
+}
+
+// AnomalyFalsePositive marks an anomaly as a false positive, which
+// excludes its reading from the baseline of its device:
+//  PUT {"anomaly_id": "<id>", "false_positive": true}
+func (env *Env) AnomalyFalsePositive(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the request body")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	req := &FalsePositiveRequest{}
+	err = json.Unmarshal(body, req)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to unmarshal - AnomalyFalsePositive")
+		log.Println(err)
+		writeValidationErrors(w, report.ValidationErrors{
+			report.ValidationError{
+				Message: err.Error(),
+			},
+		})
+		return
+	}
+
+	anomalyID, err := uuuid.FromString(req.AnomalyID)
+	if err != nil {
+		err = errors.Wrap(err, "Invalid anomaly_id")
+		log.Println(err)
+		writeValidationErrors(w, report.ValidationErrors{
+			report.ValidationError{
+				Path:    "anomaly_id",
+				Message: err.Error(),
+			},
+		})
+		return
+	}
+
+	anomaly, err := env.Anomalydb.MarkFalsePositive(anomalyID, req.FalsePositive)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to mark anomaly - AnomalyFalsePositive")
+		log.Println(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	anomalyByte, err := json.Marshal(anomaly)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal anomaly - AnomalyFalsePositive")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(anomalyByte)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// calibrator creates the Calibrator from the calibration-profiles of the
+// devices, converting into the output-units.
+func (env *Env) calibrator(deviceIDs []string, units map[string]string) (*report.Calibrator, error) {
+	calibrations := []report.Calibration{}
+	// Calibrations reads the profiles of all devices for nil deviceIDs
+	if len(deviceIDs) > 0 {
+		var err error
+		calibrations, err = env.Calibrationdb.Calibrations(deviceIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report.NewCalibrator(calibrations, units), nil
+}
+
+// inventoryDevices returns the DeviceIDs of the inventory-items,
+// whose metrics are calibrated by the profiles of these devices.
+func inventoryDevices(inventory []report.Inventory) []string {
+	deviceIDs := []string{}
+	seen := map[string]bool{}
+	for _, inv := range inventory {
+		deviceID := inv.DeviceID.String()
+		if !seen[deviceID] && deviceID != (uuuid.UUID{}).String() {
+			seen[deviceID] = true
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	return deviceIDs
+}
+
+// metricDevices returns the DeviceIDs of the metrics.
+func metricDevices(metrics []report.Metric) []string {
+	deviceIDs := []string{}
+	seen := map[string]bool{}
+	for _, m := range metrics {
+		deviceID := m.DeviceID.String()
+		if !seen[deviceID] && deviceID != (uuuid.UUID{}).String() {
+			seen[deviceID] = true
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	return deviceIDs
+}
+
+// calibrated returns a copy of the metrics, corrected into the canonical
+// units by the returned Calibrator, such as for evaluating them against
+// the ProductThresholds.
+func (env *Env) calibrated(metrics []report.Metric) ([]report.Metric, *report.Calibrator, error) {
+	cal, err := env.calibrator(metricDevices(metrics), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	calibrated := append([]report.Metric{}, metrics...)
+	cal.Apply(calibrated)
+	return calibrated, cal, nil
+}
+
+// Calibration manages the calibration-profiles of the devices:
+//  GET    ?device_id=<id>                           lists the profiles (of all devices without device_id)
+//  PUT    {device_id, effective_from, channels}     stores a profile, replacing the one with its effective_from
+//  DELETE ?device_id=<id>&effective_from=<unix>     deletes a profile
+// The channels are corrected as {"temp_in": {"unit": "F", "offset": -0.5, "gain": 1.02}}.
+// The profiles are applied to the readings when they are read, so changes
+// also apply to the stored readings.
+func (env *Env) Calibration(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	var result interface{}
+
+	switch r.Method {
+	case "GET":
+		var deviceIDs []string
+		if deviceID := r.URL.Query().Get("device_id"); deviceID != "" {
+			id, err := uuuid.FromString(deviceID)
+			if err != nil {
+				err = errors.Wrap(err, "Invalid device_id - Calibration")
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			deviceIDs = []string{id.String()}
+		}
+		calibrations, err := env.Calibrationdb.Calibrations(deviceIDs)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to list calibrations - Calibration")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		result = calibrations
+
+	case "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the request body")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		calibration := &report.Calibration{}
+		err = json.Unmarshal(body, calibration)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to unmarshal - Calibration")
+			log.Println(err)
+			writeValidationErrors(w, report.ValidationErrors{
+				report.ValidationError{
+					Message: err.Error(),
+				},
+			})
+			return
+		}
+		if verrs := calibration.Validate(); verrs != nil {
+			writeValidationErrors(w, verrs)
+			return
+		}
+
+		result, err = env.Calibrationdb.SaveCalibration(calibration)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to store calibration - Calibration")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+	case "DELETE":
+		deviceID, err := uuuid.FromString(r.URL.Query().Get("device_id"))
+		if err != nil {
+			err = errors.Wrap(err, "Invalid device_id - Calibration")
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		effectiveFrom, err := strconv.ParseInt(r.URL.Query().Get("effective_from"), 10, 64)
+		if err != nil {
+			err = errors.Wrap(err, "Invalid effective_from - Calibration")
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = env.Calibrationdb.DeleteCalibration(deviceID, effectiveFrom)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to delete calibration - Calibration")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resultByte, err := json.Marshal(result)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal calibration results - Calibration")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(resultByte)
+}
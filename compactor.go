@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/pkg/errors"
+)
+
+// compactionChunk is the time-range rolled up by each aggregation.
+const compactionChunk = 24 * 60 * 60
+
+// runCompactor compacts the metrics now and after every interval.
+func (env *Env) runCompactor(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		err := env.compactMetrics(time.Now())
+		if err != nil {
+			err = errors.Wrap(err, "Unable to compact metrics - runCompactor")
+			log.Println(err)
+		}
+		<-ticker.C
+	}
+}
+
+// compactMetrics rolls up the raw metrics of the completed intervals since
+// the latest rollup, and then deletes the metrics and rollups which are
+// older than the RetentionPolicy allows.
+func (env *Env) compactMetrics(now time.Time) error {
+	policy := env.Retention
+	end := now.Unix() - now.Unix()%policy.Interval
+
+	firstMetric, _, err := env.Metricdb.TimestampRange()
+	if err != nil {
+		return err
+	}
+	_, lastRollup, err := env.MetricRollupdb.TimestampRange()
+	if err != nil {
+		return err
+	}
+
+	// Only the Lookback before the latest rollup is recompacted, since
+	// older rollups can be of raw metrics which are already deleted
+	start := firstMetric
+	if lookback := lastRollup - int64(policy.Lookback.Seconds()); lastRollup != 0 && lookback > start {
+		start = lookback
+	}
+	start = start - start%policy.Interval
+
+	for from := start; firstMetric != 0 && from < end; from += compactionChunk {
+		to := from + compactionChunk
+		if to > end {
+			to = end
+		}
+		compacted, err := env.Metricdb.CompactMetrics(from, to, policy.Interval)
+		if err != nil {
+			return err
+		}
+		err = env.MetricRollupdb.ReplaceCompacted(from, to, compacted)
+		if err != nil {
+			return err
+		}
+	}
+
+	deleted, err := env.Metricdb.DeleteBefore(policy.RawCutoff(now), policy.BatchSize)
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d expired metrics", deleted)
+	}
+
+	if rollupCutoff := policy.RollupCutoff(now); rollupCutoff > 0 {
+		deleted, err = env.MetricRollupdb.DeleteBefore(rollupCutoff, policy.BatchSize)
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			log.Printf("Deleted %d expired metric rollups", deleted)
+		}
+	}
+	return nil
+}
+
+// splitSearch returns the searches of the rollups and of the raw metrics
+// (see RetentionPolicy.SplitSearch), if the search reaches back past the
+// raw retention. Otherwise the search of the rollups is nil, and the raw
+// metrics are searched as requested.
+func (env *Env) splitSearch(query *report.SearchQuery) (*report.SearchQuery, *report.SearchQuery, error) {
+	now := time.Now()
+	useRollups, err := env.Retention.UsesRollups(query, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !useRollups {
+		return nil, query, nil
+	}
+	rollupQuery, rawQuery := env.Retention.SplitSearch(query, now)
+	return rollupQuery, rawQuery, nil
+}
+
+// splitItems returns the metric query-trees of the rollups and of the raw
+// metrics of the items, which are ANDed with the metric query-tree, if any
+// of the items arrived before the raw retention. Otherwise the query-tree
+// of the rollups is nil, and the raw metrics of the items are read with
+// the metric query-tree.
+func (env *Env) splitItems(inventory []report.Inventory, metric *report.QueryNode) (*report.QueryNode, *report.QueryNode) {
+	if env.Retention == nil {
+		return nil, metric
+	}
+	now := time.Now()
+	rawCutoff := env.Retention.RawCutoff(now)
+	for _, inv := range inventory {
+		if inv.DateArrived < rawCutoff {
+			rollupQuery, rawQuery := env.Retention.SplitSearch(&report.SearchQuery{Metric: metric}, now)
+			return rollupQuery.Metric, rawQuery.Metric
+		}
+	}
+	return nil, metric
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/pkg/errors"
+)
+
+// WasteCorrelationReport correlates the waste of the matching inventory
+// with the mean and peak readings it was exposed to, per product and per
+// origin. The request-body is a CorrelationQuery, with an optional
+// "correlation" to correlate by lot instead of item:
+//  {"inventory": [...], "correlation": {"unit": "lot"}}
+func (env *Env) WasteCorrelationReport(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	query := &report.CorrelationQuery{}
+	if !env.readReportQuery(w, r, query, "") {
+		return
+	}
+	if query.Explain {
+		writeExplainUnsupported(w)
+		return
+	}
+
+	// The correlations need the weights of all matching items
+	invQuery := query.SearchQuery
+	invQuery.Page = nil
+	invQuery.Fields = nil
+
+	invSearchResult, _, err := env.Inventorydb.InvAdvSearch(&invQuery)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the search Inventory - WasteCorrelationReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	cal, err := env.calibrator(inventoryDevices(invSearchResult), query.Units)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the calibrations - WasteCorrelationReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Items which arrived before the raw retention are read from the
+	// rollups, and from the raw metrics from the raw retention onward
+	rollupQuery, rawQuery := env.splitItems(invSearchResult, query.Metric)
+	exposures, err := env.Metricdb.ItemExposures(invSearchResult, rawQuery, cal)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the item exposures - WasteCorrelationReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if rollupQuery != nil {
+		rollupExposures, err := env.MetricRollupdb.ItemExposures(invSearchResult, rollupQuery, cal)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the item exposures of the rollups - WasteCorrelationReport")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		exposures = report.MergeExposures(rollupExposures, exposures)
+	}
+
+	correlations := report.CorrelateWaste(invSearchResult, exposures, query.Correlation)
+	correlationByte, err := json.Marshal(correlations)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal correlations - WasteCorrelationReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(correlationByte)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// donationAttempts is how often a donation is checked against the donated
+// weight left of its item, when other donations of the item are recorded
+// concurrently.
+const donationAttempts = 3
+
+// donationRecorded returns the weight of the recorded donations of the
+// item from its counter. The counter of an item without one is seeded with
+// the donations recorded before.
+func (env *Env) donationRecorded(itemID string) (float64, error) {
+	recorded, ok, err := env.Inventorydb.DonationRecorded(itemID)
+	if err != nil || ok {
+		return recorded, err
+	}
+
+	donations, err := env.Donationdb.Donations(report.DonationFilter{
+		ItemIDs: []string{itemID},
+	})
+	if err != nil {
+		return 0, err
+	}
+	recorded = 0
+	for _, d := range donations {
+		recorded += d.Weight
+	}
+	err = env.Inventorydb.SeedDonationRecorded(itemID, recorded)
+	if err != nil {
+		return 0, err
+	}
+	// The counter may have been seeded by a concurrent donation first
+	recorded, _, err = env.Inventorydb.DonationRecorded(itemID)
+	return recorded, err
+}
+
+// recordDonation completes the donation from its inventory-item and stores
+// it. Its weight is reserved on the counter of the item before it is
+// stored, so that concurrent donations cannot exceed the item's
+// donate_weight together. The problems with the donation are returned as
+// ValidationErrors.
+func (env *Env) recordDonation(donation *report.Donation) (*report.Donation, report.ValidationErrors, error) {
+	itemID := donation.ItemID.String()
+	requested := donation.Weight
+
+	for attempt := 0; attempt < donationAttempts; attempt++ {
+		items, err := env.Inventorydb.InventoryByIDs([]string{itemID})
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(items) == 0 {
+			return nil, report.ValidationErrors{
+				report.ValidationError{
+					Path:    "item_id",
+					Message: "No inventory found with item_id " + itemID,
+				},
+			}, nil
+		}
+
+		recorded, err := env.donationRecorded(itemID)
+		if err != nil {
+			return nil, nil, err
+		}
+		donation.Weight = requested
+		if verrs := donation.FromInventory(items[0], recorded, time.Now()); verrs != nil {
+			return nil, verrs, nil
+		}
+
+		reserved, err := env.Inventorydb.ReserveDonation(items[0], donation.Weight)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Another donation of the item was recorded since its counter was read
+		if !reserved {
+			continue
+		}
+
+		inserted, err := env.Donationdb.InsertDonation(donation)
+		if err != nil {
+			releaseErr := env.Inventorydb.ReleaseDonation(itemID, donation.Weight)
+			if releaseErr != nil {
+				releaseErr = errors.Wrap(releaseErr, "Unable to release the donated weight - recordDonation")
+				log.Println(releaseErr)
+			}
+			return nil, nil, err
+		}
+		return inserted, nil, nil
+	}
+	return nil, nil, errors.Errorf(
+		"Unable to reserve the donated weight of item %s in %d attempts - recordDonation",
+		itemID, donationAttempts,
+	)
+}
+
+// Donation records who the donated weight of the inventory-items went to:
+//  GET    ?item_id=<id>&rs_customer_id=<id>&recipient=<name>  lists the donations
+//  POST   {item_id, recipient, recipient_tax_id, weight, donated_at}
+//  DELETE ?donation_id=<id>                                    deletes a donation
+// The weight defaults to the rest of the item's donate_weight, and the
+// donations of an item cannot exceed its donate_weight. The fair-market
+// value is the price of the item when the donation is recorded.
+func (env *Env) Donation(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	var result interface{}
+
+	switch r.Method {
+	case "GET":
+		filter := report.DonationFilter{
+			Recipient: r.URL.Query().Get("recipient"),
+		}
+		if itemID := r.URL.Query().Get("item_id"); itemID != "" {
+			id, err := uuuid.FromString(itemID)
+			if err != nil {
+				err = errors.Wrap(err, "Invalid item_id - Donation")
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			filter.ItemIDs = []string{id.String()}
+		}
+		if customerID := r.URL.Query().Get("rs_customer_id"); customerID != "" {
+			id, err := uuuid.FromString(customerID)
+			if err != nil {
+				err = errors.Wrap(err, "Invalid rs_customer_id - Donation")
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			filter.RsCustomerID = id.String()
+		}
+		donations, err := env.Donationdb.Donations(filter)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to list donations - Donation")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		result = donations
+
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the request body")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		donation := &report.Donation{}
+		err = json.Unmarshal(body, donation)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to unmarshal - Donation")
+			log.Println(err)
+			writeValidationErrors(w, report.ValidationErrors{
+				report.ValidationError{
+					Message: err.Error(),
+				},
+			})
+			return
+		}
+		if verrs := donation.Validate(); verrs != nil {
+			writeValidationErrors(w, verrs)
+			return
+		}
+
+		donation, verrs, err := env.recordDonation(donation)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to record donation - Donation")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if verrs != nil {
+			writeValidationErrors(w, verrs)
+			return
+		}
+		result = donation
+
+	case "DELETE":
+		donationID, err := uuuid.FromString(r.URL.Query().Get("donation_id"))
+		if err != nil {
+			err = errors.Wrap(err, "Invalid donation_id - Donation")
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		deleted, err := env.Donationdb.DeleteDonation(donationID)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to delete donation - Donation")
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// The weight of the donation can be donated again
+		err = env.Inventorydb.ReleaseDonation(deleted.ItemID.String(), deleted.Weight)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to release the donated weight - Donation")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resultByte, err := json.Marshal(result)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal donation results - Donation")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(resultByte)
+}
+
+// DonationReport totals the donated weight and fair-market value per
+// customer, recipient and period. The request-body is a DonationQuery, where
+// the inventory query-tree selects the donated items (all items if it is
+// not set), and "donation" selects the donations and the period:
+//  {"inventory": [...], "donation": {"rs_customer_id": "<id>", "from": 1514764800, "period": "month"}}
+func (env *Env) DonationReport(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	query := &report.DonationQuery{}
+	if !env.readReportQuery(w, r, query, "") {
+		return
+	}
+	if query.Explain {
+		writeExplainUnsupported(w)
+		return
+	}
+
+	var itemIDs []string
+	if isInventorySearched(&query.SearchQuery) {
+		invQuery := query.SearchQuery
+		invQuery.Page = nil
+		fields := report.FieldSet{}
+		if query.Fields != nil {
+			fields = *query.Fields
+		}
+		fields.Inventory = []string{"item_id"}
+		invQuery.Fields = &fields
+
+		invSearchResult, _, err := env.Inventorydb.InvAdvSearch(&invQuery)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the search Inventory - DonationReport")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		itemIDs = []string{}
+		for _, inv := range invSearchResult {
+			itemIDs = append(itemIDs, inv.ItemID.String())
+		}
+	}
+
+	totals, err := env.Donationdb.DonationTotals(query.Donation, itemIDs)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to total the donations - DonationReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	totalsByte, err := json.Marshal(totals)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal donation totals - DonationReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(totalsByte)
+}
+
+// DonationStatement lists the donations of a customer in a year, quarter
+// or month by recipient, with their donated weight and fair-market value,
+// for the customer's accountants:
+//  GET ?rs_customer_id=<id>&period=2018-Q4&format=csv
+// The statement is JSON, unless the format is "csv".
+func (env *Env) DonationStatement(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	verrs := report.ValidationErrors{}
+	customerID, err := uuuid.FromString(r.URL.Query().Get("rs_customer_id"))
+	if err != nil {
+		verrs = append(verrs, report.ValidationError{
+			Path:    "rs_customer_id",
+			Message: err.Error(),
+		})
+	}
+	period := r.URL.Query().Get("period")
+	from, to, err := report.ParseStatementPeriod(period)
+	if err != nil {
+		verrs = append(verrs, report.ValidationError{
+			Path:    "period",
+			Message: err.Error(),
+		})
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		verrs = append(verrs, report.ValidationError{
+			Path:    "format",
+			Message: "Invalid format " + format + ", expected json or csv",
+		})
+	}
+	if len(verrs) > 0 {
+		writeValidationErrors(w, verrs)
+		return
+	}
+
+	donations, err := env.Donationdb.Donations(report.DonationFilter{
+		RsCustomerID: customerID.String(),
+		From:         from,
+		To:           to,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the donations - DonationStatement")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	statement, err := report.NewDonationStatement(customerID, period, donations, time.Now())
+	if err != nil {
+		err = errors.Wrap(err, "Unable to create the statement - DonationStatement")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set(
+			"Content-Disposition",
+			"attachment; filename=donations-"+customerID.String()+"-"+period+".csv",
+		)
+		err = statement.WriteCSV(w)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to write the statement - DonationStatement")
+			log.Println(err)
+		}
+		return
+	}
+
+	statementByte, err := json.Marshal(statement)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal the statement - DonationStatement")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(statementByte)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/pkg/errors"
+)
+
+// ExpiryRiskReport lists the matching items which expire within the
+// horizon and still have unsold weight, ranked by their value at risk,
+// with a suggested action (markdown, donate or move) for each.
+// The request-body is an ExpiryRiskQuery, with an optional "expiry_risk" to set
+// the horizon, and rules to use instead of the configured rules:
+//  {"inventory": [...], "expiry_risk": {"horizon": "48h", "rules": [{"action": "donate", "max_hours_left": 12}]}}
+func (env *Env) ExpiryRiskReport(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	query := &report.ExpiryRiskQuery{}
+	if !env.readReportQuery(w, r, query, "") {
+		return
+	}
+	if query.Explain {
+		writeExplainUnsupported(w)
+		return
+	}
+
+	horizon, err := query.ExpiryRisk.HorizonSeconds()
+	if err != nil {
+		err = errors.Wrap(err, "Invalid horizon - ExpiryRiskReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rules := env.ExpiryRules
+	if query.ExpiryRisk != nil && len(query.ExpiryRisk.Rules) > 0 {
+		rules = query.ExpiryRisk.Rules
+	}
+
+	now := time.Now()
+	inventory, err := env.Inventorydb.ExpiringInventory(&query.SearchQuery, now.Unix(), now.Unix()+horizon)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the expiring inventory - ExpiryRiskReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	risks := report.AssessExpiryRisk(inventory, horizon, rules, now)
+	riskByte, err := json.Marshal(risks)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal expiry risks - ExpiryRiskReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(riskByte)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/pkg/errors"
+)
+
+// ExplainResponse contains the Explanations of the searches run by a report.
+type ExplainResponse struct {
+	Inventory *report.Explanation `json:"inventory,omitempty"`
+	Metric    *report.Explanation `json:"metric,omitempty"`
+	// MetricRollup is set when the rollups of the metrics are also read
+	MetricRollup *report.Explanation `json:"metric_rollup,omitempty"`
+	Device       *report.Explanation `json:"device,omitempty"`
+	Warning      *report.Explanation `json:"warning,omitempty"`
+	Anomaly      *report.Explanation `json:"anomaly,omitempty"`
+}
+
+// writeExplanation writes how the searches of the report on the entity
+// ("inventory", "metric", "device", "warning" or "anomaly") would run for the query.
+// Other entities are joined on the matching inventory, so only the IDs
+// of the matching inventory are fetched for explaining them.
+func (env *Env) writeExplanation(w http.ResponseWriter, query *report.SearchQuery, entity string) {
+	resp := &ExplainResponse{}
+
+	// Warnings and anomalies are only joined on inventory if it is searched
+	searchesInv := (entity != "warning" && entity != "anomaly") || isInventorySearched(query)
+
+	var invSearchResult []report.Inventory
+	if searchesInv {
+		invQuery := *query
+		if entity != "inventory" {
+			// The page applies to the report's results
+			invQuery.Page = nil
+		}
+
+		var err error
+		resp.Inventory, err = env.Inventorydb.InvExplain(&invQuery)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to explain the Inventory search - writeExplanation")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		invSearchResult = []report.Inventory{}
+		if entity != "inventory" && resp.Inventory.EstimatedCount > 0 {
+			fields := report.FieldSet{}
+			if query.Fields != nil {
+				fields = *query.Fields
+			}
+			fields.Inventory = []string{"item_id", "device_id"}
+			invQuery.Fields = &fields
+
+			invSearchResult, _, err = env.Inventorydb.InvAdvSearch(&invQuery)
+			if err != nil {
+				err = errors.Wrap(err, "Unable to read the search Inventory - writeExplanation")
+				log.Println(err)
+				invSearchResult = []report.Inventory{}
+			}
+		}
+	}
+
+	var err error
+	switch entity {
+	case "metric":
+		// The metrics are filtered and sorted on their corrected readings
+		var cal *report.Calibrator
+		cal, err = env.calibrator(inventoryDevices(invSearchResult), query.Units)
+		var rollupQuery, rawQuery *report.SearchQuery
+		if err == nil {
+			rollupQuery, rawQuery, err = env.splitSearch(query)
+		}
+		if err == nil {
+			resp.Metric, err = env.Metricdb.MetExplain(invSearchResult, rawQuery, cal)
+		}
+		if err == nil && rollupQuery != nil {
+			resp.MetricRollup, err = env.MetricRollupdb.MetExplain(invSearchResult, rollupQuery, cal)
+		}
+	case "device":
+		resp.Device, err = env.Devicedb.DevExplain(invSearchResult, query)
+	case "warning":
+		resp.Warning, err = env.Warningdb.WarnExplain(invSearchResult, query)
+	case "anomaly":
+		resp.Anomaly, err = env.Anomalydb.AnoExplain(invSearchResult, query)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "Unable to explain the search - writeExplanation")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respByte, err := json.Marshal(resp)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal explanation - writeExplanation")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(respByte)
+}
+
+// writeExplainUnsupported rejects explaining the reports which aggregate
+// or combine their searches, since writeExplanation only explains the
+// searches of the search-reports.
+func writeExplainUnsupported(w http.ResponseWriter) {
+	writeValidationErrors(w, report.ValidationErrors{
+		report.ValidationError{
+			Path:    "explain",
+			Message: "Explain is not supported by this report",
+		},
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// FlashSaleStatusRequest moves a flash sale to the next status of its
+// lifecycle.
+type FlashSaleStatusRequest struct {
+	SaleID string `json:"sale_id"`
+	Status string `json:"status"`
+}
+
+// flashSaleItems returns the ItemIDs of the flash sales with
+// the statuses.
+func (env *Env) flashSaleItems(statuses ...string) (map[string]bool, error) {
+	items := map[string]bool{}
+	for _, status := range statuses {
+		sales, err := env.FlashSaledb.FlashSales(status, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, sale := range sales {
+			items[sale.ItemID.String()] = true
+		}
+	}
+	return items, nil
+}
+
+// proposeFlashSales proposes and stores flash sales for the expiring items
+// matching the query, which have no open (proposed or active) flash sale.
+func (env *Env) proposeFlashSales(query *report.FlashSaleQuery, now time.Time) ([]report.FlashSale, error) {
+	horizon, err := query.FlashSale.HorizonSeconds()
+	if err != nil {
+		return nil, err
+	}
+	inventory, err := env.Inventorydb.ExpiringInventory(&query.SearchQuery, now.Unix(), now.Unix()+horizon)
+	if err != nil {
+		return nil, err
+	}
+	open, err := env.flashSaleItems(report.FlashSaleProposed, report.FlashSaleActive)
+	if err != nil {
+		return nil, err
+	}
+
+	// The readings are calibrated by the profiles of the devices
+	// of the items, which are read once for all devices
+	cal, err := env.calibrator(inventoryDevices(inventory), nil)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the calibrations - proposeFlashSales")
+		log.Println(err)
+	}
+
+	// The recent ethylene of the devices of the items
+	ethylene := map[string]float64{}
+	for _, inv := range inventory {
+		deviceID := inv.DeviceID.String()
+		if _, ok := ethylene[deviceID]; ok || deviceID == (uuuid.UUID{}).String() {
+			continue
+		}
+		recent, err := env.Metricdb.MetBaseline(
+			inv.DeviceID, now.Unix()+1, report.FlashSaleEthyleneReadings,
+		)
+		if err != nil {
+			return nil, err
+		}
+		cal.Apply(recent)
+		if eth, ok := report.RecentEthylene(recent); ok {
+			ethylene[deviceID] = eth
+		}
+	}
+
+	sales, err := report.ProposeFlashSales(inventory, ethylene, open, query.FlashSale, now)
+	if err != nil {
+		return nil, err
+	}
+	return env.FlashSaledb.InsertFlashSales(sales)
+}
+
+// measureUplift compares the item of the flash sale with the items of its
+// product which were not discounted.
+func (env *Env) measureUplift(sale *report.FlashSale, now time.Time) error {
+	items, err := env.Inventorydb.InventoryByIDs([]string{sale.ItemID.String()})
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return errors.Errorf("No inventory found with item_id %s", sale.ItemID)
+	}
+
+	discounted, err := env.flashSaleItems(report.FlashSaleActive, report.FlashSaleEnded)
+	if err != nil {
+		return err
+	}
+	exclude := []string{}
+	for itemID := range discounted {
+		exclude = append(exclude, itemID)
+	}
+	peers, err := env.Inventorydb.FlashSalePeers(items[0], exclude)
+	if err != nil {
+		return err
+	}
+
+	sale.Uplift = report.MeasureUplift(items[0], peers, now)
+	return nil
+}
+
+// FlashSale manages the flash sales (markdowns) of expiring items:
+//  GET    ?status=<status>&item_id=<id>   lists the flash sales
+//  POST   {inventory, flash_sale, ...}    proposes flash sales for the matching items
+//  PUT    {sale_id, status}               starts ("active") or ends ("ended") a flash sale
+//  DELETE ?sale_id=<id>                   rejects a proposed flash sale
+// Proposals are for the items expiring within the horizon, and are
+// discounted by the days left until expiry and their recent ethylene:
+//  {"inventory": [...], "flash_sale": {"horizon": "48h", "max_discount_pct": 40}}
+// Ending a flash sale measures its uplift over similar items which were
+// not discounted. Ending an ended flash sale measures it again.
+func (env *Env) FlashSale(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	var result interface{}
+
+	switch r.Method {
+	case "GET":
+		var itemIDs []string
+		if itemID := r.URL.Query().Get("item_id"); itemID != "" {
+			id, err := uuuid.FromString(itemID)
+			if err != nil {
+				err = errors.Wrap(err, "Invalid item_id - FlashSale")
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			itemIDs = []string{id.String()}
+		}
+		sales, err := env.FlashSaledb.FlashSales(r.URL.Query().Get("status"), itemIDs)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to list flash sales - FlashSale")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		result = sales
+
+	case "POST":
+		query := &report.FlashSaleQuery{}
+		if !env.readReportQuery(w, r, query, "") {
+			return
+		}
+		if query.Explain {
+			writeExplainUnsupported(w)
+			return
+		}
+
+		sales, err := env.proposeFlashSales(query, time.Now())
+		if err != nil {
+			err = errors.Wrap(err, "Unable to propose flash sales - FlashSale")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		result = sales
+
+	case "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the request body")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		req := &FlashSaleStatusRequest{}
+		err = json.Unmarshal(body, req)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to unmarshal - FlashSale")
+			log.Println(err)
+			writeValidationErrors(w, report.ValidationErrors{
+				report.ValidationError{
+					Message: err.Error(),
+				},
+			})
+			return
+		}
+		saleID, err := uuuid.FromString(req.SaleID)
+		if err != nil {
+			err = errors.Wrap(err, "Invalid sale_id")
+			log.Println(err)
+			writeValidationErrors(w, report.ValidationErrors{
+				report.ValidationError{
+					Path:    "sale_id",
+					Message: err.Error(),
+				},
+			})
+			return
+		}
+
+		sale, err := env.FlashSaledb.FlashSaleByID(saleID)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the flash sale - FlashSale")
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		from := sale.Status
+		err = report.ValidateFlashSaleTransition(from, req.Status)
+		if err != nil {
+			writeValidationErrors(w, report.ValidationErrors{
+				report.ValidationError{
+					Path:    "status",
+					Message: err.Error(),
+				},
+			})
+			return
+		}
+
+		now := time.Now()
+		sale.Status = req.Status
+		switch req.Status {
+		case report.FlashSaleActive:
+			sale.StartedAt = now.Unix()
+		case report.FlashSaleEnded:
+			if sale.EndedAt == 0 {
+				sale.EndedAt = now.Unix()
+			}
+			err = env.measureUplift(sale, now)
+			if err != nil {
+				err = errors.Wrap(err, "Unable to measure the uplift - FlashSale")
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err = env.FlashSaledb.UpdateFlashSale(sale, from)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to update the flash sale - FlashSale")
+			log.Println(err)
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		result = sale
+
+	case "DELETE":
+		saleID, err := uuuid.FromString(r.URL.Query().Get("sale_id"))
+		if err != nil {
+			err = errors.Wrap(err, "Invalid sale_id - FlashSale")
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = env.FlashSaledb.DeleteFlashSale(saleID)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to delete flash sale - FlashSale")
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resultByte, err := json.Marshal(result)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal flash sale results - FlashSale")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(resultByte)
+}
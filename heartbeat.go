@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// runHeartbeatMonitor checks the heartbeats now and after every interval.
+func (env *Env) runHeartbeatMonitor(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		_, err := env.checkHeartbeats(time.Now())
+		if err != nil {
+			err = errors.Wrap(err, "Unable to check heartbeats - runHeartbeatMonitor")
+			log.Println(err)
+		}
+		<-ticker.C
+	}
+}
+
+// checkHeartbeats creates a Warning for each device which went silent
+// since the last check.
+func (env *Env) checkHeartbeats(now time.Time) ([]report.Warning, error) {
+	heartbeats, err := env.Heartbeatdb.Heartbeats(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := []report.Warning{}
+	for _, h := range heartbeats {
+		if warning, ok := report.HeartbeatWarning(h, now); ok {
+			warnings = append(warnings, *warning)
+		}
+	}
+	if len(warnings) == 0 {
+		return warnings, nil
+	}
+
+	warnings, err = env.Warningdb.InsertWarnings(warnings)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		err = env.Heartbeatdb.MarkHeartbeatWarned(w.DeviceID, now.Unix())
+		if err != nil {
+			return nil, err
+		}
+	}
+	env.publishStream(nil, nil, warnings)
+	return warnings, nil
+}
+
+// HeartbeatReport lists the devices which stopped sending readings for
+// longer than their expected interval, with their outage windows and the
+// downtime per period. The request-body is a HeartbeatQuery, where the
+// inventory and device query-trees select the devices (all devices if
+// neither is set), and "heartbeat" selects the period:
+//  {"device": [...], "heartbeat": {"from": 1539820800, "period": "hourly"}}
+func (env *Env) HeartbeatReport(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	query := &report.HeartbeatQuery{}
+	if !env.readReportQuery(w, r, query, "") {
+		return
+	}
+	if query.Explain {
+		writeExplainUnsupported(w)
+		return
+	}
+
+	var deviceIDs []string
+	if isInventorySearched(&query.SearchQuery) || query.Device != nil {
+		devQuery := query.SearchQuery
+		devQuery.Page = nil
+		devQuery.Fields = nil
+
+		invSearchResult, _, err := env.Inventorydb.InvAdvSearch(&devQuery)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the search Inventory - HeartbeatReport")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		devSearchResult, _, err := env.Devicedb.DevAdvSearch(invSearchResult, &devQuery)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the search Devices - HeartbeatReport")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		deviceIDs = []string{}
+		for _, d := range devSearchResult {
+			deviceIDs = append(deviceIDs, d.DeviceID.String())
+		}
+	}
+
+	heartbeats, err := env.Heartbeatdb.Heartbeats(deviceIDs)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the heartbeats - HeartbeatReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	from, to := query.Heartbeat.Bounds(now)
+	trackedIDs := []string{}
+	for _, h := range heartbeats {
+		trackedIDs = append(trackedIDs, h.DeviceID.String())
+	}
+
+	// The last readings before the period, to find outages at its start
+	anchors, err := env.Metricdb.LastReadingsBefore(trackedIDs, from)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the readings before the period - HeartbeatReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	readings, err := env.Metricdb.ReadingTimes(trackedIDs, from, to)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the readings - HeartbeatReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	outages, err := report.FindOutages(heartbeats, readings, anchors, query.Heartbeat, now)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to find outages - HeartbeatReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	outageByte, err := json.Marshal(outages)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal outages - HeartbeatReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(outageByte)
+}
+
+// HeartbeatIntervalRequest configures the expected interval (in seconds)
+// of a device. An interval of zero estimates it from the readings again.
+type HeartbeatIntervalRequest struct {
+	DeviceID         string `json:"device_id"`
+	ExpectedInterval int64  `json:"expected_interval"`
+}
+
+// HeartbeatInterval configures how often a device is expected to send
+// readings:
+//  PUT {"device_id": "<id>", "expected_interval": 300}
+func (env *Env) HeartbeatInterval(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the request body")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	req := &HeartbeatIntervalRequest{}
+	err = json.Unmarshal(body, req)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to unmarshal - HeartbeatInterval")
+		log.Println(err)
+		writeValidationErrors(w, report.ValidationErrors{
+			report.ValidationError{
+				Message: err.Error(),
+			},
+		})
+		return
+	}
+
+	deviceID, err := uuuid.FromString(req.DeviceID)
+	if err != nil {
+		err = errors.Wrap(err, "Invalid device_id")
+		log.Println(err)
+		writeValidationErrors(w, report.ValidationErrors{
+			report.ValidationError{
+				Path:    "device_id",
+				Message: err.Error(),
+			},
+		})
+		return
+	}
+	if req.ExpectedInterval < 0 {
+		writeValidationErrors(w, report.ValidationErrors{
+			report.ValidationError{
+				Path:    "expected_interval",
+				Message: "expected_interval cannot be negative",
+			},
+		})
+		return
+	}
+
+	heartbeat, err := env.Heartbeatdb.SetHeartbeatInterval(deviceID, req.ExpectedInterval)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to set the interval - HeartbeatInterval")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	heartbeatByte, err := json.Marshal(heartbeat)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal heartbeat - HeartbeatInterval")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(heartbeatByte)
+}
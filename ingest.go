@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxIngestBody is the largest request-body accepted by IngestMetrics.
+	maxIngestBody = 64 << 20
+	// evaluationQueueSize is the number of ingested batches which can wait
+	// for their evaluation before IngestMetrics waits for the queue.
+	evaluationQueueSize = 256
+)
+
+// IngestMetrics writes a batch of sensor-readings, sent as a JSON-array or
+// as NDJSON (one reading per line), and responds with the IngestResult.
+// Readings already stored for their (device_id, timestamp) are skipped as
+// duplicates. Requests with an "Idempotency-Key" header can be retried, and
+// get the result of the first request with that key.
+// Heartbeats, warnings and anomalies are updated for the accepted readings,
+// which are also sent to the live streams, after the response is written.
+func (env *Env) IngestMetrics(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Idempotency-Key")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBody))
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the request body")
+		log.Println(err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	bodyHash := report.BodyHash(body)
+	if key != "" {
+		prevResult, err := env.Ingestdb.IngestByKey(key)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the previous ingestion - IngestMetrics")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if prevResult != nil {
+			if prevResult.BodyHash != bodyHash {
+				log.Println("Idempotency-Key reused for another batch - IngestMetrics")
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			prevResult.Replayed = true
+			writeIngestResult(w, prevResult)
+			return
+		}
+	}
+
+	result, inserted, err := env.Metricdb.IngestMetrics(body)
+	if err != nil {
+		if verrs, ok := err.(report.ValidationErrors); ok {
+			writeValidationErrors(w, verrs)
+			return
+		}
+		err = errors.Wrap(err, "Unable to ingest metrics - IngestMetrics")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if key != "" {
+		result.IdempotencyKey = key
+		result.BodyHash = bodyHash
+		err = env.Ingestdb.SaveIngest(result)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to save the ingestion for retries - IngestMetrics")
+			log.Println(err)
+		}
+	}
+
+	if len(inserted) > 0 {
+		env.Evaluation <- inserted
+	}
+	writeIngestResult(w, result)
+}
+
+// runEvaluator evaluates the ingested batches from the Evaluation queue,
+// in the order they were ingested.
+func (env *Env) runEvaluator() {
+	for metrics := range env.Evaluation {
+		env.evaluateIngested(metrics)
+	}
+}
+
+// evaluateIngested records the heartbeats of the devices, creates the
+// warnings and anomalies for the ingested metrics, and streams them.
+// Errors are only logged, since the metrics are already stored.
+func (env *Env) evaluateIngested(metrics []report.Metric) {
+	_, err := env.Heartbeatdb.RecordHeartbeats(metrics)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to record heartbeats for the ingested metrics")
+		log.Println(err)
+	}
+
+	itemIDs := []interface{}{}
+	seen := map[string]bool{}
+	for _, m := range metrics {
+		itemID := m.ItemID.String()
+		if !seen[itemID] {
+			seen[itemID] = true
+			itemIDs = append(itemIDs, itemID)
+		}
+	}
+
+	inventory, _, err := env.Inventorydb.InvAdvSearch(&report.SearchQuery{
+		Inventory: &report.QueryNode{
+			SearchParam: report.SearchParam{
+				Field:  "item_id",
+				Type:   "string",
+				Op:     report.OpIn,
+				Values: itemIDs,
+			},
+		},
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the inventory of the ingested metrics")
+		log.Println(err)
+	}
+	// The thresholds and baselines are in the canonical units, so the
+	// metrics are not evaluated if they cannot be calibrated
+	calibrated, cal, err := env.calibrated(metrics)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to calibrate the ingested metrics")
+		log.Println(err)
+		return
+	}
+
+	var warnings []report.Warning
+	if len(inventory) > 0 {
+		warnings, err = env.Warningdb.CreateWarnings(calibrated, inventory)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to create warnings for the ingested metrics")
+			log.Println(err)
+		}
+	}
+	env.publishStream(calibrated, inventory, warnings)
+
+	_, err = env.detectAnomalies(calibrated, cal)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to detect anomalies in the ingested metrics")
+		log.Println(err)
+	}
+}
+
+func writeIngestResult(w http.ResponseWriter, result *report.IngestResult) {
+	resultByte, err := json.Marshal(result)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal IngestResult")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resultByte)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/pkg/errors"
+)
+
+// KPIReport computes the sell-through, waste, donation and shrink of the
+// matching inventory per product, origin and period of arrival.
+// The request-body is a KPIQuery, with an optional "kpi" to select
+// the period:
+//  {"inventory": [...], "kpi": {"period": "week"}}
+func (env *Env) KPIReport(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	query := &report.KPIQuery{}
+	if !env.readReportQuery(w, r, query, "") {
+		return
+	}
+	if query.Explain {
+		writeExplainUnsupported(w)
+		return
+	}
+
+	kpis, err := env.Inventorydb.InventoryKPIs(query, time.Now())
+	if err != nil {
+		err = errors.Wrap(err, "Unable to compute the KPIs - KPIReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	kpiByte, err := json.Marshal(kpis)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal KPIs - KPIReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(kpiByte)
+}
@@ -7,9 +7,11 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/TerrexTech/go-agg-reports/report"
 	"github.com/TerrexTech/go-commonutils/commonutil"
+	"github.com/TerrexTech/uuuid"
 	"github.com/joho/godotenv"
 	"github.com/pkg/errors"
 )
@@ -19,12 +21,45 @@ type Env struct {
 	Metricdb    report.DBI
 	Inventorydb report.DBI
 	Devicedb    report.DBI
+
+	SavedSearchdb report.DBI
+	Warningdb     report.DBI
+	Anomalydb     report.DBI
+	Ingestdb      report.DBI
+	Heartbeatdb   report.DBI
+	Calibrationdb report.DBI
+	FlashSaledb   report.DBI
+	Donationdb    report.DBI
+
+	// MetricRollupdb has the compacted metrics, which are
+	// kept longer than the raw metrics in Metricdb
+	MetricRollupdb report.DBI
+	// Retention is nil if the metrics are kept forever
+	Retention *report.RetentionPolicy
+	// Stream has the new metrics and warnings for live clients
+	Stream *report.Stream
+	// Evaluation has the ingested metrics, which are evaluated for
+	// warnings and anomalies outside of the ingestion requests
+	Evaluation chan []report.Metric
+	// ExpiryRules suggest the actions of the expiry-risk report,
+	// unless a request has its own rules
+	ExpiryRules []report.ActionRule
 }
 
 type ReportResponse struct {
 	Inventory []report.Inventory
 	Metric    []report.Metric
 	Device    []report.Device
+	Warning   []report.Warning   `json:",omitempty"`
+	Anomaly   []report.Anomaly   `json:",omitempty"`
+	ShelfLife []report.ShelfLife `json:",omitempty"`
+}
+
+// PagedResponse wraps the ReportResponse when a page was requested.
+type PagedResponse struct {
+	Total      int64          `json:"total"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	Items      ReportResponse `json:"items"`
 }
 
 func main() {
@@ -44,8 +79,15 @@ func main() {
 	collectionInv := os.Getenv("MONGO_INV_COLLECTION")
 	collectionMet := os.Getenv("MONGO_METRIC_COLLECTION")
 	collectionDev := os.Getenv("MONGO_DEVICE_COLLECTION")
-	// collectionWarn := os.Getenv("MONGO_WARNING_COLLECTION")
-	// collectionFlash := os.Getenv("MONGO_FLASHSALE_COLLECTION")
+	collectionSavedSearch := os.Getenv("MONGO_SAVED_SEARCH_COLLECTION")
+	collectionWarn := os.Getenv("MONGO_WARNING_COLLECTION")
+	collectionAnomaly := os.Getenv("MONGO_ANOMALY_COLLECTION")
+	collectionIngest := os.Getenv("MONGO_INGEST_COLLECTION")
+	collectionMetRollup := os.Getenv("MONGO_METRIC_ROLLUP_COLLECTION")
+	collectionHeartbeat := os.Getenv("MONGO_HEARTBEAT_COLLECTION")
+	collectionCalibration := os.Getenv("MONGO_CALIBRATION_COLLECTION")
+	collectionFlash := os.Getenv("MONGO_FLASHSALE_COLLECTION")
+	collectionDonation := os.Getenv("MONGO_DONATION_COLLECTION")
 
 	timeoutMilliStr := os.Getenv("MONGO_TIMEOUT")
 	parsedTimeoutMilli, err := strconv.Atoi(timeoutMilliStr)
@@ -57,6 +99,59 @@ func main() {
 	}
 	timeoutMilli := uint32(parsedTimeoutMilli)
 
+	// Raw metrics are kept forever, unless a retention is set
+	var retention *report.RetentionPolicy
+	rawRetentionDays, err := strconv.Atoi(os.Getenv("METRIC_RAW_RETENTION_DAYS"))
+	if err == nil && rawRetentionDays > 0 {
+		rollupRetentionDays, err := strconv.Atoi(os.Getenv("METRIC_ROLLUP_RETENTION_DAYS"))
+		if err != nil {
+			log.Println("METRIC_ROLLUP_RETENTION_DAYS not set, metric rollups will be kept forever")
+			rollupRetentionDays = 0
+		}
+		rawRetention := time.Duration(rawRetentionDays) * 24 * time.Hour
+		lookback := 24 * time.Hour
+		if lookback > rawRetention/2 {
+			lookback = rawRetention / 2
+		}
+		retention = &report.RetentionPolicy{
+			RawRetention:    rawRetention,
+			RollupRetention: time.Duration(rollupRetentionDays) * 24 * time.Hour,
+			Interval:        60 * 60,
+			Lookback:        lookback,
+			BatchSize:       1000,
+		}
+	}
+	compactionMinutes, err := strconv.Atoi(os.Getenv("METRIC_COMPACTION_MINUTES"))
+	if err != nil || compactionMinutes <= 0 {
+		compactionMinutes = 60
+	}
+	heartbeatCheckMinutes, err := strconv.Atoi(os.Getenv("HEARTBEAT_CHECK_MINUTES"))
+	if err != nil || heartbeatCheckMinutes <= 0 {
+		heartbeatCheckMinutes = 5
+	}
+	// The number of streamed events kept for reconnecting clients
+	streamHistory, err := strconv.Atoi(os.Getenv("STREAM_HISTORY_SIZE"))
+	if err != nil || streamHistory <= 0 {
+		streamHistory = report.DefaultStreamHistory
+	}
+	// The rules of the expiry-risk report, as a JSON-array of ActionRules
+	expiryRules := report.DefaultActionRules
+	if rulesJSON := os.Getenv("EXPIRY_ACTION_RULES"); rulesJSON != "" {
+		rules := []report.ActionRule{}
+		err = json.Unmarshal([]byte(rulesJSON), &rules)
+		if err == nil {
+			if verrs := report.ValidateActionRules(rules, "EXPIRY_ACTION_RULES"); len(verrs) > 0 {
+				err = verrs
+			}
+		}
+		if err != nil {
+			err = errors.Wrap(err, "Invalid EXPIRY_ACTION_RULES, using the default rules")
+			log.Println(err)
+		} else {
+			expiryRules = rules
+		}
+	}
+
 	log.Println(hosts)
 
 	configReport := report.DBIConfig{
@@ -94,23 +189,86 @@ func main() {
 		Collection:          collectionDev,
 	}
 
-	// configWarn := report.DBIConfig{
-	// 	Hosts:               *commonutil.ParseHosts(hosts),
-	// 	Username:            username,
-	// 	Password:            password,
-	// 	TimeoutMilliseconds: timeoutMilli,
-	// 	Database:            database,
-	// 	Collection:          collectionWarn,
-	// }
+	configSavedSearch := report.DBIConfig{
+		Hosts:               *commonutil.ParseHosts(hosts),
+		Username:            username,
+		Password:            password,
+		TimeoutMilliseconds: timeoutMilli,
+		Database:            database,
+		Collection:          collectionSavedSearch,
+	}
 
-	// configFlash := report.DBIConfig{
-	// 	Hosts:               *commonutil.ParseHosts(hosts),
-	// 	Username:            username,
-	// 	Password:            password,
-	// 	TimeoutMilliseconds: timeoutMilli,
-	// 	Database:            database,
-	// 	Collection:          collectionFlash,
-	// }
+	configWarn := report.DBIConfig{
+		Hosts:               *commonutil.ParseHosts(hosts),
+		Username:            username,
+		Password:            password,
+		TimeoutMilliseconds: timeoutMilli,
+		Database:            database,
+		Collection:          collectionWarn,
+	}
+
+	configAnomaly := report.DBIConfig{
+		Hosts:               *commonutil.ParseHosts(hosts),
+		Username:            username,
+		Password:            password,
+		TimeoutMilliseconds: timeoutMilli,
+		Database:            database,
+		Collection:          collectionAnomaly,
+	}
+
+	configIngest := report.DBIConfig{
+		Hosts:               *commonutil.ParseHosts(hosts),
+		Username:            username,
+		Password:            password,
+		TimeoutMilliseconds: timeoutMilli,
+		Database:            database,
+		Collection:          collectionIngest,
+	}
+
+	configMetRollup := report.DBIConfig{
+		Hosts:               *commonutil.ParseHosts(hosts),
+		Username:            username,
+		Password:            password,
+		TimeoutMilliseconds: timeoutMilli,
+		Database:            database,
+		Collection:          collectionMetRollup,
+	}
+
+	configHeartbeat := report.DBIConfig{
+		Hosts:               *commonutil.ParseHosts(hosts),
+		Username:            username,
+		Password:            password,
+		TimeoutMilliseconds: timeoutMilli,
+		Database:            database,
+		Collection:          collectionHeartbeat,
+	}
+
+	configCalibration := report.DBIConfig{
+		Hosts:               *commonutil.ParseHosts(hosts),
+		Username:            username,
+		Password:            password,
+		TimeoutMilliseconds: timeoutMilli,
+		Database:            database,
+		Collection:          collectionCalibration,
+	}
+
+	configFlash := report.DBIConfig{
+		Hosts:               *commonutil.ParseHosts(hosts),
+		Username:            username,
+		Password:            password,
+		TimeoutMilliseconds: timeoutMilli,
+		Database:            database,
+		Collection:          collectionFlash,
+	}
+
+	configDonation := report.DBIConfig{
+		Hosts:               *commonutil.ParseHosts(hosts),
+		Username:            username,
+		Password:            password,
+		TimeoutMilliseconds: timeoutMilli,
+		Database:            database,
+		Collection:          collectionDonation,
+	}
 
 	dbReport, err := report.GenerateDB(configReport, &report.Report{})
 	if err != nil {
@@ -140,17 +298,132 @@ func main() {
 		return
 	}
 
+	dbSavedSearch, err := report.GenerateDB(configSavedSearch, &report.SavedSearch{})
+	if err != nil {
+		err = errors.Wrap(err, "Error connecting to SavedSearch DB")
+		log.Println(err)
+		return
+	}
+
+	dbWarning, err := report.GenerateDB(configWarn, &report.Warning{})
+	if err != nil {
+		err = errors.Wrap(err, "Error connecting to Warning DB")
+		log.Println(err)
+		return
+	}
+
+	dbAnomaly, err := report.GenerateDB(configAnomaly, &report.Anomaly{})
+	if err != nil {
+		err = errors.Wrap(err, "Error connecting to Anomaly DB")
+		log.Println(err)
+		return
+	}
+
+	dbIngest, err := report.GenerateDB(configIngest, &report.IngestResult{})
+	if err != nil {
+		err = errors.Wrap(err, "Error connecting to Ingest DB")
+		log.Println(err)
+		return
+	}
+
+	// The rollups are read as metrics
+	dbMetRollup, err := report.GenerateDB(configMetRollup, &report.Metric{})
+	if err != nil {
+		err = errors.Wrap(err, "Error connecting to Metric Rollup DB")
+		log.Println(err)
+		return
+	}
+
+	dbHeartbeat, err := report.GenerateDB(configHeartbeat, &report.Heartbeat{})
+	if err != nil {
+		err = errors.Wrap(err, "Error connecting to Heartbeat DB")
+		log.Println(err)
+		return
+	}
+
+	dbCalibration, err := report.GenerateDB(configCalibration, &report.Calibration{})
+	if err != nil {
+		err = errors.Wrap(err, "Error connecting to Calibration DB")
+		log.Println(err)
+		return
+	}
+
+	dbFlashSale, err := report.GenerateDB(configFlash, &report.FlashSale{})
+	if err != nil {
+		err = errors.Wrap(err, "Error connecting to FlashSale DB")
+		log.Println(err)
+		return
+	}
+
+	dbDonation, err := report.GenerateDB(configDonation, &report.Donation{})
+	if err != nil {
+		err = errors.Wrap(err, "Error connecting to Donation DB")
+		log.Println(err)
+		return
+	}
+
+	// The ingestion is deduplicated without these, but they prevent
+	// duplicates from concurrent requests.
+	err = dbMetric.EnsureIndex("device_id_timestamp", true, "device_id", "timestamp")
+	if err != nil {
+		log.Println("Concurrently ingested metrics can be duplicated")
+	}
+	err = dbIngest.EnsureIndex("idempotency_key", true, "idempotency_key")
+	if err != nil {
+		log.Println("Concurrent retries of an ingestion can be duplicated")
+	}
+
 	env := &Env{
 		Reportdb:    dbReport,
 		Metricdb:    dbMetric,
 		Inventorydb: dbInventory,
 		Devicedb:    dbDevice,
+
+		SavedSearchdb: dbSavedSearch,
+		Warningdb:     dbWarning,
+		Anomalydb:     dbAnomaly,
+		Ingestdb:      dbIngest,
+		Heartbeatdb:   dbHeartbeat,
+		Calibrationdb: dbCalibration,
+		FlashSaledb:   dbFlashSale,
+		Donationdb:    dbDonation,
+
+		MetricRollupdb: dbMetRollup,
+		Retention:      retention,
+		Stream:         report.NewStream(streamHistory),
+		Evaluation:     make(chan []report.Metric, evaluationQueueSize),
+		ExpiryRules:    expiryRules,
 	}
 
+	if retention != nil {
+		go env.runCompactor(time.Duration(compactionMinutes) * time.Minute)
+	}
+	go env.runHeartbeatMonitor(time.Duration(heartbeatCheckMinutes) * time.Minute)
+	go env.runEvaluator()
+
 	http.HandleFunc("/create-data", env.LoadDataInMongo)
 	http.HandleFunc("/inv-report", env.InvReport)
+	http.HandleFunc("/dist-inv-report", env.DistInvReport)
+	http.HandleFunc("/kpi-report", env.KPIReport)
+	http.HandleFunc("/expiry-risk-report", env.ExpiryRiskReport)
+	http.HandleFunc("/flash-sale", env.FlashSale)
+	http.HandleFunc("/donation", env.Donation)
+	http.HandleFunc("/donation-report", env.DonationReport)
+	http.HandleFunc("/donation-statement", env.DonationStatement)
 	http.HandleFunc("/met-report", env.MetricReport)
 	http.HandleFunc("/dev-report", env.DeviceReport)
+	http.HandleFunc("/saved-search", env.SavedSearch)
+	http.HandleFunc("/met-rollup", env.MetricRollup)
+	http.HandleFunc("/warning-report", env.WarningReport)
+	http.HandleFunc("/anomaly-report", env.AnomalyReport)
+	http.HandleFunc("/anomaly", env.AnomalyFalsePositive)
+	http.HandleFunc("/shelf-life-report", env.ShelfLifeReport)
+	http.HandleFunc("/ingest-metrics", env.IngestMetrics)
+	http.HandleFunc("/waste-correlation-report", env.WasteCorrelationReport)
+	http.HandleFunc("/heartbeat-report", env.HeartbeatReport)
+	http.HandleFunc("/heartbeat", env.HeartbeatInterval)
+	http.HandleFunc("/stream", env.StreamEvents)
+	http.HandleFunc("/calibration", env.Calibration)
 
 	http.ListenAndServe(":8080", nil)
 
@@ -183,6 +456,112 @@ func main() {
 
 }
 
+// writeValidationErrors responds with the list of validation-errors
+// and HTTP 400.
+func writeValidationErrors(w http.ResponseWriter, verrs report.ValidationErrors) {
+	errByte, err := json.Marshal(map[string]interface{}{
+		"errors": verrs,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal validation errors")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(errByte)
+}
+
+// readSearchQuery reads and validates the SearchQuery from the request-body,
+// whose page is sorted by the fields of the entity (see readReportQuery).
+// Returns false if the request was invalid, and the error-response was written.
+func (env *Env) readSearchQuery(w http.ResponseWriter, r *http.Request, entity string) (*report.SearchQuery, bool) {
+	query := &report.SearchQuery{}
+	if !env.readReportQuery(w, r, query, entity) {
+		return nil, false
+	}
+	return query, true
+}
+
+// readReportQuery reads and validates the query of a report from the
+// request-body. If the query references a saved search, the saved
+// query-trees are used, with the params of the report from the request.
+// The entity is the one paged by the report, such as "inventory", whose
+// fields the page is sorted by. It is empty if the results are not paged.
+// Returns false if the request was invalid, and the error-response was written.
+func (env *Env) readReportQuery(w http.ResponseWriter, r *http.Request, query report.ReportQuery, entity string) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the request body")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+
+	log.Println(string(body))
+
+	err = json.Unmarshal(body, query)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to unmarshal - advSearch")
+		log.Println(err)
+		writeValidationErrors(w, report.ValidationErrors{
+			report.ValidationError{
+				Message: err.Error(),
+			},
+		})
+		return false
+	}
+
+	search := query.Search()
+	if search.SavedSearchID != "" {
+		searchID, err := uuuid.FromString(search.SavedSearchID)
+		if err != nil {
+			err = errors.Wrap(err, "Invalid saved_search_id")
+			log.Println(err)
+			writeValidationErrors(w, report.ValidationErrors{
+				report.ValidationError{
+					Path:    "saved_search_id",
+					Message: err.Error(),
+				},
+			})
+			return false
+		}
+
+		customerID, err := uuuid.FromString(search.RsCustomerID)
+		if err != nil {
+			err = errors.Wrap(err, "Invalid rs_customer_id")
+			log.Println(err)
+			writeValidationErrors(w, report.ValidationErrors{
+				report.ValidationError{
+					Path:    "rs_customer_id",
+					Message: "rs_customer_id of the saved search is required",
+				},
+			})
+			return false
+		}
+
+		saved, err := env.SavedSearchdb.SavedSearchByID(searchID, customerID)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to find saved search")
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return false
+		}
+		*search = *saved.Query.WithOverrides(search)
+	}
+
+	verrs := query.Validate()
+	verrs = append(verrs, search.ValidateSort(entity)...)
+	if len(verrs) > 0 {
+		log.Println(verrs)
+		writeValidationErrors(w, verrs)
+		return false
+	}
+	return true
+}
+
 func (env *Env) LoadDataInMongo(w http.ResponseWriter, r *http.Request) {
 	if origin := r.Header.Get("Origin"); origin != "" {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
@@ -240,6 +619,30 @@ func (env *Env) LoadDataInMongo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	_, err = env.Heartbeatdb.RecordHeartbeats(metricData)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to record heartbeats for the new metrics")
+		log.Println(err)
+	}
+	// The metrics are not evaluated if they cannot be calibrated
+	calibrated, cal, err := env.calibrated(metricData)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to calibrate the new metrics")
+		log.Println(err)
+	} else {
+		warnings, err := env.Warningdb.CreateWarnings(calibrated, inventoryData)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to create warnings for the new metrics")
+			log.Println(err)
+		}
+		env.publishStream(calibrated, inventoryData, warnings)
+		_, err = env.detectAnomalies(calibrated, cal)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to detect anomalies in the new metrics")
+			log.Println(err)
+		}
+	}
+
 	// log.Println(reportData)
 	rData, err := json.Marshal(&reportData)
 	if err != nil {
@@ -281,25 +684,16 @@ func (env *Env) InvReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		err = errors.Wrap(err, "Unable to read the request body")
-		log.Println(err)
+	query, ok := env.readSearchQuery(w, r, "inventory")
+	if !ok {
 		return
 	}
-
-	var query map[string][]report.SearchParam
-
-	// advSearch := report.AdvancedInvSearch{}
-	err = json.Unmarshal(body, &query)
-	if err != nil {
-		err = errors.Wrap(err, "Unable to unmarshal - advSearch")
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println(err)
+	if query.Explain {
+		env.writeExplanation(w, query, "inventory")
 		return
 	}
 
-	invSearchResult, err := env.Inventorydb.InvAdvSearch(query)
+	invSearchResult, pageResult, err := env.Inventorydb.InvAdvSearch(query)
 	if err != nil {
 		err = errors.Wrap(err, "Unable to read the search Inventory - invResult")
 		log.Println(err)
@@ -307,7 +701,18 @@ func (env *Env) InvReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	invByte, err := json.Marshal(&invSearchResult)
+	var resp interface{} = &invSearchResult
+	if pageResult != nil {
+		resp = &PagedResponse{
+			Total:      pageResult.Total,
+			NextCursor: pageResult.NextCursor,
+			Items: ReportResponse{
+				Inventory: invSearchResult,
+			},
+		}
+	}
+
+	invByte, err := json.Marshal(resp)
 	if err != nil {
 		err = errors.Wrap(err, "Unable to marshal Inventory results - InvReport")
 		log.Println(err)
@@ -330,42 +735,72 @@ func (env *Env) MetricReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	query, ok := env.readSearchQuery(w, r, "metric")
+	if !ok {
+		return
+	}
+	if query.Explain {
+		env.writeExplanation(w, query, "metric")
+		return
+	}
+
+	// The page applies to the report's results, so all matching
+	// inventory is fetched.
+	invQuery := *query
+	invQuery.Page = nil
+
+	invSearchResult, _, err := env.Inventorydb.InvAdvSearch(&invQuery)
 	if err != nil {
-		err = errors.Wrap(err, "Unable to read the request body")
+		err = errors.Wrap(err, "Unable to read the search Inventory - invResult")
 		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	log.Println(string(body))
-
-	var query map[string][]report.SearchParam
+	log.Println(invSearchResult)
 
-	// advSearch := report.AdvancedInvSearch{}
-	err = json.Unmarshal(body, &query)
+	cal, err := env.calibrator(inventoryDevices(invSearchResult), query.Units)
 	if err != nil {
-		err = errors.Wrap(err, "Unable to unmarshal - advSearch")
-		w.WriteHeader(http.StatusInternalServerError)
+		err = errors.Wrap(err, "Unable to read the calibrations - MetricReport")
 		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
-	invSearchResult, err := env.Inventorydb.InvAdvSearch(query)
+	rollupQuery, rawQuery, err := env.splitSearch(query)
 	if err != nil {
-		err = errors.Wrap(err, "Unable to read the search Inventory - invResult")
+		err = errors.Wrap(err, "Unable to select the metrics - MetricReport")
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	log.Println(invSearchResult)
-
-	metricResult, err := env.Metricdb.MetAdvSearch(invSearchResult)
+	metricResult, pageResult, err := env.Metricdb.MetAdvSearch(invSearchResult, rawQuery, cal)
 	if err != nil {
 		err = errors.Wrap(err, "Did not get metric query result - MetricReport")
 		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	// The rollups are read with their counts and extremes,
+	// before the raw metrics from the raw retention onward
+	if rollupQuery != nil {
+		rollupResult, rollupPage, err := env.MetricRollupdb.MetAdvSearch(invSearchResult, rollupQuery, cal)
+		if err != nil {
+			err = errors.Wrap(err, "Did not get metric rollup query result - MetricReport")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		metricResult, pageResult, err = report.MergeMetricPages(
+			query.Page, rollupResult, rollupPage, metricResult, pageResult,
+		)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to merge the metric rollups - MetricReport")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
 
 	log.Println(metricResult, "&&&&&&&&&&&&")
 
@@ -374,7 +809,16 @@ func (env *Env) MetricReport(w http.ResponseWriter, r *http.Request) {
 		Metric:    metricResult,
 	}
 
-	metricByte, err := json.Marshal(&respObject)
+	var resp interface{} = &respObject
+	if pageResult != nil {
+		resp = &PagedResponse{
+			Total:      pageResult.Total,
+			NextCursor: pageResult.NextCursor,
+			Items:      respObject,
+		}
+	}
+
+	metricByte, err := json.Marshal(resp)
 	if err != nil {
 		err = errors.Wrap(err, "Unable to marshal Metric results - MetricReport")
 		log.Println(err)
@@ -397,27 +841,21 @@ func (env *Env) DeviceReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		err = errors.Wrap(err, "Unable to read the request body")
-		log.Println(err)
+	query, ok := env.readSearchQuery(w, r, "device")
+	if !ok {
 		return
 	}
-
-	log.Println(string(body))
-
-	var query map[string][]report.SearchParam
-
-	// advSearch := report.AdvancedInvSearch{}
-	err = json.Unmarshal(body, &query)
-	if err != nil {
-		err = errors.Wrap(err, "Unable to unmarshal - advSearch")
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println(err)
+	if query.Explain {
+		env.writeExplanation(w, query, "device")
 		return
 	}
 
-	invSearchResult, err := env.Inventorydb.InvAdvSearch(query)
+	// The page applies to the report's results, so all matching
+	// inventory is fetched.
+	invQuery := *query
+	invQuery.Page = nil
+
+	invSearchResult, _, err := env.Inventorydb.InvAdvSearch(&invQuery)
 	if err != nil {
 		err = errors.Wrap(err, "Unable to read the search Inventory - invResult")
 		log.Println(err)
@@ -425,7 +863,7 @@ func (env *Env) DeviceReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deviceResult, err := env.Devicedb.DevAdvSearch(invSearchResult)
+	deviceResult, pageResult, err := env.Devicedb.DevAdvSearch(invSearchResult, query)
 	if err != nil {
 		err = errors.Wrap(err, "Did not get metric query result - MetricReport")
 		log.Println(err)
@@ -437,7 +875,16 @@ func (env *Env) DeviceReport(w http.ResponseWriter, r *http.Request) {
 		Device:    deviceResult,
 	}
 
-	deviceByte, err := json.Marshal(&respObject)
+	var resp interface{} = &respObject
+	if pageResult != nil {
+		resp = &PagedResponse{
+			Total:      pageResult.Total,
+			NextCursor: pageResult.NextCursor,
+			Items:      respObject,
+		}
+	}
+
+	deviceByte, err := json.Marshal(resp)
 	if err != nil {
 		err = errors.Wrap(err, "Unable to marshal Metric results - MetricReport")
 		log.Println(err)
@@ -448,6 +895,10 @@ func (env *Env) DeviceReport(w http.ResponseWriter, r *http.Request) {
 	w.Write(deviceByte)
 }
 
+// DistInvReport sums the weights of the matching inventory by product,
+// origin, lot or customer. The request-body is a DistributionQuery, with
+// an optional "distribution" to select the grouping:
+//  {"inventory": [...], "distribution": {"group_by": "origin"}}
 func (env *Env) DistInvReport(w http.ResponseWriter, r *http.Request) {
 	if origin := r.Header.Get("Origin"); origin != "" {
 		w.Header().Set("Access-Control-Allow-Origin", origin)
@@ -460,53 +911,30 @@ func (env *Env) DistInvReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// body, err := ioutil.ReadAll(r.Body)
-	// if err != nil {
-	// 	err = errors.Wrap(err, "Unable to read the request body")
-	// 	log.Println(err)
-	// 	return
-	// }
-
-	// log.Println(string(body))
-
-	// var query map[string][]report.SearchParam
-
-	// // advSearch := report.AdvancedInvSearch{}
-	// err = json.Unmarshal(body, &query)
-	// if err != nil {
-	// 	err = errors.Wrap(err, "Unable to unmarshal - advSearch")
-	// 	w.WriteHeader(http.StatusInternalServerError)
-	// 	log.Println(err)
-	// 	return
-	// }
-
-	// invSearchResult, err := env.Inventorydb.InvAdvSearch(query)
-	// if err != nil {
-	// 	err = errors.Wrap(err, "Unable to read the search Inventory - invResult")
-	// 	log.Println(err)
-	// 	w.WriteHeader(http.StatusInternalServerError)
-	// 	return
-	// }
-
-	// invResults, err := env.Inventorydb.DistributeInvFields()
-	// if err != nil {
-	// 	err = errors.Wrap(err, "Did not get metric query result - MetricReport")
-	// 	log.Println(err)
-	// 	return
-	// }
+	query := &report.DistributionQuery{}
+	if !env.readReportQuery(w, r, query, "") {
+		return
+	}
+	if query.Explain {
+		writeExplainUnsupported(w)
+		return
+	}
 
-	// respObject := ReportResponse{
-	// 	Inventory: invSearchResult,
-	// 	Device:    deviceResult,
-	// }
+	distResult, err := env.Inventorydb.DistributionInvFields(query)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the inventory distribution - DistInvReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	// deviceByte, err := json.Marshal(&respObject)
-	// if err != nil {
-	// 	err = errors.Wrap(err, "Unable to marshal Metric results - MetricReport")
-	// 	log.Println(err)
-	// 	w.WriteHeader(http.StatusInternalServerError)
-	// 	return
-	// }
+	distByte, err := json.Marshal(distResult)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal distribution results - DistInvReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	// w.Write(deviceByte)
+	w.Write(distByte)
 }
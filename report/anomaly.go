@@ -0,0 +1,524 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/pkg/errors"
+)
+
+// Anomaly detection methods.
+const (
+	// AnomalyZScore flags sudden changes, such as sensor faults, which are
+	// far from the mean of the baseline in standard deviations.
+	AnomalyZScore = "zscore"
+	// AnomalyEWMA flags slow drifts, using an EWMA control chart of the
+	// recent readings against the older readings of the baseline.
+	AnomalyEWMA = "ewma"
+)
+
+const (
+	// AnomalyBaselineSize is the number of previous readings
+	// of a device which form its baseline.
+	AnomalyBaselineSize = 100
+	// minBaselineSize is the number of readings needed for detection.
+	minBaselineSize = 10
+	// zScoreLimit is the |z-score| from which a reading is an anomaly.
+	zScoreLimit = 3
+	// ewmaLambda is the weight of the newest reading in the EWMA.
+	ewmaLambda = 0.3
+	// ewmaLimit is the width of the EWMA control-limits in standard deviations.
+	ewmaLimit = 3
+)
+
+// Anomaly is a Metric reading which deviates from the baseline of
+// previous readings of its device. Score is the deviation in standard
+// deviations, and Explanation describes why the reading was flagged.
+// Readings of anomalies marked as FalsePositive (such as sensor faults)
+// are excluded from the baseline, and from the anomaly report.
+type Anomaly struct {
+	ID             objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	AnomalyID      uuuid.UUID        `bson:"anomaly_id,omitempty" json:"anomaly_id,omitempty"`
+	DeviceID       uuuid.UUID        `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	ItemID         uuuid.UUID        `bson:"item_id,omitempty" json:"item_id,omitempty"`
+	Channel        string            `bson:"channel,omitempty" json:"channel,omitempty"`
+	Method         string            `bson:"method,omitempty" json:"method,omitempty"`
+	Value          float64           `bson:"value" json:"value"`
+	Score          float64           `bson:"score" json:"score"`
+	BaselineMean   float64           `bson:"baseline_mean" json:"baseline_mean"`
+	BaselineStdDev float64           `bson:"baseline_stddev" json:"baseline_stddev"`
+	Explanation    string            `bson:"explanation,omitempty" json:"explanation,omitempty"`
+	FalsePositive  bool              `bson:"false_positive" json:"false_positive"`
+	Timestamp      int64             `bson:"timestamp,omitempty" json:"timestamp,omitempty"`
+	CreatedAt      int64             `bson:"created_at,omitempty" json:"created_at,omitempty"`
+
+	// selectedFields are the fields serialized by MarshalJSON, all if empty
+	selectedFields []string
+}
+
+type marshalAnomaly struct {
+	ID             objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	AnomalyID      string            `bson:"anomaly_id,omitempty" json:"anomaly_id,omitempty"`
+	DeviceID       string            `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	ItemID         string            `bson:"item_id,omitempty" json:"item_id,omitempty"`
+	Channel        string            `bson:"channel,omitempty" json:"channel,omitempty"`
+	Method         string            `bson:"method,omitempty" json:"method,omitempty"`
+	Value          float64           `bson:"value" json:"value"`
+	Score          float64           `bson:"score" json:"score"`
+	BaselineMean   float64           `bson:"baseline_mean" json:"baseline_mean"`
+	BaselineStdDev float64           `bson:"baseline_stddev" json:"baseline_stddev"`
+	Explanation    string            `bson:"explanation,omitempty" json:"explanation,omitempty"`
+	FalsePositive  bool              `bson:"false_positive" json:"false_positive"`
+	Timestamp      int64             `bson:"timestamp,omitempty" json:"timestamp,omitempty"`
+	CreatedAt      int64             `bson:"created_at,omitempty" json:"created_at,omitempty"`
+}
+
+func (a *Anomaly) toMarshal() *marshalAnomaly {
+	ma := &marshalAnomaly{
+		ID:             a.ID,
+		Channel:        a.Channel,
+		Method:         a.Method,
+		Value:          a.Value,
+		Score:          a.Score,
+		BaselineMean:   a.BaselineMean,
+		BaselineStdDev: a.BaselineStdDev,
+		Explanation:    a.Explanation,
+		FalsePositive:  a.FalsePositive,
+		Timestamp:      a.Timestamp,
+		CreatedAt:      a.CreatedAt,
+	}
+
+	if a.AnomalyID.String() != (uuuid.UUID{}).String() {
+		ma.AnomalyID = a.AnomalyID.String()
+	}
+	if a.DeviceID.String() != (uuuid.UUID{}).String() {
+		ma.DeviceID = a.DeviceID.String()
+	}
+	if a.ItemID.String() != (uuuid.UUID{}).String() {
+		ma.ItemID = a.ItemID.String()
+	}
+	return ma
+}
+
+func (a Anomaly) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(a.toMarshal())
+}
+
+func (a *Anomaly) MarshalJSON() ([]byte, error) {
+	out, err := json.Marshal(a.toMarshal())
+	if err != nil {
+		return nil, err
+	}
+	return selectJSONFields(out, a.selectedFields)
+}
+
+func (a *Anomaly) UnmarshalBSON(in []byte) error {
+	ma := &marshalAnomaly{}
+	err := bson.Unmarshal(in, ma)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+
+	a.ID = ma.ID
+	a.Channel = ma.Channel
+	a.Method = ma.Method
+	a.Value = ma.Value
+	a.Score = ma.Score
+	a.BaselineMean = ma.BaselineMean
+	a.BaselineStdDev = ma.BaselineStdDev
+	a.Explanation = ma.Explanation
+	a.FalsePositive = ma.FalsePositive
+	a.Timestamp = ma.Timestamp
+	a.CreatedAt = ma.CreatedAt
+
+	if ma.AnomalyID != "" {
+		a.AnomalyID, err = uuuid.FromString(ma.AnomalyID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing AnomalyID for anomaly")
+			return err
+		}
+	}
+	if ma.DeviceID != "" {
+		a.DeviceID, err = uuuid.FromString(ma.DeviceID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing DeviceID for anomaly")
+			return err
+		}
+	}
+	if ma.ItemID != "" {
+		a.ItemID, err = uuuid.FromString(ma.ItemID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing ItemID for anomaly")
+			return err
+		}
+	}
+	return nil
+}
+
+// readingKey identifies the reading of a channel of a device.
+func readingKey(channel string, timestamp int64) string {
+	return fmt.Sprintf("%s:%d", channel, timestamp)
+}
+
+// meanStdDev returns the mean and population standard-deviation of the values.
+func meanStdDev(values []float64) (float64, float64) {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	sqDiff := 0.0
+	for _, v := range values {
+		sqDiff += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(sqDiff / float64(len(values)))
+}
+
+// stdDevFloor prevents constant baselines from producing infinite scores.
+func stdDevFloor(mean, stdDev float64) float64 {
+	return math.Max(stdDev, math.Max(math.Abs(mean)*0.001, 1e-6))
+}
+
+func direction(diff float64) string {
+	if diff < 0 {
+		return "below"
+	}
+	return "above"
+}
+
+// DetectAnomalies checks each channel of the Metric against the baseline,
+// which are the previous readings of its device in ascending order of time.
+// The falsePositives (from FalsePositiveReadings) are excluded from the
+// baseline. A reading is checked using a rolling z-score first, and then
+// using an EWMA control chart. Channels with too few baseline-readings
+// are not checked.
+func DetectAnomalies(metric Metric, baseline []Metric, falsePositives map[string]bool) []Anomaly {
+	anomalies := []Anomaly{}
+	value := metricReadings(metric)
+
+	for _, channel := range RollupChannels {
+		v, ok := value[channel]
+		if !ok {
+			continue
+		}
+
+		values := []float64{}
+		for _, b := range baseline {
+			bv, ok := b.Reading(channel)
+			if ok && !falsePositives[readingKey(channel, b.Timestamp)] {
+				values = append(values, bv)
+			}
+		}
+		if len(values) < minBaselineSize {
+			continue
+		}
+
+		anomaly := Anomaly{
+			DeviceID:  metric.DeviceID,
+			ItemID:    metric.ItemID,
+			Channel:   channel,
+			Value:     v,
+			Timestamp: metric.Timestamp,
+		}
+
+		mean, stdDev := meanStdDev(values)
+		z := (v - mean) / stdDevFloor(mean, stdDev)
+		if math.Abs(z) >= zScoreLimit {
+			anomaly.Method = AnomalyZScore
+			anomaly.Score = math.Abs(z)
+			anomaly.BaselineMean = mean
+			anomaly.BaselineStdDev = stdDev
+			anomaly.Explanation = fmt.Sprintf(
+				"%s reading %.2f is %.1f standard deviations %s the mean %.2f of the last %d readings",
+				channel, v, math.Abs(z), direction(z), mean, len(values),
+			)
+			anomalies = append(anomalies, anomaly)
+			continue
+		}
+
+		if len(values) < 2*minBaselineSize {
+			continue
+		}
+		// The older half of the baseline is the reference for the
+		// EWMA of the newer half and the reading.
+		half := len(values) / 2
+		refMean, refStdDev := meanStdDev(values[:half])
+		recent := append(append([]float64{}, values[half:]...), v)
+		ewma := refMean
+		for _, rv := range recent {
+			ewma = ewmaLambda*rv + (1-ewmaLambda)*ewma
+		}
+		ewmaStdDev := stdDevFloor(refMean, refStdDev) * math.Sqrt(ewmaLambda/(2-ewmaLambda))
+		drift := (ewma - refMean) / ewmaStdDev
+		if math.Abs(drift) >= ewmaLimit {
+			anomaly.Method = AnomalyEWMA
+			anomaly.Score = math.Abs(drift)
+			anomaly.BaselineMean = refMean
+			anomaly.BaselineStdDev = refStdDev
+			anomaly.Explanation = fmt.Sprintf(
+				"%s has drifted %s its baseline: the EWMA %.2f is %.1f standard deviations from the mean %.2f",
+				channel, direction(drift), ewma, math.Abs(drift), refMean,
+			)
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+	return anomalies
+}
+
+// BaselineBefore returns the latest size readings of the history before
+// the timestamp, where the history is in ascending order of time. This
+// gives the baselines of several metrics of a device from one MetBaseline.
+func BaselineBefore(history []Metric, before int64, size int) []Metric {
+	end := sort.Search(len(history), func(i int) bool {
+		return history[i].Timestamp >= before
+	})
+	start := end - size
+	if start < 0 {
+		start = 0
+	}
+	return history[start:end]
+}
+
+// MetBaseline returns the latest readings of the device before
+// the timestamp, in ascending order of time.
+func (db *DB) MetBaseline(deviceID uuuid.UUID, before int64, size int64) ([]Metric, error) {
+	findResults, err := db.collection.Find(
+		map[string]interface{}{
+			"device_id": deviceID.String(),
+			"timestamp": map[string]interface{}{
+				"$lt": before,
+			},
+		},
+		findopt.Sort(map[string]interface{}{
+			"timestamp": -1,
+		}),
+		findopt.Limit(size),
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching baseline - MetBaseline")
+		log.Println(err)
+		return nil, err
+	}
+
+	baseline := make([]Metric, len(findResults))
+	for i, v := range findResults {
+		baseline[len(findResults)-1-i] = *v.(*Metric)
+	}
+	return baseline, nil
+}
+
+// FalsePositiveReadings returns the readings of the device whose
+// anomalies were marked as false positives, for DetectAnomalies.
+func (db *DB) FalsePositiveReadings(deviceID uuuid.UUID) (map[string]bool, error) {
+	findResults, err := db.collection.Find(map[string]interface{}{
+		"device_id":      deviceID.String(),
+		"false_positive": true,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching false positives - FalsePositiveReadings")
+		log.Println(err)
+		return nil, err
+	}
+
+	readings := map[string]bool{}
+	for _, v := range findResults {
+		a := v.(*Anomaly)
+		readings[readingKey(a.Channel, a.Timestamp)] = true
+	}
+	return readings, nil
+}
+
+// CreateAnomalies generates the AnomalyIDs of the anomalies, and inserts them.
+func (db *DB) CreateAnomalies(anomalies []Anomaly) ([]Anomaly, error) {
+	now := time.Now().Unix()
+	docs := []interface{}{}
+	for i := range anomalies {
+		anomalyID, err := uuuid.NewV4()
+		if err != nil {
+			err = errors.Wrap(err, "Unable to generate AnomalyID - CreateAnomalies")
+			log.Println(err)
+			return nil, err
+		}
+		anomalies[i].AnomalyID = anomalyID
+		anomalies[i].CreatedAt = now
+		docs = append(docs, anomalies[i])
+	}
+
+	err := db.insertMany(docs)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to insert Anomalies - CreateAnomalies")
+		log.Println(err)
+		return nil, err
+	}
+	return anomalies, nil
+}
+
+// MarkFalsePositive marks (or unmarks) the anomaly as a false positive.
+func (db *DB) MarkFalsePositive(anomalyID uuuid.UUID, falsePositive bool) (*Anomaly, error) {
+	updateResult, err := db.collection.UpdateMany(
+		map[string]interface{}{
+			"anomaly_id": anomalyID.String(),
+		},
+		map[string]interface{}{
+			"false_positive": falsePositive,
+		},
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to update Anomaly - MarkFalsePositive")
+		log.Println(err)
+		return nil, err
+	}
+	if updateResult.MatchedCount == 0 {
+		return nil, errors.New("No anomaly found - MarkFalsePositive")
+	}
+
+	findResult, err := db.collection.FindOne(map[string]interface{}{
+		"anomaly_id": anomalyID.String(),
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching anomaly - MarkFalsePositive")
+		log.Println(err)
+		return nil, err
+	}
+	return findResult.(*Anomaly), nil
+}
+
+// anoFindQuery compiles the query-tree in SearchQuery.Anomaly into the
+// findQuery of AnoAdvSearch, excluding false positives. The anomalies are
+// restricted to the items of searchInv, unless it is nil.
+func anoFindQuery(searchInv []Inventory, search *SearchQuery) (*findQuery, error) {
+	var node *QueryNode
+	var page *PageParams
+	var fields []string
+	if search != nil {
+		node = search.Anomaly
+		page = anoPage(search.Page)
+		if search.Fields != nil {
+			fields = search.Fields.Anomaly
+		}
+	}
+
+	var filter map[string]interface{}
+	var err error
+	if searchInv == nil {
+		filter, err = node.Filter()
+	} else {
+		ids := []string{}
+		for _, v := range searchInv {
+			ids = append(ids, v.ItemID.String())
+		}
+		filter, err = joinFilter("item_id", ids, node)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The sort-fields are needed for ordering unpaginated results
+	return &findQuery{
+		filter: map[string]interface{}{
+			"$and": []interface{}{
+				filter,
+				map[string]interface{}{
+					"false_positive": map[string]interface{}{
+						"$ne": true,
+					},
+				},
+			},
+		},
+		page: page,
+		proj: projection(fields, "device_id", "timestamp"),
+	}, nil
+}
+
+// anoPage sorts the anomalies by device and time, unless a sort is requested.
+func anoPage(page *PageParams) *PageParams {
+	if page == nil || len(page.Sort) > 0 {
+		return page
+	}
+	sorted := *page
+	sorted.Sort = []SortField{
+		SortField{Field: "device_id"},
+		SortField{Field: "timestamp"},
+	}
+	return &sorted
+}
+
+// AnoAdvSearch searches the anomalies matching the query-tree in
+// SearchQuery.Anomaly, ordered by device and time. The anomalies are
+// restricted to the items of searchInv, unless it is nil.
+// Anomalies marked as false positives are excluded.
+func (db *DB) AnoAdvSearch(searchInv []Inventory, search *SearchQuery) ([]Anomaly, *PageResult, error) {
+	var page *PageParams
+	var fields []string
+	if search != nil {
+		page = anoPage(search.Page)
+		if search.Fields != nil {
+			fields = search.Fields.Anomaly
+		}
+	}
+
+	q, err := anoFindQuery(searchInv, search)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling anomaly query - AnoAdvSearch")
+		log.Println(err)
+		return nil, nil, err
+	}
+
+	findResults, pageResult, err := db.findPage(q)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching results from anomalies.")
+		log.Println(err)
+		return nil, nil, err
+	}
+
+	//length
+	if len(findResults) == 0 && !page.continues() {
+		msg := "No results found - AnoAdvSearch"
+		return nil, nil, errors.New(msg)
+	}
+
+	anomalies := []Anomaly{}
+	for _, v := range findResults {
+		result := v.(*Anomaly)
+		result.selectedFields = fields
+		anomalies = append(anomalies, *result)
+	}
+	if page == nil {
+		sort.SliceStable(anomalies, func(i, j int) bool {
+			di := anomalies[i].DeviceID.String()
+			dj := anomalies[j].DeviceID.String()
+			if di != dj {
+				return di < dj
+			}
+			return anomalies[i].Timestamp < anomalies[j].Timestamp
+		})
+	}
+	return anomalies, pageResult, nil
+}
+
+// AnoExplain explains the search which AnoAdvSearch would run.
+func (db *DB) AnoExplain(searchInv []Inventory, search *SearchQuery) (*Explanation, error) {
+	q, err := anoFindQuery(searchInv, search)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling anomaly query - AnoExplain")
+		log.Println(err)
+		return nil, err
+	}
+
+	explanation, err := db.explainFind(q)
+	if err != nil {
+		err = errors.Wrap(err, "Error explaining anomaly search - AnoExplain")
+		return nil, err
+	}
+	return explanation, nil
+}
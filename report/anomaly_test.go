@@ -0,0 +1,109 @@
+package report
+
+import "testing"
+
+// tempHistory returns metrics with the temp_in readings, one per minute.
+func tempHistory(readings ...float64) []Metric {
+	metrics := []Metric{}
+	for i, r := range readings {
+		m := Metric{Timestamp: int64(60 * (i + 1))}
+		m.SetReading("temp_in", r)
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// repeat returns the readings repeated n times.
+func repeat(n int, readings ...float64) []float64 {
+	repeated := []float64{}
+	for i := 0; i < n; i++ {
+		repeated = append(repeated, readings...)
+	}
+	return repeated
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	steady := tempHistory(repeat(10, 10, 11)...)
+	drifting := tempHistory(append(repeat(10, 10, 11), repeat(10, 12.5, 13)...)...)
+	zeros := tempHistory(repeat(10, 0, 0.5)...)
+
+	tests := []struct {
+		name           string
+		reading        float64
+		baseline       []Metric
+		falsePositives map[string]bool
+		want           string
+	}{
+		{"normal reading", 10.5, steady, nil, ""},
+		{"spike", 20, steady, nil, AnomalyZScore},
+		{"drop", 2, steady, nil, AnomalyZScore},
+		{"drift", 13, drifting, nil, AnomalyEWMA},
+		{"too few readings", 20, steady[:minBaselineSize-1], nil, ""},
+		{
+			name:     "false positives are not in the baseline",
+			reading:  20,
+			baseline: steady[:minBaselineSize],
+			falsePositives: map[string]bool{
+				readingKey("temp_in", steady[0].Timestamp): true,
+			},
+			want: "",
+		},
+		{"zero readings are in the baseline", 6, zeros, nil, AnomalyZScore},
+	}
+
+	for _, test := range tests {
+		metric := Metric{Timestamp: 100000}
+		metric.SetReading("temp_in", test.reading)
+
+		anomalies := DetectAnomalies(metric, test.baseline, test.falsePositives)
+		if test.want == "" {
+			if len(anomalies) != 0 {
+				t.Errorf("%s: got anomalies %+v, want none", test.name, anomalies)
+			}
+			continue
+		}
+		if len(anomalies) != 1 {
+			t.Errorf("%s: got %d anomalies, want 1", test.name, len(anomalies))
+			continue
+		}
+		if a := anomalies[0]; a.Method != test.want || a.Channel != "temp_in" {
+			t.Errorf("%s: got %s anomaly of %s, want %s", test.name, a.Method, a.Channel, test.want)
+		}
+	}
+}
+
+func TestBaselineBefore(t *testing.T) {
+	// Readings at 60, 120, ..., 600
+	history := tempHistory(repeat(10, 1)...)
+
+	tests := []struct {
+		name   string
+		before int64
+		size   int
+		// want are the timestamps of the first and last reading
+		want []int64
+	}{
+		{"latest readings", 601, 3, []int64{480, 600}},
+		{"excludes the timestamp", 600, 3, []int64{420, 540}},
+		{"fewer readings than size", 200, 5, []int64{60, 180}},
+		{"before the history", 60, 5, nil},
+	}
+
+	for _, test := range tests {
+		baseline := BaselineBefore(history, test.before, test.size)
+		if test.want == nil {
+			if len(baseline) != 0 {
+				t.Errorf("%s: got %d readings, want none", test.name, len(baseline))
+			}
+			continue
+		}
+		if len(baseline) == 0 {
+			t.Errorf("%s: got no readings", test.name)
+			continue
+		}
+		first, last := baseline[0].Timestamp, baseline[len(baseline)-1].Timestamp
+		if first != test.want[0] || last != test.want[1] {
+			t.Errorf("%s: got readings %d to %d, want %v", test.name, first, last, test.want)
+		}
+	}
+}
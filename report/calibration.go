@@ -0,0 +1,626 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// linear converts a reading v into a*v + b.
+type linear struct {
+	a float64
+	b float64
+}
+
+// then returns the conversion which applies l, and then next.
+func (l linear) then(next linear) linear {
+	return linear{
+		a: next.a * l.a,
+		b: next.a*l.b + next.b,
+	}
+}
+
+// apply converts the reading. The product is rounded before the sum, as
+// it is by the aggregation-expression of the conversion (see linearExpr).
+func (l linear) apply(v float64) float64 {
+	return float64(l.a*v) + l.b
+}
+
+func (l linear) inverse() linear {
+	return linear{
+		a: 1 / l.a,
+		b: -l.b / l.a,
+	}
+}
+
+func (l linear) isIdentity() bool {
+	return l.a == 1 && l.b == 0
+}
+
+// ChannelUnits are the units of each channel, starting with its canonical
+// unit. Readings are stored in the units of their device, and reported in
+// the canonical units unless other units are requested.
+var ChannelUnits = map[string][]string{
+	"temp_in":   {"C", "F", "K"},
+	"humidity":  {"%"},
+	"ethylene":  {"ppm", "ppb"},
+	"carbon_di": {"ppm", "ppb"},
+}
+
+// toCanonical converts a reading in a unit into the canonical unit.
+var toCanonical = map[string]linear{
+	"C":   {a: 1, b: 0},
+	"F":   {a: 5.0 / 9, b: -32 * 5.0 / 9},
+	"K":   {a: 1, b: -273.15},
+	"%":   {a: 1, b: 0},
+	"ppm": {a: 1, b: 0},
+	"ppb": {a: 0.001, b: 0},
+}
+
+// validateUnit returns an error if the unit is not one of the channel.
+func validateUnit(channel string, unit string) error {
+	units, ok := ChannelUnits[channel]
+	if !ok {
+		channels := []string{}
+		for c := range ChannelUnits {
+			channels = append(channels, c)
+		}
+		sort.Strings(channels)
+		return errors.Errorf(
+			"Unknown channel %s, expected one of: %s", channel, strings.Join(channels, ", "),
+		)
+	}
+	for _, u := range units {
+		if u == unit {
+			return nil
+		}
+	}
+	return errors.Errorf(
+		"Invalid unit %s for %s, expected one of: %s", unit, channel, strings.Join(units, ", "),
+	)
+}
+
+// validateUnits returns the problems with the output-units of a SearchQuery.
+func validateUnits(units map[string]string, path string) ValidationErrors {
+	verrs := ValidationErrors{}
+	for channel, unit := range units {
+		if err := validateUnit(channel, unit); err != nil {
+			verrs = append(verrs, ValidationError{
+				Path:    path + "." + channel,
+				Field:   channel,
+				Message: err.Error(),
+			})
+		}
+	}
+	return verrs
+}
+
+// ChannelCalibration corrects the readings of a channel of a device.
+// The readings are in Unit (the canonical unit if empty), and are
+// corrected into Gain * reading + Offset, in the same unit.
+type ChannelCalibration struct {
+	Unit   string  `bson:"unit,omitempty" json:"unit,omitempty"`
+	Offset float64 `bson:"offset" json:"offset"`
+	Gain   float64 `bson:"gain" json:"gain"`
+}
+
+// correction returns the conversion of the stored readings into
+// corrected readings in the canonical unit.
+func (c ChannelCalibration) correction() linear {
+	unit := toCanonical[c.Unit]
+	if c.Unit == "" {
+		unit = linear{a: 1}
+	}
+	return linear{a: c.Gain, b: c.Offset}.then(unit)
+}
+
+// Calibration is the calibration-profile of a device, applying to its
+// readings from EffectiveFrom until the EffectiveFrom of its next profile.
+// Channels without a ChannelCalibration are not corrected.
+// Profiles are applied when the metrics are read, so stored metrics are
+// never rewritten, and corrected profiles apply retroactively.
+type Calibration struct {
+	ID            objectid.ObjectID             `bson:"_id,omitempty" json:"_id,omitempty"`
+	DeviceID      uuuid.UUID                    `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	EffectiveFrom int64                         `bson:"effective_from" json:"effective_from"`
+	Channels      map[string]ChannelCalibration `bson:"channels,omitempty" json:"channels,omitempty"`
+	CreatedAt     int64                         `bson:"created_at,omitempty" json:"created_at,omitempty"`
+}
+
+type marshalCalibration struct {
+	ID            objectid.ObjectID             `bson:"_id,omitempty" json:"_id,omitempty"`
+	DeviceID      string                        `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	EffectiveFrom int64                         `bson:"effective_from" json:"effective_from"`
+	Channels      map[string]ChannelCalibration `bson:"channels,omitempty" json:"channels,omitempty"`
+	CreatedAt     int64                         `bson:"created_at,omitempty" json:"created_at,omitempty"`
+}
+
+func (c Calibration) toMarshal() *marshalCalibration {
+	mc := &marshalCalibration{
+		ID:            c.ID,
+		EffectiveFrom: c.EffectiveFrom,
+		Channels:      c.Channels,
+		CreatedAt:     c.CreatedAt,
+	}
+	if c.DeviceID.String() != (uuuid.UUID{}).String() {
+		mc.DeviceID = c.DeviceID.String()
+	}
+	return mc
+}
+
+func (c Calibration) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(c.toMarshal())
+}
+
+func (c Calibration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.toMarshal())
+}
+
+func (c *Calibration) fromMarshal(mc *marshalCalibration) error {
+	c.ID = mc.ID
+	c.EffectiveFrom = mc.EffectiveFrom
+	c.Channels = mc.Channels
+	c.CreatedAt = mc.CreatedAt
+
+	if mc.DeviceID != "" {
+		var err error
+		c.DeviceID, err = uuuid.FromString(mc.DeviceID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing DeviceID for calibration")
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Calibration) UnmarshalBSON(in []byte) error {
+	mc := &marshalCalibration{}
+	err := bson.Unmarshal(in, mc)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+	return c.fromMarshal(mc)
+}
+
+func (c *Calibration) UnmarshalJSON(in []byte) error {
+	mc := &marshalCalibration{}
+	err := json.Unmarshal(in, mc)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+	return c.fromMarshal(mc)
+}
+
+// Validate returns the problems with the Calibration.
+// A Gain of zero is set to 1 (no gain).
+func (c *Calibration) Validate() ValidationErrors {
+	verrs := ValidationErrors{}
+	if c.DeviceID.String() == (uuuid.UUID{}).String() {
+		verrs = append(verrs, ValidationError{
+			Path:    "device_id",
+			Message: "device_id is required",
+		})
+	}
+	if len(c.Channels) == 0 {
+		verrs = append(verrs, ValidationError{
+			Path:    "channels",
+			Message: "channels is required",
+		})
+	}
+
+	for channel, cc := range c.Channels {
+		path := "channels." + channel
+		unit := cc.Unit
+		if unit == "" && ChannelUnits[channel] != nil {
+			unit = ChannelUnits[channel][0]
+		}
+		if err := validateUnit(channel, unit); err != nil {
+			verrs = append(verrs, ValidationError{
+				Path:    path,
+				Field:   channel,
+				Message: err.Error(),
+			})
+		}
+		if cc.Gain == 0 {
+			cc.Gain = 1
+			c.Channels[channel] = cc
+		}
+		// A negative gain would swap the minimum and maximum of rollups
+		if cc.Gain < 0 {
+			verrs = append(verrs, ValidationError{
+				Path:    path + ".gain",
+				Field:   channel,
+				Message: fmt.Sprintf("gain must be positive, got %g", cc.Gain),
+			})
+		}
+	}
+
+	if len(verrs) == 0 {
+		return nil
+	}
+	return verrs
+}
+
+// Calibrator converts stored readings into corrected readings, using the
+// calibration-profiles of their devices, in the requested output Units
+// (by channel). Channels without an output unit are in the canonical unit.
+// A nil Calibrator leaves the readings unchanged.
+type Calibrator struct {
+	// profiles by DeviceID, by ascending EffectiveFrom
+	profiles map[string][]Calibration
+	units    map[string]string
+}
+
+// NewCalibrator creates a Calibrator from the calibration-profiles and
+// the output-units.
+func NewCalibrator(calibrations []Calibration, units map[string]string) *Calibrator {
+	c := &Calibrator{
+		profiles: map[string][]Calibration{},
+		units:    units,
+	}
+	for _, cal := range calibrations {
+		deviceID := cal.DeviceID.String()
+		c.profiles[deviceID] = append(c.profiles[deviceID], cal)
+	}
+	for _, profiles := range c.profiles {
+		sort.Slice(profiles, func(i, j int) bool {
+			return profiles[i].EffectiveFrom < profiles[j].EffectiveFrom
+		})
+	}
+	return c
+}
+
+// WithUnits returns a copy of the Calibrator, converting into the units.
+func (c *Calibrator) WithUnits(units map[string]string) *Calibrator {
+	if c == nil {
+		return nil
+	}
+	return &Calibrator{
+		profiles: c.profiles,
+		units:    units,
+	}
+}
+
+// output returns the conversion of canonical readings into the output-unit.
+func (c *Calibrator) output(channel string) linear {
+	unit, ok := c.units[channel]
+	if !ok {
+		return linear{a: 1}
+	}
+	return toCanonical[unit].inverse()
+}
+
+// profile returns the calibration-profile of the device at the time,
+// or nil if there is none.
+func (c *Calibrator) profile(deviceID string, timestamp int64) *Calibration {
+	profiles := c.profiles[deviceID]
+	i := sort.Search(len(profiles), func(i int) bool {
+		return profiles[i].EffectiveFrom > timestamp
+	})
+	if i == 0 {
+		return nil
+	}
+	return &profiles[i-1]
+}
+
+// conversion returns the conversion of the stored readings of the channel
+// with the calibration-profile into the output-unit.
+func (c *Calibrator) conversion(profile *Calibration, channel string) linear {
+	correction := linear{a: 1}
+	if profile != nil {
+		if cc, ok := profile.Channels[channel]; ok {
+			correction = cc.correction()
+		}
+	}
+	return correction.then(c.output(channel))
+}
+
+// Converts returns whether the Calibrator changes the readings of the
+// channel, for any of its devices.
+func (c *Calibrator) Converts(channel string) bool {
+	if c == nil {
+		return false
+	}
+	if !c.conversion(nil, channel).isIdentity() {
+		return true
+	}
+	for _, profiles := range c.profiles {
+		for i := range profiles {
+			if !c.conversion(&profiles[i], channel).isIdentity() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deviceIDs returns the IDs of the devices with calibration-profiles,
+// in ascending order.
+func (c *Calibrator) deviceIDs() []string {
+	deviceIDs := []string{}
+	for deviceID := range c.profiles {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Strings(deviceIDs)
+	return deviceIDs
+}
+
+// Filter compiles the metric query-tree into a Mongo filter on the stored
+// readings, which matches the metrics whose corrected readings match the
+// query-tree. The conditions on the channels which the Calibrator converts
+// are converted back into the stored readings of each calibration-profile,
+// for the metrics of its device from its EffectiveFrom until the next one.
+// A nil Calibrator compiles the query-tree as QueryNode.Filter does.
+func (c *Calibrator) Filter(node *QueryNode) (map[string]interface{}, error) {
+	if c == nil {
+		return node.Filter()
+	}
+	return node.compile(c.filter)
+}
+
+// filter converts the SearchParam into a filter on the stored readings.
+func (c *Calibrator) filter(v SearchParam) (map[string]interface{}, error) {
+	filter, err := v.filter()
+	if err != nil || !c.Converts(v.Field) {
+		return filter, err
+	}
+	cond := filter[v.Field].(map[string]interface{})
+
+	branches := []interface{}{}
+	calibrated := []interface{}{}
+	for _, deviceID := range c.deviceIDs() {
+		profiles := c.profiles[deviceID]
+		for i := range profiles {
+			timestamp := map[string]interface{}{
+				"$gte": profiles[i].EffectiveFrom,
+			}
+			if i+1 < len(profiles) {
+				timestamp["$lt"] = profiles[i+1].EffectiveFrom
+			}
+			branches = append(branches, map[string]interface{}{
+				"device_id": deviceID,
+				"timestamp": timestamp,
+				v.Field:     convertCondition(cond, c.conversion(&profiles[i], v.Field).inverse()),
+			})
+		}
+		calibrated = append(calibrated, map[string]interface{}{
+			"device_id": deviceID,
+			"timestamp": map[string]interface{}{
+				"$gte": profiles[0].EffectiveFrom,
+			},
+		})
+	}
+
+	// The metrics before the first profile of their device, and those
+	// of devices without profiles, are only converted into the output-unit
+	uncalibrated := map[string]interface{}{
+		v.Field: convertCondition(cond, c.conversion(nil, v.Field).inverse()),
+	}
+	if len(branches) == 0 {
+		return uncalibrated, nil
+	}
+	uncalibrated["$nor"] = calibrated
+	return map[string]interface{}{
+		"$or": append(branches, uncalibrated),
+	}, nil
+}
+
+// convertCondition converts the values compared with the readings in the
+// operator-document, such as {"$gte": 5}. Since conversions have positive
+// gains, the comparisons are unchanged.
+func convertCondition(cond map[string]interface{}, conv linear) map[string]interface{} {
+	convert := func(value interface{}) interface{} {
+		if v, ok := toFloat(value); ok {
+			return conv.apply(v)
+		}
+		return value
+	}
+
+	converted := map[string]interface{}{}
+	for op, value := range cond {
+		switch op {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			converted[op] = convert(value)
+		case "$in", "$nin":
+			values := []interface{}{}
+			for _, v := range value.([]interface{}) {
+				values = append(values, convert(v))
+			}
+			converted[op] = values
+		default:
+			converted[op] = value
+		}
+	}
+	return converted
+}
+
+// Apply corrects the readings of the metrics. Missing readings are
+// left missing.
+func (c *Calibrator) Apply(metrics []Metric) {
+	if c == nil {
+		return
+	}
+	for i := range metrics {
+		m := &metrics[i]
+		profile := c.profile(m.DeviceID.String(), m.Timestamp)
+		// The extremes of rollups are copied, as the copies of
+		// metrics share them
+		m.Min, m.Max = copyFloats(m.Min), copyFloats(m.Max)
+		for _, channel := range RollupChannels {
+			reading, ok := m.Reading(channel)
+			if !ok {
+				continue
+			}
+			// Set as a reading, since it can be converted to zero
+			conv := c.conversion(profile, channel)
+			m.SetReading(channel, conv.apply(reading))
+			if v, ok := m.Min[channel]; ok {
+				m.Min[channel] = conv.apply(v)
+			}
+			if v, ok := m.Max[channel]; ok {
+				m.Max[channel] = conv.apply(v)
+			}
+		}
+	}
+}
+
+// copyFloats returns a copy of the map, or nil if it is nil.
+func copyFloats(floats map[string]float64) map[string]float64 {
+	if floats == nil {
+		return nil
+	}
+	copied := map[string]float64{}
+	for k, v := range floats {
+		copied[k] = v
+	}
+	return copied
+}
+
+// linearExpr returns the aggregation-expression converting the value,
+// which is an aggregation-expression such as "$temp_in".
+func linearExpr(value interface{}, conv linear) interface{} {
+	return map[string]interface{}{
+		"$add": []interface{}{
+			map[string]interface{}{
+				"$multiply": []interface{}{value, conv.a},
+			},
+			conv.b,
+		},
+	}
+}
+
+// expr returns the aggregation-expression which corrects the value, which
+// is a reading of the channel in an aggregation-expression such as
+// "$temp_in", or nil if the channel is not converted. The conversion is
+// selected by the device_id and timestamp of the document.
+func (c *Calibrator) expr(value interface{}, channel string) interface{} {
+	if !c.Converts(channel) {
+		return nil
+	}
+
+	branches := []interface{}{}
+	for _, deviceID := range c.deviceIDs() {
+		profiles := c.profiles[deviceID]
+		for i := range profiles {
+			conv := c.conversion(&profiles[i], channel)
+			conditions := []interface{}{
+				map[string]interface{}{
+					"$eq": []interface{}{"$device_id", deviceID},
+				},
+				map[string]interface{}{
+					"$gte": []interface{}{"$timestamp", profiles[i].EffectiveFrom},
+				},
+			}
+			if i+1 < len(profiles) {
+				conditions = append(conditions, map[string]interface{}{
+					"$lt": []interface{}{"$timestamp", profiles[i+1].EffectiveFrom},
+				})
+			}
+			branches = append(branches, map[string]interface{}{
+				"case": map[string]interface{}{
+					"$and": conditions,
+				},
+				"then": linearExpr(value, conv),
+			})
+		}
+	}
+
+	conv := c.conversion(nil, channel)
+	if len(branches) == 0 {
+		return linearExpr(value, conv)
+	}
+	return map[string]interface{}{
+		"$switch": map[string]interface{}{
+			"branches": branches,
+			"default":  linearExpr(value, conv),
+		},
+	}
+}
+
+// fields returns the aggregation-expressions which correct the readings
+// in the fields, by field, for an $addFields stage. The field of a channel
+// can be nested, such as "max.temp_in" for "temp_in".
+// Fields which are not converted are left out.
+func (c *Calibrator) fields(channels map[string]string) map[string]interface{} {
+	exprs := map[string]interface{}{}
+	for field, channel := range channels {
+		if expr := c.expr("$"+field, channel); expr != nil {
+			exprs[field] = expr
+		}
+	}
+	return exprs
+}
+
+// Calibrations returns the calibration-profiles of the devices,
+// or of all devices if deviceIDs is nil.
+func (db *DB) Calibrations(deviceIDs []string) ([]Calibration, error) {
+	filter := map[string]interface{}{}
+	if deviceIDs != nil {
+		filter["device_id"] = map[string]interface{}{
+			"$in": deviceIDs,
+		}
+	}
+
+	findResults, err := db.collection.Find(filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching Calibrations - Calibrations")
+		log.Println(err)
+		return nil, err
+	}
+
+	calibrations := []Calibration{}
+	for _, v := range findResults {
+		calibrations = append(calibrations, *v.(*Calibration))
+	}
+	sort.Slice(calibrations, func(i, j int) bool {
+		if calibrations[i].DeviceID.String() != calibrations[j].DeviceID.String() {
+			return calibrations[i].DeviceID.String() < calibrations[j].DeviceID.String()
+		}
+		return calibrations[i].EffectiveFrom < calibrations[j].EffectiveFrom
+	})
+	return calibrations, nil
+}
+
+// SaveCalibration stores the calibration-profile, replacing the profile
+// of the device with the same EffectiveFrom.
+func (db *DB) SaveCalibration(c *Calibration) (*Calibration, error) {
+	err := db.DeleteCalibration(c.DeviceID, c.EffectiveFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	c.ID = objectid.NilObjectID
+	c.CreatedAt = time.Now().Unix()
+	_, err = db.collection.InsertOne(c)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to insert Calibration - SaveCalibration")
+		log.Println(err)
+		return nil, err
+	}
+	return c, nil
+}
+
+// DeleteCalibration removes the calibration-profile of the device
+// with the EffectiveFrom.
+func (db *DB) DeleteCalibration(deviceID uuuid.UUID, effectiveFrom int64) error {
+	_, err := db.collection.DeleteMany(map[string]interface{}{
+		"device_id":      deviceID.String(),
+		"effective_from": effectiveFrom,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Unable to delete Calibration - DeleteCalibration")
+		log.Println(err)
+		return err
+	}
+	return nil
+}
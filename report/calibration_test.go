@@ -0,0 +1,287 @@
+package report
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+)
+
+func TestLinearThen(t *testing.T) {
+	tests := []struct {
+		name  string
+		first linear
+		next  linear
+		// v is converted by first and then next
+		v, want float64
+	}{
+		{"identities", linear{a: 1}, linear{a: 1}, 3, 3},
+		{"gain then offset", linear{a: 2}, linear{a: 1, b: 5}, 3, 11},
+		{"offset then gain", linear{a: 1, b: 5}, linear{a: 2}, 3, 16},
+		{"fahrenheit to celsius", linear{a: 1, b: 0.5}, toCanonical["F"], 211.5, 100},
+		{"celsius to kelvin", linear{a: 1}, toCanonical["K"].inverse(), 0, 273.15},
+	}
+
+	for _, test := range tests {
+		conv := test.first.then(test.next)
+		if got := conv.a*test.v + conv.b; math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCalibratorApply(t *testing.T) {
+	device, _ := uuuid.FromString("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+	other, _ := uuuid.FromString("6ba7b812-9dad-11d1-80b4-00c04fd430c8")
+	calibrations := []Calibration{
+		{
+			DeviceID:      device,
+			EffectiveFrom: 2000,
+			Channels:      map[string]ChannelCalibration{"temp_in": {Offset: 1, Gain: 2}},
+		},
+		{
+			DeviceID:      device,
+			EffectiveFrom: 1000,
+			Channels:      map[string]ChannelCalibration{"temp_in": {Unit: "F", Offset: 0, Gain: 1}},
+		},
+	}
+	metric := func(deviceID uuuid.UUID, timestamp int64, tempIn float64) Metric {
+		m := Metric{DeviceID: deviceID, Timestamp: timestamp}
+		m.SetReading("temp_in", tempIn)
+		return m
+	}
+
+	tests := []struct {
+		name   string
+		units  map[string]string
+		metric Metric
+		want   float64
+	}{
+		{"before the profiles", nil, metric(device, 500, 10), 10},
+		{"unit of the device", nil, metric(device, 1500, 212), 100},
+		{"latest profile", nil, metric(device, 2000, 10), 21},
+		{"device without profiles", nil, metric(other, 2000, 10), 10},
+		{"output unit", map[string]string{"temp_in": "F"}, metric(device, 2000, 10), 69.8},
+		{"zero reading", nil, metric(device, 2000, 0), 1},
+		{"converted to zero", nil, metric(device, 1500, 32), 0},
+	}
+
+	for _, test := range tests {
+		cal := NewCalibrator(calibrations, test.units)
+		metrics := []Metric{test.metric}
+		cal.Apply(metrics)
+		got, ok := metrics[0].Reading("temp_in")
+		if !ok || math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: got (%v, %t), want %v", test.name, got, ok, test.want)
+		}
+		if _, ok := metrics[0].Reading("humidity"); ok {
+			t.Errorf("%s: got a missing reading", test.name)
+		}
+	}
+
+	// A nil Calibrator leaves the readings unchanged
+	metrics := []Metric{metric(device, 2000, 10)}
+	(*Calibrator)(nil).Apply(metrics)
+	if metrics[0].TempIn != 10 {
+		t.Errorf("nil Calibrator: got %v, want 10", metrics[0].TempIn)
+	}
+}
+
+func TestCalibratorFilter(t *testing.T) {
+	device, _ := uuuid.FromString("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+	deviceID := device.String()
+	// Readings from 100 are corrected into 2 * reading + 1
+	calibrated := NewCalibrator([]Calibration{
+		{
+			DeviceID:      device,
+			EffectiveFrom: 100,
+			Channels:      map[string]ChannelCalibration{"temp_in": {Offset: 1, Gain: 2}},
+		},
+	}, nil)
+	uncalibrated := NewCalibrator([]Calibration{
+		{
+			DeviceID: device,
+			Channels: map[string]ChannelCalibration{"temp_in": {Gain: 1}},
+		},
+	}, nil)
+
+	tempIn := &QueryNode{SearchParam: SearchParam{Field: "temp_in", Type: "float", Op: OpGreater, Value: 5.0}}
+	timestamp := &QueryNode{SearchParam: SearchParam{Field: "timestamp", Type: "int", Op: OpGreater, Value: 1}}
+	// tempInFilter is the filter of the readings whose corrected
+	// readings match the condition
+	tempInFilter := func(cond, stored map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"$or": []interface{}{
+				map[string]interface{}{
+					"device_id": deviceID,
+					"timestamp": map[string]interface{}{"$gte": int64(100)},
+					"temp_in":   stored,
+				},
+				map[string]interface{}{
+					"temp_in": cond,
+					"$nor": []interface{}{
+						map[string]interface{}{
+							"device_id": deviceID,
+							"timestamp": map[string]interface{}{"$gte": int64(100)},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name string
+		cal  *Calibrator
+		node *QueryNode
+		want map[string]interface{}
+	}{
+		{
+			name: "not calibrated",
+			cal:  nil,
+			node: tempIn,
+			want: map[string]interface{}{"temp_in": map[string]interface{}{"$gt": 5.0}},
+		},
+		{
+			name: "identity calibration",
+			cal:  uncalibrated,
+			node: tempIn,
+			want: map[string]interface{}{"temp_in": map[string]interface{}{"$gt": 5.0}},
+		},
+		{
+			name: "calibrated",
+			cal:  calibrated,
+			node: tempIn,
+			want: tempInFilter(
+				map[string]interface{}{"$gt": 5.0},
+				map[string]interface{}{"$gt": 2.0},
+			),
+		},
+		{
+			name: "calibrated values",
+			cal:  calibrated,
+			node: &QueryNode{SearchParam: SearchParam{Field: "temp_in", Type: "float", Op: OpIn, Values: []interface{}{3.0, 5.0}}},
+			want: tempInFilter(
+				map[string]interface{}{"$in": []interface{}{3.0, 5.0}},
+				map[string]interface{}{"$in": []interface{}{1.0, 2.0}},
+			),
+		},
+		{
+			name: "nested",
+			cal:  calibrated,
+			node: &QueryNode{And: []*QueryNode{timestamp, {Not: tempIn}}},
+			want: map[string]interface{}{
+				"$and": []interface{}{
+					map[string]interface{}{"timestamp": map[string]interface{}{"$gt": int64(1)}},
+					map[string]interface{}{
+						"$nor": []interface{}{
+							tempInFilter(
+								map[string]interface{}{"$gt": 5.0},
+								map[string]interface{}{"$gt": 2.0},
+							),
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "not converted",
+			cal:  NewCalibrator(nil, map[string]string{"ethylene": "ppb"}),
+			node: &QueryNode{SearchParam: SearchParam{Field: "temp_in", Type: "float", Op: OpExists, Value: true}},
+			want: map[string]interface{}{"temp_in": map[string]interface{}{"$exists": true}},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := test.cal.Filter(test.node)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMetFindQueryCalibratedSort(t *testing.T) {
+	device, _ := uuuid.FromString("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+	cal := NewCalibrator([]Calibration{
+		{
+			DeviceID: device,
+			Channels: map[string]ChannelCalibration{"temp_in": {Offset: 1, Gain: 2}},
+		},
+	}, nil)
+	cursor, _ := encodeCursor(&pageCursor{Values: []interface{}{3.0, 7.0}, ID: "5bc8a00000000000000000a1"})
+
+	tests := []struct {
+		name string
+		cal  *Calibrator
+		page *PageParams
+		// want are the stages of the pipeline, and its sort-fields
+		want     []string
+		wantSort []string
+	}{
+		{
+			name: "not calibrated",
+			page: &PageParams{Sort: []SortField{{Field: "temp_in"}}},
+		},
+		{
+			name:     "calibrated sort",
+			cal:      cal,
+			page:     &PageParams{Sort: []SortField{{Field: "timestamp"}, {Field: "temp_in", Desc: true}}},
+			want:     []string{"$match", "$addFields", "$sort", "$limit"},
+			wantSort: []string{"timestamp", "computed_temp_in", "_id"},
+		},
+		{
+			name:     "after the cursor",
+			cal:      cal,
+			page:     &PageParams{Sort: []SortField{{Field: "timestamp"}, {Field: "temp_in"}}, Cursor: cursor},
+			want:     []string{"$match", "$addFields", "$match", "$sort", "$limit"},
+			wantSort: []string{"timestamp", "computed_temp_in", "_id"},
+		},
+		{
+			name: "other sort-fields",
+			cal:  cal,
+			page: &PageParams{Sort: []SortField{{Field: "humidity"}}},
+		},
+	}
+
+	for _, test := range tests {
+		q, err := metFindQuery(nil, &SearchQuery{Page: test.page}, test.cal)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if test.want == nil {
+			if q.computed != nil {
+				t.Errorf("%s: got computed %v, want none", test.name, q.computed)
+			}
+			continue
+		}
+
+		pipeline, err := q.pipeline()
+		if err != nil {
+			t.Errorf("%s: pipeline: %v", test.name, err)
+			continue
+		}
+		got, gotSort := []string{}, []string{}
+		for _, stage := range pipeline {
+			for op, value := range stage.(map[string]interface{}) {
+				got = append(got, op)
+				if op != "$sort" {
+					continue
+				}
+				keys, _ := value.(*bson.Document).Keys(false)
+				for _, k := range keys {
+					gotSort = append(gotSort, k.Name)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) || !reflect.DeepEqual(gotSort, test.wantSort) {
+			t.Errorf("%s: got %v sorted by %v, want %v sorted by %v", test.name, got, gotSort, test.want, test.wantSort)
+		}
+	}
+}
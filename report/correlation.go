@@ -0,0 +1,451 @@
+package report
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// CorrelationParams selects the unit of the waste-correlation report.
+// Unit is "item" (default) or "lot". Items are combined into lots by
+// their product, origin and lot.
+type CorrelationParams struct {
+	Unit string `json:"unit,omitempty"`
+}
+
+// CorrelationQuery is the request-body of the waste-correlation report.
+type CorrelationQuery struct {
+	SearchQuery
+	Correlation *CorrelationParams `json:"correlation,omitempty"`
+}
+
+// Validate checks the SearchQuery and the CorrelationParams.
+// Returns nil if the CorrelationQuery is valid.
+func (q *CorrelationQuery) Validate() ValidationErrors {
+	verrs := q.SearchQuery.Validate()
+	if q.Correlation != nil {
+		verrs = append(verrs, q.Correlation.validate("correlation")...)
+	}
+	return verrs
+}
+
+func (p *CorrelationParams) unit() string {
+	if p == nil || p.Unit == "" {
+		return "item"
+	}
+	return p.Unit
+}
+
+// validate returns the problems with the CorrelationParams.
+func (p *CorrelationParams) validate(path string) ValidationErrors {
+	if unit := p.unit(); unit != "item" && unit != "lot" {
+		return ValidationErrors{
+			ValidationError{
+				Path:    path + ".unit",
+				Message: fmt.Sprintf("Invalid unit %s, expected item or lot", unit),
+			},
+		}
+	}
+	return nil
+}
+
+// Exposure is the environment an item was exposed to, by channel.
+// Count is the number of readings of each channel.
+type Exposure struct {
+	Count map[string]int64
+	Mean  map[string]float64
+	Peak  map[string]float64
+}
+
+// MergeExposures combines the exposures of the items to the rollups and
+// to the raw metrics, by ItemID.
+func MergeExposures(rollups map[string]*Exposure, raw map[string]*Exposure) map[string]*Exposure {
+	merged := map[string]*Exposure{}
+	for _, exposures := range []map[string]*Exposure{rollups, raw} {
+		for itemID, e := range exposures {
+			m, ok := merged[itemID]
+			if !ok {
+				m = &Exposure{
+					Count: map[string]int64{},
+					Mean:  map[string]float64{},
+					Peak:  map[string]float64{},
+				}
+				merged[itemID] = m
+			}
+			for channel, count := range e.Count {
+				prev := m.Count[channel]
+				total := prev + count
+				if total == 0 {
+					continue
+				}
+				m.Mean[channel] = (m.Mean[channel]*float64(prev) + e.Mean[channel]*float64(count)) / float64(total)
+				if peak, ok := m.Peak[channel]; !ok || prev == 0 || e.Peak[channel] > peak {
+					m.Peak[channel] = e.Peak[channel]
+				}
+				m.Count[channel] = total
+			}
+		}
+	}
+	return merged
+}
+
+// WastePoint is the waste of an item or lot (Key), and the mean and peak
+// readings of each channel it was exposed to. The Key of an item is its
+// ItemID, and of a lot its "Name|Origin|Lot", since lot-numbers are only
+// unique per product and origin.
+// WasteRatio is WasteWeight / TotalWeight.
+type WastePoint struct {
+	Key        string             `json:"key"`
+	Name       string             `json:"name"`
+	Origin     string             `json:"origin"`
+	Lot        string             `json:"lot,omitempty"`
+	WasteRatio float64            `json:"waste_ratio"`
+	Mean       map[string]float64 `json:"mean"`
+	Peak       map[string]float64 `json:"peak"`
+}
+
+// Correlation is between the WasteRatio and a reading, over N points.
+// The coefficients are nil if they are undefined, which is the case
+// for fewer than 3 points or if either variable is constant.
+type Correlation struct {
+	N        int      `json:"n"`
+	Pearson  *float64 `json:"pearson"`
+	Spearman *float64 `json:"spearman"`
+}
+
+// ChannelCorrelation has the correlations of the WasteRatio with the
+// mean and peak readings of a channel.
+type ChannelCorrelation struct {
+	Mean Correlation `json:"mean"`
+	Peak Correlation `json:"peak"`
+}
+
+// WasteCorrelation has the correlations for the points of a product or
+// origin (Group), by channel.
+type WasteCorrelation struct {
+	Group    string                        `json:"group"`
+	Points   int                           `json:"points"`
+	Channels map[string]ChannelCorrelation `json:"channels"`
+}
+
+// WasteCorrelationReport has the correlations per product and per origin,
+// and the scatter-data (Points) they are computed from.
+type WasteCorrelationReport struct {
+	Unit     string             `json:"unit"`
+	Products []WasteCorrelation `json:"products"`
+	Origins  []WasteCorrelation `json:"origins"`
+	Points   []WastePoint       `json:"points"`
+}
+
+// pearson returns the Pearson correlation-coefficient of x and y,
+// or false if it is undefined.
+func pearson(x []float64, y []float64) (float64, bool) {
+	n := len(x)
+	if n < 3 || n != len(y) {
+		return 0, false
+	}
+	meanX, sdX := meanStdDev(x)
+	meanY, sdY := meanStdDev(y)
+	if sdX == 0 || sdY == 0 {
+		return 0, false
+	}
+
+	cov := 0.0
+	for i := range x {
+		cov += (x[i] - meanX) * (y[i] - meanY)
+	}
+	cov /= float64(n)
+	return math.Max(-1, math.Min(1, cov/(sdX*sdY))), true
+}
+
+// ranks returns the ranks (from 1) of the values, with the average
+// rank for ties.
+func ranks(values []float64) []float64 {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return values[order[i]] < values[order[j]]
+	})
+
+	r := make([]float64, len(values))
+	for i := 0; i < len(order); {
+		j := i
+		for j+1 < len(order) && values[order[j+1]] == values[order[i]] {
+			j++
+		}
+		rank := float64(i+j)/2 + 1
+		for k := i; k <= j; k++ {
+			r[order[k]] = rank
+		}
+		i = j + 1
+	}
+	return r
+}
+
+// spearman returns the Spearman rank-correlation of x and y,
+// or false if it is undefined.
+func spearman(x []float64, y []float64) (float64, bool) {
+	if len(x) != len(y) {
+		return 0, false
+	}
+	return pearson(ranks(x), ranks(y))
+}
+
+// correlate returns the Correlation of the WasteRatio of the points with
+// the readings. Points without a reading for the channel are skipped.
+func correlate(points []WastePoint, readings func(WastePoint) map[string]float64, channel string) Correlation {
+	x := []float64{}
+	y := []float64{}
+	for _, p := range points {
+		value, ok := readings(p)[channel]
+		if !ok {
+			continue
+		}
+		x = append(x, value)
+		y = append(y, p.WasteRatio)
+	}
+
+	c := Correlation{
+		N: len(x),
+	}
+	if r, ok := pearson(x, y); ok {
+		r = math.Round(r*1000) / 1000
+		c.Pearson = &r
+	}
+	if r, ok := spearman(x, y); ok {
+		r = math.Round(r*1000) / 1000
+		c.Spearman = &r
+	}
+	return c
+}
+
+// correlateGroups computes the WasteCorrelations of the points by the
+// group of each point, ordered by group.
+func correlateGroups(points []WastePoint, group func(WastePoint) string) []WasteCorrelation {
+	grouped := map[string][]WastePoint{}
+	for _, p := range points {
+		grouped[group(p)] = append(grouped[group(p)], p)
+	}
+
+	correlations := []WasteCorrelation{}
+	for g, groupPoints := range grouped {
+		wc := WasteCorrelation{
+			Group:    g,
+			Points:   len(groupPoints),
+			Channels: map[string]ChannelCorrelation{},
+		}
+		for _, channel := range RollupChannels {
+			wc.Channels[channel] = ChannelCorrelation{
+				Mean: correlate(groupPoints, func(p WastePoint) map[string]float64 { return p.Mean }, channel),
+				Peak: correlate(groupPoints, func(p WastePoint) map[string]float64 { return p.Peak }, channel),
+			}
+		}
+		correlations = append(correlations, wc)
+	}
+	sort.Slice(correlations, func(i, j int) bool {
+		return correlations[i].Group < correlations[j].Group
+	})
+	return correlations
+}
+
+// wastePoints combines the inventory with the exposures of its items into
+// the points of the unit ("item" or "lot"). Items without a TotalWeight
+// or without readings are skipped. The mean readings of a lot are weighted
+// by the readings of its items, and its peaks are the highest of its items.
+func wastePoints(inventory []Inventory, exposures map[string]*Exposure, unit string) []WastePoint {
+	type lotTotal struct {
+		point       WastePoint
+		totalWeight float64
+		wasteWeight float64
+		count       map[string]int64
+	}
+	lots := map[string]*lotTotal{}
+	keys := []string{}
+
+	for _, inv := range inventory {
+		exposure, ok := exposures[inv.ItemID.String()]
+		if !ok || inv.TotalWeight <= 0 {
+			continue
+		}
+
+		key := inv.ItemID.String()
+		if unit == "lot" {
+			key = fmt.Sprintf("%s|%s|%s", inv.Name, inv.Origin, inv.Lot)
+		}
+		lot, ok := lots[key]
+		if !ok {
+			lot = &lotTotal{
+				point: WastePoint{
+					Key:    key,
+					Name:   inv.Name,
+					Origin: inv.Origin,
+					Lot:    inv.Lot,
+					Mean:   map[string]float64{},
+					Peak:   map[string]float64{},
+				},
+				count: map[string]int64{},
+			}
+			lots[key] = lot
+			keys = append(keys, key)
+		}
+
+		lot.totalWeight += inv.TotalWeight
+		lot.wasteWeight += inv.WasteWeight
+		for channel, count := range exposure.Count {
+			if count == 0 {
+				continue
+			}
+			total := lot.count[channel] + count
+			lot.point.Mean[channel] = (lot.point.Mean[channel]*float64(lot.count[channel]) +
+				exposure.Mean[channel]*float64(count)) / float64(total)
+			lot.count[channel] = total
+
+			if peak, ok := lot.point.Peak[channel]; !ok || exposure.Peak[channel] > peak {
+				lot.point.Peak[channel] = exposure.Peak[channel]
+			}
+		}
+	}
+
+	points := []WastePoint{}
+	for _, key := range keys {
+		lot := lots[key]
+		lot.point.WasteRatio = lot.wasteWeight / lot.totalWeight
+		points = append(points, lot.point)
+	}
+	return points
+}
+
+// CorrelateWaste computes the correlations between the waste of the
+// inventory and the environment it was exposed to, per product and
+// per origin.
+func CorrelateWaste(
+	inventory []Inventory,
+	exposures map[string]*Exposure,
+	params *CorrelationParams,
+) *WasteCorrelationReport {
+	unit := params.unit()
+	points := wastePoints(inventory, exposures, unit)
+
+	return &WasteCorrelationReport{
+		Unit:     unit,
+		Products: correlateGroups(points, func(p WastePoint) string { return p.Name }),
+		Origins:  correlateGroups(points, func(p WastePoint) string { return p.Origin }),
+		Points:   points,
+	}
+}
+
+// ItemExposures returns the Exposure of each of the inventory-items, by
+// ItemID, from its readings corrected by the Calibrator, which match the
+// metric query-tree (if set). When the metric-rollups are read, their
+// means are weighted by their counts, and their peaks are used.
+func (db *DB) ItemExposures(searchInv []Inventory, metric *QueryNode, cal *Calibrator) (map[string]*Exposure, error) {
+	ids := []string{}
+	for _, v := range searchInv {
+		ids = append(ids, v.ItemID.String())
+	}
+	matchFilter, err := metricJoinFilter(ids, metric, cal)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling metric query - ItemExposures")
+		log.Println(err)
+		return nil, err
+	}
+
+	group := map[string]interface{}{
+		"_id": "$item_id",
+	}
+	for _, channel := range RollupChannels {
+		// A metric is one reading, and a rollup has the count of its readings
+		count := map[string]interface{}{
+			"$cond": []interface{}{
+				map[string]interface{}{
+					"$gt": []interface{}{"$" + channel, nil},
+				},
+				map[string]interface{}{
+					"$ifNull": []interface{}{
+						"$counts." + channel,
+						map[string]interface{}{
+							"$ifNull": []interface{}{"$count", 1},
+						},
+					},
+				},
+				0,
+			},
+		}
+		group[channel+"_count"] = map[string]interface{}{
+			"$sum": count,
+		}
+		group[channel+"_sum"] = map[string]interface{}{
+			"$sum": map[string]interface{}{
+				"$multiply": []interface{}{count, "$" + channel},
+			},
+		}
+		// Rollups have the peak of their readings in "max"
+		group[channel+"_peak"] = map[string]interface{}{
+			"$max": map[string]interface{}{
+				"$ifNull": []interface{}{"$max." + channel, "$" + channel},
+			},
+		}
+	}
+
+	calibrated := map[string]string{}
+	for _, channel := range RollupChannels {
+		calibrated[channel] = channel
+		calibrated["max."+channel] = channel
+	}
+
+	pipeline := []interface{}{
+		map[string]interface{}{
+			"$match": matchFilter,
+		},
+	}
+	if fields := cal.fields(calibrated); len(fields) > 0 {
+		pipeline = append(pipeline, map[string]interface{}{
+			"$addFields": fields,
+		})
+	}
+	pipeline = append(pipeline, map[string]interface{}{
+		"$group": group,
+	})
+
+	aggResults, err := db.collection.Aggregate(pipeline)
+	if err != nil {
+		err = errors.Wrap(err, "Error aggregating metrics - ItemExposures")
+		log.Println(err)
+		return nil, err
+	}
+
+	exposures := map[string]*Exposure{}
+	for _, r := range aggResults {
+		result, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		itemID, ok := result["_id"].(string)
+		if !ok {
+			continue
+		}
+
+		exposure := &Exposure{
+			Count: map[string]int64{},
+			Mean:  map[string]float64{},
+			Peak:  map[string]float64{},
+		}
+		for _, channel := range RollupChannels {
+			count, _ := toFloat(result[channel+"_count"])
+			sum, ok := toFloat(result[channel+"_sum"])
+			if count == 0 || !ok {
+				continue
+			}
+			exposure.Count[channel] = int64(count)
+			exposure.Mean[channel] = sum / count
+			exposure.Peak[channel], _ = toFloat(result[channel+"_peak"])
+		}
+		exposures[itemID] = exposure
+	}
+	return exposures, nil
+}
@@ -0,0 +1,209 @@
+package report
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/TerrexTech/uuuid"
+)
+
+// exposure returns the Exposure to the temp_in readings.
+func exposure(count int64, mean, peak float64) *Exposure {
+	return &Exposure{
+		Count: map[string]int64{"temp_in": count},
+		Mean:  map[string]float64{"temp_in": mean},
+		Peak:  map[string]float64{"temp_in": peak},
+	}
+}
+
+func TestMergeExposures(t *testing.T) {
+	tests := []struct {
+		name    string
+		rollups map[string]*Exposure
+		raw     map[string]*Exposure
+		// want is the exposure of the item "i"
+		want *Exposure
+	}{
+		{
+			name:    "weighted by the readings",
+			rollups: map[string]*Exposure{"i": exposure(30, 4, 9)},
+			raw:     map[string]*Exposure{"i": exposure(10, 8, 12)},
+			want:    exposure(40, 5, 12),
+		},
+		{
+			name:    "peak in the rollups",
+			rollups: map[string]*Exposure{"i": exposure(1, 14, 14)},
+			raw:     map[string]*Exposure{"i": exposure(1, -2, -1)},
+			want:    exposure(2, 6, 14),
+		},
+		{
+			name:    "negative peak",
+			rollups: map[string]*Exposure{"i": exposure(1, -5, -3)},
+			raw:     map[string]*Exposure{"i": exposure(1, -7, -6)},
+			want:    exposure(2, -6, -3),
+		},
+		{
+			name: "only raw",
+			raw:  map[string]*Exposure{"i": exposure(2, 3, 4)},
+			want: exposure(2, 3, 4),
+		},
+		{
+			name:    "no readings in the rollups",
+			rollups: map[string]*Exposure{"i": exposure(0, 0, 0)},
+			raw:     map[string]*Exposure{"i": exposure(2, -3, -1)},
+			want:    exposure(2, -3, -1),
+		},
+	}
+
+	for _, test := range tests {
+		got, ok := MergeExposures(test.rollups, test.raw)["i"]
+		if !ok {
+			t.Errorf("%s: item not found", test.name)
+			continue
+		}
+		c := "temp_in"
+		if got.Count[c] != test.want.Count[c] ||
+			math.Abs(got.Mean[c]-test.want.Mean[c]) > 1e-9 ||
+			got.Peak[c] != test.want.Peak[c] {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, *test.want)
+		}
+	}
+}
+
+func TestPearson(t *testing.T) {
+	tests := []struct {
+		name   string
+		x, y   []float64
+		want   float64
+		wantOK bool
+	}{
+		{"perfect", []float64{1, 2, 3, 4}, []float64{2, 4, 6, 8}, 1, true},
+		{"inverse", []float64{1, 2, 3}, []float64{3, 2, 1}, -1, true},
+		{"uncorrelated", []float64{1, 2, 3, 4}, []float64{1, -1, -1, 1}, 0, true},
+		{"partial", []float64{1, 2, 3, 4, 5}, []float64{2, 1, 4, 3, 5}, 0.8, true},
+		{"too few points", []float64{1, 2}, []float64{1, 2}, 0, false},
+		{"constant", []float64{1, 2, 3}, []float64{5, 5, 5}, 0, false},
+		{"different lengths", []float64{1, 2, 3}, []float64{1, 2}, 0, false},
+	}
+
+	for _, test := range tests {
+		got, ok := pearson(test.x, test.y)
+		if ok != test.wantOK || math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: got (%v, %t), want (%v, %t)", test.name, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestRanks(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   []float64
+	}{
+		{"ordered", []float64{1, 2, 3}, []float64{1, 2, 3}},
+		{"unordered", []float64{30, 10, 20}, []float64{3, 1, 2}},
+		{"ties", []float64{5, 1, 5, 5}, []float64{3, 1, 3, 3}},
+		{"pairs", []float64{2, 2, 1, 1}, []float64{3.5, 3.5, 1.5, 1.5}},
+		{"empty", []float64{}, []float64{}},
+	}
+
+	for _, test := range tests {
+		if got := ranks(test.values); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSpearman(t *testing.T) {
+	tests := []struct {
+		name   string
+		x, y   []float64
+		want   float64
+		wantOK bool
+	}{
+		{"monotonic", []float64{1, 2, 3, 4}, []float64{1, 8, 27, 64}, 1, true},
+		{"inverse", []float64{1, 2, 3, 4}, []float64{10, 5, 2, 1}, -1, true},
+		{"ties", []float64{1, 2, 2, 3}, []float64{1, 2, 3, 4}, math.Sqrt(0.9), true},
+		{"constant", []float64{1, 2, 3}, []float64{4, 4, 4}, 0, false},
+		{"different lengths", []float64{1, 2, 3}, []float64{1, 2}, 0, false},
+	}
+
+	for _, test := range tests {
+		got, ok := spearman(test.x, test.y)
+		if ok != test.wantOK || math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("%s: got (%v, %t), want (%v, %t)", test.name, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestWastePoints(t *testing.T) {
+	ids := []uuuid.UUID{}
+	for _, id := range []string{
+		"6ba7b811-9dad-11d1-80b4-00c04fd430c8",
+		"6ba7b812-9dad-11d1-80b4-00c04fd430c8",
+		"6ba7b813-9dad-11d1-80b4-00c04fd430c8",
+		"6ba7b814-9dad-11d1-80b4-00c04fd430c8",
+	} {
+		uid, _ := uuuid.FromString(id)
+		ids = append(ids, uid)
+	}
+	inventory := []Inventory{
+		{ItemID: ids[0], Name: "Banana", Origin: "ON", Lot: "L1", TotalWeight: 100, WasteWeight: 10},
+		{ItemID: ids[1], Name: "Banana", Origin: "ON", Lot: "L1", TotalWeight: 100, WasteWeight: 30},
+		// The same lot-number of another origin
+		{ItemID: ids[2], Name: "Banana", Origin: "QC", Lot: "L1", TotalWeight: 50, WasteWeight: 5},
+		{ItemID: ids[3], Name: "Banana", Origin: "QC", Lot: "L2", WasteWeight: 5},
+	}
+	exposures := map[string]*Exposure{
+		ids[0].String(): exposure(1, 10, 12),
+		ids[1].String(): exposure(3, 14, 20),
+		ids[2].String(): exposure(2, 8, 9),
+		ids[3].String(): exposure(2, 8, 9),
+	}
+
+	tests := []struct {
+		name string
+		unit string
+		want []WastePoint
+	}{
+		{
+			name: "items",
+			unit: "item",
+			want: []WastePoint{
+				{Key: ids[0].String(), Name: "Banana", Origin: "ON", Lot: "L1", WasteRatio: 0.1},
+				{Key: ids[1].String(), Name: "Banana", Origin: "ON", Lot: "L1", WasteRatio: 0.3},
+				{Key: ids[2].String(), Name: "Banana", Origin: "QC", Lot: "L1", WasteRatio: 0.1},
+			},
+		},
+		{
+			name: "lots",
+			unit: "lot",
+			want: []WastePoint{
+				{Key: "Banana|ON|L1", Name: "Banana", Origin: "ON", Lot: "L1", WasteRatio: 0.2},
+				{Key: "Banana|QC|L1", Name: "Banana", Origin: "QC", Lot: "L1", WasteRatio: 0.1},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		points := wastePoints(inventory, exposures, test.unit)
+		if len(points) != len(test.want) {
+			t.Errorf("%s: got %d points, want %d", test.name, len(points), len(test.want))
+			continue
+		}
+		for i, p := range points {
+			want := test.want[i]
+			if p.Key != want.Key || p.Name != want.Name || p.Origin != want.Origin ||
+				p.Lot != want.Lot || math.Abs(p.WasteRatio-want.WasteRatio) > 1e-9 {
+				t.Errorf("%s: got point %+v, want %+v", test.name, p, want)
+			}
+		}
+	}
+
+	// The means of a lot are weighted by the readings of its items
+	lot := wastePoints(inventory, exposures, "lot")[0]
+	if lot.Mean["temp_in"] != 13 || lot.Peak["temp_in"] != 20 {
+		t.Errorf("got lot readings %v and %v, want mean 13 and peak 20", lot.Mean, lot.Peak)
+	}
+}
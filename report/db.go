@@ -1,11 +1,13 @@
 package report
 
 import (
+	"context"
 	"log"
-	"strconv"
+	"sort"
+	"time"
 
 	"github.com/TerrexTech/go-mongoutils/mongo"
-	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/TerrexTech/uuuid"
 	"github.com/pkg/errors"
 )
 
@@ -35,10 +37,66 @@ type DBI interface {
 	GenDeviceData(device []Device) ([]Device, error)
 	SearchKeyVal(search []SearchByFieldVal) ([]interface{}, error)
 	// InsertIntoReport(inv []Inventory, reportType string) (*mgo.InsertOneResult, error)
-	InvAdvSearch(search map[string][]SearchParam) ([]Inventory, error)
-	MetAdvSearch(searchInv []Inventory) ([]Metric, error)
-	DevAdvSearch(searchInv []Inventory) ([]Device, error)
-	DistributionInvFields() ([]InvenReport, error)
+	InvAdvSearch(search *SearchQuery) ([]Inventory, *PageResult, error)
+	MetAdvSearch(searchInv []Inventory, search *SearchQuery, cal *Calibrator) ([]Metric, *PageResult, error)
+	DevAdvSearch(searchInv []Inventory, search *SearchQuery) ([]Device, *PageResult, error)
+	InvExplain(search *SearchQuery) (*Explanation, error)
+	MetExplain(searchInv []Inventory, search *SearchQuery, cal *Calibrator) (*Explanation, error)
+	DevExplain(searchInv []Inventory, search *SearchQuery) (*Explanation, error)
+	MetRollup(searchInv []Inventory, search *RollupQuery, cal *Calibrator) ([]RollupBucket, error)
+	CompactedRollup(searchInv []Inventory, search *RollupQuery, cal *Calibrator) ([]RollupBucket, error)
+	CreateWarnings(metrics []Metric, inventory []Inventory) ([]Warning, error)
+	InsertWarnings(warnings []Warning) ([]Warning, error)
+	WarnAdvSearch(searchInv []Inventory, search *SearchQuery) ([]Warning, *PageResult, error)
+	WarnExplain(searchInv []Inventory, search *SearchQuery) (*Explanation, error)
+	MetBaseline(deviceID uuuid.UUID, before int64, size int64) ([]Metric, error)
+	FalsePositiveReadings(deviceID uuuid.UUID) (map[string]bool, error)
+	CreateAnomalies(anomalies []Anomaly) ([]Anomaly, error)
+	MarkFalsePositive(anomalyID uuuid.UUID, falsePositive bool) (*Anomaly, error)
+	AnoAdvSearch(searchInv []Inventory, search *SearchQuery) ([]Anomaly, *PageResult, error)
+	AnoExplain(searchInv []Inventory, search *SearchQuery) (*Explanation, error)
+	ItemMetrics(searchInv []Inventory, metric *QueryNode, cal *Calibrator) (map[string][]Metric, error)
+	IngestMetrics(body []byte) (*IngestResult, []Metric, error)
+	IngestByKey(key string) (*IngestResult, error)
+	SaveIngest(result *IngestResult) error
+	EnsureIndex(name string, unique bool, fields ...string) error
+	CompactMetrics(from int64, to int64, interval int64) ([]CompactedMetric, error)
+	ReplaceCompacted(from int64, to int64, compacted []CompactedMetric) error
+	DeleteBefore(timestamp int64, batchSize int64) (int64, error)
+	TimestampRange() (int64, int64, error)
+	ItemExposures(searchInv []Inventory, metric *QueryNode, cal *Calibrator) (map[string]*Exposure, error)
+	RecordHeartbeats(metrics []Metric) ([]Heartbeat, error)
+	Heartbeats(deviceIDs []string) ([]Heartbeat, error)
+	SetHeartbeatInterval(deviceID uuuid.UUID, interval int64) (*Heartbeat, error)
+	MarkHeartbeatWarned(deviceID uuuid.UUID, at int64) error
+	ReadingTimes(deviceIDs []string, from int64, to int64) (map[string][]int64, error)
+	LastReadingsBefore(deviceIDs []string, before int64) (map[string]int64, error)
+	Calibrations(deviceIDs []string) ([]Calibration, error)
+	SaveCalibration(c *Calibration) (*Calibration, error)
+	DeleteCalibration(deviceID uuuid.UUID, effectiveFrom int64) error
+	DistributionInvFields(search *DistributionQuery) ([]InvenReport, error)
+	InventoryKPIs(search *KPIQuery, now time.Time) ([]KPI, error)
+	ExpiringInventory(search *SearchQuery, from int64, to int64) ([]Inventory, error)
+	InsertFlashSales(sales []FlashSale) ([]FlashSale, error)
+	FlashSales(status string, itemIDs []string) ([]FlashSale, error)
+	FlashSaleByID(saleID uuuid.UUID) (*FlashSale, error)
+	UpdateFlashSale(sale *FlashSale, from string) error
+	DeleteFlashSale(saleID uuuid.UUID) error
+	InventoryByIDs(itemIDs []string) ([]Inventory, error)
+	FlashSalePeers(item Inventory, exclude []string) ([]Inventory, error)
+	InsertDonation(d *Donation) (*Donation, error)
+	Donations(filter DonationFilter) ([]Donation, error)
+	DeleteDonation(donationID uuuid.UUID) (*Donation, error)
+	DonationRecorded(itemID string) (float64, bool, error)
+	SeedDonationRecorded(itemID string, recorded float64) error
+	ReserveDonation(item Inventory, weight float64) (bool, error)
+	ReleaseDonation(itemID string, weight float64) error
+	DonationTotals(params *DonationParams, itemIDs []string) ([]DonationTotal, error)
+	SaveSearch(search *SavedSearch) (*SavedSearch, error)
+	SavedSearches(customerID uuuid.UUID) ([]SavedSearch, error)
+	SavedSearchByID(searchID uuuid.UUID, customerID uuuid.UUID) (*SavedSearch, error)
+	UpdateSavedSearch(search *SavedSearch, fields []string) (*SavedSearch, error)
+	DeleteSavedSearch(searchID uuuid.UUID, customerID uuuid.UUID) error
 	// // SearchByTimestamp(search *SearchByDate) (*Report, error)
 	// SearchByFieldVal(search []SearchByFieldVal) ([]interface{}, error)
 }
@@ -49,15 +107,6 @@ type DB struct {
 	collection *mongo.Collection
 }
 
-type InvenReport struct {
-	ProdName    string  `bson:"prod_name,omitempty" json:"prod_name,omitempty"`
-	ProdWeight  float64 `bson:"prod_weight,omitempty" json:"prod_weight,omitempty"`
-	TotalWeight float64 `bson:"total_weight,omitempty" json:"total_weight,omitempty"`
-	SoldWeight  float64 `bson:"sold_weight,omitempty" json:"sold_weight,omitempty"`
-	WasteWeight float64 `bson:"waste_weight,omitempty" json:"waste_weight,omitempty"`
-	ProductSold int64   `bson:"prod_sold,omitempty" json:"prod_sold,omitempty"`
-}
-
 // type SearchByDate struct {
 // 	EndDate   int64 `bson:"end_date,omitempty" json:"end_date,omitempty"`
 // 	StartDate int64 `bson:"start_date,omitempty" json:"start_date,omitempty"`
@@ -135,6 +184,19 @@ func (d *DB) Collection() *mongo.Collection {
 	return d.collection
 }
 
+// insertMany inserts the documents with a single InsertMany.
+func (db *DB) insertMany(docs []interface{}) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := db.collection.Collection().InsertMany(ctx, docs)
+	return err
+}
+
 func (db *DB) GenReportData(report []Report) ([]Report, error) {
 	// report := []Report{}
 	// for i := 0; i < numOfVal; i++ {
@@ -300,256 +362,346 @@ func (db *DB) SearchKeyVal(search []SearchByFieldVal) ([]interface{}, error) {
 // 	return inventory, nil
 // }
 
-//InvAdvSearch - uses AdvancedInvSearch struct
-func (db *DB) InvAdvSearch(search map[string][]SearchParam) ([]Inventory, error) {
-
-	var findResults []interface{}
-	var err error
-	// var type string
+// invFindQuery compiles the inventory query-tree and TextSearch into
+// the findQuery of InvAdvSearch. Text-searches are not paged, since all
+// matches are fetched for ranking, and are paginated afterwards.
+func (db *DB) invFindQuery(search *SearchQuery) (*findQuery, error) {
+	var inv *QueryNode
+	var text *TextSearch
+	var page *PageParams
+	var fields []string
+	if search != nil {
+		inv = search.Inventory
+		text = search.Text
+		page = search.Page
+		if search.Fields != nil {
+			fields = search.Fields.Inventory
+		}
+	}
 
-	inv := search["inventory"]
+	findParams, err := inv.Filter()
+	if err != nil {
+		return nil, err
+	}
 
-	findParams := map[string]interface{}{}
+	// IDs are always fetched for joining with metrics and devices
+	required := []string{"item_id", "device_id"}
+	if text != nil {
+		textParams, err := db.textFilter(text, findParams)
+		if err != nil {
+			return nil, err
+		}
+		findParams = map[string]interface{}{
+			"$and": []interface{}{findParams, textParams},
+		}
+		// Text-fields are needed for scoring
+		required = append(required, text.fields()...)
+		page = nil
+	}
+	return &findQuery{
+		filter: findParams,
+		page:   page,
+		proj:   projection(fields, required...),
+	}, nil
+}
 
-	if inv != nil {
-		for _, v := range inv {
-			if v.Type == "" {
-				err := errors.Wrap(err, "Type required - InvAdvSearch.")
-				log.Println(err)
-				return nil, err
-			}
-			if v.Field == "" {
-				err := errors.Wrap(err, "Field is required - InvAdvSearch")
-				log.Println(err)
-				return nil, err
-			}
-			if v.Equal == "" && v.LowerLimit == 0 && v.UpperLimit == 0 {
-				err = errors.Wrap(err, "Missing value in equal. No lowerlimit and upperlimit set - InvAdvSearch.")
-				log.Println(err)
-				return nil, err
-			}
+//InvAdvSearch - searches inventory using the query-tree in SearchQuery.Inventory,
+// and the TextSearch in SearchQuery.Text, whose results are ranked by Score.
+func (db *DB) InvAdvSearch(search *SearchQuery) ([]Inventory, *PageResult, error) {
 
-			switch v.Type {
-			case "string":
-				findParams[v.Field] = map[string]string{
-					"$eq": v.Equal,
-				}
-
-			case "float":
-				if v.Equal != "" {
-					floatValue, err := strconv.ParseFloat(v.Equal, 64)
-					if err != nil {
-						err = errors.Wrap(err, "Error converting value of equal to float - InvAdvSearch")
-						log.Println(err)
-						return nil, err
-					}
-					findParams[v.Field] = map[string]float64{
-						"$eq": floatValue,
-					}
-				} else {
-					limitMap := map[string]map[string]float64{}
-					if v.LowerLimit != 0 {
-						limitMap[v.Field]["$gt"] = v.LowerLimit
-					}
-					if v.UpperLimit != 0 {
-						limitMap[v.Field]["$lt"] = v.UpperLimit
-					}
-					findParams[v.Field] = limitMap[v.Field]
-				}
-
-			case "int":
-				if v.Equal != "" {
-					intValue, err := strconv.ParseInt(v.Equal, 10, 64)
-					if err != nil {
-						err = errors.Wrap(err, "Error converting equal to int - InvAdvSearch")
-						log.Println(err)
-						return nil, err
-					}
-					findParams[v.Field] = map[string]int64{
-						"$eq": intValue,
-					}
-				} else {
-					limitMap := map[string]map[string]int64{}
-					if v.LowerLimit != 0 {
-						limitMap[v.Field]["$gt"] = int64(v.LowerLimit)
-					}
-					if v.UpperLimit != 0 {
-						limitMap[v.Field]["$lt"] = int64(v.UpperLimit)
-					}
-
-					findParams[v.Field] = limitMap[v.Field]
-				}
-			}
-			if v.Type == "string" {
-				findParams[v.Field] = map[string]interface{}{
-					"$eq": v.Equal,
-				}
-			}
+	var findResults []interface{}
+	var err error
 
-			// else if v.Equal {
-			// 	findParams[v.Field] = map[string]interface{}{
-			// 		"$eq": v.Equal,
-			// 	}
-			// 	log.Println(findParams[v.Field], "dsklfjdskfsl")
-			// }
+	var text *TextSearch
+	var page *PageParams
+	var fields []string
+	if search != nil {
+		text = search.Text
+		page = search.Page
+		if search.Fields != nil {
+			fields = search.Fields.Inventory
 		}
 	}
 
-	log.Println(findParams, "###123################")
-
-	findResults, err = db.collection.Find(findParams)
-	log.Println("FFFFFFFFFFFFFFF")
-	for _, r := range findResults {
-		log.Printf("%+v", r)
+	q, err := db.invFindQuery(search)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling inventory query - InvAdvSearch")
+		log.Println(err)
+		return nil, nil, err
 	}
 
+	findResults, pageResult, err := db.findPage(q)
 	if err != nil {
 		err = errors.Wrap(err, "Error while fetching results from inventory.")
 		log.Println(err)
-		return nil, err
-	}
-
-	//length
-	if len(findResults) == 0 {
-		msg := "No results found - InvAdvSearch"
-		return nil, errors.New(msg)
+		return nil, nil, err
 	}
 
 	inventory := []Inventory{}
 
 	for _, v := range findResults {
 		result := v.(*Inventory)
+		result.selectedFields = fields
 		inventory = append(inventory, *result)
 	}
-	return inventory, nil
+
+	if text != nil {
+		inventory = rankInventory(inventory, text)
+		if page != nil {
+			inventory, pageResult, err = rankedPage(inventory, page)
+			if err != nil {
+				err = errors.Wrap(err, "Error paginating text search - InvAdvSearch")
+				log.Println(err)
+				return nil, nil, err
+			}
+		}
+	}
+
+	//length
+	if len(inventory) == 0 && !page.continues() {
+		msg := "No results found - InvAdvSearch"
+		return nil, nil, errors.New(msg)
+	}
+	return inventory, pageResult, nil
 }
 
-func (db *DB) MetAdvSearch(searchInv []Inventory) ([]Metric, error) {
+// joinFilter creates a filter matching the documents whose idField is
+// any of the ids, and which also match the query-tree.
+func joinFilter(idField string, ids []string, node *QueryNode) (map[string]interface{}, error) {
+	nodeFilter, err := node.Filter()
+	if err != nil {
+		return nil, err
+	}
+	return joinFilters(idField, ids, nodeFilter), nil
+}
 
-	var findResults []interface{}
-	var err error
+// metricJoinFilter is joinFilter for the metrics, whose query-tree is
+// matched against their readings corrected by the Calibrator.
+func metricJoinFilter(ids []string, node *QueryNode, cal *Calibrator) (map[string]interface{}, error) {
+	nodeFilter, err := cal.Filter(node)
+	if err != nil {
+		return nil, err
+	}
+	return joinFilters("item_id", ids, nodeFilter), nil
+}
 
-	findParams := map[string]interface{}{}
+// joinFilters creates a filter matching the documents whose idField is
+// any of the ids, and which also match the filter.
+func joinFilters(idField string, ids []string, filter map[string]interface{}) map[string]interface{} {
+	uniqueIDs := []interface{}{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			uniqueIDs = append(uniqueIDs, id)
+		}
+	}
 
+	idFilter := map[string]interface{}{
+		idField: map[string]interface{}{
+			"$in": uniqueIDs,
+		},
+	}
+	if len(filter) == 0 {
+		return idFilter
+	}
+	return map[string]interface{}{
+		"$and": []interface{}{idFilter, filter},
+	}
+}
+
+// metFindQuery compiles the query-tree in SearchQuery.Metric into the
+// findQuery of MetAdvSearch, for the metrics of the inventory-items.
+// The metrics are filtered and sorted on their readings corrected by
+// the Calibrator.
+func metFindQuery(searchInv []Inventory, search *SearchQuery, cal *Calibrator) (*findQuery, error) {
+	var node *QueryNode
+	var page *PageParams
+	var fields []string
+	if search != nil {
+		node = search.Metric
+		page = search.Page
+		if search.Fields != nil {
+			fields = search.Fields.Metric
+		}
+	}
+
+	ids := []string{}
 	for _, v := range searchInv {
-		log.Println("%+v", v.ItemID)
-		findParams["item_id"] = map[string]interface{}{
-			"$eq": v.ItemID.String(),
+		ids = append(ids, v.ItemID.String())
+	}
+
+	findParams, err := metricJoinFilter(ids, node, cal)
+	if err != nil {
+		return nil, err
+	}
+	// The device and time of the readings select their calibration
+	q := &findQuery{
+		filter: findParams,
+		page:   page,
+		proj:   projection(fields, "device_id", "timestamp"),
+	}
+	if page != nil {
+		sortFields := map[string]string{}
+		for _, s := range page.sortFields() {
+			sortFields[s.Field] = s.Field
+		}
+		if computed := cal.fields(sortFields); len(computed) > 0 {
+			q.computed = computed
 		}
 	}
+	return q, nil
+}
 
-	findResults, err = db.collection.Find(findParams)
+// MetAdvSearch searches the metrics of the provided inventory-items, which
+// also match the query-tree in SearchQuery.Metric.
+// Use a "date" SearchParam on timestamp to search within a time-window.
+// The readings of the metrics are corrected by the Calibrator.
+// No metrics are found for a page past the last one.
+func (db *DB) MetAdvSearch(searchInv []Inventory, search *SearchQuery, cal *Calibrator) ([]Metric, *PageResult, error) {
+	var fields []string
+	if search != nil && search.Fields != nil {
+		fields = search.Fields.Metric
+	}
 
+	q, err := metFindQuery(searchInv, search, cal)
 	if err != nil {
-		err = errors.Wrap(err, "Error while fetching results from inventory.")
+		err = errors.Wrap(err, "Error compiling metric query - MetAdvSearch")
 		log.Println(err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	//length
-	if len(findResults) == 0 {
-		msg := "No results found - InvMetSearch"
-		return nil, errors.New(msg)
+	findResults, pageResult, err := db.findPage(q)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching results from inventory.")
+		log.Println(err)
+		return nil, nil, err
 	}
 
 	metric := []Metric{}
 
 	for _, v := range findResults {
 		result := v.(*Metric)
+		result.selectedFields = fields
 		metric = append(metric, *result)
 	}
-	return metric, nil
+	cal.Apply(metric)
+	return metric, pageResult, nil
 }
 
-func (db *DB) DevAdvSearch(searchInv []Inventory) ([]Device, error) {
+// MergeMetricPages merges the metrics found by MetAdvSearch in the rollups
+// and in the raw metrics (see RetentionPolicy.SplitSearch), which were
+// searched with the same page, into a page in the order of its sort-fields.
+// The metrics are not paged if the page is nil.
+func MergeMetricPages(
+	page *PageParams,
+	rollups []Metric,
+	rollupPage *PageResult,
+	raw []Metric,
+	rawPage *PageResult,
+) ([]Metric, *PageResult, error) {
+	merged := append(append([]Metric{}, rollups...), raw...)
+	if page == nil {
+		return merged, nil, nil
+	}
 
-	var findResults []interface{}
-	var err error
+	sort.SliceStable(merged, func(i, j int) bool {
+		return page.compare(&merged[i], &merged[j]) < 0
+	})
+
+	result := &PageResult{}
+	more := false
+	for _, p := range []*PageResult{rollupPage, rawPage} {
+		if p != nil {
+			result.Total += p.Total
+			more = more || p.NextCursor != ""
+		}
+	}
+	// Each search has up to a page after the cursor, so the first page
+	// of the merged metrics is the next page
+	if size := int(page.size()); len(merged) > size {
+		merged = merged[:size]
+		more = true
+	}
+	if more && len(merged) > 0 {
+		var err error
+		result.NextCursor, err = page.nextCursor(&merged[len(merged)-1])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return merged, result, nil
+}
 
-	findParams := map[string]interface{}{}
+// devFindQuery compiles the query-tree in SearchQuery.Device into the
+// findQuery of DevAdvSearch, for the devices of the inventory-items.
+func devFindQuery(searchInv []Inventory, search *SearchQuery) (*findQuery, error) {
+	var node *QueryNode
+	var page *PageParams
+	var fields []string
+	if search != nil {
+		node = search.Device
+		page = search.Page
+		if search.Fields != nil {
+			fields = search.Fields.Device
+		}
+	}
 
+	ids := []string{}
 	for _, v := range searchInv {
-		log.Println("%+v", v.DeviceID)
-		findParams["device_id"] = map[string]interface{}{
-			"$eq": v.DeviceID.String(),
+		ids = append(ids, v.DeviceID.String())
+	}
+
+	findParams, err := joinFilter("device_id", ids, node)
+	if err != nil {
+		return nil, err
+	}
+	return &findQuery{
+		filter: findParams,
+		page:   page,
+		proj:   projection(fields),
+	}, nil
+}
+
+// DevAdvSearch searches the devices of the provided inventory-items, which
+// also match the query-tree in SearchQuery.Device.
+func (db *DB) DevAdvSearch(searchInv []Inventory, search *SearchQuery) ([]Device, *PageResult, error) {
+	var page *PageParams
+	var fields []string
+	if search != nil {
+		page = search.Page
+		if search.Fields != nil {
+			fields = search.Fields.Device
 		}
 	}
 
-	findResults, err = db.collection.Find(findParams)
+	q, err := devFindQuery(searchInv, search)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling device query - DevAdvSearch")
+		log.Println(err)
+		return nil, nil, err
+	}
+
+	findResults, pageResult, err := db.findPage(q)
 
 	if err != nil {
 		err = errors.Wrap(err, "Error while fetching results from device - DevAdvSearch.")
 		log.Println(err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	//length
-	if len(findResults) == 0 {
+	if len(findResults) == 0 && !page.continues() {
 		msg := "No results found - DevAdvSearch"
-		return nil, errors.New(msg)
+		return nil, nil, errors.New(msg)
 	}
 
 	device := []Device{}
 
 	for _, v := range findResults {
 		result := v.(*Device)
+		result.selectedFields = fields
 		device = append(device, *result)
 	}
-	return device, nil
-}
-
-func (db *DB) DistributionInvFields() ([]InvenReport, error) {
-	pipeline := bson.NewArray(
-		bson.VC.Document(
-			bson.NewDocument(
-				bson.EC.SubDocumentFromElements(
-					"$group",
-					bson.EC.String("_id", "$name"),
-					bson.EC.SubDocumentFromElements(
-						"total_weight",
-						bson.EC.String("$sum", "$total_weight"),
-					),
-					bson.EC.SubDocumentFromElements(
-						"waste_weight",
-						bson.EC.String("$sum", "$waste_weight"),
-					),
-					bson.EC.SubDocumentFromElements(
-						"sold_weight",
-						bson.EC.String("$sum", "$sold_weight"),
-					),
-				),
-			),
-		),
-	)
-	aggResults, err := db.collection.Aggregate(pipeline)
-	if err != nil {
-		log.Fatalln(err)
-		return nil, err
-	}
-	// log.Println(aggResults)
-
-	dist := []InvenReport{}
-
-	for _, v := range aggResults {
-		value := v.(map[string]interface{})
-		strValue := value["_id"].(string)
-		twValue := value["total_weight"].(float64)
-		wwValue := value["waste_weight"].(float64)
-		swValue := value["sold_weight"].(float64)
-		dist = append(dist, InvenReport{
-			ProdName:    strValue,
-			TotalWeight: twValue,
-			WasteWeight: wwValue,
-			SoldWeight:  swValue,
-		})
-	}
-
-	// distWeight, err := json.Marshal(&dist)
-	// if err != nil {
-	// 	err = errors.Wrap(err, "Unable to marshal distribution")
-	// 	log.Println(err)
-	// 	return nil, err
-	// }
-
-	return dist, nil
+	return device, pageResult, nil
 }
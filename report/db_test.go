@@ -0,0 +1,165 @@
+package report
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+)
+
+func TestMergeMetricPages(t *testing.T) {
+	// metrics returns the metrics with the timestamps, and ascending IDs
+	metrics := func(timestamps ...int64) []Metric {
+		found := []Metric{}
+		for _, ts := range timestamps {
+			id, _ := objectid.FromHex(fmt.Sprintf("5bc8a00000000000%08d", ts))
+			found = append(found, Metric{ID: id, Timestamp: ts})
+		}
+		return found
+	}
+	byTime := []SortField{{Field: "timestamp", Desc: true}}
+
+	tests := []struct {
+		name       string
+		page       *PageParams
+		rollups    []Metric
+		rollupPage *PageResult
+		raw        []Metric
+		rawPage    *PageResult
+		// want are the timestamps of the merged page
+		want      []int64
+		wantTotal int64
+		wantNext  bool
+	}{
+		{
+			name:    "not paged",
+			rollups: metrics(1, 2),
+			raw:     metrics(3),
+			want:    []int64{1, 2, 3},
+		},
+		{
+			name:       "in the sort-order",
+			page:       &PageParams{Size: 5, Sort: byTime},
+			rollups:    metrics(1, 2),
+			rollupPage: &PageResult{Total: 2},
+			raw:        metrics(4, 3),
+			rawPage:    &PageResult{Total: 2},
+			want:       []int64{4, 3, 2, 1},
+			wantTotal:  4,
+		},
+		{
+			name:       "more than a page",
+			page:       &PageParams{Size: 3, Sort: byTime},
+			rollups:    metrics(2, 1),
+			rollupPage: &PageResult{Total: 2},
+			raw:        metrics(4, 3),
+			rawPage:    &PageResult{Total: 2},
+			want:       []int64{4, 3, 2},
+			wantTotal:  4,
+			wantNext:   true,
+		},
+		{
+			name:       "more raw metrics",
+			page:       &PageParams{Size: 2},
+			rollups:    metrics(1),
+			rollupPage: &PageResult{Total: 1},
+			raw:        metrics(5),
+			rawPage:    &PageResult{Total: 3, NextCursor: "next"},
+			want:       []int64{1, 5},
+			wantTotal:  4,
+			wantNext:   true,
+		},
+		{
+			name:       "past the last page",
+			page:       &PageParams{Size: 2},
+			rollupPage: &PageResult{},
+			rawPage:    &PageResult{},
+			want:       []int64{},
+		},
+	}
+
+	for _, test := range tests {
+		merged, result, err := MergeMetricPages(test.page, test.rollups, test.rollupPage, test.raw, test.rawPage)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		got := []int64{}
+		for _, m := range merged {
+			got = append(got, m.Timestamp)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got timestamps %v, want %v", test.name, got, test.want)
+		}
+		if test.page == nil {
+			if result != nil {
+				t.Errorf("%s: got page %+v, want none", test.name, result)
+			}
+			continue
+		}
+		if result.Total != test.wantTotal || (result.NextCursor != "") != test.wantNext {
+			t.Errorf(
+				"%s: got total %d and cursor %q, want %d and next %t",
+				test.name, result.Total, result.NextCursor, test.wantTotal, test.wantNext,
+			)
+		}
+	}
+}
+
+func TestJoinFilter(t *testing.T) {
+	hot := &QueryNode{
+		SearchParam: SearchParam{Field: "temp_in", Type: "float", Op: OpGreater, Value: 25.0},
+	}
+	idFilter := func(ids ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"item_id": map[string]interface{}{"$in": append([]interface{}{}, ids...)},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		ids     []string
+		node    *QueryNode
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "all items",
+			ids:  []string{"a", "b", "a"},
+			want: idFilter("a", "b"),
+		},
+		{
+			name: "metric predicates",
+			ids:  []string{"a", "b"},
+			node: hot,
+			want: map[string]interface{}{"$and": []interface{}{
+				idFilter("a", "b"),
+				map[string]interface{}{"temp_in": map[string]interface{}{"$gt": 25.0}},
+			}},
+		},
+		{
+			name: "no items",
+			ids:  nil,
+			node: &QueryNode{},
+			want: idFilter(),
+		},
+		{
+			name:    "invalid query-tree",
+			ids:     []string{"a"},
+			node:    &QueryNode{SearchParam: SearchParam{Field: "temp_in", Type: "float", Op: OpGreater}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := joinFilter("item_id", test.ids, test.node)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got filter %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
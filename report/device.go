@@ -21,6 +21,9 @@ type Device struct {
 	NumReplacement  int64             `bson:"num_replacement,omitempty" json:"num_replacement,omitempty"`
 	CostSaved       float64           `bson:"cost_saved,omitempty" json:"cost_saved,omitempty"`
 	Version         int64             `bson:"version,omitempty" json:"version,omitempty"`
+
+	// selectedFields are the fields serialized by MarshalJSON, all if empty
+	selectedFields []string
 }
 
 type marshalDevice struct {
@@ -73,7 +76,11 @@ func (d Device) MarshalJSON() ([]byte, error) {
 		md.RsCustomerID = d.RsCustomerID.String()
 	}
 
-	return json.Marshal(md)
+	out, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+	return selectJSONFields(out, d.selectedFields)
 }
 
 func (d *Device) UnmarshalBSON(in []byte) error {
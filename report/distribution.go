@@ -0,0 +1,193 @@
+package report
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// distributionGroups are the Inventory fields the distribution
+// report can be grouped by.
+var distributionGroups = map[string]string{
+	"name":     "name",
+	"origin":   "origin",
+	"lot":      "lot",
+	"customer": "rs_customer_id",
+}
+
+// DistributionParams groups the distribution report by "name" (default),
+// "origin", "lot" or "customer".
+type DistributionParams struct {
+	GroupBy string `json:"group_by,omitempty"`
+}
+
+// DistributionQuery is the request-body of the inventory distribution report.
+type DistributionQuery struct {
+	SearchQuery
+	Distribution *DistributionParams `json:"distribution,omitempty"`
+}
+
+// Validate checks the SearchQuery and the DistributionParams.
+// Returns nil if the DistributionQuery is valid.
+func (q *DistributionQuery) Validate() ValidationErrors {
+	verrs := q.SearchQuery.Validate()
+	if q.Distribution != nil {
+		verrs = append(verrs, q.Distribution.validate("distribution")...)
+	}
+	return verrs
+}
+
+func (p *DistributionParams) groupBy() string {
+	if p == nil || p.GroupBy == "" {
+		return "name"
+	}
+	return p.GroupBy
+}
+
+// validate returns the problems with the DistributionParams.
+func (p *DistributionParams) validate(path string) ValidationErrors {
+	if _, ok := distributionGroups[p.groupBy()]; !ok {
+		return ValidationErrors{
+			ValidationError{
+				Path: path + ".group_by",
+				Message: fmt.Sprintf(
+					"Invalid group_by %s, expected name, origin, lot or customer", p.GroupBy,
+				),
+			},
+		}
+	}
+	return nil
+}
+
+// InvenReport is the distribution of the inventory of a Group.
+// ProdName is the product of the group, if it has a single product.
+// ProdWeight is the weight left in stock, which was not sold, wasted
+// or donated, and ProductSold is the number of items with sales.
+type InvenReport struct {
+	Group        string  `bson:"group" json:"group"`
+	ProdName     string  `bson:"prod_name,omitempty" json:"prod_name,omitempty"`
+	Items        int64   `bson:"items" json:"items"`
+	ProdWeight   float64 `bson:"prod_weight" json:"prod_weight"`
+	TotalWeight  float64 `bson:"total_weight" json:"total_weight"`
+	SoldWeight   float64 `bson:"sold_weight" json:"sold_weight"`
+	WasteWeight  float64 `bson:"waste_weight" json:"waste_weight"`
+	DonateWeight float64 `bson:"donate_weight" json:"donate_weight"`
+	ProductSold  int64   `bson:"prod_sold" json:"prod_sold"`
+}
+
+// DistributionInvFields sums the weights of the inventory matching the
+// query-tree and TextSearch of the SearchQuery, by the group in
+// DistributionQuery.Distribution, ordered by group.
+func (db *DB) DistributionInvFields(search *DistributionQuery) ([]InvenReport, error) {
+	var params *DistributionParams
+	var invSearch *SearchQuery
+	if search != nil {
+		params = search.Distribution
+		invSearch = &search.SearchQuery
+	}
+	groupField, ok := distributionGroups[params.groupBy()]
+	if !ok {
+		return nil, errors.Errorf("Invalid group_by %s - DistributionInvFields", params.groupBy())
+	}
+
+	invQuery, err := db.invFindQuery(invSearch)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling inventory query - DistributionInvFields")
+		log.Println(err)
+		return nil, err
+	}
+
+	pipeline := distributionPipeline(invQuery.filter, groupField)
+	aggResults, err := db.collection.Aggregate(pipeline)
+	if err != nil {
+		err = errors.Wrap(err, "Error aggregating inventory - DistributionInvFields")
+		log.Println(err)
+		return nil, err
+	}
+
+	dist := []InvenReport{}
+	for _, v := range aggResults {
+		value, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		dist = append(dist, distributionReport(value))
+	}
+	return dist, nil
+}
+
+// distributionPipeline sums the weights of the inventory matching the
+// filter by the groupField, ordered by group.
+func distributionPipeline(matchFilter map[string]interface{}, groupField string) []interface{} {
+	sum := func(field string) map[string]interface{} {
+		return map[string]interface{}{
+			"$sum": "$" + field,
+		}
+	}
+	group := map[string]interface{}{
+		"_id": "$" + groupField,
+		"items": map[string]interface{}{
+			"$sum": 1,
+		},
+		"names": map[string]interface{}{
+			"$addToSet": "$name",
+		},
+		"total_weight":  sum("total_weight"),
+		"sold_weight":   sum("sold_weight"),
+		"waste_weight":  sum("waste_weight"),
+		"donate_weight": sum("donate_weight"),
+		"prod_sold": map[string]interface{}{
+			"$sum": map[string]interface{}{
+				"$cond": []interface{}{
+					map[string]interface{}{
+						"$gt": []interface{}{"$sold_weight", 0},
+					},
+					1,
+					0,
+				},
+			},
+		},
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"$match": matchFilter,
+		},
+		map[string]interface{}{
+			"$group": group,
+		},
+		map[string]interface{}{
+			"$sort": map[string]interface{}{
+				"_id": 1,
+			},
+		},
+	}
+}
+
+// distributionReport reads the InvenReport of a group from the result
+// of the distributionPipeline.
+func distributionReport(value map[string]interface{}) InvenReport {
+	groupID, _ := value["_id"].(string)
+	items, _ := toFloat(value["items"])
+	prodSold, _ := toFloat(value["prod_sold"])
+	report := InvenReport{
+		Group:       groupID,
+		Items:       int64(items),
+		ProductSold: int64(prodSold),
+	}
+	report.TotalWeight, _ = toFloat(value["total_weight"])
+	report.SoldWeight, _ = toFloat(value["sold_weight"])
+	report.WasteWeight, _ = toFloat(value["waste_weight"])
+	report.DonateWeight, _ = toFloat(value["donate_weight"])
+
+	report.ProdWeight = report.TotalWeight - report.SoldWeight -
+		report.WasteWeight - report.DonateWeight
+	if report.ProdWeight < 0 {
+		report.ProdWeight = 0
+	}
+	if names, ok := value["names"].([]interface{}); ok && len(names) == 1 {
+		report.ProdName, _ = names[0].(string)
+	}
+	return report
+}
@@ -0,0 +1,122 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDistributionParamsValidate(t *testing.T) {
+	tests := []struct {
+		params  *DistributionParams
+		want    string
+		wantErr bool
+	}{
+		{params: nil, want: "name"},
+		{params: &DistributionParams{}, want: "name"},
+		{params: &DistributionParams{GroupBy: "origin"}, want: "origin"},
+		{params: &DistributionParams{GroupBy: "customer"}, want: "customer"},
+		{params: &DistributionParams{GroupBy: "device"}, want: "device", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got := test.params.groupBy()
+		if got != test.want {
+			t.Errorf("%+v: got group %s, want %s", test.params, got, test.want)
+		}
+		if test.params == nil {
+			continue
+		}
+		verrs := test.params.validate("distribution")
+		if (len(verrs) > 0) != test.wantErr {
+			t.Errorf("%+v: got errors %v, want errors %t", test.params, verrs, test.wantErr)
+		}
+	}
+}
+
+func TestDistributionPipeline(t *testing.T) {
+	filter := map[string]interface{}{"origin": map[string]interface{}{"$eq": "ON"}}
+
+	tests := []struct {
+		name       string
+		filter     map[string]interface{}
+		groupField string
+		wantID     string
+	}{
+		{name: "by name", filter: map[string]interface{}{}, groupField: "name", wantID: "$name"},
+		{name: "by customer", filter: filter, groupField: "rs_customer_id", wantID: "$rs_customer_id"},
+	}
+
+	for _, test := range tests {
+		pipeline := distributionPipeline(test.filter, test.groupField)
+		if len(pipeline) != 3 {
+			t.Errorf("%s: got %d stages, want 3", test.name, len(pipeline))
+			continue
+		}
+		match := pipeline[0].(map[string]interface{})["$match"]
+		if !reflect.DeepEqual(match, test.filter) {
+			t.Errorf("%s: got $match %v, want %v", test.name, match, test.filter)
+		}
+		group := pipeline[1].(map[string]interface{})["$group"].(map[string]interface{})
+		if group["_id"] != test.wantID {
+			t.Errorf("%s: got group _id %v, want %s", test.name, group["_id"], test.wantID)
+		}
+		for _, field := range []string{"items", "names", "total_weight", "sold_weight", "waste_weight", "donate_weight", "prod_sold"} {
+			if _, ok := group[field]; !ok {
+				t.Errorf("%s: got no %s in the $group", test.name, field)
+			}
+		}
+	}
+}
+
+func TestDistributionReport(t *testing.T) {
+	tests := []struct {
+		name  string
+		value map[string]interface{}
+		want  InvenReport
+	}{
+		{
+			name: "single product",
+			value: map[string]interface{}{
+				"_id":           "ON",
+				"items":         int32(3),
+				"names":         []interface{}{"Banana"},
+				"total_weight":  100.0,
+				"sold_weight":   60.0,
+				"waste_weight":  int32(10),
+				"donate_weight": 5.0,
+				"prod_sold":     int64(2),
+			},
+			want: InvenReport{
+				Group: "ON", ProdName: "Banana", Items: 3, ProdWeight: 25, TotalWeight: 100,
+				SoldWeight: 60, WasteWeight: 10, DonateWeight: 5, ProductSold: 2,
+			},
+		},
+		{
+			name: "several products",
+			value: map[string]interface{}{
+				"_id":          "A1",
+				"items":        int32(2),
+				"names":        []interface{}{"Banana", "Mango"},
+				"total_weight": 10.0,
+			},
+			want: InvenReport{Group: "A1", Items: 2, ProdWeight: 10, TotalWeight: 10},
+		},
+		{
+			name: "oversold",
+			value: map[string]interface{}{
+				"_id":          "Banana",
+				"items":        int32(1),
+				"total_weight": 10.0,
+				"sold_weight":  12.0,
+			},
+			want: InvenReport{Group: "Banana", Items: 1, TotalWeight: 10, SoldWeight: 12},
+		},
+	}
+
+	for _, test := range tests {
+		got := distributionReport(test.value)
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,792 @@
+package report
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	mgo "github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/pkg/errors"
+)
+
+// donationPeriodFormats are the $dateToString formats of the periods of
+// the donation report. Weeks are ISO-weeks, such as "2018-W42".
+var donationPeriodFormats = map[string]string{
+	"day":   "%Y-%m-%d",
+	"week":  "%G-W%V",
+	"month": "%Y-%m",
+	"year":  "%Y",
+}
+
+// donationWeightTolerance allows for rounding when checking that the
+// recorded donations do not exceed the DonateWeight of an item.
+const donationWeightTolerance = 0.001
+
+// donationCounter is the field of the inventory-items which counts the
+// weight of their recorded donations, so that the donations of an item
+// are capped at its DonateWeight atomically (see ReserveDonation).
+const donationCounter = "donation_recorded"
+
+// Donation records the donation of (some of) the DonateWeight of an
+// inventory-item to a Recipient organisation. UnitPrice is the fair-market
+// value of a unit of weight (the Price of the item when the donation was
+// recorded), and Value is that of the donated Weight.
+// The product and customer are copied from the item, so statements do
+// not change with the inventory.
+type Donation struct {
+	ID             objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	DonationID     uuuid.UUID        `bson:"donation_id,omitempty" json:"donation_id,omitempty"`
+	ItemID         uuuid.UUID        `bson:"item_id,omitempty" json:"item_id,omitempty"`
+	RsCustomerID   uuuid.UUID        `bson:"rs_customer_id,omitempty" json:"rs_customer_id,omitempty"`
+	Recipient      string            `bson:"recipient,omitempty" json:"recipient,omitempty"`
+	RecipientTaxID string            `bson:"recipient_tax_id,omitempty" json:"recipient_tax_id,omitempty"`
+	Name           string            `bson:"name,omitempty" json:"name,omitempty"`
+	Origin         string            `bson:"origin,omitempty" json:"origin,omitempty"`
+	Lot            string            `bson:"lot,omitempty" json:"lot,omitempty"`
+	Weight         float64           `bson:"weight" json:"weight"`
+	UnitPrice      float64           `bson:"unit_price" json:"unit_price"`
+	Value          float64           `bson:"value" json:"value"`
+	DonatedAt      int64             `bson:"donated_at,omitempty" json:"donated_at,omitempty"`
+	RecordedAt     int64             `bson:"recorded_at,omitempty" json:"recorded_at,omitempty"`
+}
+
+type marshalDonation struct {
+	ID             objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	DonationID     string            `bson:"donation_id,omitempty" json:"donation_id,omitempty"`
+	ItemID         string            `bson:"item_id,omitempty" json:"item_id,omitempty"`
+	RsCustomerID   string            `bson:"rs_customer_id,omitempty" json:"rs_customer_id,omitempty"`
+	Recipient      string            `bson:"recipient,omitempty" json:"recipient,omitempty"`
+	RecipientTaxID string            `bson:"recipient_tax_id,omitempty" json:"recipient_tax_id,omitempty"`
+	Name           string            `bson:"name,omitempty" json:"name,omitempty"`
+	Origin         string            `bson:"origin,omitempty" json:"origin,omitempty"`
+	Lot            string            `bson:"lot,omitempty" json:"lot,omitempty"`
+	Weight         float64           `bson:"weight" json:"weight"`
+	UnitPrice      float64           `bson:"unit_price" json:"unit_price"`
+	Value          float64           `bson:"value" json:"value"`
+	DonatedAt      int64             `bson:"donated_at,omitempty" json:"donated_at,omitempty"`
+	RecordedAt     int64             `bson:"recorded_at,omitempty" json:"recorded_at,omitempty"`
+}
+
+func (d Donation) toMarshal() *marshalDonation {
+	md := &marshalDonation{
+		ID:             d.ID,
+		Recipient:      d.Recipient,
+		RecipientTaxID: d.RecipientTaxID,
+		Name:           d.Name,
+		Origin:         d.Origin,
+		Lot:            d.Lot,
+		Weight:         d.Weight,
+		UnitPrice:      d.UnitPrice,
+		Value:          d.Value,
+		DonatedAt:      d.DonatedAt,
+		RecordedAt:     d.RecordedAt,
+	}
+	if d.DonationID.String() != (uuuid.UUID{}).String() {
+		md.DonationID = d.DonationID.String()
+	}
+	if d.ItemID.String() != (uuuid.UUID{}).String() {
+		md.ItemID = d.ItemID.String()
+	}
+	if d.RsCustomerID.String() != (uuuid.UUID{}).String() {
+		md.RsCustomerID = d.RsCustomerID.String()
+	}
+	return md
+}
+
+func (d Donation) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(d.toMarshal())
+}
+
+func (d Donation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.toMarshal())
+}
+
+func (d *Donation) fromMarshal(md *marshalDonation) error {
+	d.ID = md.ID
+	d.Recipient = md.Recipient
+	d.RecipientTaxID = md.RecipientTaxID
+	d.Name = md.Name
+	d.Origin = md.Origin
+	d.Lot = md.Lot
+	d.Weight = md.Weight
+	d.UnitPrice = md.UnitPrice
+	d.Value = md.Value
+	d.DonatedAt = md.DonatedAt
+	d.RecordedAt = md.RecordedAt
+
+	var err error
+	if md.DonationID != "" {
+		d.DonationID, err = uuuid.FromString(md.DonationID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing DonationID for Donation")
+			return err
+		}
+	}
+	if md.ItemID != "" {
+		d.ItemID, err = uuuid.FromString(md.ItemID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing ItemID for Donation")
+			return err
+		}
+	}
+	if md.RsCustomerID != "" {
+		d.RsCustomerID, err = uuuid.FromString(md.RsCustomerID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing RsCustomerID for Donation")
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Donation) UnmarshalBSON(in []byte) error {
+	md := &marshalDonation{}
+	err := bson.Unmarshal(in, md)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+	return d.fromMarshal(md)
+}
+
+func (d *Donation) UnmarshalJSON(in []byte) error {
+	md := &marshalDonation{}
+	err := json.Unmarshal(in, md)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+	return d.fromMarshal(md)
+}
+
+// Validate returns the problems with a Donation to be recorded.
+func (d *Donation) Validate() ValidationErrors {
+	verrs := ValidationErrors{}
+	if d.ItemID.String() == (uuuid.UUID{}).String() {
+		verrs = append(verrs, ValidationError{
+			Path:    "item_id",
+			Message: "item_id is required",
+		})
+	}
+	if d.Recipient == "" {
+		verrs = append(verrs, ValidationError{
+			Path:    "recipient",
+			Message: "recipient is required",
+		})
+	}
+	if d.Weight < 0 {
+		verrs = append(verrs, ValidationError{
+			Path:    "weight",
+			Message: "weight cannot be negative",
+		})
+	}
+	if len(verrs) == 0 {
+		return nil
+	}
+	return verrs
+}
+
+// FromInventory completes the Donation from its inventory-item, of which
+// the recorded weight was already recorded as donated. A Weight of zero
+// is the rest of the DonateWeight of the item, and a DonatedAt of zero
+// is now.
+func (d *Donation) FromInventory(item Inventory, recorded float64, now time.Time) ValidationErrors {
+	available := item.DonateWeight - recorded
+	if d.Weight == 0 {
+		d.Weight = available
+	}
+	if d.Weight <= 0 || d.Weight > available+donationWeightTolerance {
+		return ValidationErrors{
+			ValidationError{
+				Path: "weight",
+				Message: fmt.Sprintf(
+					"The item has %g of its donated weight of %g left to record, got %g",
+					math.Max(available, 0), item.DonateWeight, d.Weight,
+				),
+			},
+		}
+	}
+
+	d.RsCustomerID = item.RsCustomerID
+	d.Name = item.Name
+	d.Origin = item.Origin
+	d.Lot = item.Lot
+	d.UnitPrice = item.Price
+	d.Value = math.Round(d.Weight*item.Price*100) / 100
+	if d.DonatedAt == 0 {
+		d.DonatedAt = now.Unix()
+	}
+	return nil
+}
+
+// DonationFilter selects the donations of the items (all items if ItemIDs
+// is nil), of the customer and recipient (all if empty), donated from
+// From until To (Unix-timestamps in seconds, To excluded, unbounded if zero).
+type DonationFilter struct {
+	ItemIDs      []string
+	RsCustomerID string
+	Recipient    string
+	From         int64
+	To           int64
+}
+
+func (f DonationFilter) query() map[string]interface{} {
+	filter := map[string]interface{}{}
+	if f.ItemIDs != nil {
+		filter["item_id"] = map[string]interface{}{
+			"$in": f.ItemIDs,
+		}
+	}
+	if f.RsCustomerID != "" {
+		filter["rs_customer_id"] = f.RsCustomerID
+	}
+	if f.Recipient != "" {
+		filter["recipient"] = f.Recipient
+	}
+	if f.From != 0 || f.To != 0 {
+		donatedAt := map[string]interface{}{}
+		if f.From != 0 {
+			donatedAt["$gte"] = f.From
+		}
+		if f.To != 0 {
+			donatedAt["$lt"] = f.To
+		}
+		filter["donated_at"] = donatedAt
+	}
+	return filter
+}
+
+// DonationParams select the donations of the donation report: those of the
+// customer (RsCustomerID) and Recipient, if set, from From until To
+// (Unix-timestamps in seconds, unbounded if zero). They are totalled per
+// Period, which is "day", "week", "month" (default) or "year", in UTC.
+type DonationParams struct {
+	RsCustomerID string `json:"rs_customer_id,omitempty"`
+	Recipient    string `json:"recipient,omitempty"`
+	From         int64  `json:"from,omitempty"`
+	To           int64  `json:"to,omitempty"`
+	Period       string `json:"period,omitempty"`
+}
+
+// DonationQuery is the request-body of the donation report.
+type DonationQuery struct {
+	SearchQuery
+	Donation *DonationParams `json:"donation,omitempty"`
+}
+
+// Validate checks the SearchQuery and the DonationParams.
+// Returns nil if the DonationQuery is valid.
+func (q *DonationQuery) Validate() ValidationErrors {
+	verrs := q.SearchQuery.Validate()
+	if q.Donation != nil {
+		verrs = append(verrs, q.Donation.validate("donation")...)
+	}
+	return verrs
+}
+
+func (p *DonationParams) period() string {
+	if p == nil || p.Period == "" {
+		return "month"
+	}
+	return p.Period
+}
+
+// Filter returns the DonationFilter of the params, for the items
+// (all items if itemIDs is nil).
+func (p *DonationParams) Filter(itemIDs []string) DonationFilter {
+	filter := DonationFilter{
+		ItemIDs: itemIDs,
+	}
+	if p != nil {
+		filter.RsCustomerID = p.RsCustomerID
+		filter.Recipient = p.Recipient
+		filter.From = p.From
+		filter.To = p.To
+	}
+	return filter
+}
+
+// validate returns the problems with the DonationParams.
+func (p *DonationParams) validate(path string) ValidationErrors {
+	verrs := ValidationErrors{}
+	if p.RsCustomerID != "" {
+		if _, err := uuuid.FromString(p.RsCustomerID); err != nil {
+			verrs = append(verrs, ValidationError{
+				Path:    path + ".rs_customer_id",
+				Message: err.Error(),
+			})
+		}
+	}
+	if p.From != 0 && p.To != 0 && p.From >= p.To {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".from",
+			Message: "from must be before to",
+		})
+	}
+	if _, ok := donationPeriodFormats[p.period()]; !ok {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".period",
+			Message: fmt.Sprintf("Invalid period %s, expected day, week, month or year", p.Period),
+		})
+	}
+	return verrs
+}
+
+// DonationTotal is the donated weight and fair-market value of a customer
+// to a recipient in a period. Items is the number of donated items.
+type DonationTotal struct {
+	RsCustomerID string  `json:"rs_customer_id"`
+	Recipient    string  `json:"recipient"`
+	Period       string  `json:"period"`
+	Donations    int64   `json:"donations"`
+	Items        int64   `json:"items"`
+	Weight       float64 `json:"weight"`
+	Value        float64 `json:"value"`
+}
+
+// DonationTotals totals the donations of the items (all items if itemIDs
+// is nil) selected by the params, per customer, recipient and the period
+// of their DonatedAt. The totals are computed by Mongo, ordered by period,
+// customer and recipient.
+func (db *DB) DonationTotals(params *DonationParams, itemIDs []string) ([]DonationTotal, error) {
+	format, ok := donationPeriodFormats[params.period()]
+	if !ok {
+		return nil, errors.Errorf("Invalid period %s - DonationTotals", params.period())
+	}
+
+	project := map[string]interface{}{
+		"rs_customer_id": 1,
+		"recipient":      1,
+		"item_id":        1,
+		"weight":         1,
+		"value":          1,
+		"period": map[string]interface{}{
+			"$dateToString": map[string]interface{}{
+				"format": format,
+				"date": map[string]interface{}{
+					"$add": []interface{}{
+						time.Unix(0, 0).UTC(),
+						map[string]interface{}{
+							"$multiply": []interface{}{"$donated_at", 1000},
+						},
+					},
+				},
+			},
+		},
+	}
+	group := map[string]interface{}{
+		"_id": map[string]interface{}{
+			"rs_customer_id": "$rs_customer_id",
+			"recipient":      "$recipient",
+			"period":         "$period",
+		},
+		"donations": map[string]interface{}{
+			"$sum": 1,
+		},
+		"items": map[string]interface{}{
+			"$addToSet": "$item_id",
+		},
+		"weight": map[string]interface{}{
+			"$sum": "$weight",
+		},
+		"value": map[string]interface{}{
+			"$sum": "$value",
+		},
+	}
+
+	pipeline := []interface{}{
+		map[string]interface{}{
+			"$match": params.Filter(itemIDs).query(),
+		},
+		map[string]interface{}{
+			"$project": project,
+		},
+		map[string]interface{}{
+			"$group": group,
+		},
+		bson.NewDocument(
+			bson.EC.SubDocumentFromElements(
+				"$sort",
+				bson.EC.Int32("_id.period", 1),
+				bson.EC.Int32("_id.rs_customer_id", 1),
+				bson.EC.Int32("_id.recipient", 1),
+			),
+		),
+	}
+
+	aggResults, err := db.collection.Aggregate(pipeline)
+	if err != nil {
+		err = errors.Wrap(err, "Error aggregating donations - DonationTotals")
+		log.Println(err)
+		return nil, err
+	}
+
+	totals := []DonationTotal{}
+	for _, v := range aggResults {
+		value, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := value["_id"].(map[string]interface{})
+
+		total := DonationTotal{}
+		total.RsCustomerID, _ = id["rs_customer_id"].(string)
+		total.Recipient, _ = id["recipient"].(string)
+		total.Period, _ = id["period"].(string)
+
+		donations, _ := toFloat(value["donations"])
+		total.Donations = int64(donations)
+		if items, ok := value["items"].([]interface{}); ok {
+			total.Items = int64(len(items))
+		}
+		total.Weight, _ = toFloat(value["weight"])
+		total.Value, _ = toFloat(value["value"])
+		total.Value = math.Round(total.Value*100) / 100
+
+		totals = append(totals, total)
+	}
+	return totals, nil
+}
+
+// statementPeriodRegex matches the periods of donation statements:
+// a year ("2018"), a quarter ("2018-Q4") or a month ("2018-10").
+var statementPeriodRegex = regexp.MustCompile(`^(\d{4})(?:-Q([1-4])|-(\d{2}))?$`)
+
+// ParseStatementPeriod returns the start and end (excluded) of the period
+// of a donation statement, in UTC.
+func ParseStatementPeriod(period string) (int64, int64, error) {
+	match := statementPeriodRegex.FindStringSubmatch(period)
+	if match == nil {
+		return 0, 0, errors.Errorf(
+			"Invalid period %s, expected a year (2018), quarter (2018-Q4) or month (2018-10)",
+			period,
+		)
+	}
+
+	year, _ := strconv.Atoi(match[1])
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, 0)
+	switch {
+	case match[2] != "":
+		quarter, _ := strconv.Atoi(match[2])
+		start = start.AddDate(0, 3*(quarter-1), 0)
+		end = start.AddDate(0, 3, 0)
+	case match[3] != "":
+		month, _ := strconv.Atoi(match[3])
+		if month < 1 || month > 12 {
+			return 0, 0, errors.Errorf("Invalid month in period %s", period)
+		}
+		start = start.AddDate(0, month-1, 0)
+		end = start.AddDate(0, 1, 0)
+	}
+	return start.Unix(), end.Unix(), nil
+}
+
+// RecipientDonations are the donations of a statement to a recipient.
+type RecipientDonations struct {
+	Recipient      string     `json:"recipient"`
+	RecipientTaxID string     `json:"recipient_tax_id,omitempty"`
+	Donations      []Donation `json:"donations"`
+	Weight         float64    `json:"weight"`
+	Value          float64    `json:"value"`
+}
+
+// DonationStatement lists the donations of a customer in a Period (from
+// From until To, excluded), by recipient, with their donated weight and
+// fair-market value, such as for a tax-return.
+type DonationStatement struct {
+	RsCustomerID string               `json:"rs_customer_id"`
+	Period       string               `json:"period"`
+	From         int64                `json:"from"`
+	To           int64                `json:"to"`
+	Recipients   []RecipientDonations `json:"recipients"`
+	TotalWeight  float64              `json:"total_weight"`
+	TotalValue   float64              `json:"total_value"`
+	GeneratedAt  int64                `json:"generated_at"`
+}
+
+// NewDonationStatement creates the statement of the customer's donations
+// in the period, ordered by recipient and the time of donation.
+func NewDonationStatement(
+	customerID uuuid.UUID,
+	period string,
+	donations []Donation,
+	now time.Time,
+) (*DonationStatement, error) {
+	from, to, err := ParseStatementPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+	statement := &DonationStatement{
+		RsCustomerID: customerID.String(),
+		Period:       period,
+		From:         from,
+		To:           to,
+		Recipients:   []RecipientDonations{},
+		GeneratedAt:  now.Unix(),
+	}
+
+	byRecipient := map[string]*RecipientDonations{}
+	recipients := []string{}
+	for _, d := range donations {
+		if d.RsCustomerID.String() != customerID.String() || d.DonatedAt < from || d.DonatedAt >= to {
+			continue
+		}
+		rd, ok := byRecipient[d.Recipient]
+		if !ok {
+			rd = &RecipientDonations{
+				Recipient: d.Recipient,
+				Donations: []Donation{},
+			}
+			byRecipient[d.Recipient] = rd
+			recipients = append(recipients, d.Recipient)
+		}
+		if d.RecipientTaxID != "" {
+			rd.RecipientTaxID = d.RecipientTaxID
+		}
+		rd.Donations = append(rd.Donations, d)
+		rd.Weight += d.Weight
+		rd.Value += d.Value
+	}
+
+	sort.Strings(recipients)
+	for _, recipient := range recipients {
+		rd := byRecipient[recipient]
+		sort.SliceStable(rd.Donations, func(i, j int) bool {
+			return rd.Donations[i].DonatedAt < rd.Donations[j].DonatedAt
+		})
+		rd.Value = math.Round(rd.Value*100) / 100
+		statement.Recipients = append(statement.Recipients, *rd)
+		statement.TotalWeight += rd.Weight
+		statement.TotalValue += rd.Value
+	}
+	statement.TotalValue = math.Round(statement.TotalValue*100) / 100
+	return statement, nil
+}
+
+// WriteCSV writes the statement as CSV, a row per donation followed by
+// a row with the totals.
+func (s *DonationStatement) WriteCSV(w io.Writer) error {
+	formatFloat := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	writer := csv.NewWriter(w)
+	rows := [][]string{
+		[]string{
+			"donated_at", "recipient", "recipient_tax_id", "item_id",
+			"name", "origin", "lot", "weight", "unit_price", "value",
+		},
+	}
+	for _, rd := range s.Recipients {
+		for _, d := range rd.Donations {
+			rows = append(rows, []string{
+				time.Unix(d.DonatedAt, 0).UTC().Format(time.RFC3339),
+				rd.Recipient,
+				rd.RecipientTaxID,
+				d.ItemID.String(),
+				d.Name,
+				d.Origin,
+				d.Lot,
+				formatFloat(d.Weight),
+				formatFloat(d.UnitPrice),
+				formatFloat(d.Value),
+			})
+		}
+	}
+	rows = append(rows, []string{
+		"total", "", "", "", "", "", "",
+		formatFloat(s.TotalWeight), "", formatFloat(s.TotalValue),
+	})
+
+	err := writer.WriteAll(rows)
+	if err != nil {
+		return errors.Wrap(err, "Error writing the statement - WriteCSV")
+	}
+	return nil
+}
+
+// InsertDonation stores the Donation, and generates its DonationID.
+func (db *DB) InsertDonation(d *Donation) (*Donation, error) {
+	donationID, err := uuuid.NewV4()
+	if err != nil {
+		err = errors.Wrap(err, "Unable to generate DonationID - InsertDonation")
+		log.Println(err)
+		return nil, err
+	}
+	d.ID = objectid.NilObjectID
+	d.DonationID = donationID
+	d.RecordedAt = time.Now().Unix()
+
+	_, err = db.collection.InsertOne(d)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to insert Donation - InsertDonation")
+		log.Println(err)
+		return nil, err
+	}
+	return d, nil
+}
+
+// Donations returns the donations selected by the filter, ordered by
+// the time of donation.
+func (db *DB) Donations(filter DonationFilter) ([]Donation, error) {
+	findResults, err := db.collection.Find(filter.query())
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching Donations - Donations")
+		log.Println(err)
+		return nil, err
+	}
+
+	donations := []Donation{}
+	for _, v := range findResults {
+		donations = append(donations, *v.(*Donation))
+	}
+	sort.SliceStable(donations, func(i, j int) bool {
+		return donations[i].DonatedAt < donations[j].DonatedAt
+	})
+	return donations, nil
+}
+
+// DeleteDonation deletes the Donation, such as one recorded by mistake,
+// and returns it.
+func (db *DB) DeleteDonation(donationID uuuid.UUID) (*Donation, error) {
+	filter := map[string]interface{}{
+		"donation_id": donationID.String(),
+	}
+	findResults, err := db.collection.Find(filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching Donation - DeleteDonation")
+		log.Println(err)
+		return nil, err
+	}
+	if len(findResults) == 0 {
+		return nil, errors.New("No donation found - DeleteDonation")
+	}
+
+	deleteResult, err := db.collection.DeleteMany(filter)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to delete Donation - DeleteDonation")
+		log.Println(err)
+		return nil, err
+	}
+	// Deleted concurrently
+	if deleteResult.DeletedCount == 0 {
+		return nil, errors.New("No donation found - DeleteDonation")
+	}
+	return findResults[0].(*Donation), nil
+}
+
+// DonationRecorded returns the weight of the recorded donations of the
+// inventory-item, from its "donation_recorded" counter. Returns false if
+// the item has no counter yet (see SeedDonationRecorded).
+func (db *DB) DonationRecorded(itemID string) (float64, bool, error) {
+	pipeline := []interface{}{
+		map[string]interface{}{
+			"$match": map[string]interface{}{
+				"item_id": itemID,
+			},
+		},
+		map[string]interface{}{
+			"$project": map[string]interface{}{
+				donationCounter: 1,
+			},
+		},
+	}
+
+	aggResults, err := db.collection.Aggregate(pipeline)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching the recorded donations - DonationRecorded")
+		log.Println(err)
+		return 0, false, err
+	}
+	if len(aggResults) == 0 {
+		return 0, false, errors.New("No inventory found - DonationRecorded")
+	}
+	recorded, ok := toFloat(aggResults[0].(map[string]interface{})[donationCounter])
+	return recorded, ok, nil
+}
+
+// SeedDonationRecorded sets the "donation_recorded" counter of the
+// inventory-item to the weight of the donations recorded before the item
+// had a counter, unless it has one already.
+func (db *DB) SeedDonationRecorded(itemID string, recorded float64) error {
+	_, err := db.collection.UpdateMany(
+		map[string]interface{}{
+			"item_id": itemID,
+			donationCounter: map[string]interface{}{
+				"$exists": false,
+			},
+		},
+		map[string]interface{}{
+			donationCounter: recorded,
+		},
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to seed the recorded donations - SeedDonationRecorded")
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// ReserveDonation adds the weight to the "donation_recorded" counter of
+// the inventory-item, unless the counter would exceed the DonateWeight of
+// the item. The counter is checked and incremented in a single update, so
+// concurrent donations of an item cannot exceed its DonateWeight together.
+// Returns false if the weight was not reserved.
+func (db *DB) ReserveDonation(item Inventory, weight float64) (bool, error) {
+	filter := map[string]interface{}{
+		"item_id": item.ItemID.String(),
+		donationCounter: map[string]interface{}{
+			"$lte": item.DonateWeight - weight + donationWeightTolerance,
+		},
+	}
+	updateResult, err := db.incDonationRecorded(filter, weight)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to reserve the donated weight - ReserveDonation")
+		log.Println(err)
+		return false, err
+	}
+	return updateResult.MatchedCount > 0, nil
+}
+
+// ReleaseDonation subtracts the weight from the "donation_recorded"
+// counter of the inventory-item, such as that of a deleted donation.
+func (db *DB) ReleaseDonation(itemID string, weight float64) error {
+	filter := map[string]interface{}{
+		"item_id": itemID,
+		donationCounter: map[string]interface{}{
+			"$exists": true,
+		},
+	}
+	_, err := db.incDonationRecorded(filter, -weight)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to release the donated weight - ReleaseDonation")
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+func (db *DB) incDonationRecorded(filter map[string]interface{}, weight float64) (*mgo.UpdateResult, error) {
+	timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return db.collection.Collection().UpdateOne(ctx, filter, map[string]interface{}{
+		"$inc": map[string]interface{}{
+			donationCounter: weight,
+		},
+	})
+}
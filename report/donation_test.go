@@ -0,0 +1,171 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+)
+
+func TestParseStatementPeriod(t *testing.T) {
+	day := func(year int, month time.Month, d int) int64 {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC).Unix()
+	}
+
+	tests := []struct {
+		period     string
+		start, end int64
+		wantErr    bool
+	}{
+		{period: "2018", start: day(2018, 1, 1), end: day(2019, 1, 1)},
+		{period: "2018-Q1", start: day(2018, 1, 1), end: day(2018, 4, 1)},
+		{period: "2018-Q4", start: day(2018, 10, 1), end: day(2019, 1, 1)},
+		{period: "2018-02", start: day(2018, 2, 1), end: day(2018, 3, 1)},
+		{period: "2018-12", start: day(2018, 12, 1), end: day(2019, 1, 1)},
+		{period: "2018-13", wantErr: true},
+		{period: "2018-00", wantErr: true},
+		{period: "2018-Q5", wantErr: true},
+		{period: "2018-1", wantErr: true},
+		{period: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		start, end, err := ParseStatementPeriod(test.period)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %t", test.period, err, test.wantErr)
+			continue
+		}
+		if start != test.start || end != test.end {
+			t.Errorf("%q: got %d to %d, want %d to %d", test.period, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestNewDonationStatement(t *testing.T) {
+	now := time.Unix(1539820800, 0)
+	customer, _ := uuuid.FromString("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+	other, _ := uuuid.FromString("6ba7b812-9dad-11d1-80b4-00c04fd430c8")
+	october := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+	// donation of the customer to the recipient, the days into October
+	donation := func(c uuuid.UUID, recipient string, days int64, value float64) Donation {
+		return Donation{
+			RsCustomerID: c,
+			Recipient:    recipient,
+			Weight:       2,
+			Value:        value,
+			DonatedAt:    october + days*86400,
+		}
+	}
+	donations := []Donation{
+		donation(customer, "Food Bank", 5, 1.005),
+		donation(customer, "Shelter", 3, 4),
+		donation(customer, "Food Bank", 2, 2),
+		donation(customer, "Food Bank", 31, 8),
+		donation(customer, "Food Bank", -1, 8),
+		donation(other, "Food Bank", 4, 8),
+	}
+
+	tests := []struct {
+		name   string
+		period string
+		// want are the recipients, with the days of their donations
+		want        map[string][]int64
+		recipients  []string
+		totalWeight float64
+		totalValue  float64
+		wantErr     bool
+	}{
+		{
+			name:        "month",
+			period:      "2018-10",
+			recipients:  []string{"Food Bank", "Shelter"},
+			want:        map[string][]int64{"Food Bank": {2, 5}, "Shelter": {3}},
+			totalWeight: 6,
+			totalValue:  7.01,
+		},
+		{
+			name:        "quarter",
+			period:      "2018-Q4",
+			recipients:  []string{"Food Bank", "Shelter"},
+			want:        map[string][]int64{"Food Bank": {2, 5, 31}, "Shelter": {3}},
+			totalWeight: 8,
+			totalValue:  15.01,
+		},
+		{
+			name:       "no donations",
+			period:     "2017",
+			recipients: []string{},
+			want:       map[string][]int64{},
+		},
+		{name: "invalid period", period: "2018-Q0", wantErr: true},
+	}
+
+	for _, test := range tests {
+		statement, err := NewDonationStatement(customer, test.period, donations, now)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		recipients, got := []string{}, map[string][]int64{}
+		for _, rd := range statement.Recipients {
+			recipients = append(recipients, rd.Recipient)
+			days := []int64{}
+			for _, d := range rd.Donations {
+				days = append(days, (d.DonatedAt-october)/86400)
+			}
+			got[rd.Recipient] = days
+		}
+		if !reflect.DeepEqual(recipients, test.recipients) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got recipients %v with %v, want %v with %v", test.name, recipients, got, test.recipients, test.want)
+		}
+		if statement.TotalWeight != test.totalWeight || statement.TotalValue != test.totalValue {
+			t.Errorf(
+				"%s: got totals %v and %v, want %v and %v",
+				test.name, statement.TotalWeight, statement.TotalValue, test.totalWeight, test.totalValue,
+			)
+		}
+	}
+}
+
+func TestDonationFromInventory(t *testing.T) {
+	now := time.Unix(1539820800, 0)
+	item := Inventory{Name: "Banana", Lot: "A1", DonateWeight: 10, Price: 1.25}
+
+	tests := []struct {
+		name     string
+		weight   float64
+		recorded float64
+		// want are the weight and value of the donation
+		wantWeight float64
+		wantValue  float64
+		wantErr    bool
+	}{
+		{name: "remaining weight", weight: 0, recorded: 4, wantWeight: 6, wantValue: 7.5},
+		{name: "part of the weight", weight: 3, recorded: 4, wantWeight: 3, wantValue: 3.75},
+		{name: "within the tolerance", weight: 6.0005, recorded: 4, wantWeight: 6.0005, wantValue: 7.5},
+		{name: "more than the remaining weight", weight: 7, recorded: 4, wantErr: true},
+		{name: "fully recorded", weight: 0, recorded: 10, wantErr: true},
+		{name: "negative weight", weight: -1, recorded: 0, wantErr: true},
+	}
+
+	for _, test := range tests {
+		d := &Donation{Weight: test.weight}
+		verrs := d.FromInventory(item, test.recorded, now)
+		if (len(verrs) > 0) != test.wantErr {
+			t.Errorf("%s: got errors %v, want errors %t", test.name, verrs, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if d.Weight != test.wantWeight || d.Value != test.wantValue || d.Name != "Banana" || d.DonatedAt != now.Unix() {
+			t.Errorf("%s: got %+v, want weight %v and value %v", test.name, *d, test.wantWeight, test.wantValue)
+		}
+	}
+}
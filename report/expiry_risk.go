@@ -0,0 +1,259 @@
+package report
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Actions suggested for items at risk of expiring.
+const (
+	ActionMarkdown = "markdown"
+	ActionDonate   = "donate"
+	ActionMove     = "move"
+)
+
+// DefaultExpiryHorizon is how far ahead the expiry-risk report looks.
+const DefaultExpiryHorizon = "72h"
+
+// ActionRule suggests its Action for the items matching all of its set
+// conditions. HoursLeft is until the ExpiryDate, and RemainingPct is the
+// unsold weight as a percentage of the TotalWeight.
+// MarkdownPct is the suggested discount of a markdown.
+type ActionRule struct {
+	Action          string  `json:"action"`
+	MaxHoursLeft    float64 `json:"max_hours_left,omitempty"`
+	MinHoursLeft    float64 `json:"min_hours_left,omitempty"`
+	MinRemainingPct float64 `json:"min_remaining_pct,omitempty"`
+	MinValueAtRisk  float64 `json:"min_value_at_risk,omitempty"`
+	MarkdownPct     float64 `json:"markdown_pct,omitempty"`
+}
+
+// DefaultActionRules donate what cannot be sold in time, mark down what
+// expires soon, and move the slow sellers to where they sell faster.
+// Everything else is marked down lightly.
+var DefaultActionRules = []ActionRule{
+	ActionRule{
+		Action:       ActionDonate,
+		MaxHoursLeft: 24,
+	},
+	ActionRule{
+		Action:       ActionMarkdown,
+		MaxHoursLeft: 48,
+		MarkdownPct:  30,
+	},
+	ActionRule{
+		Action:          ActionMove,
+		MinRemainingPct: 75,
+	},
+	ActionRule{
+		Action:      ActionMarkdown,
+		MarkdownPct: 15,
+	},
+}
+
+// matches returns true if the item-risk meets all conditions of the rule.
+func (rule ActionRule) matches(risk *ExpiryRisk) bool {
+	if rule.MaxHoursLeft > 0 && risk.HoursLeft > rule.MaxHoursLeft {
+		return false
+	}
+	if rule.MinHoursLeft > 0 && risk.HoursLeft < rule.MinHoursLeft {
+		return false
+	}
+	if rule.MinRemainingPct > 0 && risk.RemainingPct < rule.MinRemainingPct {
+		return false
+	}
+	if rule.MinValueAtRisk > 0 && risk.ValueAtRisk < rule.MinValueAtRisk {
+		return false
+	}
+	return true
+}
+
+// ValidateActionRules returns the problems with the rules.
+func ValidateActionRules(rules []ActionRule, path string) ValidationErrors {
+	verrs := ValidationErrors{}
+	for i, rule := range rules {
+		rulePath := fmt.Sprintf("%s[%d]", path, i)
+		switch rule.Action {
+		case ActionMarkdown, ActionDonate, ActionMove:
+		default:
+			verrs = append(verrs, ValidationError{
+				Path: rulePath + ".action",
+				Message: fmt.Sprintf(
+					"Invalid action %s, expected %s, %s or %s",
+					rule.Action, ActionMarkdown, ActionDonate, ActionMove,
+				),
+			})
+		}
+		if rule.MarkdownPct < 0 || rule.MarkdownPct > 100 {
+			verrs = append(verrs, ValidationError{
+				Path:    rulePath + ".markdown_pct",
+				Message: "markdown_pct must be from 0 to 100",
+			})
+		}
+	}
+	return verrs
+}
+
+// ExpiryRiskParams selects the items expiring within the Horizon (a
+// duration such as "72h" or "daily"), and the rules suggesting their
+// actions, in order of precedence. The configured rules are used if
+// Rules is empty.
+type ExpiryRiskParams struct {
+	Horizon string       `json:"horizon,omitempty"`
+	Rules   []ActionRule `json:"rules,omitempty"`
+}
+
+// ExpiryRiskQuery is the request-body of the expiry-risk report.
+type ExpiryRiskQuery struct {
+	SearchQuery
+	ExpiryRisk *ExpiryRiskParams `json:"expiry_risk,omitempty"`
+}
+
+// Validate checks the SearchQuery and the ExpiryRiskParams.
+// Returns nil if the ExpiryRiskQuery is valid.
+func (q *ExpiryRiskQuery) Validate() ValidationErrors {
+	verrs := q.SearchQuery.Validate()
+	if q.ExpiryRisk != nil {
+		verrs = append(verrs, q.ExpiryRisk.validate("expiry_risk")...)
+	}
+	return verrs
+}
+
+// HorizonSeconds returns the length of the horizon.
+func (p *ExpiryRiskParams) HorizonSeconds() (int64, error) {
+	if p == nil || p.Horizon == "" {
+		return parseInterval(DefaultExpiryHorizon)
+	}
+	return parseInterval(p.Horizon)
+}
+
+// validate returns the problems with the ExpiryRiskParams.
+func (p *ExpiryRiskParams) validate(path string) ValidationErrors {
+	verrs := ValidationErrors{}
+	if _, err := p.HorizonSeconds(); err != nil {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".horizon",
+			Message: err.Error(),
+		})
+	}
+	verrs = append(verrs, ValidateActionRules(p.Rules, path+".rules")...)
+	return verrs
+}
+
+// ExpiryRisk is an item expiring within the horizon with unsold weight.
+// UnitPrice is the SalePrice, or the Price if there is no SalePrice,
+// and ValueAtRisk is the UnitPrice of the RemainingWeight.
+type ExpiryRisk struct {
+	ItemID          string  `json:"item_id"`
+	Name            string  `json:"name"`
+	Origin          string  `json:"origin"`
+	Lot             string  `json:"lot,omitempty"`
+	ExpiryDate      int64   `json:"expiry_date"`
+	HoursLeft       float64 `json:"hours_left"`
+	RemainingWeight float64 `json:"remaining_weight"`
+	RemainingPct    float64 `json:"remaining_pct"`
+	UnitPrice       float64 `json:"unit_price"`
+	ValueAtRisk     float64 `json:"value_at_risk"`
+	Action          string  `json:"action"`
+	MarkdownPct     float64 `json:"markdown_pct,omitempty"`
+}
+
+// AssessExpiryRisk returns the ExpiryRisk of the inventory-items which
+// expire from now until the horizon and have unsold weight, with the
+// action of the first matching rule, ordered by ValueAtRisk (highest
+// first). Items which no rule matches get no action.
+func AssessExpiryRisk(
+	inventory []Inventory,
+	horizon int64,
+	rules []ActionRule,
+	now time.Time,
+) []ExpiryRisk {
+	risks := []ExpiryRisk{}
+	for _, inv := range inventory {
+		if inv.ExpiryDate < now.Unix() || inv.ExpiryDate > now.Unix()+horizon {
+			continue
+		}
+		remaining := inv.TotalWeight - inv.SoldWeight - inv.WasteWeight - inv.DonateWeight
+		if remaining <= 0 {
+			continue
+		}
+
+		unitPrice := inv.SalePrice
+		if unitPrice <= 0 {
+			unitPrice = inv.Price
+		}
+		risk := ExpiryRisk{
+			ItemID:          inv.ItemID.String(),
+			Name:            inv.Name,
+			Origin:          inv.Origin,
+			Lot:             inv.Lot,
+			ExpiryDate:      inv.ExpiryDate,
+			HoursLeft:       math.Round(float64(inv.ExpiryDate-now.Unix())/36) / 100,
+			RemainingWeight: remaining,
+			UnitPrice:       unitPrice,
+			ValueAtRisk:     math.Round(unitPrice*remaining*100) / 100,
+		}
+		if inv.TotalWeight > 0 {
+			risk.RemainingPct = math.Round(remaining/inv.TotalWeight*10000) / 100
+		}
+
+		for _, rule := range rules {
+			if rule.matches(&risk) {
+				risk.Action = rule.Action
+				if rule.Action == ActionMarkdown {
+					risk.MarkdownPct = rule.MarkdownPct
+				}
+				break
+			}
+		}
+		risks = append(risks, risk)
+	}
+
+	sort.SliceStable(risks, func(i, j int) bool {
+		if risks[i].ValueAtRisk != risks[j].ValueAtRisk {
+			return risks[i].ValueAtRisk > risks[j].ValueAtRisk
+		}
+		return risks[i].ExpiryDate < risks[j].ExpiryDate
+	})
+	return risks
+}
+
+// ExpiringInventory returns the inventory matching the query-tree and
+// TextSearch of the SearchQuery, whose ExpiryDate is from "from" until "to".
+func (db *DB) ExpiringInventory(search *SearchQuery, from int64, to int64) ([]Inventory, error) {
+	invQuery, err := db.invFindQuery(search)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling inventory query - ExpiringInventory")
+		log.Println(err)
+		return nil, err
+	}
+	filter := invQuery.filter
+
+	findResults, err := db.collection.Find(map[string]interface{}{
+		"$and": []interface{}{
+			filter,
+			map[string]interface{}{
+				"expiry_date": map[string]interface{}{
+					"$gte": from,
+					"$lte": to,
+				},
+			},
+		},
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching inventory - ExpiringInventory")
+		log.Println(err)
+		return nil, err
+	}
+
+	inventory := []Inventory{}
+	for _, v := range findResults {
+		inventory = append(inventory, *v.(*Inventory))
+	}
+	return inventory, nil
+}
@@ -0,0 +1,102 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAssessExpiryRisk(t *testing.T) {
+	now := time.Unix(1539820800, 0)
+	const hour = 3600
+	horizon := int64(72 * hour)
+
+	// item expires in the hours, with the unsold kilograms out of 10,
+	// and a Price of 2
+	item := func(name string, hours float64, unsold float64) Inventory {
+		return Inventory{
+			Name:        name,
+			ExpiryDate:  now.Unix() + int64(hours*hour),
+			TotalWeight: 10,
+			SoldWeight:  10 - unsold,
+			Price:       2,
+		}
+	}
+
+	tests := []struct {
+		name      string
+		inventory []Inventory
+		rules     []ActionRule
+		// want are the names of the items at risk in order, with their actions
+		want    []string
+		actions []string
+	}{
+		{
+			name:      "default rules",
+			inventory: []Inventory{item("donate", 12, 5), item("markdown", 36, 5), item("move", 60, 8), item("light", 60, 5)},
+			rules:     DefaultActionRules,
+			want:      []string{"move", "donate", "markdown", "light"},
+			actions:   []string{ActionMove, ActionDonate, ActionMarkdown, ActionMarkdown},
+		},
+		{
+			name:      "outside the horizon",
+			inventory: []Inventory{item("expired", -1, 5), item("later", 73, 5), item("soon", 1, 5)},
+			rules:     DefaultActionRules,
+			want:      []string{"soon"},
+			actions:   []string{ActionDonate},
+		},
+		{
+			name:      "sold out",
+			inventory: []Inventory{item("sold", 12, 0)},
+			rules:     DefaultActionRules,
+			want:      []string{},
+			actions:   []string{},
+		},
+		{
+			name:      "no matching rule",
+			inventory: []Inventory{item("valuable", 12, 1), item("cheap", 12, 5)},
+			rules:     []ActionRule{{Action: ActionDonate, MinValueAtRisk: 5}},
+			want:      []string{"cheap", "valuable"},
+			actions:   []string{ActionDonate, ""},
+		},
+		{
+			name:      "equal value by expiry",
+			inventory: []Inventory{item("b", 30, 5), item("a", 20, 5)},
+			rules:     []ActionRule{{Action: ActionMarkdown, MinHoursLeft: 25}},
+			want:      []string{"a", "b"},
+			actions:   []string{"", ActionMarkdown},
+		},
+	}
+
+	for _, test := range tests {
+		risks := AssessExpiryRisk(test.inventory, horizon, test.rules, now)
+		got, actions := []string{}, []string{}
+		for _, r := range risks {
+			got = append(got, r.Name)
+			actions = append(actions, r.Action)
+		}
+		if !reflect.DeepEqual(got, test.want) || !reflect.DeepEqual(actions, test.actions) {
+			t.Errorf("%s: got %v with actions %v, want %v with %v", test.name, got, actions, test.want, test.actions)
+		}
+	}
+
+	// The figures of an item at risk
+	sale := item("sale", 36, 4)
+	sale.SalePrice = 1.5
+	risks := AssessExpiryRisk([]Inventory{sale}, horizon, DefaultActionRules, now)
+	want := ExpiryRisk{
+		ItemID:          sale.ItemID.String(),
+		Name:            "sale",
+		ExpiryDate:      sale.ExpiryDate,
+		HoursLeft:       36,
+		RemainingWeight: 4,
+		RemainingPct:    40,
+		UnitPrice:       1.5,
+		ValueAtRisk:     6,
+		Action:          ActionMarkdown,
+		MarkdownPct:     30,
+	}
+	if len(risks) != 1 || risks[0] != want {
+		t.Errorf("got risks %+v, want %+v", risks, want)
+	}
+}
@@ -0,0 +1,323 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	mgo "github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/pkg/errors"
+)
+
+// Explanation describes how a search is run by Mongo, without fetching
+// its results. Filter, Projection, Pipeline and WinningPlan are Extended JSON.
+// Pipeline is the aggregation-pipeline which is run instead of a Find when
+// sorting on computed fields, such as calibrated readings.
+// Index is the index used by the winning query-plan, or its stage (such
+// as "COLLSCAN") if no index is used. EstimatedCount is the number of
+// documents matching the Filter, counted by Mongo.
+type Explanation struct {
+	Collection     string          `json:"collection"`
+	Filter         json.RawMessage `json:"filter"`
+	Projection     json.RawMessage `json:"projection,omitempty"`
+	Pipeline       json.RawMessage `json:"pipeline,omitempty"`
+	Sort           []SortField     `json:"sort,omitempty"`
+	Limit          int64           `json:"limit,omitempty"`
+	RankedByScore  bool            `json:"ranked_by_score,omitempty"`
+	Index          string          `json:"index"`
+	WinningPlan    json.RawMessage `json:"winning_plan,omitempty"`
+	EstimatedCount int64           `json:"estimated_count"`
+}
+
+// extJSON converts the filter or projection to Extended JSON.
+func extJSON(doc map[string]interface{}) (json.RawMessage, error) {
+	bsonDoc, err := mgo.TransformDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	s, err := bsonDoc.ToExtJSONErr(false)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(s), nil
+}
+
+// planIndex returns the index used by the query-plan, or the
+// stage of the plan if it uses no index.
+func planIndex(plan *bson.Document) string {
+	if name, ok := plan.Lookup("indexName").StringValueOK(); ok {
+		return name
+	}
+	if input, ok := plan.Lookup("inputStage").MutableDocumentOK(); ok {
+		return planIndex(input)
+	}
+	if inputs, ok := plan.Lookup("inputStages").MutableArrayOK(); ok {
+		for i := 0; i < inputs.Len(); i++ {
+			v, err := inputs.Lookup(uint(i))
+			if err != nil {
+				continue
+			}
+			if input, ok := v.MutableDocumentOK(); ok {
+				return planIndex(input)
+			}
+		}
+	}
+	stage, _ := plan.Lookup("stage").StringValueOK()
+	return stage
+}
+
+// explainFind explains the Find which findPage would run for the findQuery.
+func (db *DB) explainFind(q *findQuery) (*Explanation, error) {
+	filter, page, proj := q.filter, q.page, q.proj
+	if page != nil && len(q.computed) > 0 {
+		return db.explainAggregate(q)
+	}
+	timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	explanation := &Explanation{
+		Collection: db.collection.Name,
+	}
+
+	total, err := db.collection.Collection().CountDocuments(ctx, filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error counting documents - explainFind")
+		log.Println(err)
+		return nil, err
+	}
+	explanation.EstimatedCount = total
+
+	findFilter := filter
+	if page != nil {
+		findFilter, err = page.pageFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		proj = page.pageProjection(proj)
+	}
+	findFilterDoc, err := mgo.TransformDocument(findFilter)
+	if err != nil {
+		err = errors.Wrap(err, "Error transforming filter - explainFind")
+		return nil, err
+	}
+	explanation.Filter, err = extJSON(findFilter)
+	if err != nil {
+		err = errors.Wrap(err, "Error converting filter - explainFind")
+		return nil, err
+	}
+
+	find := bson.NewDocument(
+		bson.EC.String("find", db.collection.Name),
+		bson.EC.SubDocument("filter", findFilterDoc),
+	)
+	if proj != nil {
+		projDoc, err := mgo.TransformDocument(proj)
+		if err != nil {
+			err = errors.Wrap(err, "Error transforming projection - explainFind")
+			return nil, err
+		}
+		find.Append(bson.EC.SubDocument("projection", projDoc))
+		explanation.Projection, err = extJSON(proj)
+		if err != nil {
+			err = errors.Wrap(err, "Error converting projection - explainFind")
+			return nil, err
+		}
+	}
+	if page != nil {
+		explanation.Sort = append(page.sortFields(), SortField{Field: "_id"})
+		// One extra document tells if there is a next page
+		explanation.Limit = page.size() + 1
+		find.Append(
+			bson.EC.SubDocument("sort", page.sortDocument()),
+			bson.EC.Int64("limit", explanation.Limit),
+		)
+	}
+
+	plan, err := db.explainPlan(ctx, find)
+	if err != nil {
+		err = errors.Wrap(err, "Error explaining find - explainFind")
+		return nil, err
+	}
+	explanation.Index = planIndex(plan)
+	planJSON, err := plan.ToExtJSONErr(false)
+	if err != nil {
+		err = errors.Wrap(err, "Error converting winning plan - explainFind")
+		return nil, err
+	}
+	explanation.WinningPlan = json.RawMessage(planJSON)
+
+	return explanation, nil
+}
+
+// explainPlan returns the winning query-plan of the command.
+func (db *DB) explainPlan(ctx context.Context, command *bson.Document) (*bson.Document, error) {
+	cmd := bson.NewDocument(
+		bson.EC.SubDocument("explain", command),
+		bson.EC.String("verbosity", "queryPlanner"),
+	)
+	database := db.collection.Connection.Client.Database(db.collection.Database)
+	result, err := database.RunCommand(ctx, cmd)
+	if err != nil {
+		err = errors.Wrap(err, "Error running explain - explainPlan")
+		log.Println(err)
+		return nil, err
+	}
+	resultDoc, err := bson.ReadDocument(result)
+	if err != nil {
+		err = errors.Wrap(err, "Error reading explain result - explainPlan")
+		return nil, err
+	}
+
+	plan, ok := resultDoc.Lookup("queryPlanner", "winningPlan").MutableDocumentOK()
+	if ok {
+		return plan, nil
+	}
+	// The plan of an aggregation is in its first stage, unless the
+	// whole pipeline is run by the query-planner
+	stages, ok := resultDoc.Lookup("stages").MutableArrayOK()
+	if ok && stages.Len() > 0 {
+		stage, err := stages.Lookup(0)
+		if err == nil {
+			if stageDoc, ok := stage.MutableDocumentOK(); ok {
+				plan, ok = stageDoc.Lookup("$cursor", "queryPlanner", "winningPlan").MutableDocumentOK()
+				if ok {
+					return plan, nil
+				}
+			}
+		}
+	}
+	return nil, errors.New("Explain result has no winning plan - explainPlan")
+}
+
+// explainAggregate explains the aggregation which findPage would run for
+// the findQuery with computed sort-fields (see aggregatePage).
+func (db *DB) explainAggregate(q *findQuery) (*Explanation, error) {
+	timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	explanation := &Explanation{
+		Collection: db.collection.Name,
+	}
+
+	total, err := db.collection.Collection().CountDocuments(ctx, q.filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error counting documents - explainAggregate")
+		log.Println(err)
+		return nil, err
+	}
+	explanation.EstimatedCount = total
+
+	explanation.Filter, err = extJSON(q.filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error converting filter - explainAggregate")
+		return nil, err
+	}
+	page := q.computedPage()
+	explanation.Sort = append(page.sortFields(), SortField{Field: "_id"})
+	explanation.Limit = page.size() + 1
+
+	pipeline, err := q.pipeline()
+	if err != nil {
+		return nil, err
+	}
+	pipelineArr := bson.NewArray()
+	for _, stage := range pipeline {
+		stageDoc, err := mgo.TransformDocument(stage)
+		if err != nil {
+			err = errors.Wrap(err, "Error transforming pipeline - explainAggregate")
+			return nil, err
+		}
+		pipelineArr.Append(bson.VC.Document(stageDoc))
+	}
+	pipelineJSON, err := bson.NewDocument(
+		bson.EC.Array("pipeline", pipelineArr),
+	).ToExtJSONErr(false)
+	if err != nil {
+		err = errors.Wrap(err, "Error converting pipeline - explainAggregate")
+		return nil, err
+	}
+	wrapped := struct {
+		Pipeline json.RawMessage `json:"pipeline"`
+	}{}
+	err = json.Unmarshal([]byte(pipelineJSON), &wrapped)
+	if err != nil {
+		err = errors.Wrap(err, "Error converting pipeline - explainAggregate")
+		return nil, err
+	}
+	explanation.Pipeline = wrapped.Pipeline
+
+	plan, err := db.explainPlan(ctx, bson.NewDocument(
+		bson.EC.String("aggregate", db.collection.Name),
+		bson.EC.Array("pipeline", pipelineArr),
+		bson.EC.SubDocument("cursor", bson.NewDocument()),
+	))
+	if err != nil {
+		err = errors.Wrap(err, "Error explaining aggregation - explainAggregate")
+		return nil, err
+	}
+	explanation.Index = planIndex(plan)
+	planJSON, err := plan.ToExtJSONErr(false)
+	if err != nil {
+		err = errors.Wrap(err, "Error converting winning plan - explainAggregate")
+		return nil, err
+	}
+	explanation.WinningPlan = json.RawMessage(planJSON)
+
+	return explanation, nil
+}
+
+// InvExplain explains the search which InvAdvSearch would run.
+func (db *DB) InvExplain(search *SearchQuery) (*Explanation, error) {
+	q, err := db.invFindQuery(search)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling inventory query - InvExplain")
+		log.Println(err)
+		return nil, err
+	}
+
+	explanation, err := db.explainFind(q)
+	if err != nil {
+		err = errors.Wrap(err, "Error explaining inventory search - InvExplain")
+		return nil, err
+	}
+	explanation.RankedByScore = search != nil && search.Text != nil
+	return explanation, nil
+}
+
+// MetExplain explains the search which MetAdvSearch would run.
+func (db *DB) MetExplain(searchInv []Inventory, search *SearchQuery, cal *Calibrator) (*Explanation, error) {
+	q, err := metFindQuery(searchInv, search, cal)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling metric query - MetExplain")
+		log.Println(err)
+		return nil, err
+	}
+
+	explanation, err := db.explainFind(q)
+	if err != nil {
+		err = errors.Wrap(err, "Error explaining metric search - MetExplain")
+		return nil, err
+	}
+	return explanation, nil
+}
+
+// DevExplain explains the search which DevAdvSearch would run.
+func (db *DB) DevExplain(searchInv []Inventory, search *SearchQuery) (*Explanation, error) {
+	q, err := devFindQuery(searchInv, search)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling device query - DevExplain")
+		log.Println(err)
+		return nil, err
+	}
+
+	explanation, err := db.explainFind(q)
+	if err != nil {
+		err = errors.Wrap(err, "Error explaining device search - DevExplain")
+		return nil, err
+	}
+	return explanation, nil
+}
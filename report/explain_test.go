@@ -0,0 +1,133 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+)
+
+func TestFindQueries(t *testing.T) {
+	itemID, _ := uuuid.FromString("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+	deviceID, _ := uuuid.FromString("6ba7b812-9dad-11d1-80b4-00c04fd430c8")
+	inventory := []Inventory{{ItemID: itemID, DeviceID: deviceID}}
+
+	page := &PageParams{Size: 10}
+	search := &SearchQuery{
+		Inventory: &QueryNode{SearchParam: SearchParam{Field: "name", Type: "string", Op: OpEqual, Value: "Mango"}},
+		Metric:    &QueryNode{SearchParam: SearchParam{Field: "humidity", Type: "float", Op: OpGreater, Value: 80.0}},
+		Device:    &QueryNode{SearchParam: SearchParam{Field: "status", Type: "string", Op: OpEqual, Value: "ok"}},
+		Page:      page,
+		Fields: &FieldSet{
+			Inventory: []string{"name"},
+			Metric:    []string{"humidity"},
+			Device:    []string{"status"},
+		},
+	}
+
+	invQuery, err := (&DB{}).invFindQuery(search)
+	if err != nil {
+		t.Fatalf("invFindQuery: %v", err)
+	}
+	metQuery, err := metFindQuery(inventory, search, nil)
+	if err != nil {
+		t.Fatalf("metFindQuery: %v", err)
+	}
+	devQuery, err := devFindQuery(inventory, search)
+	if err != nil {
+		t.Fatalf("devFindQuery: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  *findQuery
+		want *findQuery
+	}{
+		{
+			name: "inventory",
+			got:  invQuery,
+			want: &findQuery{
+				filter: map[string]interface{}{"name": map[string]interface{}{"$eq": "Mango"}},
+				page:   page,
+				proj:   map[string]interface{}{"name": 1, "item_id": 1, "device_id": 1},
+			},
+		},
+		{
+			name: "metric",
+			got:  metQuery,
+			want: &findQuery{
+				filter: map[string]interface{}{
+					"$and": []interface{}{
+						map[string]interface{}{"item_id": map[string]interface{}{"$in": []interface{}{itemID.String()}}},
+						map[string]interface{}{"humidity": map[string]interface{}{"$gt": 80.0}},
+					},
+				},
+				page: page,
+				proj: map[string]interface{}{"humidity": 1, "device_id": 1, "timestamp": 1},
+			},
+		},
+		{
+			name: "device",
+			got:  devQuery,
+			want: &findQuery{
+				filter: map[string]interface{}{
+					"$and": []interface{}{
+						map[string]interface{}{"device_id": map[string]interface{}{"$in": []interface{}{deviceID.String()}}},
+						map[string]interface{}{"status": map[string]interface{}{"$eq": "ok"}},
+					},
+				},
+				page: page,
+				proj: map[string]interface{}{"status": 1},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *test.got, *test.want)
+		}
+	}
+}
+
+func TestPlanIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		plan *bson.Document
+		want string
+	}{
+		{
+			name: "collection scan",
+			plan: bson.NewDocument(bson.EC.String("stage", "COLLSCAN")),
+			want: "COLLSCAN",
+		},
+		{
+			name: "index of the input stage",
+			plan: bson.NewDocument(
+				bson.EC.String("stage", "FETCH"),
+				bson.EC.SubDocumentFromElements("inputStage",
+					bson.EC.String("stage", "IXSCAN"),
+					bson.EC.String("indexName", "item_id_1"),
+				),
+			),
+			want: "item_id_1",
+		},
+		{
+			name: "index of the first input stage",
+			plan: bson.NewDocument(
+				bson.EC.String("stage", "OR"),
+				bson.EC.ArrayFromElements("inputStages",
+					bson.VC.DocumentFromElements(bson.EC.String("indexName", "timestamp_1")),
+					bson.VC.DocumentFromElements(bson.EC.String("indexName", "device_id_1")),
+				),
+			),
+			want: "timestamp_1",
+		},
+	}
+
+	for _, test := range tests {
+		if got := planIndex(test.plan); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
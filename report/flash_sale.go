@@ -0,0 +1,669 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+	"github.com/pkg/errors"
+)
+
+// The lifecycle of a FlashSale: proposed -> active -> ended.
+const (
+	FlashSaleProposed = "proposed"
+	FlashSaleActive   = "active"
+	FlashSaleEnded    = "ended"
+)
+
+// DefaultFlashSaleHorizon is how far ahead flash sales are proposed for
+// expiring items.
+const DefaultFlashSaleHorizon = "72h"
+
+// DefaultMaxDiscountPct caps the proposed discounts.
+const DefaultMaxDiscountPct = 50
+
+// FlashSaleEthyleneReadings is the number of latest readings of a device
+// averaged into the recent ethylene of its items.
+const FlashSaleEthyleneReadings = 12
+
+// flashSalePeerWindow is how close (in seconds) the ExpiryDate of an item
+// must be to that of a discounted item to be compared with it.
+const flashSalePeerWindow = 2 * 24 * 60 * 60
+
+// flashSaleDiscounts are the discounts by the days left until expiry.
+// The first whose maxDays is at least the days left applies.
+var flashSaleDiscounts = []struct {
+	maxDays     float64
+	discountPct float64
+}{
+	{maxDays: 1, discountPct: 40},
+	{maxDays: 2, discountPct: 30},
+	{maxDays: 3, discountPct: 20},
+	{maxDays: math.Inf(1), discountPct: 10},
+}
+
+// flashSaleEthyleneDiscount is added to the discount of items whose recent
+// ethylene is above the maximum of their product, since they ripen faster.
+const flashSaleEthyleneDiscount = 10
+
+// FlashSaleParams selects the items expiring within the Horizon (a duration
+// such as "72h" or "daily") for flash sales, and caps their discount at
+// MaxDiscountPct (DefaultMaxDiscountPct if zero).
+type FlashSaleParams struct {
+	Horizon        string  `json:"horizon,omitempty"`
+	MaxDiscountPct float64 `json:"max_discount_pct,omitempty"`
+}
+
+// FlashSaleQuery is the request-body of the flash-sale proposals.
+type FlashSaleQuery struct {
+	SearchQuery
+	FlashSale *FlashSaleParams `json:"flash_sale,omitempty"`
+}
+
+// Validate checks the SearchQuery and the FlashSaleParams.
+// Returns nil if the FlashSaleQuery is valid.
+func (q *FlashSaleQuery) Validate() ValidationErrors {
+	verrs := q.SearchQuery.Validate()
+	if q.FlashSale != nil {
+		verrs = append(verrs, q.FlashSale.validate("flash_sale")...)
+	}
+	return verrs
+}
+
+// HorizonSeconds returns the length of the horizon.
+func (p *FlashSaleParams) HorizonSeconds() (int64, error) {
+	if p == nil || p.Horizon == "" {
+		return parseInterval(DefaultFlashSaleHorizon)
+	}
+	return parseInterval(p.Horizon)
+}
+
+func (p *FlashSaleParams) maxDiscountPct() float64 {
+	if p == nil || p.MaxDiscountPct == 0 {
+		return DefaultMaxDiscountPct
+	}
+	return p.MaxDiscountPct
+}
+
+// validate returns the problems with the FlashSaleParams.
+func (p *FlashSaleParams) validate(path string) ValidationErrors {
+	verrs := ValidationErrors{}
+	if _, err := p.HorizonSeconds(); err != nil {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".horizon",
+			Message: err.Error(),
+		})
+	}
+	if p.MaxDiscountPct < 0 || p.MaxDiscountPct > 100 {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".max_discount_pct",
+			Message: "max_discount_pct must be from 0 to 100",
+		})
+	}
+	return verrs
+}
+
+// FlashSaleUplift compares the sales and waste of a discounted item with
+// its Peers, the items of the same product and customer expiring around
+// the same time which were not discounted. The percentages are of the
+// TotalWeight, pooled over the peers. SoldUplift and WasteReduction are in
+// percentage points, and are zero if there are no peers.
+type FlashSaleUplift struct {
+	Peers          int64   `bson:"peers" json:"peers"`
+	SoldPct        float64 `bson:"sold_pct" json:"sold_pct"`
+	WastePct       float64 `bson:"waste_pct" json:"waste_pct"`
+	PeerSoldPct    float64 `bson:"peer_sold_pct" json:"peer_sold_pct"`
+	PeerWastePct   float64 `bson:"peer_waste_pct" json:"peer_waste_pct"`
+	SoldUplift     float64 `bson:"sold_uplift" json:"sold_uplift"`
+	WasteReduction float64 `bson:"waste_reduction" json:"waste_reduction"`
+	MeasuredAt     int64   `bson:"measured_at" json:"measured_at"`
+}
+
+// FlashSale is a markdown of an inventory-item. BasePrice is the price
+// before the sale (the SalePrice of the item, or its Price), and
+// FlashPrice is the BasePrice discounted by DiscountPct.
+// DaysToExpiry and Ethylene (the recent average, in ppm) are as of the
+// proposal. The Uplift is measured when the sale ends.
+type FlashSale struct {
+	ID           objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	SaleID       uuuid.UUID        `bson:"sale_id,omitempty" json:"sale_id,omitempty"`
+	ItemID       uuuid.UUID        `bson:"item_id,omitempty" json:"item_id,omitempty"`
+	DeviceID     uuuid.UUID        `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	RsCustomerID uuuid.UUID        `bson:"rs_customer_id,omitempty" json:"rs_customer_id,omitempty"`
+	Name         string            `bson:"name,omitempty" json:"name,omitempty"`
+	Origin       string            `bson:"origin,omitempty" json:"origin,omitempty"`
+	Lot          string            `bson:"lot,omitempty" json:"lot,omitempty"`
+	Status       string            `bson:"status,omitempty" json:"status,omitempty"`
+	BasePrice    float64           `bson:"base_price" json:"base_price"`
+	FlashPrice   float64           `bson:"flash_price" json:"flash_price"`
+	DiscountPct  float64           `bson:"discount_pct" json:"discount_pct"`
+	ExpiryDate   int64             `bson:"expiry_date,omitempty" json:"expiry_date,omitempty"`
+	DaysToExpiry float64           `bson:"days_to_expiry" json:"days_to_expiry"`
+	Ethylene     float64           `bson:"ethylene,omitempty" json:"ethylene,omitempty"`
+	Reason       string            `bson:"reason,omitempty" json:"reason,omitempty"`
+	ProposedAt   int64             `bson:"proposed_at,omitempty" json:"proposed_at,omitempty"`
+	StartedAt    int64             `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	EndedAt      int64             `bson:"ended_at,omitempty" json:"ended_at,omitempty"`
+	Uplift       *FlashSaleUplift  `bson:"uplift,omitempty" json:"uplift,omitempty"`
+}
+
+type marshalFlashSale struct {
+	ID           objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	SaleID       string            `bson:"sale_id,omitempty" json:"sale_id,omitempty"`
+	ItemID       string            `bson:"item_id,omitempty" json:"item_id,omitempty"`
+	DeviceID     string            `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	RsCustomerID string            `bson:"rs_customer_id,omitempty" json:"rs_customer_id,omitempty"`
+	Name         string            `bson:"name,omitempty" json:"name,omitempty"`
+	Origin       string            `bson:"origin,omitempty" json:"origin,omitempty"`
+	Lot          string            `bson:"lot,omitempty" json:"lot,omitempty"`
+	Status       string            `bson:"status,omitempty" json:"status,omitempty"`
+	BasePrice    float64           `bson:"base_price" json:"base_price"`
+	FlashPrice   float64           `bson:"flash_price" json:"flash_price"`
+	DiscountPct  float64           `bson:"discount_pct" json:"discount_pct"`
+	ExpiryDate   int64             `bson:"expiry_date,omitempty" json:"expiry_date,omitempty"`
+	DaysToExpiry float64           `bson:"days_to_expiry" json:"days_to_expiry"`
+	Ethylene     float64           `bson:"ethylene,omitempty" json:"ethylene,omitempty"`
+	Reason       string            `bson:"reason,omitempty" json:"reason,omitempty"`
+	ProposedAt   int64             `bson:"proposed_at,omitempty" json:"proposed_at,omitempty"`
+	StartedAt    int64             `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	EndedAt      int64             `bson:"ended_at,omitempty" json:"ended_at,omitempty"`
+	Uplift       *FlashSaleUplift  `bson:"uplift,omitempty" json:"uplift,omitempty"`
+}
+
+func (s FlashSale) toMarshal() *marshalFlashSale {
+	ms := &marshalFlashSale{
+		ID:           s.ID,
+		Name:         s.Name,
+		Origin:       s.Origin,
+		Lot:          s.Lot,
+		Status:       s.Status,
+		BasePrice:    s.BasePrice,
+		FlashPrice:   s.FlashPrice,
+		DiscountPct:  s.DiscountPct,
+		ExpiryDate:   s.ExpiryDate,
+		DaysToExpiry: s.DaysToExpiry,
+		Ethylene:     s.Ethylene,
+		Reason:       s.Reason,
+		ProposedAt:   s.ProposedAt,
+		StartedAt:    s.StartedAt,
+		EndedAt:      s.EndedAt,
+		Uplift:       s.Uplift,
+	}
+	if s.SaleID.String() != (uuuid.UUID{}).String() {
+		ms.SaleID = s.SaleID.String()
+	}
+	if s.ItemID.String() != (uuuid.UUID{}).String() {
+		ms.ItemID = s.ItemID.String()
+	}
+	if s.DeviceID.String() != (uuuid.UUID{}).String() {
+		ms.DeviceID = s.DeviceID.String()
+	}
+	if s.RsCustomerID.String() != (uuuid.UUID{}).String() {
+		ms.RsCustomerID = s.RsCustomerID.String()
+	}
+	return ms
+}
+
+func (s FlashSale) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(s.toMarshal())
+}
+
+func (s FlashSale) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.toMarshal())
+}
+
+func (s *FlashSale) fromMarshal(ms *marshalFlashSale) error {
+	s.ID = ms.ID
+	s.Name = ms.Name
+	s.Origin = ms.Origin
+	s.Lot = ms.Lot
+	s.Status = ms.Status
+	s.BasePrice = ms.BasePrice
+	s.FlashPrice = ms.FlashPrice
+	s.DiscountPct = ms.DiscountPct
+	s.ExpiryDate = ms.ExpiryDate
+	s.DaysToExpiry = ms.DaysToExpiry
+	s.Ethylene = ms.Ethylene
+	s.Reason = ms.Reason
+	s.ProposedAt = ms.ProposedAt
+	s.StartedAt = ms.StartedAt
+	s.EndedAt = ms.EndedAt
+	s.Uplift = ms.Uplift
+
+	var err error
+	if ms.SaleID != "" {
+		s.SaleID, err = uuuid.FromString(ms.SaleID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing SaleID for FlashSale")
+			return err
+		}
+	}
+	if ms.ItemID != "" {
+		s.ItemID, err = uuuid.FromString(ms.ItemID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing ItemID for FlashSale")
+			return err
+		}
+	}
+	if ms.DeviceID != "" {
+		s.DeviceID, err = uuuid.FromString(ms.DeviceID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing DeviceID for FlashSale")
+			return err
+		}
+	}
+	if ms.RsCustomerID != "" {
+		s.RsCustomerID, err = uuuid.FromString(ms.RsCustomerID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing RsCustomerID for FlashSale")
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FlashSale) UnmarshalBSON(in []byte) error {
+	ms := &marshalFlashSale{}
+	err := bson.Unmarshal(in, ms)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+	return s.fromMarshal(ms)
+}
+
+func (s *FlashSale) UnmarshalJSON(in []byte) error {
+	ms := &marshalFlashSale{}
+	err := json.Unmarshal(in, ms)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+	return s.fromMarshal(ms)
+}
+
+// ValidateFlashSaleTransition returns an error if a FlashSale cannot move
+// from its status into the next status. Ending an ended sale measures its
+// uplift again, such as after late waste was recorded.
+func ValidateFlashSaleTransition(from string, to string) error {
+	switch {
+	case from == FlashSaleProposed && to == FlashSaleActive:
+	case from == FlashSaleActive && to == FlashSaleEnded:
+	case from == FlashSaleEnded && to == FlashSaleEnded:
+	default:
+		return errors.Errorf(
+			"Invalid status %s for a %s flash sale, expected %s -> %s -> %s",
+			to, from, FlashSaleProposed, FlashSaleActive, FlashSaleEnded,
+		)
+	}
+	return nil
+}
+
+// RecentEthylene returns the average ethylene of the metrics, skipping
+// missing readings, and false if there are none.
+func RecentEthylene(metrics []Metric) (float64, bool) {
+	sum := 0.0
+	count := 0
+	for _, m := range metrics {
+		ethylene, ok := m.Reading("ethylene")
+		if !ok {
+			continue
+		}
+		sum += ethylene
+		count++
+	}
+	if count == 0 {
+		return 0, false
+	}
+	return sum / float64(count), true
+}
+
+// ProposeFlashSales proposes flash sales for the inventory-items which
+// expire from now until the horizon and have unsold weight, except for the
+// items in exclude (by ItemID), such as those with open flash sales.
+// The discount grows as the expiry nears, and grows further if the recent
+// ethylene (by DeviceID) of the item is above the maximum of its product.
+// The proposals are ordered by the value of their unsold weight (highest
+// first), and are not stored.
+func ProposeFlashSales(
+	inventory []Inventory,
+	ethylene map[string]float64,
+	exclude map[string]bool,
+	params *FlashSaleParams,
+	now time.Time,
+) ([]FlashSale, error) {
+	horizon, err := params.HorizonSeconds()
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid horizon - ProposeFlashSales")
+	}
+	maxDiscount := params.maxDiscountPct()
+
+	type proposal struct {
+		sale  FlashSale
+		value float64
+	}
+	proposals := []proposal{}
+	for _, inv := range inventory {
+		if exclude[inv.ItemID.String()] {
+			continue
+		}
+		if inv.ExpiryDate < now.Unix() || inv.ExpiryDate > now.Unix()+horizon {
+			continue
+		}
+		remaining := inv.TotalWeight - inv.SoldWeight - inv.WasteWeight - inv.DonateWeight
+		basePrice := inv.SalePrice
+		if basePrice <= 0 {
+			basePrice = inv.Price
+		}
+		if remaining <= 0 || basePrice <= 0 {
+			continue
+		}
+
+		days := float64(inv.ExpiryDate-now.Unix()) / 86400
+		discount := 0.0
+		for _, d := range flashSaleDiscounts {
+			if days <= d.maxDays {
+				discount = d.discountPct
+				break
+			}
+		}
+		reason := fmt.Sprintf("%.1f days to expiry", days)
+
+		eth, hasEthylene := ethylene[inv.DeviceID.String()]
+		if hasEthylene {
+			if t, ok := ThresholdsFor(inv.Name); ok && t.Ethylene.Max > 0 && eth > t.Ethylene.Max {
+				discount += flashSaleEthyleneDiscount
+				reason += fmt.Sprintf(
+					", ethylene %.1f ppm above the maximum of %.1f ppm", eth, t.Ethylene.Max,
+				)
+			}
+		}
+		discount = math.Min(discount, maxDiscount)
+
+		proposals = append(proposals, proposal{
+			sale: FlashSale{
+				ItemID:       inv.ItemID,
+				DeviceID:     inv.DeviceID,
+				RsCustomerID: inv.RsCustomerID,
+				Name:         inv.Name,
+				Origin:       inv.Origin,
+				Lot:          inv.Lot,
+				Status:       FlashSaleProposed,
+				BasePrice:    basePrice,
+				FlashPrice:   math.Round(basePrice*(100-discount)) / 100,
+				DiscountPct:  discount,
+				ExpiryDate:   inv.ExpiryDate,
+				DaysToExpiry: math.Round(days*100) / 100,
+				Ethylene:     math.Round(eth*100) / 100,
+				Reason:       reason,
+			},
+			value: basePrice * remaining,
+		})
+	}
+
+	sort.SliceStable(proposals, func(i, j int) bool {
+		return proposals[i].value > proposals[j].value
+	})
+	sales := make([]FlashSale, len(proposals))
+	for i, p := range proposals {
+		sales[i] = p.sale
+	}
+	return sales, nil
+}
+
+// weightPcts returns the sold and wasted weight of the items as
+// percentages of their total weight.
+func weightPcts(items []Inventory) (float64, float64) {
+	total, sold, waste := 0.0, 0.0, 0.0
+	for _, inv := range items {
+		total += inv.TotalWeight
+		sold += inv.SoldWeight
+		waste += inv.WasteWeight
+	}
+	if total <= 0 {
+		return 0, 0
+	}
+	return math.Round(sold/total*10000) / 100, math.Round(waste/total*10000) / 100
+}
+
+// MeasureUplift compares the discounted item with its undiscounted peers.
+func MeasureUplift(item Inventory, peers []Inventory, now time.Time) *FlashSaleUplift {
+	uplift := &FlashSaleUplift{
+		Peers:      int64(len(peers)),
+		MeasuredAt: now.Unix(),
+	}
+	uplift.SoldPct, uplift.WastePct = weightPcts([]Inventory{item})
+	if len(peers) == 0 {
+		return uplift
+	}
+	uplift.PeerSoldPct, uplift.PeerWastePct = weightPcts(peers)
+	uplift.SoldUplift = math.Round((uplift.SoldPct-uplift.PeerSoldPct)*100) / 100
+	uplift.WasteReduction = math.Round((uplift.PeerWastePct-uplift.WastePct)*100) / 100
+	return uplift
+}
+
+// InsertFlashSales stores the proposed flash sales, and generates their
+// SaleIDs. Each sale is only inserted if its item has no proposed or active
+// flash sale, including one proposed since the open sales were read.
+// Returns the inserted sales.
+func (db *DB) InsertFlashSales(sales []FlashSale) ([]FlashSale, error) {
+	now := time.Now().Unix()
+	inserted := []FlashSale{}
+	for i := range sales {
+		saleID, err := uuuid.NewV4()
+		if err != nil {
+			err = errors.Wrap(err, "Unable to generate SaleID - InsertFlashSales")
+			log.Println(err)
+			return nil, err
+		}
+		sales[i].ID = objectid.New()
+		sales[i].SaleID = saleID
+		sales[i].Status = FlashSaleProposed
+		sales[i].ProposedAt = now
+
+		isInserted, err := db.insertOpenFlashSale(sales[i])
+		if err != nil {
+			err = errors.Wrap(err, "Unable to insert FlashSale - InsertFlashSales")
+			log.Println(err)
+			return nil, err
+		}
+		if isInserted {
+			inserted = append(inserted, sales[i])
+		}
+	}
+	return inserted, nil
+}
+
+// insertOpenFlashSale upserts the sale on the proposed or active sale of
+// its item, which is only inserted if there is none. Returns false if the
+// item already has an open sale.
+func (db *DB) insertOpenFlashSale(sale FlashSale) (bool, error) {
+	marshaled, err := sale.MarshalBSON()
+	if err != nil {
+		return false, err
+	}
+	doc, err := bson.ReadDocument(marshaled)
+	if err != nil {
+		return false, err
+	}
+	filter := map[string]interface{}{
+		"item_id": sale.ItemID.String(),
+		"status": map[string]interface{}{
+			"$in": []interface{}{FlashSaleProposed, FlashSaleActive},
+		},
+	}
+
+	timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	updateResult, err := db.collection.Collection().UpdateOne(
+		ctx,
+		filter,
+		map[string]interface{}{
+			"$setOnInsert": doc,
+		},
+		updateopt.Upsert(true),
+	)
+	if err != nil {
+		return false, err
+	}
+	return updateResult.UpsertedID != nil, nil
+}
+
+// FlashSales returns the flash sales with the status (of any status if
+// empty), of the items (of all items if itemIDs is nil), by the latest
+// proposal first.
+func (db *DB) FlashSales(status string, itemIDs []string) ([]FlashSale, error) {
+	filter := map[string]interface{}{}
+	if status != "" {
+		filter["status"] = status
+	}
+	if itemIDs != nil {
+		filter["item_id"] = map[string]interface{}{
+			"$in": itemIDs,
+		}
+	}
+
+	findResults, err := db.collection.Find(filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching FlashSales - FlashSales")
+		log.Println(err)
+		return nil, err
+	}
+
+	sales := []FlashSale{}
+	for _, v := range findResults {
+		sales = append(sales, *v.(*FlashSale))
+	}
+	sort.SliceStable(sales, func(i, j int) bool {
+		return sales[i].ProposedAt > sales[j].ProposedAt
+	})
+	return sales, nil
+}
+
+// FlashSaleByID returns the flash sale with the SaleID.
+func (db *DB) FlashSaleByID(saleID uuuid.UUID) (*FlashSale, error) {
+	findResults, err := db.collection.Find(map[string]interface{}{
+		"sale_id": saleID.String(),
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching FlashSale - FlashSaleByID")
+		log.Println(err)
+		return nil, err
+	}
+	if len(findResults) == 0 {
+		return nil, errors.Errorf("No flash sale found with sale_id %s - FlashSaleByID", saleID)
+	}
+	return findResults[0].(*FlashSale), nil
+}
+
+// UpdateFlashSale stores the Status, StartedAt, EndedAt and Uplift of the
+// flash sale, if it still has the status "from". This keeps concurrent
+// updates from skipping a step of the lifecycle.
+func (db *DB) UpdateFlashSale(sale *FlashSale, from string) error {
+	update := map[string]interface{}{
+		"status":     sale.Status,
+		"started_at": sale.StartedAt,
+		"ended_at":   sale.EndedAt,
+	}
+	if sale.Uplift != nil {
+		update["uplift"] = sale.Uplift
+	}
+
+	updateResult, err := db.collection.UpdateMany(
+		map[string]interface{}{
+			"sale_id": sale.SaleID.String(),
+			"status":  from,
+		},
+		update,
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to update FlashSale - UpdateFlashSale")
+		log.Println(err)
+		return err
+	}
+	if updateResult.MatchedCount == 0 {
+		return errors.Errorf("No %s flash sale found - UpdateFlashSale", from)
+	}
+	return nil
+}
+
+// DeleteFlashSale deletes the proposed flash sale, such as a rejected
+// proposal. Active and ended sales are kept.
+func (db *DB) DeleteFlashSale(saleID uuuid.UUID) error {
+	deleteResult, err := db.collection.DeleteMany(map[string]interface{}{
+		"sale_id": saleID.String(),
+		"status":  FlashSaleProposed,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Unable to delete FlashSale - DeleteFlashSale")
+		log.Println(err)
+		return err
+	}
+	if deleteResult.DeletedCount == 0 {
+		return errors.New("No proposed flash sale found - DeleteFlashSale")
+	}
+	return nil
+}
+
+// InventoryByIDs returns the inventory-items with the ItemIDs.
+func (db *DB) InventoryByIDs(itemIDs []string) ([]Inventory, error) {
+	findResults, err := db.collection.Find(map[string]interface{}{
+		"item_id": map[string]interface{}{
+			"$in": itemIDs,
+		},
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching inventory - InventoryByIDs")
+		log.Println(err)
+		return nil, err
+	}
+
+	inventory := []Inventory{}
+	for _, v := range findResults {
+		inventory = append(inventory, *v.(*Inventory))
+	}
+	return inventory, nil
+}
+
+// FlashSalePeers returns the items of the same product and customer as the
+// item, which expire within two days of it, except for the item and the
+// items in exclude (by ItemID), such as discounted items.
+func (db *DB) FlashSalePeers(item Inventory, exclude []string) ([]Inventory, error) {
+	excludeIDs := append([]string{item.ItemID.String()}, exclude...)
+	filter := map[string]interface{}{
+		"name": item.Name,
+		"item_id": map[string]interface{}{
+			"$nin": excludeIDs,
+		},
+		"expiry_date": map[string]interface{}{
+			"$gte": item.ExpiryDate - flashSalePeerWindow,
+			"$lte": item.ExpiryDate + flashSalePeerWindow,
+		},
+	}
+	if item.RsCustomerID.String() != (uuuid.UUID{}).String() {
+		filter["rs_customer_id"] = item.RsCustomerID.String()
+	}
+
+	findResults, err := db.collection.Find(filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching inventory - FlashSalePeers")
+		log.Println(err)
+		return nil, err
+	}
+
+	peers := []Inventory{}
+	for _, v := range findResults {
+		peers = append(peers, *v.(*Inventory))
+	}
+	return peers, nil
+}
@@ -0,0 +1,179 @@
+package report
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+)
+
+func TestProposeFlashSales(t *testing.T) {
+	now := time.Unix(1539820800, 0)
+	const day = 86400
+	device, _ := uuuid.FromString("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+
+	// item expires in the days, with 5 of its 10 kilograms unsold at the price
+	item := func(lot string, days float64, price float64) Inventory {
+		itemID, _ := uuuid.NewV4()
+		return Inventory{
+			ItemID:      itemID,
+			DeviceID:    device,
+			Name:        "Banana",
+			Lot:         lot,
+			ExpiryDate:  now.Unix() + int64(days*day),
+			TotalWeight: 10,
+			SoldWeight:  5,
+			Price:       price,
+		}
+	}
+	soon, later := item("soon", 0.5, 2), item("later", 2.5, 4)
+	soldOut := item("sold out", 1, 2)
+	soldOut.SoldWeight = 10
+	onSale := item("on sale", 1.5, 2)
+	onSale.SalePrice = 1
+
+	tests := []struct {
+		name      string
+		inventory []Inventory
+		ethylene  map[string]float64
+		exclude   map[string]bool
+		params    *FlashSaleParams
+		// want are the lots of the proposals in order, with their discounts
+		want      []string
+		discounts []float64
+	}{
+		{
+			name:      "discount by days to expiry",
+			inventory: []Inventory{soon, later},
+			want:      []string{"later", "soon"},
+			discounts: []float64{20, 40},
+		},
+		{
+			name:      "ethylene above the maximum",
+			inventory: []Inventory{later},
+			ethylene:  map[string]float64{device.String(): 12},
+			want:      []string{"later"},
+			discounts: []float64{30},
+		},
+		{
+			name:      "ethylene within the maximum",
+			inventory: []Inventory{later},
+			ethylene:  map[string]float64{device.String(): 8},
+			want:      []string{"later"},
+			discounts: []float64{20},
+		},
+		{
+			name:      "capped discount",
+			inventory: []Inventory{soon},
+			ethylene:  map[string]float64{device.String(): 12},
+			params:    &FlashSaleParams{MaxDiscountPct: 25},
+			want:      []string{"soon"},
+			discounts: []float64{25},
+		},
+		{
+			name:      "outside the horizon",
+			inventory: []Inventory{soon, later},
+			params:    &FlashSaleParams{Horizon: "24h"},
+			want:      []string{"soon"},
+			discounts: []float64{40},
+		},
+		{
+			name:      "excluded and sold out",
+			inventory: []Inventory{soon, later, soldOut},
+			exclude:   map[string]bool{later.ItemID.String(): true},
+			want:      []string{"soon"},
+			discounts: []float64{40},
+		},
+		{
+			name:      "sale price",
+			inventory: []Inventory{onSale, soon},
+			want:      []string{"soon", "on sale"},
+			discounts: []float64{40, 30},
+		},
+	}
+
+	for _, test := range tests {
+		sales, err := ProposeFlashSales(test.inventory, test.ethylene, test.exclude, test.params, now)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		got, discounts := []string{}, []float64{}
+		for _, s := range sales {
+			got = append(got, s.Lot)
+			discounts = append(discounts, s.DiscountPct)
+			wantPrice := math.Round(s.BasePrice*(100-s.DiscountPct)) / 100
+			if s.Status != FlashSaleProposed || s.FlashPrice != wantPrice {
+				t.Errorf("%s: got %s sale at %v, want proposed at %v", test.name, s.Status, s.FlashPrice, wantPrice)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) || !reflect.DeepEqual(discounts, test.discounts) {
+			t.Errorf("%s: got %v with discounts %v, want %v with %v", test.name, got, discounts, test.want, test.discounts)
+		}
+	}
+
+	_, err := ProposeFlashSales(nil, nil, nil, &FlashSaleParams{Horizon: "x"}, now)
+	if err == nil {
+		t.Errorf("got no error for an invalid horizon")
+	}
+}
+
+func TestValidateFlashSaleTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		wantErr  bool
+	}{
+		{FlashSaleProposed, FlashSaleActive, false},
+		{FlashSaleActive, FlashSaleEnded, false},
+		{FlashSaleEnded, FlashSaleEnded, false},
+		{FlashSaleProposed, FlashSaleEnded, true},
+		{FlashSaleActive, FlashSaleProposed, true},
+		{FlashSaleEnded, FlashSaleActive, true},
+		{FlashSaleActive, FlashSaleActive, true},
+		{FlashSaleProposed, "x", true},
+	}
+
+	for _, test := range tests {
+		err := ValidateFlashSaleTransition(test.from, test.to)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s -> %s: got error %v, want error %t", test.from, test.to, err, test.wantErr)
+		}
+	}
+}
+
+func TestMeasureUplift(t *testing.T) {
+	now := time.Unix(1539820800, 0)
+	item := Inventory{TotalWeight: 10, SoldWeight: 8, WasteWeight: 1}
+
+	tests := []struct {
+		name  string
+		peers []Inventory
+		want  FlashSaleUplift
+	}{
+		{
+			name:  "no peers",
+			peers: nil,
+			want:  FlashSaleUplift{SoldPct: 80, WastePct: 10, MeasuredAt: now.Unix()},
+		},
+		{
+			name: "pooled peers",
+			peers: []Inventory{
+				{TotalWeight: 10, SoldWeight: 5, WasteWeight: 4},
+				{TotalWeight: 30, SoldWeight: 15, WasteWeight: 8},
+			},
+			want: FlashSaleUplift{
+				Peers: 2, SoldPct: 80, WastePct: 10, PeerSoldPct: 50, PeerWastePct: 30,
+				SoldUplift: 30, WasteReduction: 20, MeasuredAt: now.Unix(),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := MeasureUplift(item, test.peers, now)
+		if *got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, test.want)
+		}
+	}
+}
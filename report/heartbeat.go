@@ -0,0 +1,697 @@
+package report
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/pkg/errors"
+)
+
+// WarningHeartbeat is the WarningType of warnings for devices which
+// stopped sending readings.
+const WarningHeartbeat = "heartbeat"
+
+const (
+	// DefaultHeartbeatInterval is the expected interval (in seconds)
+	// of a new device, until it is estimated from its readings.
+	DefaultHeartbeatInterval = 5 * 60
+	// heartbeatTolerance is how many expected intervals a gap
+	// between readings can be before it is an outage.
+	heartbeatTolerance = 1.5
+	// heartbeatSmoothing is the weight of a new gap in the
+	// estimated interval.
+	heartbeatSmoothing = 0.2
+	// heartbeatSeedGaps is how many gaps between readings the
+	// estimated interval is seeded with, and how many regular
+	// outages move it to a new interval.
+	heartbeatSeedGaps = 5
+)
+
+// Heartbeat tracks the readings of a device. ExpectedInterval is how often
+// (in seconds) the device sends readings. It is estimated from the gaps
+// between its readings, unless it is Configured: it is the median of the
+// first gaps until it is Seeded, and then smoothed with the later gaps.
+// Gaps are the first gaps until it is Seeded, and then the latest outages.
+// WarnedAt is when a Warning was created for the latest outage.
+type Heartbeat struct {
+	ID               objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	DeviceID         uuuid.UUID        `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	LastReading      int64             `bson:"last_reading,omitempty" json:"last_reading,omitempty"`
+	ExpectedInterval int64             `bson:"expected_interval,omitempty" json:"expected_interval,omitempty"`
+	Configured       bool              `bson:"configured" json:"configured"`
+	Seeded           bool              `bson:"seeded" json:"seeded"`
+	Gaps             []int64           `bson:"gaps,omitempty" json:"gaps,omitempty"`
+	WarnedAt         int64             `bson:"warned_at,omitempty" json:"warned_at,omitempty"`
+	UpdatedAt        int64             `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+type marshalHeartbeat struct {
+	ID               objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	DeviceID         string            `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	LastReading      int64             `bson:"last_reading,omitempty" json:"last_reading,omitempty"`
+	ExpectedInterval int64             `bson:"expected_interval,omitempty" json:"expected_interval,omitempty"`
+	Configured       bool              `bson:"configured" json:"configured"`
+	Seeded           bool              `bson:"seeded" json:"seeded"`
+	Gaps             []int64           `bson:"gaps,omitempty" json:"gaps,omitempty"`
+	WarnedAt         int64             `bson:"warned_at,omitempty" json:"warned_at,omitempty"`
+	UpdatedAt        int64             `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+func (h *Heartbeat) toMarshal() *marshalHeartbeat {
+	mh := &marshalHeartbeat{
+		ID:               h.ID,
+		LastReading:      h.LastReading,
+		ExpectedInterval: h.ExpectedInterval,
+		Configured:       h.Configured,
+		Seeded:           h.Seeded,
+		Gaps:             h.Gaps,
+		WarnedAt:         h.WarnedAt,
+		UpdatedAt:        h.UpdatedAt,
+	}
+
+	if h.DeviceID.String() != (uuuid.UUID{}).String() {
+		mh.DeviceID = h.DeviceID.String()
+	}
+	return mh
+}
+
+func (h Heartbeat) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(h.toMarshal())
+}
+
+func (h Heartbeat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.toMarshal())
+}
+
+func (h *Heartbeat) UnmarshalBSON(in []byte) error {
+	mh := &marshalHeartbeat{}
+	err := bson.Unmarshal(in, mh)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+
+	h.ID = mh.ID
+	h.LastReading = mh.LastReading
+	h.ExpectedInterval = mh.ExpectedInterval
+	h.Configured = mh.Configured
+	h.Seeded = mh.Seeded
+	h.Gaps = mh.Gaps
+	h.WarnedAt = mh.WarnedAt
+	h.UpdatedAt = mh.UpdatedAt
+
+	if mh.DeviceID != "" {
+		h.DeviceID, err = uuuid.FromString(mh.DeviceID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing DeviceID for heartbeat")
+			return err
+		}
+	}
+	return nil
+}
+
+// isOutage returns true if the gap (in seconds) is too long
+// for the expected interval.
+func isOutage(gap int64, interval int64) bool {
+	return float64(gap) > float64(interval)*heartbeatTolerance
+}
+
+// observe updates the Heartbeat with the timestamps of new readings,
+// in ascending order.
+func (h *Heartbeat) observe(timestamps []int64) {
+	for _, ts := range timestamps {
+		if ts <= h.LastReading {
+			continue
+		}
+		if h.LastReading != 0 && !h.Configured {
+			h.observeGap(ts - h.LastReading)
+		}
+		h.LastReading = ts
+	}
+}
+
+// observeGap updates the estimated interval with the gap between two
+// readings. Once Seeded, outages are left out of the estimate, unless
+// heartbeatSeedGaps of them in a row are regular, such as when the device
+// was set to send readings less often. The estimate is then their median.
+func (h *Heartbeat) observeGap(gap int64) {
+	if h.Seeded && !isOutage(gap, h.ExpectedInterval) {
+		estimate := (1-heartbeatSmoothing)*float64(h.ExpectedInterval) +
+			heartbeatSmoothing*float64(gap)
+		h.ExpectedInterval = int64(math.Max(math.Round(estimate), 1))
+		h.Gaps = nil
+		return
+	}
+
+	h.Gaps = append(h.Gaps, gap)
+	median := medianGap(h.Gaps)
+	if !h.Seeded {
+		h.ExpectedInterval = median
+		if len(h.Gaps) >= heartbeatSeedGaps {
+			h.Seeded = true
+			h.Gaps = nil
+		}
+		return
+	}
+	if len(h.Gaps) < heartbeatSeedGaps {
+		return
+	}
+	for _, g := range h.Gaps {
+		if isOutage(g, median) || isOutage(median, g) {
+			// Not regular, so the oldest outage is dropped
+			h.Gaps = h.Gaps[1:]
+			return
+		}
+	}
+	h.ExpectedInterval = median
+	h.Gaps = nil
+}
+
+// medianGap returns the median of the gaps, which is at least a second.
+func medianGap(gaps []int64) int64 {
+	sorted := append([]int64{}, gaps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	n := len(sorted)
+	median := sorted[n/2]
+	if n%2 == 0 {
+		median = (sorted[n/2-1] + sorted[n/2] + 1) / 2
+	}
+	return maxInt64(median, 1)
+}
+
+// HeartbeatParams are the period of the silent-device report, from From
+// until To (Unix-timestamps in seconds). To defaults to now, and From to
+// a day before To. The downtime is totalled per Period, which is "5m",
+// "hourly", "daily" (default), or a duration such as "6h".
+type HeartbeatParams struct {
+	From   int64  `json:"from,omitempty"`
+	To     int64  `json:"to,omitempty"`
+	Period string `json:"period,omitempty"`
+}
+
+// HeartbeatQuery is the request-body of the silent-device report.
+type HeartbeatQuery struct {
+	SearchQuery
+	Heartbeat *HeartbeatParams `json:"heartbeat,omitempty"`
+}
+
+// Validate checks the SearchQuery and the HeartbeatParams.
+// Returns nil if the HeartbeatQuery is valid.
+func (q *HeartbeatQuery) Validate() ValidationErrors {
+	verrs := q.SearchQuery.Validate()
+	if q.Heartbeat != nil {
+		verrs = append(verrs, q.Heartbeat.validate("heartbeat")...)
+	}
+	return verrs
+}
+
+// Bounds returns the From and To of the params, with their defaults.
+func (p *HeartbeatParams) Bounds(now time.Time) (int64, int64) {
+	var from, to int64
+	if p != nil {
+		from, to = p.From, p.To
+	}
+	if to == 0 || to > now.Unix() {
+		to = now.Unix()
+	}
+	if from == 0 {
+		from = to - 24*60*60
+	}
+	return from, to
+}
+
+func (p *HeartbeatParams) periodSeconds() (int64, error) {
+	if p == nil || p.Period == "" {
+		return parseInterval("daily")
+	}
+	return parseInterval(p.Period)
+}
+
+// validate returns the problems with the HeartbeatParams.
+func (p *HeartbeatParams) validate(path string) ValidationErrors {
+	verrs := ValidationErrors{}
+	if p.From != 0 && p.To != 0 && p.From >= p.To {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".from",
+			Message: "from must be before to",
+		})
+	}
+	if _, err := p.periodSeconds(); err != nil {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".period",
+			Message: err.Error(),
+		})
+	}
+	return verrs
+}
+
+// OutageWindow is a time when a device was expected to send readings, but
+// did not. It starts an ExpectedInterval after the last reading, and ends
+// at the next reading. Ongoing outages end at the end of the period.
+type OutageWindow struct {
+	Start   int64 `json:"start"`
+	End     int64 `json:"end"`
+	Ongoing bool  `json:"ongoing,omitempty"`
+}
+
+// PeriodDowntime is the downtime (in seconds) from Start until End.
+type PeriodDowntime struct {
+	Start    int64 `json:"start"`
+	End      int64 `json:"end"`
+	Downtime int64 `json:"downtime"`
+}
+
+// DeviceOutages are the outages of a device in the period of the report.
+// Silent is true if the device is in an outage now.
+// Downtime is the total length (in seconds) of the Windows.
+type DeviceOutages struct {
+	DeviceID         string           `json:"device_id"`
+	LastReading      int64            `json:"last_reading"`
+	ExpectedInterval int64            `json:"expected_interval"`
+	Silent           bool             `json:"silent"`
+	Windows          []OutageWindow   `json:"windows"`
+	Downtime         int64            `json:"downtime"`
+	DowntimeByPeriod []PeriodDowntime `json:"downtime_by_period"`
+}
+
+// outageWindows returns the outages between the readings (in ascending
+// order of time) from the time "from" until "to". The anchor is the last
+// reading before "from", or zero if there is none.
+func outageWindows(anchor int64, timestamps []int64, interval int64, from int64, to int64) []OutageWindow {
+	windows := []OutageWindow{}
+	addGap := func(prev int64, next int64, ongoing bool) {
+		if !isOutage(next-prev, interval) {
+			return
+		}
+		start := prev + interval
+		if start < from {
+			start = from
+		}
+		if next > to {
+			next = to
+		}
+		if start < next {
+			windows = append(windows, OutageWindow{
+				Start:   start,
+				End:     next,
+				Ongoing: ongoing,
+			})
+		}
+	}
+
+	prev := anchor
+	if prev == 0 {
+		// Without an earlier reading, the device is only silent
+		// after its first reading.
+		if len(timestamps) == 0 {
+			return windows
+		}
+		prev = timestamps[0]
+	}
+	for _, ts := range timestamps {
+		if ts <= prev {
+			continue
+		}
+		addGap(prev, ts, false)
+		prev = ts
+	}
+	addGap(prev, to, true)
+	return windows
+}
+
+// downtimeByPeriod splits the downtime of the windows into the periods
+// (aligned to the Unix-epoch) from the time "from" until "to".
+func downtimeByPeriod(windows []OutageWindow, period int64, from int64, to int64) []PeriodDowntime {
+	periods := []PeriodDowntime{}
+	for start := from - from%period; start < to; start += period {
+		pd := PeriodDowntime{
+			Start: start,
+			End:   start + period,
+		}
+		for _, w := range windows {
+			overlap := minInt64(w.End, pd.End) - maxInt64(w.Start, pd.Start)
+			if overlap > 0 {
+				pd.Downtime += overlap
+			}
+		}
+		periods = append(periods, pd)
+	}
+	return periods
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// FindOutages returns the outages of the devices from the HeartbeatParams,
+// using the readings (and anchors, the last reading before the period)
+// of each device. Only devices with outages in the period are returned,
+// ordered by most downtime.
+func FindOutages(
+	heartbeats []Heartbeat,
+	readings map[string][]int64,
+	anchors map[string]int64,
+	params *HeartbeatParams,
+	now time.Time,
+) ([]DeviceOutages, error) {
+	from, to := params.Bounds(now)
+	period, err := params.periodSeconds()
+	if err != nil {
+		return nil, err
+	}
+
+	outages := []DeviceOutages{}
+	for _, h := range heartbeats {
+		deviceID := h.DeviceID.String()
+		interval := h.ExpectedInterval
+		if interval <= 0 {
+			interval = DefaultHeartbeatInterval
+		}
+
+		windows := outageWindows(anchors[deviceID], readings[deviceID], interval, from, to)
+		if len(windows) == 0 {
+			continue
+		}
+
+		do := DeviceOutages{
+			DeviceID:         deviceID,
+			LastReading:      h.LastReading,
+			ExpectedInterval: interval,
+			Silent:           isOutage(now.Unix()-h.LastReading, interval),
+			Windows:          windows,
+			DowntimeByPeriod: downtimeByPeriod(windows, period, from, to),
+		}
+		for _, w := range windows {
+			do.Downtime += w.End - w.Start
+		}
+		outages = append(outages, do)
+	}
+
+	sort.SliceStable(outages, func(i, j int) bool {
+		return outages[i].Downtime > outages[j].Downtime
+	})
+	return outages, nil
+}
+
+// HeartbeatWarning returns the Warning for a device which is silent now,
+// or false if it is not silent or was already warned of this outage.
+// Value is the time since the last reading, and Limit is the longest
+// gap allowed for the ExpectedInterval (both in seconds).
+func HeartbeatWarning(h Heartbeat, now time.Time) (*Warning, bool) {
+	interval := h.ExpectedInterval
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	gap := now.Unix() - h.LastReading
+	if h.LastReading == 0 || !isOutage(gap, interval) || h.WarnedAt > h.LastReading {
+		return nil, false
+	}
+
+	limit := float64(interval) * heartbeatTolerance
+	return &Warning{
+		WarningType: WarningHeartbeat,
+		DeviceID:    h.DeviceID,
+		Channel:     WarningHeartbeat,
+		Value:       float64(gap),
+		Limit:       limit,
+		LimitType:   "max",
+		Severity:    severity(float64(gap)-limit, ClimateRange{Max: limit}),
+		Timestamp:   h.LastReading,
+	}, true
+}
+
+// RecordHeartbeats updates the Heartbeats of the devices of the metrics.
+func (db *DB) RecordHeartbeats(metrics []Metric) ([]Heartbeat, error) {
+	timestamps := map[string][]int64{}
+	deviceIDs := map[string]uuuid.UUID{}
+	for _, m := range metrics {
+		deviceID := m.DeviceID.String()
+		timestamps[deviceID] = append(timestamps[deviceID], m.Timestamp)
+		deviceIDs[deviceID] = m.DeviceID
+	}
+
+	ids := []string{}
+	for deviceID := range timestamps {
+		ids = append(ids, deviceID)
+	}
+	stored, err := db.Heartbeats(ids)
+	if err != nil {
+		return nil, err
+	}
+	heartbeatOf := map[string]*Heartbeat{}
+	for i := range stored {
+		heartbeatOf[stored[i].DeviceID.String()] = &stored[i]
+	}
+
+	heartbeats := []Heartbeat{}
+	// The Heartbeats of new devices are inserted together
+	newHeartbeats := []interface{}{}
+	now := time.Now().Unix()
+	for deviceID, ts := range timestamps {
+		sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+
+		heartbeat := heartbeatOf[deviceID]
+		if heartbeat == nil {
+			heartbeat = &Heartbeat{
+				DeviceID:         deviceIDs[deviceID],
+				ExpectedInterval: DefaultHeartbeatInterval,
+				UpdatedAt:        now,
+			}
+			heartbeat.observe(ts)
+			newHeartbeats = append(newHeartbeats, heartbeat)
+			heartbeats = append(heartbeats, *heartbeat)
+			continue
+		}
+
+		lastReading := heartbeat.LastReading
+		heartbeat.observe(ts)
+		if heartbeat.LastReading == lastReading {
+			continue
+		}
+		heartbeat.UpdatedAt = now
+		_, err := db.collection.UpdateMany(
+			map[string]interface{}{
+				"device_id": deviceID,
+			},
+			map[string]interface{}{
+				"last_reading":      heartbeat.LastReading,
+				"expected_interval": heartbeat.ExpectedInterval,
+				"seeded":            heartbeat.Seeded,
+				"gaps":              append([]int64{}, heartbeat.Gaps...),
+				"updated_at":        heartbeat.UpdatedAt,
+			},
+		)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to update Heartbeat - RecordHeartbeats")
+			log.Println(err)
+			return nil, err
+		}
+		heartbeats = append(heartbeats, *heartbeat)
+	}
+
+	err = db.insertMany(newHeartbeats)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to insert Heartbeats - RecordHeartbeats")
+		log.Println(err)
+		return nil, err
+	}
+	return heartbeats, nil
+}
+
+// heartbeat returns the Heartbeat of the device, or nil if it has none.
+func (db *DB) heartbeat(deviceID string) (*Heartbeat, error) {
+	findResults, err := db.collection.Find(map[string]interface{}{
+		"device_id": deviceID,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching Heartbeat - heartbeat")
+		log.Println(err)
+		return nil, err
+	}
+	if len(findResults) == 0 {
+		return nil, nil
+	}
+	return findResults[0].(*Heartbeat), nil
+}
+
+// Heartbeats returns the Heartbeats of the devices, or of all
+// devices if deviceIDs is nil.
+func (db *DB) Heartbeats(deviceIDs []string) ([]Heartbeat, error) {
+	filter := map[string]interface{}{}
+	if deviceIDs != nil {
+		filter["device_id"] = map[string]interface{}{
+			"$in": deviceIDs,
+		}
+	}
+
+	findResults, err := db.collection.Find(filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching Heartbeats - Heartbeats")
+		log.Println(err)
+		return nil, err
+	}
+
+	heartbeats := []Heartbeat{}
+	for _, v := range findResults {
+		heartbeats = append(heartbeats, *v.(*Heartbeat))
+	}
+	return heartbeats, nil
+}
+
+// SetHeartbeatInterval configures the ExpectedInterval (in seconds) of the
+// device. An interval of zero returns to estimating it from the readings.
+func (db *DB) SetHeartbeatInterval(deviceID uuuid.UUID, interval int64) (*Heartbeat, error) {
+	heartbeat, err := db.heartbeat(deviceID.String())
+	if err != nil {
+		return nil, err
+	}
+	if heartbeat == nil {
+		heartbeat = &Heartbeat{
+			DeviceID: deviceID,
+		}
+	}
+
+	heartbeat.Configured = interval > 0
+	if heartbeat.Configured {
+		heartbeat.ExpectedInterval = interval
+	} else if heartbeat.ExpectedInterval == 0 {
+		heartbeat.ExpectedInterval = DefaultHeartbeatInterval
+	}
+	heartbeat.UpdatedAt = time.Now().Unix()
+
+	if heartbeat.ID == objectid.NilObjectID {
+		_, err = db.collection.InsertOne(heartbeat)
+	} else {
+		_, err = db.collection.UpdateMany(
+			map[string]interface{}{
+				"device_id": deviceID.String(),
+			},
+			map[string]interface{}{
+				"expected_interval": heartbeat.ExpectedInterval,
+				"configured":        heartbeat.Configured,
+				"updated_at":        heartbeat.UpdatedAt,
+			},
+		)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "Unable to save Heartbeat - SetHeartbeatInterval")
+		log.Println(err)
+		return nil, err
+	}
+	return heartbeat, nil
+}
+
+// MarkHeartbeatWarned records that the device was warned of its
+// outage at the time.
+func (db *DB) MarkHeartbeatWarned(deviceID uuuid.UUID, at int64) error {
+	_, err := db.collection.UpdateMany(
+		map[string]interface{}{
+			"device_id": deviceID.String(),
+		},
+		map[string]interface{}{
+			"warned_at": at,
+		},
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to update Heartbeat - MarkHeartbeatWarned")
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// ReadingTimes returns the timestamps of the readings of the devices from
+// the time "from" until "to", in ascending order, by DeviceID.
+func (db *DB) ReadingTimes(deviceIDs []string, from int64, to int64) (map[string][]int64, error) {
+	findResults, err := db.collection.Find(
+		map[string]interface{}{
+			"device_id": map[string]interface{}{
+				"$in": deviceIDs,
+			},
+			"timestamp": map[string]interface{}{
+				"$gte": from,
+				"$lte": to,
+			},
+		},
+		findopt.Sort(map[string]interface{}{
+			"timestamp": 1,
+		}),
+		findopt.Projection(map[string]interface{}{
+			"device_id": 1,
+			"timestamp": 1,
+		}),
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching readings - ReadingTimes")
+		log.Println(err)
+		return nil, err
+	}
+
+	readings := map[string][]int64{}
+	for _, v := range findResults {
+		m := v.(*Metric)
+		deviceID := m.DeviceID.String()
+		readings[deviceID] = append(readings[deviceID], m.Timestamp)
+	}
+	return readings, nil
+}
+
+// LastReadingsBefore returns the timestamp of the last reading of each
+// of the devices before the timestamp, by DeviceID. Devices without
+// readings before it are left out.
+func (db *DB) LastReadingsBefore(deviceIDs []string, before int64) (map[string]int64, error) {
+	pipeline := []interface{}{
+		map[string]interface{}{
+			"$match": map[string]interface{}{
+				"device_id": map[string]interface{}{
+					"$in": deviceIDs,
+				},
+				"timestamp": map[string]interface{}{
+					"$lt": before,
+				},
+			},
+		},
+		map[string]interface{}{
+			"$group": map[string]interface{}{
+				"_id": "$device_id",
+				"last_reading": map[string]interface{}{
+					"$max": "$timestamp",
+				},
+			},
+		},
+	}
+
+	aggResults, err := db.collection.Aggregate(pipeline)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching last readings - LastReadingsBefore")
+		log.Println(err)
+		return nil, err
+	}
+
+	lastReadings := map[string]int64{}
+	for _, v := range aggResults {
+		value := v.(map[string]interface{})
+		deviceID, _ := value["_id"].(string)
+		if lastReading, ok := toInt(value["last_reading"]); ok && deviceID != "" {
+			lastReadings[deviceID] = lastReading
+		}
+	}
+	return lastReadings, nil
+}
@@ -0,0 +1,186 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+)
+
+// readingTimes returns the timestamps after start, one after each gap.
+func readingTimes(start int64, gaps ...int64) []int64 {
+	timestamps := []int64{start}
+	for _, gap := range gaps {
+		start += gap
+		timestamps = append(timestamps, start)
+	}
+	return timestamps
+}
+
+func TestHeartbeatObserve(t *testing.T) {
+	seeded := Heartbeat{LastReading: 1000, ExpectedInterval: 300, Seeded: true}
+
+	tests := []struct {
+		name       string
+		heartbeat  Heartbeat
+		timestamps []int64
+		want       int64
+		wantSeeded bool
+	}{
+		{
+			name:       "seeded from the median of the first gaps",
+			heartbeat:  Heartbeat{ExpectedInterval: DefaultHeartbeatInterval},
+			timestamps: readingTimes(1000, 3600, 3500, 9000, 3700, 3600),
+			want:       3600,
+			wantSeeded: true,
+		},
+		{
+			name:       "median while seeding",
+			heartbeat:  Heartbeat{ExpectedInterval: DefaultHeartbeatInterval},
+			timestamps: readingTimes(1000, 60, 80),
+			want:       70,
+		},
+		{
+			name:       "smoothed with regular gaps",
+			heartbeat:  seeded,
+			timestamps: readingTimes(1300, 400),
+			want:       320,
+			wantSeeded: true,
+		},
+		{
+			name:       "outages are left out",
+			heartbeat:  seeded,
+			timestamps: readingTimes(1300, 5000, 300),
+			want:       300,
+			wantSeeded: true,
+		},
+		{
+			name:       "adapts to regular outages",
+			heartbeat:  seeded,
+			timestamps: readingTimes(1900, 900, 950, 900, 850),
+			want:       900,
+			wantSeeded: true,
+		},
+		{
+			name:       "irregular outages",
+			heartbeat:  seeded,
+			timestamps: readingTimes(1900, 900, 7200, 950, 20000, 850),
+			want:       300,
+			wantSeeded: true,
+		},
+		{
+			name:       "configured",
+			heartbeat:  Heartbeat{LastReading: 1000, ExpectedInterval: 60, Configured: true},
+			timestamps: readingTimes(1600, 600, 600, 600, 600, 600),
+			want:       60,
+		},
+		{
+			name:       "earlier readings",
+			heartbeat:  seeded,
+			timestamps: []int64{500, 1000},
+			want:       300,
+			wantSeeded: true,
+		},
+	}
+
+	for _, test := range tests {
+		h := test.heartbeat
+		h.observe(test.timestamps)
+		if h.ExpectedInterval != test.want || h.Seeded != test.wantSeeded {
+			t.Errorf(
+				"%s: got interval %d (seeded %t), want %d (seeded %t)",
+				test.name, h.ExpectedInterval, h.Seeded, test.want, test.wantSeeded,
+			)
+		}
+		if last := test.timestamps[len(test.timestamps)-1]; h.LastReading < last {
+			t.Errorf("%s: got last reading %d, want %d", test.name, h.LastReading, last)
+		}
+	}
+}
+
+func TestOutageWindows(t *testing.T) {
+	tests := []struct {
+		name       string
+		anchor     int64
+		timestamps []int64
+		from, to   int64
+		want       []OutageWindow
+	}{
+		{
+			name:       "no outages",
+			timestamps: readingTimes(1000, 100, 100, 140),
+			from:       1000,
+			to:         1400,
+			want:       []OutageWindow{},
+		},
+		{
+			name:       "outage between readings",
+			timestamps: readingTimes(1000, 100, 500),
+			from:       1000,
+			to:         1650,
+			want:       []OutageWindow{{Start: 1200, End: 1600}},
+		},
+		{
+			name:       "ongoing outage",
+			timestamps: readingTimes(1000, 100),
+			from:       1000,
+			to:         2000,
+			want:       []OutageWindow{{Start: 1200, End: 2000, Ongoing: true}},
+		},
+		{
+			name:       "outage from the anchor",
+			anchor:     500,
+			timestamps: readingTimes(1000, 100),
+			from:       800,
+			to:         1150,
+			want:       []OutageWindow{{Start: 800, End: 1000}},
+		},
+		{
+			name:   "silent for the whole period",
+			anchor: 500,
+			from:   1000,
+			to:     2000,
+			want:   []OutageWindow{{Start: 1000, End: 2000, Ongoing: true}},
+		},
+		{
+			name: "no readings",
+			from: 1000,
+			to:   2000,
+			want: []OutageWindow{},
+		},
+	}
+
+	for _, test := range tests {
+		got := outageWindows(test.anchor, test.timestamps, 100, test.from, test.to)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDowntimeByPeriod(t *testing.T) {
+	tests := []struct {
+		name     string
+		windows  []OutageWindow
+		from, to int64
+		want     []int64
+	}{
+		{"no outages", nil, 0, 300, []int64{0, 0, 0}},
+		{"within a period", []OutageWindow{{Start: 120, End: 150}}, 0, 300, []int64{0, 30, 0}},
+		{"across periods", []OutageWindow{{Start: 50, End: 250}}, 0, 300, []int64{50, 100, 50}},
+		{"several outages", []OutageWindow{{Start: 10, End: 20}, {Start: 80, End: 120}}, 0, 200, []int64{30, 20}},
+		{"aligned to the epoch", []OutageWindow{{Start: 150, End: 160}}, 150, 250, []int64{10, 0}},
+	}
+
+	for _, test := range tests {
+		periods := downtimeByPeriod(test.windows, 100, test.from, test.to)
+		got := []int64{}
+		for _, p := range periods {
+			got = append(got, p.Downtime)
+			if p.End-p.Start != 100 || p.Start%100 != 0 {
+				t.Errorf("%s: got period %d to %d", test.name, p.Start, p.End)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got downtime %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	mgo "github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/insertopt"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ingestBatchSize is the number of metrics written by each InsertMany.
+	ingestBatchSize = 1000
+	// maxIngestSkew is how far in the future a reading's timestamp can be.
+	maxIngestSkew = time.Hour
+	// duplicateKeyCode is the Mongo error-code for unique-index violations.
+	duplicateKeyCode = 11000
+)
+
+// IngestRanges are the plausible ranges of the sensor-channels.
+// Readings outside of these are rejected as sensor errors.
+var IngestRanges = map[string]ClimateRange{
+	"temp_in":   {Min: -50, Max: 80},
+	"humidity":  {Min: 0, Max: 100},
+	"ethylene":  {Min: 0, Max: 10000},
+	"carbon_di": {Min: 0, Max: 100000},
+}
+
+// IngestError is the reason the record at Index of the batch was rejected.
+type IngestError struct {
+	Index   int64  `bson:"index" json:"index"`
+	Message string `bson:"message" json:"message"`
+}
+
+// IngestResult is the outcome of ingesting a batch of metrics.
+// Records are either accepted, skipped as Duplicates of stored readings
+// (or of earlier records in the batch), or rejected with their Errors.
+// The result is stored by its IdempotencyKey, so a retried request gets
+// the same result, with Replayed set.
+type IngestResult struct {
+	ID             objectid.ObjectID `bson:"_id,omitempty" json:"-"`
+	IdempotencyKey string            `bson:"idempotency_key,omitempty" json:"idempotency_key,omitempty"`
+	BodyHash       string            `bson:"body_hash,omitempty" json:"-"`
+	Received       int64             `bson:"received" json:"received"`
+	Accepted       int64             `bson:"accepted" json:"accepted"`
+	Duplicates     int64             `bson:"duplicates" json:"duplicates"`
+	Rejected       int64             `bson:"rejected" json:"rejected"`
+	Errors         []IngestError     `bson:"errors,omitempty" json:"errors,omitempty"`
+	CreatedAt      int64             `bson:"created_at,omitempty" json:"created_at,omitempty"`
+	Replayed       bool              `bson:"-" json:"replayed,omitempty"`
+}
+
+// ingestRecord is a metric as sent by the sensors. Readings are pointers,
+// so missing readings can be told apart from zero readings.
+type ingestRecord struct {
+	ItemID    string   `json:"item_id"`
+	DeviceID  string   `json:"device_id"`
+	Timestamp int64    `json:"timestamp"`
+	TempIn    *float64 `json:"temp_in"`
+	Humidity  *float64 `json:"humidity"`
+	Ethylene  *float64 `json:"ethylene"`
+	CarbonDi  *float64 `json:"carbon_di"`
+}
+
+// BodyHash is the hash of a request-body, which is stored with the
+// IngestResult so an IdempotencyKey cannot be reused for another batch.
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// splitIngestBody splits the body into its records. The body is either
+// a JSON-array of records, or newline-delimited JSON (one record per line,
+// blank lines are skipped).
+func splitIngestBody(body []byte) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		records := []json.RawMessage{}
+		err := json.Unmarshal(trimmed, &records)
+		if err != nil {
+			err = errors.Wrap(err, "Invalid JSON-array")
+			return nil, err
+		}
+		return records, nil
+	}
+
+	records := []json.RawMessage{}
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		record := make(json.RawMessage, len(line))
+		copy(record, line)
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		err = errors.Wrap(err, "Invalid NDJSON")
+		return nil, err
+	}
+	return records, nil
+}
+
+// parseIngestRecord validates the record and converts it to a Metric.
+func parseIngestRecord(raw json.RawMessage, now time.Time) (*Metric, error) {
+	record := &ingestRecord{}
+	err := json.Unmarshal(raw, record)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid record")
+	}
+
+	metric := &Metric{
+		Timestamp: record.Timestamp,
+	}
+	metric.ItemID, err = uuuid.FromString(record.ItemID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid item_id")
+	}
+	metric.DeviceID, err = uuuid.FromString(record.DeviceID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid device_id")
+	}
+
+	if record.Timestamp <= 0 {
+		return nil, errors.New("timestamp is required")
+	}
+	if record.Timestamp > now.Add(maxIngestSkew).Unix() {
+		return nil, errors.New("timestamp is in the future, it must be in seconds")
+	}
+
+	readings := map[string]*float64{
+		"temp_in":   record.TempIn,
+		"humidity":  record.Humidity,
+		"ethylene":  record.Ethylene,
+		"carbon_di": record.CarbonDi,
+	}
+	hasReading := false
+	for _, channel := range RollupChannels {
+		value := readings[channel]
+		if value == nil {
+			continue
+		}
+		r := IngestRanges[channel]
+		if *value < r.Min || *value > r.Max {
+			return nil, fmt.Errorf(
+				"%s must be between %v and %v", channel, r.Min, r.Max,
+			)
+		}
+		hasReading = true
+	}
+	if !hasReading {
+		return nil, errors.New("At least one reading is required")
+	}
+
+	// Zero readings are kept, so they are stored
+	for channel, value := range readings {
+		if value != nil {
+			metric.SetReading(channel, *value)
+		}
+	}
+	return metric, nil
+}
+
+// metricKey identifies the reading of a device at a time.
+func metricKey(deviceID string, timestamp int64) string {
+	return fmt.Sprintf("%s:%d", deviceID, timestamp)
+}
+
+// storedMetricKeys returns the metricKeys of the metrics which are
+// already stored.
+func (db *DB) storedMetricKeys(metrics []Metric) (map[string]bool, error) {
+	deviceIDs := []string{}
+	timestamps := []int64{}
+	seen := map[string]bool{}
+	for _, m := range metrics {
+		deviceID := m.DeviceID.String()
+		if !seen[deviceID] {
+			seen[deviceID] = true
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+		timestamps = append(timestamps, m.Timestamp)
+	}
+
+	findResults, err := db.collection.Find(
+		map[string]interface{}{
+			"device_id": map[string]interface{}{
+				"$in": deviceIDs,
+			},
+			"timestamp": map[string]interface{}{
+				"$in": timestamps,
+			},
+		},
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching stored metrics - storedMetricKeys")
+		log.Println(err)
+		return nil, err
+	}
+
+	stored := map[string]bool{}
+	for _, v := range findResults {
+		m := v.(*Metric)
+		stored[metricKey(m.DeviceID.String(), m.Timestamp)] = true
+	}
+	return stored, nil
+}
+
+// IngestMetrics validates the metrics in the body (a JSON-array or NDJSON),
+// and inserts the ones which are not already stored for their
+// (device_id, timestamp). Returns the result and the inserted metrics.
+// A body which cannot be split into records returns ValidationErrors.
+func (db *DB) IngestMetrics(body []byte) (*IngestResult, []Metric, error) {
+	records, err := splitIngestBody(body)
+	if err != nil {
+		return nil, nil, ValidationErrors{
+			ValidationError{
+				Path:    "body",
+				Message: err.Error(),
+			},
+		}
+	}
+
+	now := time.Now()
+	result := &IngestResult{
+		Received: int64(len(records)),
+	}
+	metrics := []Metric{}
+	indexes := []int64{}
+	batchKeys := map[string]bool{}
+	for i, raw := range records {
+		metric, err := parseIngestRecord(raw, now)
+		if err != nil {
+			result.Rejected++
+			result.Errors = append(result.Errors, IngestError{
+				Index:   int64(i),
+				Message: err.Error(),
+			})
+			continue
+		}
+
+		key := metricKey(metric.DeviceID.String(), metric.Timestamp)
+		if batchKeys[key] {
+			result.Duplicates++
+			continue
+		}
+		batchKeys[key] = true
+		metrics = append(metrics, *metric)
+		indexes = append(indexes, int64(i))
+	}
+
+	inserted := []Metric{}
+	for start := 0; start < len(metrics); start += ingestBatchSize {
+		end := start + ingestBatchSize
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		batch, err := db.insertMetricBatch(metrics[start:end], indexes[start:end], result)
+		if err != nil {
+			err = errors.Wrap(err, "Error inserting metrics - IngestMetrics")
+			log.Println(err)
+			return nil, nil, err
+		}
+		inserted = append(inserted, batch...)
+	}
+	result.Accepted = int64(len(inserted))
+	return result, inserted, nil
+}
+
+// insertMetricBatch inserts the metrics which are not already stored,
+// and records the duplicates and failed writes in the result.
+// Indexes are the positions of the metrics in the request.
+func (db *DB) insertMetricBatch(
+	metrics []Metric,
+	indexes []int64,
+	result *IngestResult,
+) ([]Metric, error) {
+	stored, err := db.storedMetricKeys(metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []Metric{}
+	pendingIndexes := []int64{}
+	docs := []interface{}{}
+	for i, m := range metrics {
+		if stored[metricKey(m.DeviceID.String(), m.Timestamp)] {
+			result.Duplicates++
+			continue
+		}
+		m.ID = objectid.New()
+		pending = append(pending, m)
+		pendingIndexes = append(pendingIndexes, indexes[i])
+		docs = append(docs, m)
+	}
+	if len(docs) == 0 {
+		return pending, nil
+	}
+
+	timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Unordered, so a failed write does not stop the rest of the batch
+	_, err = db.collection.Collection().InsertMany(ctx, docs, insertopt.Ordered(false))
+	if err == nil {
+		return pending, nil
+	}
+	bulkErr, ok := err.(mgo.BulkWriteError)
+	if !ok || bulkErr.WriteConcernError != nil {
+		return nil, err
+	}
+
+	failed := map[int]bool{}
+	for _, writeErr := range bulkErr.WriteErrors {
+		failed[writeErr.Index] = true
+		// Written concurrently by another request
+		if writeErr.Code == duplicateKeyCode {
+			result.Duplicates++
+			continue
+		}
+		result.Rejected++
+		result.Errors = append(result.Errors, IngestError{
+			Index:   pendingIndexes[writeErr.Index],
+			Message: writeErr.Message,
+		})
+	}
+
+	inserted := []Metric{}
+	for i, m := range pending {
+		if !failed[i] {
+			inserted = append(inserted, m)
+		}
+	}
+	return inserted, nil
+}
+
+// IngestByKey returns the stored IngestResult for the IdempotencyKey,
+// or nil if the key was not used yet.
+func (db *DB) IngestByKey(key string) (*IngestResult, error) {
+	findResults, err := db.collection.Find(map[string]interface{}{
+		"idempotency_key": map[string]interface{}{
+			"$eq": key,
+		},
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching IngestResult - IngestByKey")
+		log.Println(err)
+		return nil, err
+	}
+	if len(findResults) == 0 {
+		return nil, nil
+	}
+	return findResults[0].(*IngestResult), nil
+}
+
+// SaveIngest stores the IngestResult by its IdempotencyKey.
+func (db *DB) SaveIngest(result *IngestResult) error {
+	if result == nil || result.IdempotencyKey == "" {
+		return errors.New("IngestResult with IdempotencyKey is required - SaveIngest")
+	}
+
+	result.ID = objectid.NilObjectID
+	result.CreatedAt = time.Now().Unix()
+	_, err := db.collection.InsertOne(result)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to insert IngestResult - SaveIngest")
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// EnsureIndex creates the index on the fields (in ascending order) if it
+// does not exist. Unique indexes cannot be created while the collection
+// has duplicates of the fields.
+func (db *DB) EnsureIndex(name string, unique bool, fields ...string) error {
+	keys := bson.NewDocument()
+	for _, field := range fields {
+		keys.Append(bson.EC.Int32(field, 1))
+	}
+
+	timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := db.collection.Collection().Indexes().CreateOne(ctx, mgo.IndexModel{
+		Keys: keys,
+		Options: bson.NewDocument(
+			bson.EC.String("name", name),
+			bson.EC.Boolean("unique", unique),
+		),
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "Unable to create index %s - EnsureIndex", name)
+		log.Println(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package report
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSplitIngestBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		records int
+		wantErr bool
+	}{
+		{"json array", `[{"a":1},{"a":2}]`, 2, false},
+		{"empty json array", `  []  `, 0, false},
+		{"ndjson", "{\"a\":1}\n{\"a\":2}\n{\"a\":3}", 3, false},
+		{"ndjson with blank lines", "{\"a\":1}\n\n  \n{\"a\":2}\n", 2, false},
+		{"empty body", "", 0, false},
+		{"invalid json array", `[{"a":1},`, 0, true},
+	}
+
+	for _, test := range tests {
+		records, err := splitIngestBody([]byte(test.body))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if len(records) != test.records {
+			t.Errorf("%s: got %d records, want %d", test.name, len(records), test.records)
+		}
+	}
+}
+
+func TestParseIngestRecord(t *testing.T) {
+	now := time.Unix(1540000000, 0)
+	const (
+		itemID   = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+		deviceID = "6ba7b811-9dad-11d1-80b4-00c04fd430c8"
+	)
+	record := func(readings string) string {
+		return `{"item_id":"` + itemID + `","device_id":"` + deviceID +
+			`","timestamp":1539990000` + readings + `}`
+	}
+
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name: "all readings",
+			raw:  record(`,"temp_in":4.5,"humidity":90,"ethylene":12,"carbon_di":400`),
+			want: map[string]float64{"temp_in": 4.5, "humidity": 90, "ethylene": 12, "carbon_di": 400},
+		},
+		{
+			name: "zero reading",
+			raw:  record(`,"temp_in":0`),
+			want: map[string]float64{"temp_in": 0},
+		},
+		{
+			name: "zero and missing readings",
+			raw:  record(`,"ethylene":0,"humidity":55`),
+			want: map[string]float64{"ethylene": 0, "humidity": 55},
+		},
+		{
+			name:    "no readings",
+			raw:     record(``),
+			wantErr: true,
+		},
+		{
+			name:    "null readings",
+			raw:     record(`,"temp_in":null`),
+			wantErr: true,
+		},
+		{
+			name:    "reading out of range",
+			raw:     record(`,"humidity":101`),
+			wantErr: true,
+		},
+		{
+			name:    "invalid item_id",
+			raw:     `{"item_id":"x","device_id":"` + deviceID + `","timestamp":1539990000,"temp_in":1}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing timestamp",
+			raw:     `{"item_id":"` + itemID + `","device_id":"` + deviceID + `","temp_in":1}`,
+			wantErr: true,
+		},
+		{
+			name:    "timestamp in milliseconds",
+			raw:     `{"item_id":"` + itemID + `","device_id":"` + deviceID + `","timestamp":1539990000000,"temp_in":1}`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		metric, err := parseIngestRecord(json.RawMessage(test.raw), now)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		// The readings are kept when the metric is stored and read back
+		in, err := metric.MarshalBSON()
+		if err != nil {
+			t.Errorf("%s: MarshalBSON: %v", test.name, err)
+			continue
+		}
+		stored := &Metric{}
+		err = stored.UnmarshalBSON(in)
+		if err != nil {
+			t.Errorf("%s: UnmarshalBSON: %v", test.name, err)
+			continue
+		}
+
+		for _, m := range []*Metric{metric, stored} {
+			for _, channel := range RollupChannels {
+				want, wantOK := test.want[channel]
+				got, ok := m.Reading(channel)
+				if ok != wantOK || got != want {
+					t.Errorf(
+						"%s: %s got (%v, %t), want (%v, %t)",
+						test.name, channel, got, ok, want, wantOK,
+					)
+				}
+			}
+		}
+		if stored.ItemID.String() != itemID || stored.Timestamp != 1539990000 {
+			t.Errorf("%s: got stored metric %+v", test.name, stored)
+		}
+	}
+}
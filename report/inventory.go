@@ -640,6 +640,11 @@ type Inventory struct {
 	SoldWeight       float64           `bson:"sold_weight,omitempty" json:"sold_weight,omitempty"`
 	ProdQuantity     int64             `bson:"prod_quantity,omitempty" json:"prod_quantity,omitempty"`
 	Version          int64             `bson:"version,omitempty" json:"version,omitempty"`
+	// Score is the relevance to a TextSearch, and is not stored
+	Score float64 `bson:"-" json:"score,omitempty"`
+
+	// selectedFields are the fields serialized by MarshalJSON, all if empty
+	selectedFields []string
 }
 
 type marshalInventory struct {
@@ -665,6 +670,7 @@ type marshalInventory struct {
 	SoldWeight       float64           `bson:"sold_weight,omitempty" json:"sold_weight,omitempty"`
 	ProdQuantity     int64             `bson:"prod_quantity,omitempty" json:"prod_quantity,omitempty"`
 	Version          int64             `bson:"version,omitempty" json:"version,omitempty"`
+	Score            float64           `bson:"-" json:"score,omitempty"`
 }
 
 func (i *Inventory) MarshalJSON() ([]byte, error) {
@@ -687,6 +693,7 @@ func (i *Inventory) MarshalJSON() ([]byte, error) {
 		SoldWeight:       i.SoldWeight,
 		Version:          i.Version,
 		ProdQuantity:     i.ProdQuantity,
+		Score:            i.Score,
 	}
 
 	if i.ItemID.String() != (uuuid.UUID{}).String() {
@@ -699,7 +706,21 @@ func (i *Inventory) MarshalJSON() ([]byte, error) {
 		in.RsCustomerID = i.RsCustomerID.String()
 	}
 
-	return json.Marshal(in)
+	out, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	fields := i.selectedFields
+	if len(fields) > 0 && i.Score > 0 {
+		fields = append([]string{"score"}, fields...)
+	}
+	return selectJSONFields(out, fields)
+}
+
+// SelectFields sets the fields serialized by MarshalJSON, all if empty,
+// such as when more fields were searched than requested.
+func (i *Inventory) SelectFields(fields []string) {
+	i.selectedFields = fields
 }
 
 func (i Inventory) MarshalBSON() ([]byte, error) {
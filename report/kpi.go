@@ -0,0 +1,338 @@
+package report
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/pkg/errors"
+)
+
+// kpiPeriodFormats are the $dateToString formats of the KPI periods.
+// Weeks are ISO-weeks, such as "2018-W42".
+var kpiPeriodFormats = map[string]string{
+	"day":   "%Y-%m-%d",
+	"week":  "%G-W%V",
+	"month": "%Y-%m",
+}
+
+// KPIParams selects the Period of the KPI report, which is "day", "week"
+// or "month" (default), in UTC.
+type KPIParams struct {
+	Period string `json:"period,omitempty"`
+}
+
+// KPIQuery is the request-body of the KPI report.
+type KPIQuery struct {
+	SearchQuery
+	KPI *KPIParams `json:"kpi,omitempty"`
+}
+
+// Validate checks the SearchQuery and the KPIParams.
+// Returns nil if the KPIQuery is valid.
+func (q *KPIQuery) Validate() ValidationErrors {
+	verrs := q.SearchQuery.Validate()
+	if q.KPI != nil {
+		verrs = append(verrs, q.KPI.validate("kpi")...)
+	}
+	return verrs
+}
+
+func (p *KPIParams) period() string {
+	if p == nil || p.Period == "" {
+		return "month"
+	}
+	return p.Period
+}
+
+// validate returns the problems with the KPIParams.
+func (p *KPIParams) validate(path string) ValidationErrors {
+	if _, ok := kpiPeriodFormats[p.period()]; !ok {
+		return ValidationErrors{
+			ValidationError{
+				Path:    path + ".period",
+				Message: fmt.Sprintf("Invalid period %s, expected day, week or month", p.Period),
+			},
+		}
+	}
+	return nil
+}
+
+// KPI are the sales and waste indicators of the items of a product and
+// origin which arrived in the Period.
+// The percentages are of the TotalWeight, and are nil if it is zero.
+// AvgDaysToSell is from arrival until sale, over the items with a DateSold,
+// and is nil if there are none.
+// ShrinkWeight is the weight of the expired items which is not accounted
+// for by sales, waste or donations.
+type KPI struct {
+	Name           string   `json:"name"`
+	Origin         string   `json:"origin"`
+	Period         string   `json:"period"`
+	Items          int64    `json:"items"`
+	SoldItems      int64    `json:"sold_items"`
+	TotalWeight    float64  `json:"total_weight"`
+	SoldWeight     float64  `json:"sold_weight"`
+	WasteWeight    float64  `json:"waste_weight"`
+	DonateWeight   float64  `json:"donate_weight"`
+	ShrinkWeight   float64  `json:"shrink_weight"`
+	SellThroughPct *float64 `json:"sell_through_pct"`
+	WastePct       *float64 `json:"waste_pct"`
+	DonationPct    *float64 `json:"donation_pct"`
+	ShrinkPct      *float64 `json:"shrink_pct"`
+	AvgDaysToSell  *float64 `json:"avg_days_to_sell"`
+}
+
+// pctOfTotal returns the expression for the field as a percentage of the
+// total_weight, or null if the total is zero.
+func pctOfTotal(field string) map[string]interface{} {
+	return map[string]interface{}{
+		"$cond": []interface{}{
+			map[string]interface{}{
+				"$gt": []interface{}{"$total_weight", 0},
+			},
+			map[string]interface{}{
+				"$multiply": []interface{}{
+					map[string]interface{}{
+						"$divide": []interface{}{"$" + field, "$total_weight"},
+					},
+					100,
+				},
+			},
+			nil,
+		},
+	}
+}
+
+// roundedFloat returns the aggregated value rounded to 2 decimals,
+// or nil if it is null.
+func roundedFloat(value interface{}) *float64 {
+	v, ok := toFloat(value)
+	if !ok {
+		return nil
+	}
+	v = math.Round(v*100) / 100
+	return &v
+}
+
+// InventoryKPIs computes the KPIs of the inventory matching the query-tree
+// and TextSearch of the SearchQuery, per product, origin and the period
+// (KPIQuery.KPI) of the DateArrived of the items. The KPIs are computed
+// by Mongo, ordered by period, product and origin.
+func (db *DB) InventoryKPIs(search *KPIQuery, now time.Time) ([]KPI, error) {
+	var params *KPIParams
+	var invSearch *SearchQuery
+	if search != nil {
+		params = search.KPI
+		invSearch = &search.SearchQuery
+	}
+	format, ok := kpiPeriodFormats[params.period()]
+	if !ok {
+		return nil, errors.Errorf("Invalid period %s - InventoryKPIs", params.period())
+	}
+
+	invQuery, err := db.invFindQuery(invSearch)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling inventory query - InventoryKPIs")
+		log.Println(err)
+		return nil, err
+	}
+	pipeline := kpiPipeline(invQuery.filter, format, now)
+	aggResults, err := db.collection.Aggregate(pipeline)
+	if err != nil {
+		err = errors.Wrap(err, "Error aggregating inventory - InventoryKPIs")
+		log.Println(err)
+		return nil, err
+	}
+
+	kpis := []KPI{}
+	for _, v := range aggResults {
+		value, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		kpis = append(kpis, kpiResult(value))
+	}
+	return kpis, nil
+}
+
+// kpiPipeline computes the KPIs of the inventory matching the filter, with
+// the periods in the $dateToString format, and the expired items at now.
+func kpiPipeline(filter map[string]interface{}, format string, now time.Time) []interface{} {
+	// Items without an arrival have no period
+	matchFilter := map[string]interface{}{
+		"$and": []interface{}{
+			filter,
+			map[string]interface{}{
+				"date_arrived": map[string]interface{}{
+					"$gt": 0,
+				},
+			},
+		},
+	}
+
+	weight := func(field string) map[string]interface{} {
+		return map[string]interface{}{
+			"$ifNull": []interface{}{"$" + field, 0},
+		}
+	}
+	isSold := map[string]interface{}{
+		"$gt": []interface{}{"$date_sold", 0},
+	}
+
+	// The per-item values, which are summed by the $group
+	project := map[string]interface{}{
+		"name":          1,
+		"origin":        1,
+		"total_weight":  weight("total_weight"),
+		"sold_weight":   weight("sold_weight"),
+		"waste_weight":  weight("waste_weight"),
+		"donate_weight": weight("donate_weight"),
+		"period": map[string]interface{}{
+			"$dateToString": map[string]interface{}{
+				"format": format,
+				"date": map[string]interface{}{
+					"$add": []interface{}{
+						time.Unix(0, 0).UTC(),
+						map[string]interface{}{
+							"$multiply": []interface{}{"$date_arrived", 1000},
+						},
+					},
+				},
+			},
+		},
+		"sold": map[string]interface{}{
+			"$cond": []interface{}{isSold, 1, 0},
+		},
+		// $avg skips the nulls of unsold items
+		"days_to_sell": map[string]interface{}{
+			"$cond": []interface{}{
+				isSold,
+				map[string]interface{}{
+					"$divide": []interface{}{
+						map[string]interface{}{
+							"$subtract": []interface{}{"$date_sold", "$date_arrived"},
+						},
+						86400,
+					},
+				},
+				nil,
+			},
+		},
+		"shrink_weight": map[string]interface{}{
+			"$cond": []interface{}{
+				map[string]interface{}{
+					"$and": []interface{}{
+						map[string]interface{}{
+							"$gt": []interface{}{"$expiry_date", 0},
+						},
+						map[string]interface{}{
+							"$lt": []interface{}{"$expiry_date", now.Unix()},
+						},
+					},
+				},
+				map[string]interface{}{
+					"$max": []interface{}{
+						0,
+						map[string]interface{}{
+							"$subtract": []interface{}{
+								weight("total_weight"),
+								map[string]interface{}{
+									"$add": []interface{}{
+										weight("sold_weight"),
+										weight("waste_weight"),
+										weight("donate_weight"),
+									},
+								},
+							},
+						},
+					},
+				},
+				0,
+			},
+		},
+	}
+
+	sum := func(field string) map[string]interface{} {
+		return map[string]interface{}{
+			"$sum": "$" + field,
+		}
+	}
+	group := map[string]interface{}{
+		"_id": map[string]interface{}{
+			"name":   "$name",
+			"origin": "$origin",
+			"period": "$period",
+		},
+		"items": map[string]interface{}{
+			"$sum": 1,
+		},
+		"sold_items":    sum("sold"),
+		"total_weight":  sum("total_weight"),
+		"sold_weight":   sum("sold_weight"),
+		"waste_weight":  sum("waste_weight"),
+		"donate_weight": sum("donate_weight"),
+		"shrink_weight": sum("shrink_weight"),
+		"avg_days_to_sell": map[string]interface{}{
+			"$avg": "$days_to_sell",
+		},
+	}
+
+	addPcts := map[string]interface{}{
+		"sell_through_pct": pctOfTotal("sold_weight"),
+		"waste_pct":        pctOfTotal("waste_weight"),
+		"donation_pct":     pctOfTotal("donate_weight"),
+		"shrink_pct":       pctOfTotal("shrink_weight"),
+	}
+
+	return []interface{}{
+		map[string]interface{}{
+			"$match": matchFilter,
+		},
+		map[string]interface{}{
+			"$project": project,
+		},
+		map[string]interface{}{
+			"$group": group,
+		},
+		map[string]interface{}{
+			"$addFields": addPcts,
+		},
+		bson.NewDocument(
+			bson.EC.SubDocumentFromElements(
+				"$sort",
+				bson.EC.Int32("_id.period", 1),
+				bson.EC.Int32("_id.name", 1),
+				bson.EC.Int32("_id.origin", 1),
+			),
+		),
+	}
+}
+
+// kpiResult reads the KPI from a result of the kpiPipeline.
+func kpiResult(value map[string]interface{}) KPI {
+	id, _ := value["_id"].(map[string]interface{})
+	kpi := KPI{
+		SellThroughPct: roundedFloat(value["sell_through_pct"]),
+		WastePct:       roundedFloat(value["waste_pct"]),
+		DonationPct:    roundedFloat(value["donation_pct"]),
+		ShrinkPct:      roundedFloat(value["shrink_pct"]),
+		AvgDaysToSell:  roundedFloat(value["avg_days_to_sell"]),
+	}
+	kpi.Name, _ = id["name"].(string)
+	kpi.Origin, _ = id["origin"].(string)
+	kpi.Period, _ = id["period"].(string)
+
+	items, _ := toFloat(value["items"])
+	soldItems, _ := toFloat(value["sold_items"])
+	kpi.Items = int64(items)
+	kpi.SoldItems = int64(soldItems)
+	kpi.TotalWeight, _ = toFloat(value["total_weight"])
+	kpi.SoldWeight, _ = toFloat(value["sold_weight"])
+	kpi.WasteWeight, _ = toFloat(value["waste_weight"])
+	kpi.DonateWeight, _ = toFloat(value["donate_weight"])
+	kpi.ShrinkWeight, _ = toFloat(value["shrink_weight"])
+	return kpi
+}
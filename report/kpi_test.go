@@ -0,0 +1,149 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+)
+
+func TestKPIParamsValidate(t *testing.T) {
+	tests := []struct {
+		params  *KPIParams
+		want    string
+		wantErr bool
+	}{
+		{params: nil, want: "month"},
+		{params: &KPIParams{}, want: "month"},
+		{params: &KPIParams{Period: "day"}, want: "day"},
+		{params: &KPIParams{Period: "week"}, want: "week"},
+		{params: &KPIParams{Period: "year"}, want: "year", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got := test.params.period()
+		if got != test.want {
+			t.Errorf("%+v: got period %s, want %s", test.params, got, test.want)
+		}
+		if test.params == nil {
+			continue
+		}
+		verrs := test.params.validate("kpi")
+		if (len(verrs) > 0) != test.wantErr {
+			t.Errorf("%+v: got errors %v, want errors %t", test.params, verrs, test.wantErr)
+		}
+	}
+}
+
+func TestKPIPipeline(t *testing.T) {
+	now := time.Unix(1539820800, 0)
+	filter := map[string]interface{}{"name": map[string]interface{}{"$eq": "Banana"}}
+
+	pipeline := kpiPipeline(filter, kpiPeriodFormats["week"], now)
+	stages := []string{}
+	for _, stage := range pipeline {
+		switch s := stage.(type) {
+		case map[string]interface{}:
+			for key := range s {
+				stages = append(stages, key)
+			}
+		case *bson.Document:
+			stages = append(stages, s.ElementAt(0).Key())
+		}
+	}
+	wantStages := []string{"$match", "$project", "$group", "$addFields", "$sort"}
+	if !reflect.DeepEqual(stages, wantStages) {
+		t.Fatalf("got stages %v, want %v", stages, wantStages)
+	}
+
+	project := pipeline[1].(map[string]interface{})["$project"].(map[string]interface{})
+	period := project["period"].(map[string]interface{})["$dateToString"].(map[string]interface{})
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{
+			name: "items with an arrival",
+			got:  pipeline[0].(map[string]interface{})["$match"],
+			want: map[string]interface{}{
+				"$and": []interface{}{
+					filter,
+					map[string]interface{}{"date_arrived": map[string]interface{}{"$gt": 0}},
+				},
+			},
+		},
+		{
+			name: "period format",
+			got:  period["format"],
+			want: "%G-W%V",
+		},
+		{
+			name: "groups",
+			got:  pipeline[2].(map[string]interface{})["$group"].(map[string]interface{})["_id"],
+			want: map[string]interface{}{"name": "$name", "origin": "$origin", "period": "$period"},
+		},
+	}
+
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestKPIResult(t *testing.T) {
+	pct := func(v float64) *float64 {
+		return &v
+	}
+
+	tests := []struct {
+		name  string
+		value map[string]interface{}
+		want  KPI
+	}{
+		{
+			name: "sold items",
+			value: map[string]interface{}{
+				"_id":              map[string]interface{}{"name": "Banana", "origin": "ON", "period": "2018-10"},
+				"items":            int32(3),
+				"sold_items":       int32(2),
+				"total_weight":     30.0,
+				"sold_weight":      20.0,
+				"waste_weight":     int32(5),
+				"donate_weight":    0.0,
+				"shrink_weight":    5.0,
+				"sell_through_pct": 66.66666,
+				"waste_pct":        16.66666,
+				"donation_pct":     0.0,
+				"shrink_pct":       16.66666,
+				"avg_days_to_sell": 2.5,
+			},
+			want: KPI{
+				Name: "Banana", Origin: "ON", Period: "2018-10", Items: 3, SoldItems: 2,
+				TotalWeight: 30, SoldWeight: 20, WasteWeight: 5, ShrinkWeight: 5,
+				SellThroughPct: pct(66.67), WastePct: pct(16.67), DonationPct: pct(0),
+				ShrinkPct: pct(16.67), AvgDaysToSell: pct(2.5),
+			},
+		},
+		{
+			name: "no weight or sales",
+			value: map[string]interface{}{
+				"_id":              map[string]interface{}{"name": "Mango", "origin": "MX", "period": "2018-10"},
+				"items":            int64(1),
+				"sell_through_pct": nil,
+				"avg_days_to_sell": nil,
+			},
+			want: KPI{Name: "Mango", Origin: "MX", Period: "2018-10", Items: 1},
+		},
+	}
+
+	for _, test := range tests {
+		got := kpiResult(test.value)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -22,32 +22,123 @@ type Metric struct {
 	CarbonDi         float64           `bson:"carbon_di,omitempty" json:"carbon_di,omitempty"`
 	Version          int64             `bson:"version,omitempty" json:"version,omitempty"`
 	AggregateVersion int64             `bson:"aggregate_version,omitempty" json:"aggregate_version,omitempty"`
+
+	// Interval, Count, Min and Max are only set for the rollups of metrics
+	// (see CompactedMetric), whose readings are the means of Count readings
+	// over Interval seconds.
+	Interval int64              `bson:"interval,omitempty" json:"interval,omitempty"`
+	Count    int64              `bson:"count,omitempty" json:"count,omitempty"`
+	Min      map[string]float64 `bson:"min,omitempty" json:"min,omitempty"`
+	Max      map[string]float64 `bson:"max,omitempty" json:"max,omitempty"`
+
+	// selectedFields are the fields serialized by MarshalJSON, all if empty
+	selectedFields []string
+	// zeroReadings are the readingBits of the channels with a zero reading,
+	// so these can be told apart from missing readings
+	zeroReadings uint8
+}
+
+// readingBits are the bits of the channels in Metric.zeroReadings.
+var readingBits = map[string]uint8{
+	"temp_in":   1 << 0,
+	"humidity":  1 << 1,
+	"ethylene":  1 << 2,
+	"carbon_di": 1 << 3,
 }
 
 type marshalMetric struct {
-	ID               objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
-	RsCustomerID     string            `bson:"rs_customer_id,omitempty" json:"rs_customer_id,omitempty"`
-	ItemID           string            `bson:"item_id,omitempty" json:"item_id,omitempty"`
-	DeviceID         string            `bson:"device_id,omitempty" json:"device_id,omitempty"`
-	Timestamp        int64             `bson:"timestamp,omitempty" json:"timestamp,omitempty"`
-	TempIn           float64           `bson:"temp_in,omitempty" json:"temp_in,omitempty"`
-	Humidity         float64           `bson:"humidity,omitempty" json:"humidity,omitempty"`
-	Ethylene         float64           `bson:"ethylene,omitempty" json:"ethylene,omitempty"`
-	CarbonDi         float64           `bson:"carbon_di,omitempty" json:"carbon_di,omitempty"`
-	Version          int64             `bson:"version,omitempty" json:"version,omitempty"`
-	AggregateVersion int64             `bson:"aggregate_version,omitempty" json:"aggregate_version,omitempty"`
+	ID               objectid.ObjectID  `bson:"_id,omitempty" json:"_id,omitempty"`
+	RsCustomerID     string             `bson:"rs_customer_id,omitempty" json:"rs_customer_id,omitempty"`
+	ItemID           string             `bson:"item_id,omitempty" json:"item_id,omitempty"`
+	DeviceID         string             `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	Timestamp        int64              `bson:"timestamp,omitempty" json:"timestamp,omitempty"`
+	TempIn           *float64           `bson:"temp_in,omitempty" json:"temp_in,omitempty"`
+	Humidity         *float64           `bson:"humidity,omitempty" json:"humidity,omitempty"`
+	Ethylene         *float64           `bson:"ethylene,omitempty" json:"ethylene,omitempty"`
+	CarbonDi         *float64           `bson:"carbon_di,omitempty" json:"carbon_di,omitempty"`
+	Version          int64              `bson:"version,omitempty" json:"version,omitempty"`
+	AggregateVersion int64              `bson:"aggregate_version,omitempty" json:"aggregate_version,omitempty"`
+	Interval         int64              `bson:"interval,omitempty" json:"interval,omitempty"`
+	Count            int64              `bson:"count,omitempty" json:"count,omitempty"`
+	Min              map[string]float64 `bson:"min,omitempty" json:"min,omitempty"`
+	Max              map[string]float64 `bson:"max,omitempty" json:"max,omitempty"`
+}
+
+// Reading returns the reading of the channel, and false if the Metric
+// has none. Zero readings are missing, unless set with SetReading or read
+// from a stored metric.
+func (m *Metric) Reading(channel string) (float64, bool) {
+	field := m.channelField(channel)
+	if field == nil {
+		return 0, false
+	}
+	return *field, *field != 0 || m.zeroReadings&readingBits[channel] != 0
+}
+
+// SetReading sets the reading of the channel, which is kept if it is zero.
+func (m *Metric) SetReading(channel string, value float64) {
+	field := m.channelField(channel)
+	if field == nil {
+		return
+	}
+	*field = value
+	if value == 0 {
+		m.zeroReadings |= readingBits[channel]
+	} else {
+		m.zeroReadings &^= readingBits[channel]
+	}
+}
+
+// channelField returns the field of the channel, or nil if it is unknown.
+func (m *Metric) channelField(channel string) *float64 {
+	switch channel {
+	case "temp_in":
+		return &m.TempIn
+	case "humidity":
+		return &m.Humidity
+	case "ethylene":
+		return &m.Ethylene
+	case "carbon_di":
+		return &m.CarbonDi
+	}
+	return nil
+}
+
+// storedReading returns the reading of the channel as it is stored,
+// which is nil if the Metric has none.
+func (m *Metric) storedReading(channel string) *float64 {
+	if value, ok := m.Reading(channel); ok {
+		return &value
+	}
+	return nil
+}
+
+// storedFieldValue returns the stored readings, so the zero readings
+// are compared and paged as they are stored.
+func (m Metric) storedFieldValue(field string) (interface{}, bool) {
+	if _, ok := readingBits[field]; !ok {
+		return nil, false
+	}
+	if value := m.storedReading(field); value != nil {
+		return *value, true
+	}
+	return nil, true
 }
 
 func (m Metric) MarshalBSON() ([]byte, error) {
 	mm := &marshalMetric{
 		ID:               m.ID,
 		Timestamp:        m.Timestamp,
-		Ethylene:         m.Ethylene,
-		TempIn:           m.TempIn,
-		Humidity:         m.Humidity,
-		CarbonDi:         m.CarbonDi,
+		Ethylene:         m.storedReading("ethylene"),
+		TempIn:           m.storedReading("temp_in"),
+		Humidity:         m.storedReading("humidity"),
+		CarbonDi:         m.storedReading("carbon_di"),
 		Version:          m.Version,
 		AggregateVersion: m.AggregateVersion,
+		Interval:         m.Interval,
+		Count:            m.Count,
+		Min:              m.Min,
+		Max:              m.Max,
 	}
 
 	if m.ItemID.String() != (uuuid.UUID{}).String() {
@@ -64,12 +155,16 @@ func (m *Metric) MarshalJSON() ([]byte, error) {
 	mm := &marshalMetric{
 		ID:               m.ID,
 		Timestamp:        m.Timestamp,
-		Ethylene:         m.Ethylene,
-		TempIn:           m.TempIn,
-		Humidity:         m.Humidity,
-		CarbonDi:         m.CarbonDi,
+		Ethylene:         m.storedReading("ethylene"),
+		TempIn:           m.storedReading("temp_in"),
+		Humidity:         m.storedReading("humidity"),
+		CarbonDi:         m.storedReading("carbon_di"),
 		Version:          m.Version,
 		AggregateVersion: m.AggregateVersion,
+		Interval:         m.Interval,
+		Count:            m.Count,
+		Min:              m.Min,
+		Max:              m.Max,
 	}
 
 	if m.ItemID.String() != (uuuid.UUID{}).String() {
@@ -80,7 +175,11 @@ func (m *Metric) MarshalJSON() ([]byte, error) {
 		mm.DeviceID = m.DeviceID.String()
 	}
 
-	return json.Marshal(mm)
+	out, err := json.Marshal(mm)
+	if err != nil {
+		return nil, err
+	}
+	return selectJSONFields(out, m.selectedFields)
 }
 
 func (r *Metric) UnmarshalBSON(in []byte) error {
@@ -122,6 +221,7 @@ func (r *Metric) UnmarshalBSON(in []byte) error {
 				r.TempIn = float64(val)
 			}
 		}
+		r.SetReading("temp_in", r.TempIn)
 	}
 
 	if m["humidity"] != nil {
@@ -133,6 +233,7 @@ func (r *Metric) UnmarshalBSON(in []byte) error {
 				r.Humidity = float64(val)
 			}
 		}
+		r.SetReading("humidity", r.Humidity)
 	}
 
 	if m["ethylene"] != nil {
@@ -144,6 +245,7 @@ func (r *Metric) UnmarshalBSON(in []byte) error {
 				r.Ethylene = float64(val)
 			}
 		}
+		r.SetReading("ethylene", r.Ethylene)
 	}
 
 	if m["carbon_di"] != nil {
@@ -155,6 +257,7 @@ func (r *Metric) UnmarshalBSON(in []byte) error {
 				r.CarbonDi = float64(val)
 			}
 		}
+		r.SetReading("carbon_di", r.CarbonDi)
 	}
 
 	if m["timestamp"] != nil {
@@ -194,6 +297,12 @@ func (r *Metric) UnmarshalBSON(in []byte) error {
 		}
 	}
 
+	// The rollups of metrics have their interval, count and extremes
+	r.Interval, _ = toInt(m["interval"])
+	r.Count, _ = toInt(m["count"])
+	r.Min = floatMap(m["min"])
+	r.Max = floatMap(m["max"])
+
 	return nil
 }
 
@@ -236,6 +345,7 @@ func (r *Metric) UnmarshalJSON(in []byte) error {
 				r.TempIn = float64(val)
 			}
 		}
+		r.SetReading("temp_in", r.TempIn)
 	}
 
 	if m["humidity"] != nil {
@@ -247,6 +357,7 @@ func (r *Metric) UnmarshalJSON(in []byte) error {
 				r.Humidity = float64(val)
 			}
 		}
+		r.SetReading("humidity", r.Humidity)
 	}
 
 	if m["ethylene"] != nil {
@@ -258,6 +369,7 @@ func (r *Metric) UnmarshalJSON(in []byte) error {
 				r.Ethylene = float64(val)
 			}
 		}
+		r.SetReading("ethylene", r.Ethylene)
 	}
 
 	if m["carbon_di"] != nil {
@@ -269,6 +381,7 @@ func (r *Metric) UnmarshalJSON(in []byte) error {
 				r.CarbonDi = float64(val)
 			}
 		}
+		r.SetReading("carbon_di", r.CarbonDi)
 	}
 
 	if m["timestamp"] != nil {
@@ -308,5 +421,11 @@ func (r *Metric) UnmarshalJSON(in []byte) error {
 		}
 	}
 
+	// The rollups of metrics have their interval, count and extremes
+	r.Interval, _ = toInt(m["interval"])
+	r.Count, _ = toInt(m["count"])
+	r.Min = floatMap(m["min"])
+	r.Max = floatMap(m["max"])
+
 	return nil
 }
@@ -0,0 +1,519 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/pkg/errors"
+)
+
+// DefaultPageSize is used when PageParams.Size is not set.
+const DefaultPageSize = 50
+
+// MaxPageSize is the largest allowed PageParams.Size.
+const MaxPageSize = 1000
+
+// SortField is a field to sort the search-results on.
+type SortField struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc,omitempty"`
+}
+
+// PageParams defines the pagination for a search.
+// Cursor is the NextCursor from the previous page, and must be used
+// with the same query and sort-order it was generated for.
+type PageParams struct {
+	Size   int64       `json:"size,omitempty"`
+	Cursor string      `json:"cursor,omitempty"`
+	Sort   []SortField `json:"sort,omitempty"`
+}
+
+// PageResult is the pagination-info for a page of search-results.
+// NextCursor is empty when there are no more results.
+type PageResult struct {
+	Total      int64  `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// pageCursor is the decoded form of the opaque continuation-token.
+// It contains the sort-values and ID of the last document on a page,
+// or the Offset of the next page for ranked results.
+type pageCursor struct {
+	Values []interface{} `json:"v,omitempty"`
+	ID     string        `json:"id,omitempty"`
+	Offset int64         `json:"o,omitempty"`
+}
+
+func decodeCursor(encoded string) (*pageCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		err = errors.Wrap(err, "Invalid cursor")
+		return nil, err
+	}
+	cursor := &pageCursor{}
+	err = json.Unmarshal(decoded, cursor)
+	if err != nil {
+		err = errors.Wrap(err, "Invalid cursor")
+		return nil, err
+	}
+	return cursor, nil
+}
+
+func encodeCursor(cursor *pageCursor) (string, error) {
+	encoded, err := json.Marshal(cursor)
+	if err != nil {
+		err = errors.Wrap(err, "Error encoding cursor")
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+func (p *PageParams) size() int64 {
+	if p.Size <= 0 {
+		return DefaultPageSize
+	}
+	if p.Size > MaxPageSize {
+		return MaxPageSize
+	}
+	return p.Size
+}
+
+// continues returns true if the page continues from a cursor. A page
+// past the last one has no results, which is not an error.
+func (p *PageParams) continues() bool {
+	return p != nil && p.Cursor != ""
+}
+
+// sortDocument creates the sort-document for Find. The _id is always
+// added as the last sort-field so that the sort-order is stable.
+func (p *PageParams) sortDocument() *bson.Document {
+	doc := bson.NewDocument()
+	for _, s := range p.Sort {
+		if s.Field == "_id" {
+			continue
+		}
+		order := int32(1)
+		if s.Desc {
+			order = -1
+		}
+		doc.Append(bson.EC.Int32(s.Field, order))
+	}
+	doc.Append(bson.EC.Int32("_id", 1))
+	return doc
+}
+
+// sortFields returns the sort-fields, excluding _id.
+func (p *PageParams) sortFields() []SortField {
+	fields := []SortField{}
+	for _, s := range p.Sort {
+		if s.Field != "_id" {
+			fields = append(fields, s)
+		}
+	}
+	return fields
+}
+
+// compare orders the documents a and b by the sort-fields and _id, as
+// they are sorted by sortDocument.
+func (p *PageParams) compare(a interface{}, b interface{}) int {
+	for _, s := range p.sortFields() {
+		c := compareValues(bsonFieldValue(a, s.Field), bsonFieldValue(b, s.Field))
+		if s.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareValues(bsonFieldValue(a, "_id"), bsonFieldValue(b, "_id"))
+}
+
+// compareValues orders the values of sort-fields as Mongo does: missing
+// values first, then numbers, strings and ObjectIDs.
+func compareValues(a interface{}, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case string:
+			return 2
+		case objectid.ObjectID:
+			return 3
+		}
+		if _, ok := toFloat(v); ok {
+			return 1
+		}
+		return 4
+	}
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	switch ra {
+	case 1:
+		fa, _ := toFloat(a)
+		fb, _ := toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+	case 2:
+		return strings.Compare(a.(string), b.(string))
+	case 3:
+		idA, idB := a.(objectid.ObjectID), b.(objectid.ObjectID)
+		return bytes.Compare(idA[:], idB[:])
+	}
+	return 0
+}
+
+// cursorFilter creates the filter matching the documents
+// after the cursor in the sort-order.
+func (p *PageParams) cursorFilter() (map[string]interface{}, error) {
+	cursor, err := decodeCursor(p.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := p.sortFields()
+	if len(cursor.Values) != len(fields) {
+		return nil, errors.New("Cursor does not match the sort-fields")
+	}
+	id, err := objectid.FromHex(cursor.ID)
+	if err != nil {
+		err = errors.Wrap(err, "Invalid cursor")
+		return nil, err
+	}
+
+	// For sort-fields (a, b), the documents after (va, vb, id) are:
+	//  a > va OR (a = va AND b > vb) OR (a = va AND b = vb AND _id > id)
+	or := []interface{}{}
+	equal := map[string]interface{}{}
+	for i, s := range fields {
+		value := cursor.Values[i]
+
+		var after interface{}
+		switch {
+		case value == nil && !s.Desc:
+			// Missing fields sort first, so anything present is after them
+			after = map[string]interface{}{"$ne": nil}
+		case value == nil && s.Desc:
+			// Nothing sorts after missing fields in descending order
+		case s.Desc:
+			after = map[string]interface{}{"$lt": value}
+		default:
+			after = map[string]interface{}{"$gt": value}
+		}
+
+		if after != nil {
+			cond := map[string]interface{}{}
+			for k, v := range equal {
+				cond[k] = v
+			}
+			cond[s.Field] = after
+			or = append(or, cond)
+		}
+		equal[s.Field] = value
+	}
+
+	cond := map[string]interface{}{}
+	for k, v := range equal {
+		cond[k] = v
+	}
+	cond["_id"] = map[string]interface{}{"$gt": id}
+	or = append(or, cond)
+
+	return map[string]interface{}{
+		"$or": or,
+	}, nil
+}
+
+// nextCursor creates the continuation-token from the last document on a page.
+func (p *PageParams) nextCursor(lastDoc interface{}) (string, error) {
+	cursor := &pageCursor{
+		Values: []interface{}{},
+	}
+	for _, s := range p.sortFields() {
+		cursor.Values = append(cursor.Values, bsonFieldValue(lastDoc, s.Field))
+	}
+	id, ok := bsonFieldValue(lastDoc, "_id").(objectid.ObjectID)
+	if !ok {
+		return "", errors.New("Document has no ObjectID")
+	}
+	cursor.ID = id.Hex()
+	return encodeCursor(cursor)
+}
+
+// cursorOffset returns the offset of the page for ranked results.
+func (p *PageParams) cursorOffset() (int64, error) {
+	if p.Cursor == "" {
+		return 0, nil
+	}
+	cursor, err := decodeCursor(p.Cursor)
+	if err != nil {
+		return 0, err
+	}
+	if cursor.ID != "" || len(cursor.Values) > 0 || cursor.Offset < 0 {
+		return 0, errors.New("Cursor is not for ranked results")
+	}
+	return cursor.Offset, nil
+}
+
+// offsetCursor creates the continuation-token for ranked results.
+func offsetCursor(offset int64) (string, error) {
+	return encodeCursor(&pageCursor{
+		Offset: offset,
+	})
+}
+
+// pageFilter restricts the filter to the documents after the cursor.
+func (p *PageParams) pageFilter(filter map[string]interface{}) (map[string]interface{}, error) {
+	if p.Cursor == "" {
+		return filter, nil
+	}
+	cursorFilter, err := p.cursorFilter()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"$and": []interface{}{filter, cursorFilter},
+	}, nil
+}
+
+// pageProjection adds the sort-fields to the projection,
+// since these are needed for creating the next cursor.
+func (p *PageParams) pageProjection(proj map[string]interface{}) map[string]interface{} {
+	if proj == nil {
+		return nil
+	}
+	for _, s := range p.sortFields() {
+		proj[s.Field] = 1
+	}
+	return proj
+}
+
+// findQuery is a compiled search, which is run by findPage and explained
+// by explainFind, so that the explanation is of the search which is run.
+// The page is optional, and so is the projection, to which the sort-fields
+// are added when paginating.
+// Computed are the aggregation-expressions of the sort-fields whose sorted
+// values are not stored, by sort-field. Such pages are aggregated instead
+// (see aggregatePage).
+type findQuery struct {
+	filter   map[string]interface{}
+	page     *PageParams
+	proj     map[string]interface{}
+	computed map[string]interface{}
+}
+
+// findPage finds a page of documents matching the filter of the findQuery,
+// along with the total number of documents matching the filter.
+// If its page is nil, all matching documents are returned and PageResult is nil.
+func (db *DB) findPage(q *findQuery) ([]interface{}, *PageResult, error) {
+	filter, page, proj := q.filter, q.page, q.proj
+	if page == nil {
+		opts := []findopt.Find{}
+		if proj != nil {
+			opts = append(opts, findopt.Projection(proj))
+		}
+		findResults, err := db.collection.Find(filter, opts...)
+		return findResults, nil, err
+	}
+	if len(q.computed) > 0 {
+		return db.aggregatePage(q)
+	}
+
+	timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	total, err := db.collection.Collection().CountDocuments(ctx, filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error counting documents - findPage")
+		log.Println(err)
+		return nil, nil, err
+	}
+
+	pageFilter, err := page.pageFilter(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size := page.size()
+	// One extra document tells if there is a next page
+	opts := []findopt.Find{
+		findopt.Sort(page.sortDocument()),
+		findopt.Limit(size + 1),
+	}
+	if proj != nil {
+		opts = append(opts, findopt.Projection(page.pageProjection(proj)))
+	}
+	findResults, err := db.collection.Find(pageFilter, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &PageResult{
+		Total: total,
+	}
+	if int64(len(findResults)) > size {
+		findResults = findResults[:size]
+		result.NextCursor, err = page.nextCursor(findResults[size-1])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return findResults, result, nil
+}
+
+// computedField is the field which a computed sort-field is added as.
+func computedField(field string) string {
+	return "computed_" + field
+}
+
+// computedPage returns the page of the findQuery, which is sorted on the
+// computed fields instead of the computed sort-fields.
+func (q *findQuery) computedPage() *PageParams {
+	page := *q.page
+	page.Sort = []SortField{}
+	for _, s := range q.page.Sort {
+		if _, ok := q.computed[s.Field]; ok {
+			s.Field = computedField(s.Field)
+		}
+		page.Sort = append(page.Sort, s)
+	}
+	return &page
+}
+
+// pipeline returns the aggregation-pipeline which finds the page of the
+// findQuery. Its computed sort-fields are added as computed fields, which
+// the documents are sorted and paginated on.
+func (q *findQuery) pipeline() ([]interface{}, error) {
+	page := q.computedPage()
+
+	computed := map[string]interface{}{}
+	for field, expr := range q.computed {
+		computed[computedField(field)] = expr
+	}
+	pipeline := []interface{}{
+		map[string]interface{}{
+			"$match": q.filter,
+		},
+		map[string]interface{}{
+			"$addFields": computed,
+		},
+	}
+	if page.Cursor != "" {
+		cursorFilter, err := page.cursorFilter()
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, map[string]interface{}{
+			"$match": cursorFilter,
+		})
+	}
+	// One extra document tells if there is a next page
+	pipeline = append(
+		pipeline,
+		map[string]interface{}{
+			"$sort": page.sortDocument(),
+		},
+		map[string]interface{}{
+			"$limit": page.size() + 1,
+		},
+	)
+
+	if q.proj != nil {
+		// The computed fields are needed for creating the next cursor
+		proj := page.pageProjection(q.page.pageProjection(q.proj))
+		pipeline = append(pipeline, map[string]interface{}{
+			"$project": proj,
+		})
+	}
+	return pipeline, nil
+}
+
+// aggregatePage is findPage for the findQuery with computed sort-fields.
+// The next cursor has the values of the computed fields, so it can only
+// be created from documents which have these values in the sort-fields,
+// such as the metrics corrected by the Calibrator.
+func (db *DB) aggregatePage(q *findQuery) ([]interface{}, *PageResult, error) {
+	timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	total, err := db.collection.Collection().CountDocuments(ctx, q.filter)
+	if err != nil {
+		err = errors.Wrap(err, "Error counting documents - aggregatePage")
+		log.Println(err)
+		return nil, nil, err
+	}
+
+	pipeline, err := q.pipeline()
+	if err != nil {
+		return nil, nil, err
+	}
+	cur, err := db.collection.Collection().Aggregate(ctx, pipeline)
+	if err != nil {
+		err = errors.Wrap(err, "Error aggregating documents - aggregatePage")
+		log.Println(err)
+		return nil, nil, err
+	}
+	defer cur.Close(ctx)
+
+	schema := reflect.TypeOf(db.collection.SchemaStruct).Elem()
+	findResults := []interface{}{}
+	docs := []map[string]interface{}{}
+	for cur.Next(ctx) {
+		raw, err := cur.DecodeBytes()
+		if err != nil {
+			err = errors.Wrap(err, "Error reading document - aggregatePage")
+			return nil, nil, err
+		}
+		result := reflect.New(schema).Interface()
+		err = bson.Unmarshal(raw, result)
+		if err != nil {
+			err = errors.Wrap(err, "Error decoding document - aggregatePage")
+			return nil, nil, err
+		}
+		// The computed fields are only in the aggregated documents
+		doc := map[string]interface{}{}
+		err = bson.Unmarshal(raw, doc)
+		if err != nil {
+			err = errors.Wrap(err, "Error decoding document - aggregatePage")
+			return nil, nil, err
+		}
+		findResults = append(findResults, result)
+		docs = append(docs, doc)
+	}
+	if err := cur.Err(); err != nil {
+		err = errors.Wrap(err, "Error reading documents - aggregatePage")
+		return nil, nil, err
+	}
+
+	result := &PageResult{
+		Total: total,
+	}
+	if size := q.page.size(); int64(len(findResults)) > size {
+		findResults = findResults[:size]
+		result.NextCursor, err = q.computedPage().nextCursor(docs[size-1])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return findResults, result, nil
+}
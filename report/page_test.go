@@ -0,0 +1,243 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+)
+
+func TestCompareValues(t *testing.T) {
+	low, _ := objectid.FromHex("5bc8a0000000000000000001")
+	high, _ := objectid.FromHex("5bc8a0000000000000000002")
+
+	tests := []struct {
+		name string
+		a, b interface{}
+		want int
+	}{
+		{"equal numbers", 2.0, int64(2), 0},
+		{"numbers", int32(1), 1.5, -1},
+		{"negative numbers", -3.0, int64(-4), 1},
+		{"strings", "apple", "banana", -1},
+		{"equal strings", "kiwi", "kiwi", 0},
+		{"ObjectIDs", high, low, 1},
+		{"missing before numbers", nil, 0.0, -1},
+		{"both missing", nil, nil, 0},
+		{"numbers before strings", "1", 2.0, 1},
+		{"strings before ObjectIDs", "z", low, -1},
+	}
+
+	for _, test := range tests {
+		if got := compareValues(test.a, test.b); got != test.want {
+			t.Errorf("%s: compareValues(%v, %v) = %d, want %d", test.name, test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestPageCompare(t *testing.T) {
+	low, _ := objectid.FromHex("5bc8a0000000000000000001")
+	high, _ := objectid.FromHex("5bc8a0000000000000000002")
+	frozen := Metric{ID: high}
+	frozen.SetReading("temp_in", 0)
+
+	tests := []struct {
+		name string
+		sort []SortField
+		a, b Metric
+		want int
+	}{
+		{"by _id", nil, Metric{ID: high, Timestamp: 1}, Metric{ID: low, Timestamp: 2}, 1},
+		{
+			"by timestamp",
+			[]SortField{{Field: "timestamp"}},
+			Metric{ID: high, Timestamp: 1}, Metric{ID: low, Timestamp: 2},
+			-1,
+		},
+		{
+			"descending",
+			[]SortField{{Field: "timestamp", Desc: true}},
+			Metric{ID: high, Timestamp: 1}, Metric{ID: low, Timestamp: 2},
+			1,
+		},
+		{
+			"ties are ordered by _id",
+			[]SortField{{Field: "timestamp", Desc: true}},
+			Metric{ID: low, Timestamp: 2}, Metric{ID: high, Timestamp: 2},
+			-1,
+		},
+		{
+			"zero readings after missing readings",
+			[]SortField{{Field: "temp_in"}},
+			frozen, Metric{ID: low},
+			1,
+		},
+		{
+			"zero readings before positive readings",
+			[]SortField{{Field: "temp_in"}},
+			frozen, Metric{ID: low, TempIn: 0.5},
+			-1,
+		},
+	}
+
+	for _, test := range tests {
+		page := &PageParams{Sort: test.sort}
+		if got := page.compare(&test.a, &test.b); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNextCursor(t *testing.T) {
+	id, _ := objectid.FromHex("5bc8a0000000000000000001")
+	frozen := Metric{ID: id}
+	frozen.SetReading("temp_in", 0)
+
+	tests := []struct {
+		name   string
+		metric Metric
+		want   []interface{}
+	}{
+		{"reading", Metric{ID: id, TempIn: 4.5}, []interface{}{4.5}},
+		{"zero reading", frozen, []interface{}{0.0}},
+		{"missing reading", Metric{ID: id}, []interface{}{nil}},
+	}
+
+	page := &PageParams{Sort: []SortField{{Field: "temp_in"}}}
+	for _, test := range tests {
+		encoded, err := page.nextCursor(&test.metric)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		cursor, err := decodeCursor(encoded)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cursor.Values, test.want) || cursor.ID != id.Hex() {
+			t.Errorf("%s: got cursor %+v, want values %v", test.name, cursor, test.want)
+		}
+	}
+}
+
+func TestCursorFilter(t *testing.T) {
+	id, _ := objectid.FromHex("5bc8a0000000000000000001")
+	cursor := func(values ...interface{}) string {
+		encoded, _ := encodeCursor(&pageCursor{Values: values, ID: id.Hex()})
+		return encoded
+	}
+	afterID := map[string]interface{}{"$gt": id}
+
+	tests := []struct {
+		name    string
+		page    PageParams
+		want    []interface{}
+		wantErr bool
+	}{
+		{
+			name: "by _id",
+			page: PageParams{Cursor: cursor()},
+			want: []interface{}{
+				map[string]interface{}{"_id": afterID},
+			},
+		},
+		{
+			name: "ascending",
+			page: PageParams{Cursor: cursor(4.5), Sort: []SortField{{Field: "temp_in"}}},
+			want: []interface{}{
+				map[string]interface{}{"temp_in": map[string]interface{}{"$gt": 4.5}},
+				map[string]interface{}{"temp_in": 4.5, "_id": afterID},
+			},
+		},
+		{
+			name: "descending and ascending",
+			page: PageParams{
+				Cursor: cursor("Mango", 2.0),
+				Sort:   []SortField{{Field: "name", Desc: true}, {Field: "price"}},
+			},
+			want: []interface{}{
+				map[string]interface{}{"name": map[string]interface{}{"$lt": "Mango"}},
+				map[string]interface{}{"name": "Mango", "price": map[string]interface{}{"$gt": 2.0}},
+				map[string]interface{}{"name": "Mango", "price": 2.0, "_id": afterID},
+			},
+		},
+		{
+			name: "missing value ascending",
+			page: PageParams{Cursor: cursor(nil), Sort: []SortField{{Field: "lot"}}},
+			want: []interface{}{
+				map[string]interface{}{"lot": map[string]interface{}{"$ne": nil}},
+				map[string]interface{}{"lot": nil, "_id": afterID},
+			},
+		},
+		{
+			name: "missing value descending",
+			page: PageParams{Cursor: cursor(nil), Sort: []SortField{{Field: "lot", Desc: true}}},
+			want: []interface{}{
+				map[string]interface{}{"lot": nil, "_id": afterID},
+			},
+		},
+		{
+			name: "_id is not a sort-value",
+			page: PageParams{Cursor: cursor(), Sort: []SortField{{Field: "_id", Desc: true}}},
+			want: []interface{}{
+				map[string]interface{}{"_id": afterID},
+			},
+		},
+		{
+			name:    "sort-fields changed",
+			page:    PageParams{Cursor: cursor(4.5)},
+			wantErr: true,
+		},
+		{
+			name:    "not base64",
+			page:    PageParams{Cursor: "%%%"},
+			wantErr: true,
+		},
+		{
+			name:    "ranked cursor",
+			page:    PageParams{Cursor: func() string { c, _ := offsetCursor(20); return c }()},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		filter, err := test.page.cursorFilter()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(filter["$or"], test.want) {
+			t.Errorf("%s: got filter %v, want $or %v", test.name, filter, test.want)
+		}
+	}
+}
+
+func TestCursorOffset(t *testing.T) {
+	ranked, _ := offsetCursor(40)
+	sorted, _ := encodeCursor(&pageCursor{Values: []interface{}{1.0}, ID: "5bc8a0000000000000000001"})
+
+	tests := []struct {
+		name    string
+		cursor  string
+		want    int64
+		wantErr bool
+	}{
+		{"first page", "", 0, false},
+		{"next page", ranked, 40, false},
+		{"cursor of sorted results", sorted, 0, true},
+		{"invalid cursor", "x", 0, true},
+	}
+
+	for _, test := range tests {
+		page := &PageParams{Cursor: test.cursor}
+		got, err := page.cursorOffset()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got offset %d, want %d", test.name, got, test.want)
+		}
+	}
+}
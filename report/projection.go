@@ -0,0 +1,60 @@
+package report
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// FieldSet lists the fields (bson/json names) to be returned for each entity.
+// All fields are returned for an entity if its list is empty.
+type FieldSet struct {
+	Inventory []string `json:"inventory,omitempty"`
+	Metric    []string `json:"metric,omitempty"`
+	Device    []string `json:"device,omitempty"`
+	Warning   []string `json:"warning,omitempty"`
+	Anomaly   []string `json:"anomaly,omitempty"`
+}
+
+// projection creates the Mongo projection for the fields.
+// The required fields are also fetched (such as the IDs used for joining
+// or the sort-fields for pagination), but these are not serialized unless
+// they are also present in fields.
+// Returns nil if no fields are specified, so all fields are fetched.
+func projection(fields []string, required ...string) map[string]interface{} {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	proj := map[string]interface{}{}
+	for _, f := range fields {
+		proj[f] = 1
+	}
+	for _, f := range required {
+		proj[f] = 1
+	}
+	return proj
+}
+
+// selectJSONFields removes the keys not present in fields from
+// the JSON-object. The JSON is returned unchanged if fields is empty.
+func selectJSONFields(in []byte, fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return in, nil
+	}
+
+	m := map[string]json.RawMessage{}
+	err := json.Unmarshal(in, &m)
+	if err != nil {
+		err = errors.Wrap(err, "Error selecting JSON fields")
+		return nil, err
+	}
+
+	selected := map[string]json.RawMessage{}
+	for _, f := range fields {
+		if v, ok := m[f]; ok {
+			selected[f] = v
+		}
+	}
+	return json.Marshal(selected)
+}
@@ -0,0 +1,114 @@
+package report
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/TerrexTech/uuuid"
+)
+
+func TestProjection(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   []string
+		required []string
+		want     map[string]interface{}
+	}{
+		{name: "all fields", fields: nil, required: []string{"item_id"}, want: nil},
+		{
+			name:   "fields",
+			fields: []string{"name", "lot"},
+			want:   map[string]interface{}{"name": 1, "lot": 1},
+		},
+		{
+			name:     "required fields",
+			fields:   []string{"name"},
+			required: []string{"item_id", "name"},
+			want:     map[string]interface{}{"name": 1, "item_id": 1},
+		},
+	}
+
+	for _, test := range tests {
+		got := projection(test.fields, test.required...)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSelectJSONFields(t *testing.T) {
+	in := []byte(`{"name":"Banana","lot":"A1","price":1.5}`)
+
+	tests := []struct {
+		name    string
+		in      []byte
+		fields  []string
+		want    string
+		wantErr bool
+	}{
+		{name: "all fields", in: in, fields: nil, want: string(in)},
+		{name: "selected fields", in: in, fields: []string{"price", "name"}, want: `{"name":"Banana","price":1.5}`},
+		{name: "unknown field", in: in, fields: []string{"lot", "x"}, want: `{"lot":"A1"}`},
+		{name: "not an object", in: []byte(`[1]`), fields: []string{"name"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := selectJSONFields(test.in, test.fields)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && string(got) != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestInventorySelectFields(t *testing.T) {
+	itemID, _ := uuuid.FromString("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+
+	tests := []struct {
+		name   string
+		score  float64
+		fields []string
+		// want are the keys of the serialized inventory
+		want []string
+	}{
+		{name: "selected fields", fields: []string{"item_id", "name"}, want: []string{"item_id", "name"}},
+		{name: "text search", score: 2, fields: []string{"name"}, want: []string{"name", "score"}},
+	}
+
+	for _, test := range tests {
+		inv := Inventory{ItemID: itemID, Name: "Banana", Lot: "A1", Score: test.score}
+		inv.SelectFields(test.fields)
+		out, err := json.Marshal(&inv)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		m := map[string]json.RawMessage{}
+		err = json.Unmarshal(out, &m)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		got := []string{}
+		for _, f := range []string{"item_id", "name", "lot", "score"} {
+			if _, ok := m[f]; ok {
+				got = append(got, f)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got fields %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// All fields are serialized without selected fields
+	out, _ := json.Marshal(&Inventory{Name: "Banana", Lot: "A1"})
+	m := map[string]json.RawMessage{}
+	json.Unmarshal(out, &m)
+	if _, ok := m["lot"]; !ok {
+		t.Errorf("got %s, want all fields", out)
+	}
+}
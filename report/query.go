@@ -0,0 +1,199 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// SearchQuery is the request-body accepted by the report endpoints.
+// Each entity has its own query-tree.
+// Text is an optional text-search over Inventory, ANDed with its query-tree.
+// Page is optional, and applies to the main entity of the report.
+// Fields is optional, and limits the fields returned for each entity.
+// SavedSearchID runs the query-trees of a SavedSearch instead, and
+// requires the RsCustomerID owning the SavedSearch.
+// Explain returns how the search would run, instead of its results. It is
+// rejected by the reports which aggregate their results.
+// Units are the output-units of the calibrated readings, by channel,
+// such as {"temp_in": "F", "ethylene": "ppb"} (see ChannelUnits).
+// The metric query-tree is matched against the stored readings.
+// The reports with params of their own embed the SearchQuery in their
+// request-body, such as the RollupQuery.
+type SearchQuery struct {
+	Inventory     *QueryNode        `json:"inventory,omitempty"`
+	Metric        *QueryNode        `json:"metric,omitempty"`
+	Device        *QueryNode        `json:"device,omitempty"`
+	Warning       *QueryNode        `json:"warning,omitempty"`
+	Anomaly       *QueryNode        `json:"anomaly,omitempty"`
+	Text          *TextSearch       `json:"text,omitempty"`
+	Page          *PageParams       `json:"page,omitempty"`
+	Fields        *FieldSet         `json:"fields,omitempty"`
+	SavedSearchID string            `json:"saved_search_id,omitempty"`
+	RsCustomerID  string            `json:"rs_customer_id,omitempty"`
+	Explain       bool              `json:"explain,omitempty"`
+	Units         map[string]string `json:"units,omitempty"`
+}
+
+// ReportQuery is the request-body of a report, which is either the
+// SearchQuery, or the query of a report embedding the SearchQuery.
+type ReportQuery interface {
+	// Search returns the SearchQuery of the request-body.
+	Search() *SearchQuery
+	Validate() ValidationErrors
+}
+
+// Search returns the SearchQuery itself, which is the request-body of
+// the reports without params of their own.
+func (q *SearchQuery) Search() *SearchQuery {
+	return q
+}
+
+// WithOverrides returns a copy of the (saved) SearchQuery, with its
+// Page, Fields and Units replaced by those in the request, if set.
+// Explain is always taken from the request.
+func (q *SearchQuery) WithOverrides(req *SearchQuery) *SearchQuery {
+	merged := &SearchQuery{}
+	if q != nil {
+		*merged = *q
+	}
+	merged.SavedSearchID = ""
+	merged.RsCustomerID = ""
+	merged.Explain = false
+
+	if req != nil {
+		merged.Explain = req.Explain
+		if req.Page != nil {
+			merged.Page = req.Page
+		}
+		if req.Fields != nil {
+			merged.Fields = req.Fields
+		}
+		if req.Units != nil {
+			merged.Units = req.Units
+		}
+	}
+	return merged
+}
+
+// QueryNode is a node in a boolean query-tree.
+// A node is either a group (And, Or, Not) or a leaf-condition
+// described by the embedded SearchParam.
+// For example, "(name = Mango OR name = Banana) AND origin != ON Canada" is:
+//
+//	{"and": [
+//	  {"or": [
+//	    {"Field": "name", "Type": "string", "Equal": "Mango"},
+//	    {"Field": "name", "Type": "string", "Equal": "Banana"}
+//	  ]},
+//	  {"not": {"Field": "origin", "Type": "string", "Equal": "ON Canada"}}
+//	]}
+//
+// A plain array of SearchParams is also accepted, and its
+// conditions are ANDed together.
+type QueryNode struct {
+	SearchParam
+	And []*QueryNode `json:"and,omitempty"`
+	Or  []*QueryNode `json:"or,omitempty"`
+	Not *QueryNode   `json:"not,omitempty"`
+}
+
+// UnmarshalJSON allows the QueryNode to be specified as an array of
+// SearchParams, which is how the search-requests were specified before.
+func (q *QueryNode) UnmarshalJSON(in []byte) error {
+	in = bytes.TrimSpace(in)
+	if len(in) > 0 && in[0] == '[' {
+		params := []SearchParam{}
+		err := json.Unmarshal(in, &params)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing array of SearchParams")
+			return err
+		}
+		for _, p := range params {
+			q.And = append(q.And, &QueryNode{SearchParam: p})
+		}
+		return nil
+	}
+
+	// Alias prevents recursion into this UnmarshalJSON
+	type queryNode QueryNode
+	node := (*queryNode)(q)
+	return json.Unmarshal(in, node)
+}
+
+// isLeaf returns true if the QueryNode is a condition and not a group.
+func (q *QueryNode) isLeaf() bool {
+	return q.And == nil && q.Or == nil && q.Not == nil
+}
+
+// Filter compiles the query-tree into a Mongo filter.
+// AND and OR groups compile to $and and $or, and NOT compiles to $nor.
+// A nil or empty QueryNode matches all documents.
+func (q *QueryNode) Filter() (map[string]interface{}, error) {
+	return q.compile(SearchParam.filter)
+}
+
+// compile compiles the query-tree into a Mongo filter, using leaf to
+// compile its SearchParams.
+func (q *QueryNode) compile(leaf func(SearchParam) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	if q == nil {
+		return map[string]interface{}{}, nil
+	}
+
+	if q.isLeaf() {
+		if q.Field == "" && q.Type == "" {
+			return map[string]interface{}{}, nil
+		}
+		return leaf(q.SearchParam)
+	}
+
+	filter := map[string]interface{}{}
+	if q.And != nil {
+		and, err := filterList(q.And, leaf)
+		if err != nil {
+			err = errors.Wrap(err, "Error compiling AND-group")
+			return nil, err
+		}
+		if len(and) > 0 {
+			filter["$and"] = and
+		}
+	}
+	if q.Or != nil {
+		or, err := filterList(q.Or, leaf)
+		if err != nil {
+			err = errors.Wrap(err, "Error compiling OR-group")
+			return nil, err
+		}
+		if len(or) > 0 {
+			filter["$or"] = or
+		}
+	}
+	if q.Not != nil {
+		not, err := q.Not.compile(leaf)
+		if err != nil {
+			err = errors.Wrap(err, "Error compiling NOT-group")
+			return nil, err
+		}
+		filter["$nor"] = []interface{}{not}
+	}
+	return filter, nil
+}
+
+func filterList(
+	nodes []*QueryNode,
+	leaf func(SearchParam) (map[string]interface{}, error),
+) ([]interface{}, error) {
+	filters := []interface{}{}
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		f, err := n.compile(leaf)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
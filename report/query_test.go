@@ -0,0 +1,183 @@
+package report
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestReportQueryValidate(t *testing.T) {
+	inventory := `"inventory": [{"Field": "name", "Type": "string", "Equal": "Mango"}]`
+
+	tests := []struct {
+		name  string
+		query ReportQuery
+		body  string
+		// want are the paths of the validation errors
+		want []string
+	}{
+		{"search", &SearchQuery{}, `{` + inventory + `}`, nil},
+		{"search with invalid field", &SearchQuery{}, `{"inventory": [{"Field": "x", "Type": "string"}]}`, []string{"inventory.and[0]"}},
+		{"search ignores report params", &SearchQuery{}, `{"rollup": {"group_by": "x"}}`, nil},
+		{"rollup", &RollupQuery{}, `{` + inventory + `, "rollup": {"group_by": "device", "interval": "hourly"}}`, nil},
+		{"invalid rollup", &RollupQuery{}, `{"rollup": {"group_by": "x", "interval": "hourly"}}`, []string{"rollup.group_by"}},
+		{"invalid search and rollup", &RollupQuery{}, `{"inventory": [{"Field": "x", "Type": "string"}], "rollup": {"group_by": "item", "interval": "x"}}`, []string{"inventory.and[0]", "rollup.interval"}},
+		{"correlation", &CorrelationQuery{}, `{"correlation": {"unit": "lot"}}`, nil},
+		{"invalid correlation", &CorrelationQuery{}, `{"correlation": {"unit": "x"}}`, []string{"correlation.unit"}},
+		{"invalid heartbeat", &HeartbeatQuery{}, `{"heartbeat": {"from": 2, "to": 1}}`, []string{"heartbeat.from"}},
+		{"invalid distribution", &DistributionQuery{}, `{"distribution": {"group_by": "x"}}`, []string{"distribution.group_by"}},
+		{"invalid kpi", &KPIQuery{}, `{"kpi": {"period": "x"}}`, []string{"kpi.period"}},
+		{"invalid expiry risk", &ExpiryRiskQuery{}, `{"expiry_risk": {"horizon": "x"}}`, []string{"expiry_risk.horizon"}},
+		{"invalid flash sale", &FlashSaleQuery{}, `{"flash_sale": {"horizon": "x"}}`, []string{"flash_sale.horizon"}},
+		{"invalid donation", &DonationQuery{}, `{"donation": {"period": "x"}}`, []string{"donation.period"}},
+		{"params are optional", &DonationQuery{}, `{` + inventory + `}`, nil},
+	}
+
+	for _, test := range tests {
+		err := json.Unmarshal([]byte(test.body), test.query)
+		if err != nil {
+			t.Errorf("%s: Unmarshal: %v", test.name, err)
+			continue
+		}
+		verrs := test.query.Validate()
+		if test.want == nil {
+			if verrs != nil {
+				t.Errorf("%s: got errors %v, want none", test.name, verrs)
+			}
+			continue
+		}
+		got := []string{}
+		for _, e := range verrs {
+			got = append(got, e.Path)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got errors at %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWithOverrides(t *testing.T) {
+	inventory := &QueryNode{SearchParam: SearchParam{Field: "name", Type: "string", Op: OpEqual, Value: "Mango"}}
+	saved := &SearchQuery{
+		Inventory: inventory,
+		Page:      &PageParams{Size: 10},
+		Units:     map[string]string{"temp_in": "F"},
+	}
+
+	tests := []struct {
+		name  string
+		saved *SearchQuery
+		req   *SearchQuery
+		want  SearchQuery
+	}{
+		{
+			name:  "saved query-trees",
+			saved: saved,
+			req:   &SearchQuery{SavedSearchID: "x", Inventory: &QueryNode{}},
+			want:  SearchQuery{Inventory: inventory, Page: saved.Page, Units: saved.Units},
+		},
+		{
+			name:  "overrides",
+			saved: saved,
+			req:   &SearchQuery{Page: &PageParams{Size: 5}, Units: map[string]string{}, Explain: true},
+			want:  SearchQuery{Inventory: inventory, Page: &PageParams{Size: 5}, Units: map[string]string{}, Explain: true},
+		},
+		{
+			name:  "saved without a query",
+			saved: nil,
+			req:   &SearchQuery{Explain: true},
+			want:  SearchQuery{Explain: true},
+		},
+	}
+
+	for _, test := range tests {
+		got := test.saved.WithOverrides(test.req)
+		if !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, test.want)
+		}
+	}
+}
+
+func TestQueryNodeFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		node    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			node: `{}`,
+			want: `{}`,
+		},
+		{
+			name: "leaf",
+			node: `{"Field": "name", "Type": "string", "Op": "eq", "Value": "Mango"}`,
+			want: `{"name": {"$eq": "Mango"}}`,
+		},
+		{
+			name: "array of SearchParams",
+			node: `[{"Field": "name", "Type": "string", "Equal": "Mango"}, {"Field": "origin", "Type": "string", "Equal": "ON"}]`,
+			want: `{"$and": [{"name": {"$eq": "Mango"}}, {"origin": {"$eq": "ON"}}]}`,
+		},
+		{
+			name: "nested groups",
+			node: `{"and": [
+				{"or": [
+					{"Field": "name", "Type": "string", "Equal": "Mango"},
+					{"Field": "name", "Type": "string", "Equal": "Banana"}
+				]},
+				{"not": {"Field": "origin", "Type": "string", "Equal": "ON Canada"}}
+			]}`,
+			want: `{"$and": [
+				{"$or": [{"name": {"$eq": "Mango"}}, {"name": {"$eq": "Banana"}}]},
+				{"$nor": [{"origin": {"$eq": "ON Canada"}}]}
+			]}`,
+		},
+		{
+			name: "empty group",
+			node: `{"and": []}`,
+			want: `{}`,
+		},
+		{
+			name:    "invalid leaf in a group",
+			node:    `{"or": [{"Field": "name", "Type": "string", "Op": "gt"}]}`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		node := &QueryNode{}
+		err := json.Unmarshal([]byte(test.node), node)
+		if err != nil {
+			t.Errorf("%s: Unmarshal: %v", test.name, err)
+			continue
+		}
+		filter, err := node.Filter()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		// The filters are compared as JSON, since the values are nested
+		got, _ := json.Marshal(filter)
+		want := map[string]interface{}{}
+		err = json.Unmarshal([]byte(test.want), &want)
+		if err != nil {
+			t.Errorf("%s: Unmarshal want: %v", test.name, err)
+			continue
+		}
+		wantJSON, _ := json.Marshal(want)
+		if string(got) != string(wantJSON) {
+			t.Errorf("%s: got filter %s, want %s", test.name, got, wantJSON)
+		}
+	}
+
+	var nilNode *QueryNode
+	if filter, err := nilNode.Filter(); err != nil || len(filter) != 0 {
+		t.Errorf("nil QueryNode: got filter %v and error %v, want an empty filter", filter, err)
+	}
+}
@@ -0,0 +1,447 @@
+package report
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/insertopt"
+	"github.com/pkg/errors"
+)
+
+// RetentionPolicy is how long metrics are kept. Raw metrics are compacted
+// into rollups of Interval seconds, and are deleted after RawRetention.
+// The rollups are deleted after RollupRetention, or kept if it is zero.
+// Lookback is how far back the rollups are recompacted on each run, so
+// readings which arrive late are included.
+type RetentionPolicy struct {
+	RawRetention    time.Duration
+	RollupRetention time.Duration
+	Interval        int64
+	Lookback        time.Duration
+	BatchSize       int64
+}
+
+// CompactedMetric is the rollup of the metrics of an item and device over
+// Interval seconds, from Timestamp. It is stored with the same fields as
+// Metric (with the mean of the readings, or without the channel if it has
+// no readings), so the rollups can be searched like metrics. Counts, Min,
+// Max and StdDev are the number of readings, extremes and population
+// standard-deviation of each channel, so the statistics of rollups can
+// be combined. Digest is the digest of the readings of each channel, for
+// the percentiles of the rollups.
+type CompactedMetric struct {
+	ID        objectid.ObjectID     `bson:"_id,omitempty" json:"_id,omitempty"`
+	ItemID    string                `bson:"item_id,omitempty" json:"item_id,omitempty"`
+	DeviceID  string                `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	Timestamp int64                 `bson:"timestamp" json:"timestamp"`
+	Interval  int64                 `bson:"interval" json:"interval"`
+	Count     int64                 `bson:"count" json:"count"`
+	TempIn    *float64              `bson:"temp_in,omitempty" json:"temp_in,omitempty"`
+	Humidity  *float64              `bson:"humidity,omitempty" json:"humidity,omitempty"`
+	Ethylene  *float64              `bson:"ethylene,omitempty" json:"ethylene,omitempty"`
+	CarbonDi  *float64              `bson:"carbon_di,omitempty" json:"carbon_di,omitempty"`
+	Counts    map[string]int64      `bson:"counts,omitempty" json:"counts,omitempty"`
+	Min       map[string]float64    `bson:"min,omitempty" json:"min,omitempty"`
+	Max       map[string]float64    `bson:"max,omitempty" json:"max,omitempty"`
+	StdDev    map[string]float64    `bson:"stddev,omitempty" json:"stddev,omitempty"`
+	Digest    map[string][]Centroid `bson:"digest,omitempty" json:"digest,omitempty"`
+}
+
+// align rounds the timestamp down to the start of its rollup-interval.
+func (p *RetentionPolicy) align(timestamp int64) int64 {
+	return timestamp - timestamp%p.Interval
+}
+
+// RawCutoff is the time before which raw metrics are deleted.
+func (p *RetentionPolicy) RawCutoff(now time.Time) int64 {
+	return p.align(now.Add(-p.RawRetention).Unix())
+}
+
+// RollupCutoff is the time before which rollups are deleted,
+// or zero if they are kept.
+func (p *RetentionPolicy) RollupCutoff(now time.Time) int64 {
+	if p.RollupRetention == 0 {
+		return 0
+	}
+	return p.align(now.Add(-p.RollupRetention).Unix())
+}
+
+// UsesRollups returns true if the metric query-tree of the search reaches
+// back further than the RawCutoff, so it has to be read from the rollups.
+// Searches without a lower bound on the timestamp reach back to the first
+// rollup.
+func (p *RetentionPolicy) UsesRollups(search *SearchQuery, now time.Time) (bool, error) {
+	if p == nil {
+		return false, nil
+	}
+	if search == nil || search.Metric == nil {
+		return true, nil
+	}
+	filter, err := search.Metric.Filter()
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling metric query - UsesRollups")
+		return false, err
+	}
+	lower, ok := lowerBound(filter, "timestamp")
+	return !ok || lower < float64(p.RawCutoff(now)), nil
+}
+
+// SplitSearch splits the search at the RawCutoff, into the search of the
+// rollups before the cutoff, and the search of the raw metrics from the
+// cutoff onward. The raw metrics before the cutoff are left out, since
+// they are deleted soon, and are already in the rollups.
+func (p *RetentionPolicy) SplitSearch(search *SearchQuery, now time.Time) (*SearchQuery, *SearchQuery) {
+	cutoff := p.RawCutoff(now)
+	rollups := *search
+	rollups.Metric = withTimestamp(search.Metric, OpLess, cutoff)
+	raw := *search
+	raw.Metric = withTimestamp(search.Metric, OpGreaterEqual, cutoff)
+	return &rollups, &raw
+}
+
+// withTimestamp ANDs the query-tree with the condition on the timestamp.
+func withTimestamp(node *QueryNode, op string, timestamp int64) *QueryNode {
+	cond := &QueryNode{
+		SearchParam: SearchParam{
+			Field: "timestamp",
+			Type:  "int",
+			Op:    op,
+			Value: timestamp,
+		},
+	}
+	if node == nil {
+		return cond
+	}
+	return &QueryNode{
+		And: []*QueryNode{node, cond},
+	}
+}
+
+// lowerBound returns the lowest value of the field which can match the
+// filter, or false if the filter does not bound the field.
+func lowerBound(filter map[string]interface{}, field string) (float64, bool) {
+	bound, found := 0.0, false
+	// The filter matches the highest bound of its conditions
+	raise := func(b float64) {
+		if !found || b > bound {
+			bound, found = b, true
+		}
+	}
+
+	for key, value := range filter {
+		switch key {
+		case "$and":
+			list, _ := value.([]interface{})
+			for _, f := range list {
+				sub, _ := f.(map[string]interface{})
+				if b, ok := lowerBound(sub, field); ok {
+					raise(b)
+				}
+			}
+
+		case "$or":
+			// Every branch needs a bound, and the lowest one applies
+			list, _ := value.([]interface{})
+			orBound, orFound := 0.0, len(list) > 0
+			for i, f := range list {
+				sub, _ := f.(map[string]interface{})
+				b, ok := lowerBound(sub, field)
+				if !ok {
+					orFound = false
+					break
+				}
+				if i == 0 || b < orBound {
+					orBound = b
+				}
+			}
+			if orFound {
+				raise(orBound)
+			}
+
+		case field:
+			cond, ok := value.(map[string]interface{})
+			if !ok {
+				if b, ok := toFloat(value); ok {
+					raise(b)
+				}
+				continue
+			}
+			for op, v := range cond {
+				switch op {
+				case "$eq", "$gt", "$gte":
+					if b, ok := toFloat(v); ok {
+						raise(b)
+					}
+				case "$in":
+					list, _ := v.([]interface{})
+					inBound, inFound := 0.0, len(list) > 0
+					for i, item := range list {
+						b, ok := toFloat(item)
+						if !ok {
+							inFound = false
+							break
+						}
+						if i == 0 || b < inBound {
+							inBound = b
+						}
+					}
+					if inFound {
+						raise(inBound)
+					}
+				}
+			}
+		}
+	}
+	return bound, found
+}
+
+// CompactMetrics rolls up the metrics from the time "from" until "to"
+// (exclusive) by item, device and interval.
+func (db *DB) CompactMetrics(from int64, to int64, interval int64) ([]CompactedMetric, error) {
+	group := map[string]interface{}{
+		"_id": map[string]interface{}{
+			"item_id":   "$item_id",
+			"device_id": "$device_id",
+			"bucket": map[string]interface{}{
+				"$subtract": []interface{}{
+					"$timestamp",
+					map[string]interface{}{
+						"$mod": []interface{}{"$timestamp", interval},
+					},
+				},
+			},
+		},
+		"count": map[string]interface{}{
+			"$sum": 1,
+		},
+	}
+	for _, channel := range RollupChannels {
+		group[channel] = map[string]interface{}{"$avg": "$" + channel}
+		group[channel+"_count"] = map[string]interface{}{
+			"$sum": map[string]interface{}{
+				"$cond": []interface{}{
+					map[string]interface{}{
+						"$gt": []interface{}{"$" + channel, nil},
+					},
+					1,
+					0,
+				},
+			},
+		}
+		group[channel+"_min"] = map[string]interface{}{"$min": "$" + channel}
+		group[channel+"_max"] = map[string]interface{}{"$max": "$" + channel}
+		group[channel+"_stddev"] = map[string]interface{}{"$stdDevPop": "$" + channel}
+		group[channel+"_values"] = map[string]interface{}{"$push": "$" + channel}
+	}
+
+	pipeline := []interface{}{
+		map[string]interface{}{
+			"$match": map[string]interface{}{
+				"timestamp": map[string]interface{}{
+					"$gte": from,
+					"$lt":  to,
+				},
+			},
+		},
+		map[string]interface{}{
+			"$group": group,
+		},
+	}
+
+	aggResults, err := db.collection.Aggregate(pipeline)
+	if err != nil {
+		err = errors.Wrap(err, "Error compacting metrics - CompactMetrics")
+		log.Println(err)
+		return nil, err
+	}
+
+	compacted := []CompactedMetric{}
+	for _, r := range aggResults {
+		result, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := result["_id"].(map[string]interface{})
+		bucket, ok := toFloat(id["bucket"])
+		if !ok {
+			continue
+		}
+		count, _ := toFloat(result["count"])
+
+		c := CompactedMetric{
+			Timestamp: int64(bucket),
+			Interval:  interval,
+			Count:     int64(count),
+			Counts:    map[string]int64{},
+			Min:       map[string]float64{},
+			Max:       map[string]float64{},
+			StdDev:    map[string]float64{},
+			Digest:    map[string][]Centroid{},
+		}
+		c.ItemID, _ = id["item_id"].(string)
+		c.DeviceID, _ = id["device_id"].(string)
+
+		means := map[string]**float64{
+			"temp_in":   &c.TempIn,
+			"humidity":  &c.Humidity,
+			"ethylene":  &c.Ethylene,
+			"carbon_di": &c.CarbonDi,
+		}
+		for _, channel := range RollupChannels {
+			// Channels without readings have null averages
+			mean, ok := toFloat(result[channel])
+			if !ok {
+				continue
+			}
+			*means[channel] = &mean
+			c.Counts[channel], _ = toInt(result[channel+"_count"])
+			c.Min[channel], _ = toFloat(result[channel+"_min"])
+			c.Max[channel], _ = toFloat(result[channel+"_max"])
+			c.StdDev[channel], _ = toFloat(result[channel+"_stddev"])
+			c.Digest[channel] = newDigest(toFloats(result[channel+"_values"]))
+		}
+		compacted = append(compacted, c)
+	}
+	return compacted, nil
+}
+
+// ReplaceCompacted replaces the rollups from the time "from" until "to"
+// (exclusive) with the compacted metrics. The compacted metrics are inserted
+// before the previous rollups are deleted, so the range is never without
+// rollups. If the insert fails, the compacted metrics which were inserted
+// are deleted again, and the previous rollups are kept.
+func (db *DB) ReplaceCompacted(from int64, to int64, compacted []CompactedMetric) error {
+	docs := []interface{}{}
+	ids := []interface{}{}
+	for i := range compacted {
+		compacted[i].ID = objectid.New()
+		docs = append(docs, compacted[i])
+		ids = append(ids, compacted[i].ID)
+	}
+
+	if len(docs) > 0 {
+		timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		_, err := db.collection.Collection().InsertMany(ctx, docs, insertopt.Ordered(false))
+		if err != nil {
+			err = errors.Wrap(err, "Unable to insert rollups - ReplaceCompacted")
+			log.Println(err)
+			_, delErr := db.collection.DeleteMany(map[string]interface{}{
+				"_id": map[string]interface{}{
+					"$in": ids,
+				},
+			})
+			if delErr != nil {
+				delErr = errors.Wrap(delErr, "Unable to delete inserted rollups - ReplaceCompacted")
+				log.Println(delErr)
+			}
+			return err
+		}
+	}
+
+	_, err := db.collection.DeleteMany(map[string]interface{}{
+		"timestamp": map[string]interface{}{
+			"$gte": from,
+			"$lt":  to,
+		},
+		"_id": map[string]interface{}{
+			"$nin": ids,
+		},
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Unable to delete previous rollups - ReplaceCompacted")
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// DeleteBefore deletes the documents with a timestamp before the time,
+// in batches of batchSize. Returns the number of deleted documents.
+func (db *DB) DeleteBefore(timestamp int64, batchSize int64) (int64, error) {
+	filter := map[string]interface{}{
+		"timestamp": map[string]interface{}{
+			"$lt": timestamp,
+		},
+	}
+
+	var deleted int64
+	for {
+		findResults, err := db.collection.Find(
+			filter,
+			findopt.Limit(batchSize),
+			findopt.Projection(map[string]interface{}{"_id": 1}),
+		)
+		if err != nil {
+			err = errors.Wrap(err, "Error while fetching expired documents - DeleteBefore")
+			log.Println(err)
+			return deleted, err
+		}
+		if len(findResults) == 0 {
+			return deleted, nil
+		}
+
+		ids := []interface{}{}
+		for _, v := range findResults {
+			ids = append(ids, v.(*Metric).ID)
+		}
+		deleteResult, err := db.collection.DeleteMany(map[string]interface{}{
+			"_id": map[string]interface{}{
+				"$in": ids,
+			},
+		})
+		if err != nil {
+			err = errors.Wrap(err, "Unable to delete expired documents - DeleteBefore")
+			log.Println(err)
+			return deleted, err
+		}
+		deleted += deleteResult.DeletedCount
+
+		if int64(len(findResults)) < batchSize {
+			return deleted, nil
+		}
+	}
+}
+
+// TimestampRange returns the earliest and latest timestamps in the
+// collection, which are zero if it is empty.
+func (db *DB) TimestampRange() (int64, int64, error) {
+	edge := func(order int32) (int64, error) {
+		findResults, err := db.collection.Find(
+			map[string]interface{}{
+				"timestamp": map[string]interface{}{
+					"$exists": true,
+				},
+			},
+			findopt.Sort(bson.NewDocument(
+				bson.EC.Int32("timestamp", order),
+			)),
+			findopt.Limit(1),
+			findopt.Projection(map[string]interface{}{"timestamp": 1}),
+		)
+		if err != nil || len(findResults) == 0 {
+			return 0, err
+		}
+		return findResults[0].(*Metric).Timestamp, nil
+	}
+
+	first, err := edge(1)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching the earliest timestamp - TimestampRange")
+		log.Println(err)
+		return 0, 0, err
+	}
+	last, err := edge(-1)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching the latest timestamp - TimestampRange")
+		log.Println(err)
+		return 0, 0, err
+	}
+	return first, last, nil
+}
@@ -0,0 +1,107 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitSearch(t *testing.T) {
+	policy := &RetentionPolicy{RawRetention: 24 * time.Hour, Interval: 3600}
+	now := time.Unix(1540000000, 0)
+	cutoff := policy.RawCutoff(now)
+
+	device := &QueryNode{
+		SearchParam: SearchParam{Field: "device_id", Type: "string", Op: OpEqual, Value: "d1"},
+	}
+	tests := []struct {
+		name   string
+		metric *QueryNode
+		// want are the filters of the rollups and raw metrics
+		wantRollups, wantRaw map[string]interface{}
+	}{
+		{
+			name:        "no metric query",
+			metric:      nil,
+			wantRollups: map[string]interface{}{"timestamp": map[string]interface{}{"$lt": cutoff}},
+			wantRaw:     map[string]interface{}{"timestamp": map[string]interface{}{"$gte": cutoff}},
+		},
+		{
+			name:   "metric query",
+			metric: device,
+			wantRollups: map[string]interface{}{"$and": []interface{}{
+				map[string]interface{}{"device_id": map[string]interface{}{"$eq": "d1"}},
+				map[string]interface{}{"timestamp": map[string]interface{}{"$lt": cutoff}},
+			}},
+			wantRaw: map[string]interface{}{"$and": []interface{}{
+				map[string]interface{}{"device_id": map[string]interface{}{"$eq": "d1"}},
+				map[string]interface{}{"timestamp": map[string]interface{}{"$gte": cutoff}},
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		search := &SearchQuery{Metric: test.metric}
+		rollups, raw := policy.SplitSearch(search, now)
+		if search.Metric != test.metric {
+			t.Errorf("%s: the search was modified", test.name)
+		}
+		for _, split := range []struct {
+			query *SearchQuery
+			want  map[string]interface{}
+		}{{rollups, test.wantRollups}, {raw, test.wantRaw}} {
+			got, err := split.query.Metric.Filter()
+			if err != nil {
+				t.Errorf("%s: Filter: %v", test.name, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, split.want) {
+				t.Errorf("%s: got filter %#v, want %#v", test.name, got, split.want)
+			}
+		}
+	}
+}
+
+func TestUsesRollups(t *testing.T) {
+	policy := &RetentionPolicy{RawRetention: 24 * time.Hour, Interval: 3600}
+	now := time.Unix(1540000000, 0)
+	cutoff := policy.RawCutoff(now)
+
+	since := func(timestamp int64) *QueryNode {
+		return &QueryNode{
+			SearchParam: SearchParam{Field: "timestamp", Type: "int", Op: OpGreaterEqual, Value: timestamp},
+		}
+	}
+	device := &QueryNode{
+		SearchParam: SearchParam{Field: "device_id", Type: "string", Op: OpEqual, Value: "d1"},
+	}
+	tests := []struct {
+		name   string
+		policy *RetentionPolicy
+		metric *QueryNode
+		want   bool
+	}{
+		{name: "no policy", policy: nil, metric: since(cutoff - 1), want: false},
+		{name: "no metric query", policy: policy, metric: nil, want: true},
+		{name: "no lower bound", policy: policy, metric: device, want: true},
+		{name: "before the cutoff", policy: policy, metric: since(cutoff - 1), want: true},
+		{name: "from the cutoff", policy: policy, metric: since(cutoff), want: false},
+		{
+			name:   "highest lower bound",
+			policy: policy,
+			metric: &QueryNode{And: []*QueryNode{since(cutoff - 1), since(cutoff)}},
+			want:   false,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := test.policy.UsesRollups(&SearchQuery{Metric: test.metric}, now)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
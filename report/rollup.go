@@ -0,0 +1,730 @@
+package report
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/pkg/errors"
+)
+
+// RollupChannels are the sensor-channels of Metric which are rolled up.
+var RollupChannels = []string{"temp_in", "humidity", "ethylene", "carbon_di"}
+
+// rollupIntervals are the named bucket-intervals.
+var rollupIntervals = map[string]time.Duration{
+	"5m":     5 * time.Minute,
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+}
+
+// RollupParams groups the metrics by device or item into time-buckets.
+// GroupBy is "device" or "item".
+// Interval is "5m", "hourly", "daily", or a custom duration such as "15m"
+// or "6h". Buckets are aligned to the Unix-epoch, so daily buckets are UTC days.
+// Channels defaults to all RollupChannels.
+type RollupParams struct {
+	GroupBy  string   `json:"group_by"`
+	Interval string   `json:"interval"`
+	Channels []string `json:"channels,omitempty"`
+}
+
+// RollupQuery is the request-body of the metric-rollup report.
+type RollupQuery struct {
+	SearchQuery
+	Rollup *RollupParams `json:"rollup,omitempty"`
+}
+
+// Validate checks the SearchQuery and the RollupParams.
+// Returns nil if the RollupQuery is valid.
+func (q *RollupQuery) Validate() ValidationErrors {
+	verrs := q.SearchQuery.Validate()
+	if q.Rollup != nil {
+		verrs = append(verrs, q.Rollup.validate("rollup")...)
+	}
+	return verrs
+}
+
+// ChannelStats are the statistics of a sensor-channel in a bucket.
+// StdDev is the population standard-deviation. P95 is the 95th percentile
+// (by nearest rank) of the digest of the readings, so it is exact for
+// buckets of up to digestSize readings.
+type ChannelStats struct {
+	Count  int64   `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+	P95    float64 `json:"p95"`
+
+	// digest is kept for merging the statistics
+	digest []Centroid
+}
+
+// Centroid is a group of Count readings of a channel, with the Mean value.
+type Centroid struct {
+	Mean  float64 `bson:"mean" json:"mean"`
+	Count int64   `bson:"count" json:"count"`
+}
+
+// digestSize is the most centroids a digest is compressed to. Digests of
+// up to digestSize readings keep every reading.
+const digestSize = 200
+
+// newDigest returns the digest of the readings.
+func newDigest(values []float64) []Centroid {
+	centroids := []Centroid{}
+	for _, v := range values {
+		centroids = append(centroids, Centroid{Mean: v, Count: 1})
+	}
+	return compressDigest(centroids)
+}
+
+// compressDigest sorts the centroids by their means, and merges neighbouring
+// centroids into at most digestSize centroids of about equal counts.
+// Centroids without readings are left out.
+func compressDigest(centroids []Centroid) []Centroid {
+	sorted := []Centroid{}
+	var total int64
+	for _, c := range centroids {
+		if c.Count > 0 {
+			sorted = append(sorted, c)
+			total += c.Count
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Mean < sorted[j].Mean
+	})
+	if len(sorted) <= digestSize {
+		return sorted
+	}
+
+	compressed := []Centroid{}
+	var rank int64
+	last := -1
+	for _, c := range sorted {
+		// The centroids are merged by the rank of their first reading
+		group := int(rank * digestSize / total)
+		rank += c.Count
+		if group != last {
+			compressed = append(compressed, c)
+			last = group
+			continue
+		}
+		m := &compressed[len(compressed)-1]
+		count := m.Count + c.Count
+		m.Mean = (m.Mean*float64(m.Count) + c.Mean*float64(c.Count)) / float64(count)
+		m.Count = count
+	}
+	return compressed
+}
+
+// digestPercentile returns the mean of the centroid of the reading at the
+// nearest rank of the percentile (0 to 1), or zero for an empty digest.
+func digestPercentile(digest []Centroid, p float64) float64 {
+	var total int64
+	for _, c := range digest {
+		total += c.Count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(p * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for _, c := range digest {
+		seen += c.Count
+		if seen >= rank {
+			return c.Mean
+		}
+	}
+	return digest[len(digest)-1].Mean
+}
+
+// digestCentroids reads the centroids of a digest in an aggregation result.
+func digestCentroids(value interface{}) []Centroid {
+	list, _ := value.([]interface{})
+	centroids := []Centroid{}
+	for _, v := range list {
+		doc, _ := v.(map[string]interface{})
+		mean, ok := toFloat(doc["mean"])
+		if !ok {
+			continue
+		}
+		count, _ := toInt(doc["count"])
+		centroids = append(centroids, Centroid{Mean: mean, Count: count})
+	}
+	return centroids
+}
+
+// RollupBucket contains the statistics of the metrics of a device or
+// item (GroupID), with Timestamps from Start until (excluding) End.
+type RollupBucket struct {
+	GroupID  string                   `json:"group_id"`
+	Start    int64                    `json:"start"`
+	End      int64                    `json:"end"`
+	Count    int64                    `json:"count"`
+	Channels map[string]*ChannelStats `json:"channels"`
+}
+
+// intervalSeconds returns the length of the buckets in seconds.
+func (p *RollupParams) intervalSeconds() (int64, error) {
+	return parseInterval(p.Interval)
+}
+
+// parseInterval returns the length in seconds of a named interval
+// ("5m", "hourly" or "daily") or of a duration such as "15m".
+func parseInterval(name string) (int64, error) {
+	interval, ok := rollupIntervals[name]
+	if !ok {
+		var err error
+		interval, err = time.ParseDuration(name)
+		if err != nil {
+			return 0, errors.Errorf(
+				"Invalid interval %s, expected one of 5m, hourly, daily or a duration such as 15m",
+				name,
+			)
+		}
+	}
+	if interval < time.Second || interval%time.Second != 0 {
+		return 0, errors.Errorf("Interval %s must be a whole number of seconds", name)
+	}
+	return int64(interval / time.Second), nil
+}
+
+// groupField returns the Metric field the buckets are grouped by.
+func (p *RollupParams) groupField() (string, error) {
+	switch p.GroupBy {
+	case "device":
+		return "device_id", nil
+	case "item":
+		return "item_id", nil
+	}
+	return "", errors.Errorf("Invalid group_by %s, expected device or item", p.GroupBy)
+}
+
+func (p *RollupParams) channels() []string {
+	if len(p.Channels) == 0 {
+		return RollupChannels
+	}
+	return p.Channels
+}
+
+// validate returns the problems with the RollupParams.
+func (p *RollupParams) validate(path string) ValidationErrors {
+	verrs := ValidationErrors{}
+	if _, err := p.groupField(); err != nil {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".group_by",
+			Message: err.Error(),
+		})
+	}
+	if _, err := p.intervalSeconds(); err != nil {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".interval",
+			Message: err.Error(),
+		})
+	}
+	for i, c := range p.Channels {
+		isChannel := false
+		for _, rc := range RollupChannels {
+			if c == rc {
+				isChannel = true
+				break
+			}
+		}
+		if !isChannel {
+			verrs = append(verrs, ValidationError{
+				Path:  fmt.Sprintf("%s.channels[%d]", path, i),
+				Field: c,
+				Message: fmt.Sprintf(
+					"Unknown channel %s, expected one of: %s",
+					c, strings.Join(RollupChannels, ", "),
+				),
+			})
+		}
+	}
+	return verrs
+}
+
+// toFloat converts the numeric values returned by aggregations.
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// toInt converts the integer values returned by aggregations.
+func toInt(value interface{}) (int64, bool) {
+	f, ok := toFloat(value)
+	return int64(f), ok
+}
+
+// toFloats converts the numbers of an array returned by aggregations,
+// such as by $push, skipping missing readings.
+func toFloats(value interface{}) []float64 {
+	list, _ := value.([]interface{})
+	floats := []float64{}
+	for _, v := range list {
+		if f, ok := toFloat(v); ok {
+			floats = append(floats, f)
+		}
+	}
+	return floats
+}
+
+// floatMap converts an embedded document of numbers, such as the "min"
+// of a rollup, or returns nil if the value is not a document.
+func floatMap(value interface{}) map[string]float64 {
+	doc, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	floats := map[string]float64{}
+	for k, v := range doc {
+		if f, ok := toFloat(v); ok {
+			floats[k] = f
+		}
+	}
+	return floats
+}
+
+// channelStats reads the statistics of the channel from the result of the
+// rollup $group. Channels without readings have empty statistics.
+func channelStats(result map[string]interface{}, channel string) *ChannelStats {
+	count, _ := toFloat(result[channel+"_count"])
+	if count == 0 {
+		return &ChannelStats{}
+	}
+
+	stats := &ChannelStats{
+		Count: int64(count),
+	}
+	stats.Min, _ = toFloat(result[channel+"_min"])
+	stats.Max, _ = toFloat(result[channel+"_max"])
+	stats.Mean, _ = toFloat(result[channel+"_avg"])
+	stats.StdDev, _ = toFloat(result[channel+"_stddev"])
+
+	stats.digest = newDigest(toFloats(result[channel+"_values"]))
+	stats.P95 = digestPercentile(stats.digest, 0.95)
+	return stats
+}
+
+// rollupSums reads the statistics of the channel from the result of the
+// $group of CompactedRollup, which are the sums of the counts, readings
+// and squared readings of the rollups, and the digests of the rollups.
+func rollupSums(result map[string]interface{}, channel string) *ChannelStats {
+	count, _ := toFloat(result[channel+"_count"])
+	if count == 0 {
+		return &ChannelStats{}
+	}
+
+	sum, _ := toFloat(result[channel+"_sum"])
+	sumSq, _ := toFloat(result[channel+"_sumsq"])
+	stats := &ChannelStats{
+		Count: int64(count),
+		Mean:  sum / count,
+	}
+	stats.Min, _ = toFloat(result[channel+"_min"])
+	stats.Max, _ = toFloat(result[channel+"_max"])
+	stats.StdDev = math.Sqrt(math.Max(sumSq/count-stats.Mean*stats.Mean, 0))
+
+	digest := []Centroid{}
+	digests, _ := result[channel+"_digests"].([]interface{})
+	for _, d := range digests {
+		digest = append(digest, digestCentroids(d)...)
+	}
+	stats.digest = compressDigest(digest)
+	stats.P95 = digestPercentile(stats.digest, 0.95)
+	return stats
+}
+
+// mergeChannelStats combines the statistics of two sets of readings.
+func mergeChannelStats(a *ChannelStats, b *ChannelStats) *ChannelStats {
+	if b == nil || b.Count == 0 {
+		merged := *a
+		return &merged
+	}
+	if a == nil || a.Count == 0 {
+		merged := *b
+		return &merged
+	}
+
+	na, nb := float64(a.Count), float64(b.Count)
+	n := na + nb
+	merged := &ChannelStats{
+		Count: a.Count + b.Count,
+		Min:   math.Min(a.Min, b.Min),
+		Max:   math.Max(a.Max, b.Max),
+		Mean:  (na*a.Mean + nb*b.Mean) / n,
+	}
+	// The mean of the squared readings, from the variance of each set
+	meanSq := (na*(a.StdDev*a.StdDev+a.Mean*a.Mean) + nb*(b.StdDev*b.StdDev+b.Mean*b.Mean)) / n
+	merged.StdDev = math.Sqrt(math.Max(meanSq-merged.Mean*merged.Mean, 0))
+	merged.digest = compressDigest(append(append([]Centroid{}, a.digest...), b.digest...))
+	merged.P95 = digestPercentile(merged.digest, 0.95)
+	return merged
+}
+
+// MergeRollupBuckets merges the buckets of the rollups (from
+// CompactedRollup) and of the raw metrics (from MetRollup), combining the
+// statistics of the buckets of the same group and start.
+func MergeRollupBuckets(rollups []RollupBucket, raw []RollupBucket) []RollupBucket {
+	merged := []RollupBucket{}
+	index := map[string]int{}
+	for _, buckets := range [][]RollupBucket{rollups, raw} {
+		for _, b := range buckets {
+			key := fmt.Sprintf("%s:%d", b.GroupID, b.Start)
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(merged)
+				merged = append(merged, b)
+				continue
+			}
+
+			m := &merged[i]
+			m.Count += b.Count
+			channels := map[string]*ChannelStats{}
+			for c, stats := range m.Channels {
+				channels[c] = mergeChannelStats(stats, b.Channels[c])
+			}
+			for c, stats := range b.Channels {
+				if _, ok := channels[c]; !ok {
+					channels[c] = stats
+				}
+			}
+			m.Channels = channels
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].GroupID != merged[j].GroupID {
+			return merged[i].GroupID < merged[j].GroupID
+		}
+		return merged[i].Start < merged[j].Start
+	})
+	return merged
+}
+
+// rollupSearch returns the RollupParams, the field the buckets are grouped
+// by, the bucket-interval and the filter of the search, which matches the
+// readings corrected by the Calibrator.
+func rollupSearch(searchInv []Inventory, search *RollupQuery, cal *Calibrator) (*RollupParams, string, int64, map[string]interface{}, error) {
+	if search == nil || search.Rollup == nil {
+		return nil, "", 0, nil, errors.New("Rollup is required")
+	}
+	rollup := search.Rollup
+
+	groupField, err := rollup.groupField()
+	if err != nil {
+		return nil, "", 0, nil, err
+	}
+	interval, err := rollup.intervalSeconds()
+	if err != nil {
+		return nil, "", 0, nil, err
+	}
+
+	ids := []string{}
+	for _, v := range searchInv {
+		ids = append(ids, v.ItemID.String())
+	}
+	findParams, err := metricJoinFilter(ids, search.Metric, cal)
+	if err != nil {
+		return nil, "", 0, nil, err
+	}
+	return rollup, groupField, interval, findParams, nil
+}
+
+// rollupGroupID is the _id of the rollup $group, which is the group and
+// the start of the bucket.
+func rollupGroupID(groupField string, interval int64) map[string]interface{} {
+	return map[string]interface{}{
+		"group": "$" + groupField,
+		"bucket": map[string]interface{}{
+			"$subtract": []interface{}{
+				"$timestamp",
+				map[string]interface{}{
+					"$mod": []interface{}{"$timestamp", interval},
+				},
+			},
+		},
+	}
+}
+
+// rollupBuckets runs the rollup pipeline, and reads the statistics of
+// the channels of each bucket using channelStats.
+func (db *DB) rollupBuckets(
+	pipeline []interface{},
+	channels []string,
+	interval int64,
+	channelStats func(map[string]interface{}, string) *ChannelStats,
+) ([]RollupBucket, error) {
+	pipeline = append(pipeline, bson.NewDocument(
+		bson.EC.SubDocumentFromElements(
+			"$sort",
+			bson.EC.Int32("_id.group", 1),
+			bson.EC.Int32("_id.bucket", 1),
+		),
+	))
+
+	aggResults, err := db.collection.Aggregate(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := []RollupBucket{}
+	for _, v := range aggResults {
+		value := v.(map[string]interface{})
+		id, _ := value["_id"].(map[string]interface{})
+		groupID, _ := id["group"].(string)
+		start, ok := toFloat(id["bucket"])
+		if !ok {
+			// Metrics without a timestamp have no bucket
+			continue
+		}
+		count, _ := toFloat(value["count"])
+
+		bucket := RollupBucket{
+			GroupID:  groupID,
+			Start:    int64(start),
+			End:      int64(start) + interval,
+			Count:    int64(count),
+			Channels: map[string]*ChannelStats{},
+		}
+		for _, c := range channels {
+			bucket.Channels[c] = channelStats(value, c)
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// MetRollup groups the metrics of the provided inventory-items, which also
+// match the query-tree in SearchQuery.Metric, into the time-buckets
+// described by RollupQuery.Rollup.
+// The statistics are calculated by Mongo, except for the P95, which is
+// calculated from the readings of each bucket.
+// The readings are corrected by the Calibrator before they are grouped.
+func (db *DB) MetRollup(searchInv []Inventory, search *RollupQuery, cal *Calibrator) ([]RollupBucket, error) {
+	rollup, groupField, interval, findParams, err := rollupSearch(searchInv, search, cal)
+	if err != nil {
+		err = errors.Wrap(err, "Error in rollup - MetRollup")
+		log.Println(err)
+		return nil, err
+	}
+
+	group := map[string]interface{}{
+		"_id": rollupGroupID(groupField, interval),
+		"count": map[string]interface{}{
+			"$sum": 1,
+		},
+	}
+	// Missing readings are not counted, and are skipped by the accumulators
+	for _, c := range rollup.channels() {
+		group[c+"_count"] = map[string]interface{}{
+			"$sum": map[string]interface{}{
+				"$cond": []interface{}{
+					map[string]interface{}{
+						"$gt": []interface{}{"$" + c, nil},
+					},
+					1,
+					0,
+				},
+			},
+		}
+		group[c+"_min"] = map[string]interface{}{"$min": "$" + c}
+		group[c+"_max"] = map[string]interface{}{"$max": "$" + c}
+		group[c+"_avg"] = map[string]interface{}{"$avg": "$" + c}
+		group[c+"_stddev"] = map[string]interface{}{"$stdDevPop": "$" + c}
+		group[c+"_values"] = map[string]interface{}{"$push": "$" + c}
+	}
+
+	calibrated := map[string]string{}
+	for _, c := range rollup.channels() {
+		calibrated[c] = c
+	}
+
+	pipeline := []interface{}{
+		map[string]interface{}{
+			"$match": findParams,
+		},
+	}
+	if fields := cal.fields(calibrated); len(fields) > 0 {
+		pipeline = append(pipeline, map[string]interface{}{
+			"$addFields": fields,
+		})
+	}
+	pipeline = append(pipeline, map[string]interface{}{
+		"$group": group,
+	})
+
+	buckets, err := db.rollupBuckets(pipeline, rollup.channels(), interval, channelStats)
+	if err != nil {
+		err = errors.Wrap(err, "Error aggregating metrics - MetRollup")
+		log.Println(err)
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// rollupChannelCount is the expression of the number of readings of the
+// channel in a rollup. Rollups without counts by channel have the count
+// of the rollup.
+func rollupChannelCount(channel string) map[string]interface{} {
+	return map[string]interface{}{
+		"$ifNull": []interface{}{
+			"$counts." + channel,
+			map[string]interface{}{
+				"$cond": []interface{}{
+					map[string]interface{}{
+						"$gt": []interface{}{"$" + channel, nil},
+					},
+					"$count",
+					0,
+				},
+			},
+		},
+	}
+}
+
+// CompactedRollup is MetRollup for the collection of CompactedMetrics,
+// whose statistics are combined using their counts. A rollup is in the
+// bucket of its Timestamp, so buckets shorter than the rollups only
+// contain the rollups starting in them.
+// The rollups are corrected by the Calibrator, using the calibration of
+// their Timestamp. The P95 is calculated from the digests of the rollups.
+func (db *DB) CompactedRollup(searchInv []Inventory, search *RollupQuery, cal *Calibrator) ([]RollupBucket, error) {
+	rollup, groupField, interval, findParams, err := rollupSearch(searchInv, search, cal)
+	if err != nil {
+		err = errors.Wrap(err, "Error in rollup - CompactedRollup")
+		log.Println(err)
+		return nil, err
+	}
+
+	// The mean plus the standard-deviation is calibrated with the mean,
+	// so the calibrated standard-deviation is their difference
+	spread := map[string]interface{}{}
+	calibrated := map[string]string{}
+	// The means of the centroids of the digests are calibrated one by one.
+	// Rollups without digests are a single centroid of their mean.
+	digests := map[string]interface{}{}
+	for _, c := range rollup.channels() {
+		spread[c+"_spread"] = map[string]interface{}{
+			"$add": []interface{}{
+				"$" + c,
+				map[string]interface{}{
+					"$ifNull": []interface{}{"$stddev." + c, 0},
+				},
+			},
+		}
+		calibrated[c] = c
+		calibrated[c+"_spread"] = c
+		calibrated["min."+c] = c
+		calibrated["max."+c] = c
+
+		mean := cal.expr("$$centroid.mean", c)
+		if mean == nil {
+			mean = "$$centroid.mean"
+		}
+		digests[c+"_digest"] = map[string]interface{}{
+			"$map": map[string]interface{}{
+				"input": map[string]interface{}{
+					"$ifNull": []interface{}{
+						"$digest." + c,
+						[]interface{}{
+							map[string]interface{}{
+								"mean":  "$" + c,
+								"count": rollupChannelCount(c),
+							},
+						},
+					},
+				},
+				"as": "centroid",
+				"in": map[string]interface{}{
+					"mean":  mean,
+					"count": "$$centroid.count",
+				},
+			},
+		}
+	}
+
+	group := map[string]interface{}{
+		"_id": rollupGroupID(groupField, interval),
+		"count": map[string]interface{}{
+			"$sum": "$count",
+		},
+	}
+	for _, c := range rollup.channels() {
+		count := rollupChannelCount(c)
+		stdDev := map[string]interface{}{
+			"$subtract": []interface{}{"$" + c + "_spread", "$" + c},
+		}
+		group[c+"_count"] = map[string]interface{}{"$sum": count}
+		group[c+"_sum"] = map[string]interface{}{
+			"$sum": map[string]interface{}{
+				"$multiply": []interface{}{count, "$" + c},
+			},
+		}
+		group[c+"_sumsq"] = map[string]interface{}{
+			"$sum": map[string]interface{}{
+				"$multiply": []interface{}{
+					count,
+					map[string]interface{}{
+						"$add": []interface{}{
+							map[string]interface{}{
+								"$multiply": []interface{}{stdDev, stdDev},
+							},
+							map[string]interface{}{
+								"$multiply": []interface{}{"$" + c, "$" + c},
+							},
+						},
+					},
+				},
+			},
+		}
+		group[c+"_min"] = map[string]interface{}{"$min": "$min." + c}
+		group[c+"_max"] = map[string]interface{}{"$max": "$max." + c}
+		group[c+"_digests"] = map[string]interface{}{"$push": "$" + c + "_digest"}
+	}
+
+	pipeline := []interface{}{
+		map[string]interface{}{
+			"$match": findParams,
+		},
+		map[string]interface{}{
+			"$addFields": spread,
+		},
+		map[string]interface{}{
+			"$addFields": digests,
+		},
+	}
+	if fields := cal.fields(calibrated); len(fields) > 0 {
+		pipeline = append(pipeline, map[string]interface{}{
+			"$addFields": fields,
+		})
+	}
+	pipeline = append(pipeline, map[string]interface{}{
+		"$group": group,
+	})
+
+	buckets, err := db.rollupBuckets(pipeline, rollup.channels(), interval, rollupSums)
+	if err != nil {
+		err = errors.Wrap(err, "Error aggregating metric rollups - CompactedRollup")
+		log.Println(err)
+		return nil, err
+	}
+	return buckets, nil
+}
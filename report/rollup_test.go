@@ -0,0 +1,319 @@
+package report
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseInterval(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    int64
+		wantErr bool
+	}{
+		{"5m", 300, false},
+		{"hourly", 3600, false},
+		{"daily", 86400, false},
+		{"15m", 900, false},
+		{"6h", 21600, false},
+		{"weekly", 0, true},
+		{"500ms", 0, true},
+		{"1.5s", 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseInterval(test.name)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseInterval(%s): got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseInterval(%s) = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDigestPercentile(t *testing.T) {
+	// The readings 1 to 100
+	values := []float64{}
+	for i := 100; i > 0; i-- {
+		values = append(values, float64(i))
+	}
+
+	tests := []struct {
+		name   string
+		digest []Centroid
+		p      float64
+		want   float64
+	}{
+		{"p95 of the readings", newDigest(values), 0.95, 95},
+		{"median of the readings", newDigest(values), 0.5, 50},
+		{"minimum", newDigest(values), 0, 1},
+		{"maximum", newDigest(values), 1, 100},
+		{"weighted centroids", []Centroid{{Mean: 1, Count: 9}, {Mean: 5, Count: 1}}, 0.95, 5},
+		{"within a centroid", []Centroid{{Mean: 1, Count: 95}, {Mean: 5, Count: 5}}, 0.95, 1},
+		{"single reading", newDigest([]float64{3}), 0.95, 3},
+		{"no readings", newDigest(nil), 0.95, 0},
+	}
+
+	for _, test := range tests {
+		got := digestPercentile(test.digest, test.p)
+		if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCompressDigest(t *testing.T) {
+	values := []float64{}
+	for i := 0; i < 10*digestSize; i++ {
+		values = append(values, float64(i%1000))
+	}
+
+	tests := []struct {
+		name      string
+		centroids []Centroid
+		// want is the number of centroids, and of their readings
+		want      int
+		wantCount int64
+	}{
+		{"compressed readings", newDigest(values), digestSize, 10 * digestSize},
+		{
+			name:      "kept centroids",
+			centroids: []Centroid{{Mean: 3, Count: 2}, {Mean: 1, Count: 4}},
+			want:      2,
+			wantCount: 6,
+		},
+		{
+			name:      "centroids without readings",
+			centroids: []Centroid{{Mean: 3, Count: 0}, {Mean: 1, Count: 4}},
+			want:      1,
+			wantCount: 4,
+		},
+	}
+
+	for _, test := range tests {
+		got := compressDigest(test.centroids)
+		var count int64
+		for i, c := range got {
+			count += c.Count
+			if i > 0 && c.Mean < got[i-1].Mean {
+				t.Errorf("%s: got centroids out of order %v", test.name, got)
+				break
+			}
+		}
+		if len(got) != test.want || count != test.wantCount {
+			t.Errorf("%s: got %d centroids of %d readings, want %d of %d", test.name, len(got), count, test.want, test.wantCount)
+		}
+	}
+
+	// The percentiles of a compressed digest are within a centroid
+	// of the exact percentiles
+	if got := digestPercentile(newDigest(values), 0.95); math.Abs(got-950) > 10 {
+		t.Errorf("got p95 %v of the compressed readings, want about 950", got)
+	}
+}
+
+func TestChannelStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		result map[string]interface{}
+		want   ChannelStats
+	}{
+		{
+			name: "readings",
+			result: map[string]interface{}{
+				"temp_in_count":  int32(4),
+				"temp_in_min":    1.0,
+				"temp_in_max":    9.0,
+				"temp_in_avg":    4.0,
+				"temp_in_stddev": 2.0,
+				"temp_in_values": []interface{}{9.0, 1.0, nil, 3.0, 3.0},
+			},
+			want: ChannelStats{Count: 4, Min: 1, Max: 9, Mean: 4, StdDev: 2, P95: 9},
+		},
+		{
+			name: "integer readings",
+			result: map[string]interface{}{
+				"temp_in_count":  int64(2),
+				"temp_in_min":    int32(3),
+				"temp_in_max":    int32(3),
+				"temp_in_avg":    3.0,
+				"temp_in_stddev": 0.0,
+				"temp_in_values": []interface{}{int32(3), int32(3)},
+			},
+			want: ChannelStats{Count: 2, Min: 3, Max: 3, Mean: 3, P95: 3},
+		},
+		{
+			name: "no readings",
+			result: map[string]interface{}{
+				"temp_in_count":  int32(0),
+				"temp_in_min":    nil,
+				"temp_in_avg":    nil,
+				"temp_in_stddev": nil,
+			},
+			want: ChannelStats{},
+		},
+		{
+			name:   "channel not grouped",
+			result: map[string]interface{}{},
+			want:   ChannelStats{},
+		},
+	}
+
+	for _, test := range tests {
+		got := channelStats(test.result, "temp_in")
+		if !closeStats(*got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, test.want)
+		}
+	}
+}
+
+func TestRollupSums(t *testing.T) {
+	tests := []struct {
+		name   string
+		result map[string]interface{}
+		want   ChannelStats
+	}{
+		{
+			name: "rollups",
+			// Readings 2, 4, 4, 4, 5, 5, 7 and 9
+			result: map[string]interface{}{
+				"temp_in_count": int32(8),
+				"temp_in_sum":   40.0,
+				"temp_in_sumsq": 232.0,
+				"temp_in_min":   2.0,
+				"temp_in_max":   9.0,
+				"temp_in_digests": []interface{}{
+					[]interface{}{
+						map[string]interface{}{"mean": 4.0, "count": int32(3)},
+						map[string]interface{}{"mean": 2.0, "count": int32(1)},
+					},
+					[]interface{}{
+						map[string]interface{}{"mean": 9.0, "count": int64(1)},
+						map[string]interface{}{"mean": 6.0, "count": int64(3)},
+					},
+				},
+			},
+			want: ChannelStats{Count: 8, Min: 2, Max: 9, Mean: 5, StdDev: 2, P95: 9},
+		},
+		{
+			name: "negative variance from rounding",
+			result: map[string]interface{}{
+				"temp_in_count": int64(3),
+				"temp_in_sum":   3.0,
+				"temp_in_sumsq": 2.9,
+				"temp_in_min":   1.0,
+				"temp_in_max":   1.0,
+				"temp_in_digests": []interface{}{
+					[]interface{}{map[string]interface{}{"mean": 1.0, "count": int32(3)}},
+				},
+			},
+			want: ChannelStats{Count: 3, Min: 1, Max: 1, Mean: 1, P95: 1},
+		},
+		{
+			name:   "no readings",
+			result: map[string]interface{}{"temp_in_count": int32(0), "temp_in_sum": 0.0},
+			want:   ChannelStats{},
+		},
+	}
+
+	for _, test := range tests {
+		got := rollupSums(test.result, "temp_in")
+		if !closeStats(*got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, test.want)
+		}
+	}
+}
+
+func TestMergeChannelStats(t *testing.T) {
+	// The readings 2, 4, 4, 4 and 5, 5, 7, 9
+	low := &ChannelStats{
+		Count: 4, Min: 2, Max: 4, Mean: 3.5, StdDev: math.Sqrt(0.75), P95: 4,
+		digest: newDigest([]float64{2, 4, 4, 4}),
+	}
+	high := &ChannelStats{
+		Count: 4, Min: 5, Max: 9, Mean: 6.5, StdDev: math.Sqrt(2.75), P95: 9,
+		digest: newDigest([]float64{5, 5, 7, 9}),
+	}
+
+	tests := []struct {
+		name string
+		a, b *ChannelStats
+		want ChannelStats
+	}{
+		{"both", low, high, ChannelStats{Count: 8, Min: 2, Max: 9, Mean: 5, StdDev: 2, P95: 9}},
+		{"no readings", low, &ChannelStats{}, *low},
+		{"missing channel", low, nil, *low},
+		{"only the second", &ChannelStats{}, high, *high},
+	}
+
+	for _, test := range tests {
+		got := mergeChannelStats(test.a, test.b)
+		if !closeStats(*got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, test.want)
+		}
+	}
+}
+
+func TestMergeRollupBuckets(t *testing.T) {
+	stats := func(count int64, mean float64) map[string]*ChannelStats {
+		return map[string]*ChannelStats{
+			"temp_in": {Count: count, Min: mean, Max: mean, Mean: mean, P95: mean},
+		}
+	}
+	rollups := []RollupBucket{
+		{GroupID: "b", Start: 0, Count: 2, Channels: stats(2, 4)},
+		{GroupID: "a", Start: 3600, Count: 1, Channels: stats(1, 1)},
+	}
+	raw := []RollupBucket{
+		{GroupID: "a", Start: 7200, Count: 1, Channels: stats(1, 3)},
+		// The bucket of the raw retention-cutoff
+		{GroupID: "b", Start: 0, Count: 2, Channels: stats(2, 6)},
+	}
+
+	tests := []struct {
+		name    string
+		rollups []RollupBucket
+		raw     []RollupBucket
+		// want are the group:start of the buckets, and their means
+		want  []string
+		means []float64
+	}{
+		{"rollups and raw", rollups, raw, []string{"a:3600", "a:7200", "b:0"}, []float64{1, 3, 5}},
+		{"only rollups", rollups, nil, []string{"a:3600", "b:0"}, []float64{1, 4}},
+		{"only raw", nil, raw, []string{"a:7200", "b:0"}, []float64{3, 6}},
+		{"none", nil, nil, []string{}, []float64{}},
+	}
+
+	for _, test := range tests {
+		merged := MergeRollupBuckets(test.rollups, test.raw)
+		got, means := []string{}, []float64{}
+		for _, b := range merged {
+			got = append(got, fmt.Sprintf("%s:%d", b.GroupID, b.Start))
+			means = append(means, b.Channels["temp_in"].Mean)
+		}
+		if !reflect.DeepEqual(got, test.want) || !reflect.DeepEqual(means, test.means) {
+			t.Errorf("%s: got buckets %v with means %v, want %v with %v", test.name, got, means, test.want, test.means)
+		}
+	}
+	// The buckets of the same group and start are counted once each
+	merged := MergeRollupBuckets(rollups, raw)
+	if b := merged[2]; b.Count != 4 || b.Channels["temp_in"].Count != 4 {
+		t.Errorf("got merged bucket %+v, want 4 readings", b)
+	}
+	if rollups[0].Channels["temp_in"].Mean != 4 {
+		t.Errorf("the rollups were modified")
+	}
+}
+
+// closeStats returns whether the statistics are equal, within rounding.
+func closeStats(a ChannelStats, b ChannelStats) bool {
+	close := func(x, y float64) bool {
+		return math.Abs(x-y) < 1e-9
+	}
+	return a.Count == b.Count && close(a.Min, b.Min) && close(a.Max, b.Max) &&
+		close(a.Mean, b.Mean) && close(a.StdDev, b.StdDev) && close(a.P95, b.P95)
+}
@@ -0,0 +1,310 @@
+package report
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// SavedSearch is a named SearchQuery owned by a customer, which can be
+// run against any of the report endpoints using its SearchID.
+type SavedSearch struct {
+	ID           objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	SearchID     uuuid.UUID        `bson:"search_id,omitempty" json:"search_id,omitempty"`
+	RsCustomerID uuuid.UUID        `bson:"rs_customer_id,omitempty" json:"rs_customer_id,omitempty"`
+	Name         string            `bson:"name,omitempty" json:"name,omitempty"`
+	Description  string            `bson:"description,omitempty" json:"description,omitempty"`
+	Query        *SearchQuery      `bson:"query,omitempty" json:"query,omitempty"`
+	CreatedAt    int64             `bson:"created_at,omitempty" json:"created_at,omitempty"`
+	UpdatedAt    int64             `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+// marshalSavedSearch stores the Query as a JSON-string in BSON, since
+// the values in SearchParams can be of any type.
+type marshalSavedSearch struct {
+	ID           objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	SearchID     string            `bson:"search_id,omitempty" json:"search_id,omitempty"`
+	RsCustomerID string            `bson:"rs_customer_id,omitempty" json:"rs_customer_id,omitempty"`
+	Name         string            `bson:"name,omitempty" json:"name,omitempty"`
+	Description  string            `bson:"description,omitempty" json:"description,omitempty"`
+	Query        string            `bson:"query,omitempty" json:"query,omitempty"`
+	CreatedAt    int64             `bson:"created_at,omitempty" json:"created_at,omitempty"`
+	UpdatedAt    int64             `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+func (s SavedSearch) MarshalBSON() ([]byte, error) {
+	ms := &marshalSavedSearch{
+		ID:          s.ID,
+		Name:        s.Name,
+		Description: s.Description,
+		CreatedAt:   s.CreatedAt,
+		UpdatedAt:   s.UpdatedAt,
+	}
+
+	if s.SearchID.String() != (uuuid.UUID{}).String() {
+		ms.SearchID = s.SearchID.String()
+	}
+	if s.RsCustomerID.String() != (uuuid.UUID{}).String() {
+		ms.RsCustomerID = s.RsCustomerID.String()
+	}
+	if s.Query != nil {
+		query, err := json.Marshal(s.Query)
+		if err != nil {
+			err = errors.Wrap(err, "Error marshalling Query for SavedSearch")
+			return nil, err
+		}
+		ms.Query = string(query)
+	}
+
+	return bson.Marshal(ms)
+}
+
+// jsonSavedSearch keeps the Query as an object in JSON.
+type jsonSavedSearch struct {
+	SearchID     string       `json:"search_id,omitempty"`
+	RsCustomerID string       `json:"rs_customer_id,omitempty"`
+	Name         string       `json:"name,omitempty"`
+	Description  string       `json:"description,omitempty"`
+	Query        *SearchQuery `json:"query,omitempty"`
+	CreatedAt    int64        `json:"created_at,omitempty"`
+	UpdatedAt    int64        `json:"updated_at,omitempty"`
+}
+
+func (s SavedSearch) MarshalJSON() ([]byte, error) {
+	js := &jsonSavedSearch{
+		Name:        s.Name,
+		Description: s.Description,
+		Query:       s.Query,
+		CreatedAt:   s.CreatedAt,
+		UpdatedAt:   s.UpdatedAt,
+	}
+
+	if s.SearchID.String() != (uuuid.UUID{}).String() {
+		js.SearchID = s.SearchID.String()
+	}
+	if s.RsCustomerID.String() != (uuuid.UUID{}).String() {
+		js.RsCustomerID = s.RsCustomerID.String()
+	}
+
+	return json.Marshal(js)
+}
+
+func (s *SavedSearch) UnmarshalJSON(in []byte) error {
+	js := &jsonSavedSearch{}
+	err := json.Unmarshal(in, js)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+
+	s.Name = js.Name
+	s.Description = js.Description
+	s.Query = js.Query
+
+	if js.SearchID != "" {
+		s.SearchID, err = uuuid.FromString(js.SearchID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing SearchID for SavedSearch")
+			return err
+		}
+	}
+	if js.RsCustomerID != "" {
+		s.RsCustomerID, err = uuuid.FromString(js.RsCustomerID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing RsCustomerID for SavedSearch")
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SavedSearch) UnmarshalBSON(in []byte) error {
+	ms := &marshalSavedSearch{}
+	err := bson.Unmarshal(in, ms)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+
+	s.ID = ms.ID
+	s.Name = ms.Name
+	s.Description = ms.Description
+	s.CreatedAt = ms.CreatedAt
+	s.UpdatedAt = ms.UpdatedAt
+
+	if ms.SearchID != "" {
+		s.SearchID, err = uuuid.FromString(ms.SearchID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing SearchID for SavedSearch")
+			return err
+		}
+	}
+	if ms.RsCustomerID != "" {
+		s.RsCustomerID, err = uuuid.FromString(ms.RsCustomerID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing RsCustomerID for SavedSearch")
+			return err
+		}
+	}
+	if ms.Query != "" {
+		s.Query = &SearchQuery{}
+		err = json.Unmarshal([]byte(ms.Query), s.Query)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing Query for SavedSearch")
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveSearch stores a new SavedSearch, and generates its SearchID.
+func (db *DB) SaveSearch(search *SavedSearch) (*SavedSearch, error) {
+	if search == nil {
+		return nil, errors.New("SavedSearch is required - SaveSearch")
+	}
+
+	searchID, err := uuuid.NewV4()
+	if err != nil {
+		err = errors.Wrap(err, "Unable to generate SearchID - SaveSearch")
+		log.Println(err)
+		return nil, err
+	}
+	now := time.Now().Unix()
+
+	search.ID = objectid.NilObjectID
+	search.SearchID = searchID
+	search.CreatedAt = now
+	search.UpdatedAt = now
+
+	_, err = db.collection.InsertOne(search)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to insert SavedSearch - SaveSearch")
+		log.Println(err)
+		return nil, err
+	}
+	return search, nil
+}
+
+// SavedSearches lists the SavedSearches owned by the customer.
+func (db *DB) SavedSearches(customerID uuuid.UUID) ([]SavedSearch, error) {
+	findResults, err := db.collection.Find(map[string]interface{}{
+		"rs_customer_id": map[string]interface{}{
+			"$eq": customerID.String(),
+		},
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching saved searches - SavedSearches")
+		log.Println(err)
+		return nil, err
+	}
+
+	searches := []SavedSearch{}
+	for _, v := range findResults {
+		result := v.(*SavedSearch)
+		searches = append(searches, *result)
+	}
+	return searches, nil
+}
+
+// SavedSearchByID returns the SavedSearch with the SearchID, if it is
+// owned by the customer.
+func (db *DB) SavedSearchByID(searchID uuuid.UUID, customerID uuuid.UUID) (*SavedSearch, error) {
+	findResult, err := db.collection.FindOne(map[string]interface{}{
+		"search_id": map[string]interface{}{
+			"$eq": searchID.String(),
+		},
+		"rs_customer_id": map[string]interface{}{
+			"$eq": customerID.String(),
+		},
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching saved search - SavedSearchByID")
+		log.Println(err)
+		return nil, err
+	}
+	return findResult.(*SavedSearch), nil
+}
+
+// savedSearchUpdate returns the update of the fields of the SavedSearch,
+// which are any of "name", "description" and "query".
+func savedSearchUpdate(search *SavedSearch, fields []string, now int64) (map[string]interface{}, error) {
+	update := map[string]interface{}{
+		"updated_at": now,
+	}
+	for _, field := range fields {
+		switch field {
+		case "name":
+			update["name"] = search.Name
+		case "description":
+			update["description"] = search.Description
+		case "query":
+			if search.Query == nil {
+				continue
+			}
+			query, err := json.Marshal(search.Query)
+			if err != nil {
+				err = errors.Wrap(err, "Error marshalling Query - savedSearchUpdate")
+				return nil, err
+			}
+			update["query"] = string(query)
+		}
+	}
+	return update, nil
+}
+
+// UpdateSavedSearch updates the fields of the SavedSearch, which are any
+// of "name", "description" and "query". The other fields are left as they
+// are. The SavedSearch must be owned by its RsCustomerID, and nil is
+// returned if the customer has no SavedSearch with the SearchID.
+func (db *DB) UpdateSavedSearch(search *SavedSearch, fields []string) (*SavedSearch, error) {
+	if search == nil {
+		return nil, errors.New("SavedSearch is required - UpdateSavedSearch")
+	}
+
+	update, err := savedSearchUpdate(search, fields, time.Now().Unix())
+	if err != nil {
+		err = errors.Wrap(err, "Unable to build the update - UpdateSavedSearch")
+		log.Println(err)
+		return nil, err
+	}
+
+	updateResult, err := db.collection.UpdateMany(
+		map[string]interface{}{
+			"search_id":      search.SearchID.String(),
+			"rs_customer_id": search.RsCustomerID.String(),
+		},
+		update,
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to update SavedSearch - UpdateSavedSearch")
+		log.Println(err)
+		return nil, err
+	}
+	if updateResult.MatchedCount == 0 {
+		return nil, nil
+	}
+
+	return db.SavedSearchByID(search.SearchID, search.RsCustomerID)
+}
+
+// DeleteSavedSearch deletes the SavedSearch owned by the customer.
+func (db *DB) DeleteSavedSearch(searchID uuuid.UUID, customerID uuuid.UUID) error {
+	deleteResult, err := db.collection.DeleteMany(map[string]interface{}{
+		"search_id":      searchID.String(),
+		"rs_customer_id": customerID.String(),
+	})
+	if err != nil {
+		err = errors.Wrap(err, "Unable to delete SavedSearch - DeleteSavedSearch")
+		log.Println(err)
+		return err
+	}
+	if deleteResult.DeletedCount == 0 {
+		return errors.New("No saved search found for customer - DeleteSavedSearch")
+	}
+	return nil
+}
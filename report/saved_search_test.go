@@ -0,0 +1,109 @@
+package report
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+)
+
+func TestSavedSearchUpdate(t *testing.T) {
+	query := &SearchQuery{
+		Inventory: &QueryNode{SearchParam: SearchParam{Field: "name", Type: "string", Op: OpEqual, Value: "Mango"}},
+	}
+	queryJSON, _ := json.Marshal(query)
+	search := &SavedSearch{Name: "Mangoes", Description: "", Query: query}
+
+	tests := []struct {
+		name   string
+		fields []string
+		want   map[string]interface{}
+	}{
+		{
+			name:   "name only",
+			fields: []string{"name"},
+			want:   map[string]interface{}{"name": "Mangoes", "updated_at": int64(10)},
+		},
+		{
+			name:   "cleared description",
+			fields: []string{"description", "search_id", "rs_customer_id"},
+			want:   map[string]interface{}{"description": "", "updated_at": int64(10)},
+		},
+		{
+			name:   "query",
+			fields: []string{"query"},
+			want:   map[string]interface{}{"query": string(queryJSON), "updated_at": int64(10)},
+		},
+		{
+			name:   "nothing sent",
+			fields: nil,
+			want:   map[string]interface{}{"updated_at": int64(10)},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := savedSearchUpdate(search, test.fields, 10)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSavedSearchMarshal(t *testing.T) {
+	searchID, _ := uuuid.FromString("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+	customerID, _ := uuuid.FromString("6ba7b812-9dad-11d1-80b4-00c04fd430c8")
+	search := SavedSearch{
+		SearchID:     searchID,
+		RsCustomerID: customerID,
+		Name:         "Mangoes",
+		Query: &SearchQuery{
+			Inventory: &QueryNode{SearchParam: SearchParam{Field: "name", Type: "string", Op: OpEqual, Value: "Mango"}},
+			Units:     map[string]string{"temp_in": "F"},
+		},
+		CreatedAt: 10,
+	}
+
+	tests := []struct {
+		name      string
+		marshal   func(SavedSearch) ([]byte, error)
+		unmarshal func([]byte, *SavedSearch) error
+	}{
+		{
+			name:      "json",
+			marshal:   func(s SavedSearch) ([]byte, error) { return json.Marshal(s) },
+			unmarshal: func(in []byte, s *SavedSearch) error { return json.Unmarshal(in, s) },
+		},
+		{
+			name:      "bson",
+			marshal:   func(s SavedSearch) ([]byte, error) { return s.MarshalBSON() },
+			unmarshal: func(in []byte, s *SavedSearch) error { return bson.Unmarshal(in, s) },
+		},
+	}
+
+	for _, test := range tests {
+		out, err := test.marshal(search)
+		if err != nil {
+			t.Errorf("%s: Marshal: %v", test.name, err)
+			continue
+		}
+		got := SavedSearch{}
+		err = test.unmarshal(out, &got)
+		if err != nil {
+			t.Errorf("%s: Unmarshal: %v", test.name, err)
+			continue
+		}
+		// CreatedAt is only stored in BSON
+		got.CreatedAt = search.CreatedAt
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(search)
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("%s: got %s, want %s", test.name, gotJSON, wantJSON)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package report
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/TerrexTech/uuuid"
+)
+
+// Searchable fields and their allowed search-types, derived from the
+// bson-tags of the schema-structs.
+var (
+	inventoryFields = searchableFields(&Inventory{})
+	metricFields    = searchableFields(&Metric{})
+	deviceFields    = searchableFields(&Device{})
+	warningFields   = searchableFields(&Warning{})
+	anomalyFields   = searchableFields(&Anomaly{})
+)
+
+// pagedFields are the searchable fields of the entities paged by the reports.
+var pagedFields = map[string]map[string][]string{
+	"inventory": inventoryFields,
+	"metric":    metricFields,
+	"device":    deviceFields,
+	"warning":   warningFields,
+	"anomaly":   anomalyFields,
+}
+
+var uuidType = reflect.TypeOf(uuuid.UUID{})
+
+// bsonTagName returns the name from the bson-tag of a struct-field.
+func bsonTagName(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("bson"), ",")[0]
+}
+
+// isDateField returns true if the field stores a Unix-timestamp, such as
+// "timestamp", "date_sold", "expiry_date" or "created_at".
+func isDateField(name string) bool {
+	return name == "timestamp" ||
+		strings.HasPrefix(name, "date_") ||
+		strings.HasSuffix(name, "_date") ||
+		strings.HasSuffix(name, "_at")
+}
+
+// searchableFields maps the bson-names of the schema's fields to the
+// SearchParam-types which can be used to search them.
+func searchableFields(schema interface{}) map[string][]string {
+	fields := map[string][]string{}
+
+	schemaType := reflect.TypeOf(schema)
+	if schemaType.Kind() == reflect.Ptr {
+		schemaType = schemaType.Elem()
+	}
+	for i := 0; i < schemaType.NumField(); i++ {
+		field := schemaType.Field(i)
+		name := bsonTagName(field)
+		if name == "" || name == "-" || name == "_id" {
+			continue
+		}
+
+		switch {
+		case field.Type == uuidType:
+			// UUIDs are stored as strings
+			fields[name] = []string{"string"}
+		case field.Type.Kind() == reflect.String:
+			fields[name] = []string{"string"}
+		case field.Type.Kind() == reflect.Float32, field.Type.Kind() == reflect.Float64:
+			fields[name] = []string{"float", "int"}
+		case field.Type.Kind() >= reflect.Int && field.Type.Kind() <= reflect.Int64:
+			if isDateField(name) {
+				fields[name] = []string{"date", "int"}
+			} else {
+				fields[name] = []string{"int", "float"}
+			}
+		}
+	}
+	return fields
+}
+
+// storedFieldValuer is implemented by the documents which store some
+// zero-values. storedFieldValue returns the stored value of such a field,
+// and false for the other fields.
+type storedFieldValuer interface {
+	storedFieldValue(field string) (interface{}, bool)
+}
+
+// bsonFieldValue returns the value of the struct-field which has the
+// provided bson-tag name, or of the key of a document decoded as a map
+// (such as the aggregated documents of aggregatePage). UUIDs and other Stringers are returned as strings
+// (which is how they are stored in the collections), and zero-values
+// are returned as nil since they are omitted when stored, unless the
+// document stores them (see storedFieldValuer).
+func bsonFieldValue(doc interface{}, field string) interface{} {
+	// Aggregated documents are decoded as maps
+	if m, ok := doc.(map[string]interface{}); ok {
+		return m[field]
+	}
+	if valuer, ok := doc.(storedFieldValuer); ok {
+		if value, ok := valuer.storedFieldValue(field); ok {
+			return value
+		}
+	}
+
+	docValue := reflect.ValueOf(doc)
+	if docValue.Kind() == reflect.Ptr {
+		docValue = docValue.Elem()
+	}
+	if docValue.Kind() != reflect.Struct {
+		return nil
+	}
+
+	docType := docValue.Type()
+	for i := 0; i < docType.NumField(); i++ {
+		tagName := bsonTagName(docType.Field(i))
+		if tagName != field {
+			continue
+		}
+
+		fieldValue := docValue.Field(i)
+		if fieldValue.IsZero() {
+			return nil
+		}
+		// ObjectIDs are kept as-is so they can be compared with _id
+		if tagName == "_id" {
+			return fieldValue.Interface()
+		}
+		if s, ok := fieldValue.Interface().(fmt.Stringer); ok {
+			return s.String()
+		}
+		return fieldValue.Interface()
+	}
+	return nil
+}
@@ -1,9 +1,372 @@
 package report
 
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Operators supported by SearchParam.Op
+const (
+	OpEqual        = "eq"
+	OpNotEqual     = "ne"
+	OpGreater      = "gt"
+	OpGreaterEqual = "gte"
+	OpLess         = "lt"
+	OpLessEqual    = "lte"
+	OpIn           = "in"
+	OpNotIn        = "nin"
+	OpExists       = "exists"
+	OpPrefix       = "prefix"
+	OpRegex        = "regex"
+	OpBetween      = "between"
+)
+
+// SearchParam is a single search-condition on a Field.
+// Type is one of "string", "int", "float" or "date", and is used to convert the values.
+// Values for "date" are parsed using ParseTimeWindow in the TimeZone
+// (an IANA name such as "America/Toronto", UTC by default), and match the
+// Unix-timestamps (in seconds) stored in the collections. A date-window
+// such as "last_7d" or "2018-10-18" matches the whole window for eq,
+// and its bounds for the other comparison operators.
+// Op selects the operator:
+//
+//	eq, ne, gt, gte, lt, lte: compare with Value
+//	in, nin:                  match any/none of Values
+//	exists:                   Value is a boolean, defaults to true
+//	prefix, regex:            match the string in Value (Type "string" only)
+//	between:                  Values[0] <= field <= Values[1] (inclusive)
+//
+// Value and Values are checked for presence rather than zero-ness,
+// so a zero is a valid value.
+// If Op is not set, Equal is matched using $eq, else the exclusive
+// LowerLimit ($gt) and UpperLimit ($lt) are used.
 type SearchParam struct {
-	Field      string
-	Type       string
-	Equal      string
-	UpperLimit float64
-	LowerLimit float64
+	Field      string        `json:",omitempty"`
+	Type       string        `json:",omitempty"`
+	Op         string        `json:",omitempty"`
+	Value      interface{}   `json:",omitempty"`
+	Values     []interface{} `json:",omitempty"`
+	Equal      *string       `json:",omitempty"`
+	UpperLimit *float64      `json:",omitempty"`
+	LowerLimit *float64      `json:",omitempty"`
+	TimeZone   string        `json:",omitempty"`
+}
+
+// filter converts the SearchParam into a Mongo filter for its Field.
+func (v SearchParam) filter() (map[string]interface{}, error) {
+	var err error
+
+	if v.Type == "" {
+		err = errors.New("Type required - SearchParam")
+		return nil, err
+	}
+	if v.Field == "" {
+		err = errors.New("Field is required - SearchParam")
+		return nil, err
+	}
+
+	cond, err := v.condition()
+	if err != nil {
+		err = errors.Wrapf(err, "Invalid condition for Field %s - SearchParam", v.Field)
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		v.Field: cond,
+	}, nil
+}
+
+// condition returns the operator-document for the SearchParam,
+// such as {"$gte": 5}.
+func (v SearchParam) condition() (map[string]interface{}, error) {
+	if v.Type == "date" {
+		switch v.Op {
+		case "":
+			if v.Equal != nil {
+				return v.dateCondition(OpEqual, *v.Equal)
+			}
+		case OpEqual, OpNotEqual, OpGreater, OpGreaterEqual, OpLess, OpLessEqual:
+			return v.dateCondition(v.Op, v.Value)
+		case OpBetween:
+			if len(v.Values) != 2 {
+				return nil, errors.New("Exactly two Values are required for operator between")
+			}
+			return v.dateCondition(v.Op, v.Values...)
+		}
+	}
+
+	if v.Op == "" {
+		return v.legacyCondition()
+	}
+
+	switch v.Op {
+	case OpEqual, OpNotEqual, OpGreater, OpGreaterEqual, OpLess, OpLessEqual:
+		if v.Value == nil {
+			return nil, errors.Errorf("Value is required for operator %s", v.Op)
+		}
+		val, err := v.convert(v.Value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"$" + v.Op: val,
+		}, nil
+
+	case OpIn, OpNotIn:
+		if len(v.Values) == 0 {
+			return nil, errors.Errorf("Values are required for operator %s", v.Op)
+		}
+		vals := []interface{}{}
+		for _, value := range v.Values {
+			val, err := v.convert(value)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, val)
+		}
+		return map[string]interface{}{
+			"$" + v.Op: vals,
+		}, nil
+
+	case OpBetween:
+		if len(v.Values) != 2 {
+			return nil, errors.New("Exactly two Values are required for operator between")
+		}
+		lower, err := v.convert(v.Values[0])
+		if err != nil {
+			return nil, err
+		}
+		upper, err := v.convert(v.Values[1])
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"$gte": lower,
+			"$lte": upper,
+		}, nil
+
+	case OpExists:
+		exists := true
+		if v.Value != nil {
+			b, ok := v.Value.(bool)
+			if !ok {
+				return nil, errors.New("Value for operator exists must be a boolean")
+			}
+			exists = b
+		}
+		return map[string]interface{}{
+			"$exists": exists,
+		}, nil
+
+	case OpPrefix, OpRegex:
+		if v.Type != "string" {
+			return nil, errors.Errorf("Operator %s requires Type string", v.Op)
+		}
+		pattern, ok := v.Value.(string)
+		if !ok {
+			return nil, errors.Errorf("Value for operator %s must be a string", v.Op)
+		}
+		if v.Op == OpPrefix {
+			pattern = "^" + regexp.QuoteMeta(pattern)
+		}
+		return map[string]interface{}{
+			"$regex": pattern,
+		}, nil
+	}
+
+	return nil, errors.Errorf("Unknown operator %s", v.Op)
+}
+
+// legacyCondition handles SearchParams which use Equal,
+// UpperLimit and LowerLimit instead of an Op.
+func (v SearchParam) legacyCondition() (map[string]interface{}, error) {
+	if v.Equal != nil {
+		val, err := v.convert(*v.Equal)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"$eq": val,
+		}, nil
+	}
+
+	if v.LowerLimit == nil && v.UpperLimit == nil {
+		return nil, errors.New("Missing value in equal. No lowerlimit and upperlimit set")
+	}
+
+	limitMap := map[string]interface{}{}
+	if v.LowerLimit != nil {
+		val, err := v.convert(*v.LowerLimit)
+		if err != nil {
+			return nil, err
+		}
+		limitMap["$gt"] = val
+	}
+	if v.UpperLimit != nil {
+		val, err := v.convert(*v.UpperLimit)
+		if err != nil {
+			return nil, err
+		}
+		limitMap["$lt"] = val
+	}
+	return limitMap, nil
+}
+
+// dateCondition creates the operator-document for a "date" SearchParam.
+// The values are parsed as TimeWindows, so ranged values such as
+// "this_week" can be used with comparison operators.
+func (v SearchParam) dateCondition(op string, values ...interface{}) (map[string]interface{}, error) {
+	loc, err := v.location()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	windows := []*TimeWindow{}
+	for _, value := range values {
+		if value == nil {
+			return nil, errors.Errorf("Value is required for operator %s", op)
+		}
+		w, err := ParseTimeWindow(value, loc, now)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+
+	w := windows[0]
+	start := w.Start.Unix()
+	end := w.End.Unix()
+
+	switch op {
+	case OpEqual:
+		if w.IsInstant() {
+			return map[string]interface{}{"$eq": start}, nil
+		}
+		return map[string]interface{}{"$gte": start, "$lt": end}, nil
+
+	case OpNotEqual:
+		if w.IsInstant() {
+			return map[string]interface{}{"$ne": start}, nil
+		}
+		return map[string]interface{}{
+			"$not": map[string]interface{}{"$gte": start, "$lt": end},
+		}, nil
+
+	case OpGreater:
+		if w.IsInstant() {
+			return map[string]interface{}{"$gt": end}, nil
+		}
+		return map[string]interface{}{"$gte": end}, nil
+
+	case OpGreaterEqual:
+		return map[string]interface{}{"$gte": start}, nil
+
+	case OpLess:
+		return map[string]interface{}{"$lt": start}, nil
+
+	case OpLessEqual:
+		if w.IsInstant() {
+			return map[string]interface{}{"$lte": end}, nil
+		}
+		return map[string]interface{}{"$lt": end}, nil
+
+	case OpBetween:
+		upper := windows[1]
+		if upper.IsInstant() {
+			return map[string]interface{}{"$gte": start, "$lte": upper.End.Unix()}, nil
+		}
+		return map[string]interface{}{"$gte": start, "$lt": upper.End.Unix()}, nil
+	}
+
+	return nil, errors.Errorf("Operator %s is not supported for Type date", op)
+}
+
+// location returns the time-zone for the SearchParam, defaults to UTC.
+func (v SearchParam) location() (*time.Location, error) {
+	if v.TimeZone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(v.TimeZone)
+	if err != nil {
+		err = errors.Wrapf(err, "Invalid TimeZone %s", v.TimeZone)
+		return nil, err
+	}
+	return loc, nil
+}
+
+// convert converts a value to the Go-type for SearchParam.Type.
+// Numbers can be provided as JSON-numbers or as strings.
+func (v SearchParam) convert(value interface{}) (interface{}, error) {
+	switch v.Type {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return nil, errors.Errorf("Expected a string value, got %v", value)
+		}
+		return str, nil
+
+	case "int":
+		switch val := value.(type) {
+		case string:
+			intValue, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				err = errors.Wrap(err, "Error converting value to int")
+				return nil, err
+			}
+			return intValue, nil
+		case float64:
+			if val != math.Trunc(val) {
+				return nil, errors.Errorf("Expected an int value, got %v", val)
+			}
+			return int64(val), nil
+		case int:
+			return int64(val), nil
+		case int32:
+			return int64(val), nil
+		case int64:
+			return val, nil
+		}
+		return nil, errors.Errorf("Expected an int value, got %v", value)
+
+	case "float":
+		switch val := value.(type) {
+		case string:
+			floatValue, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				err = errors.Wrap(err, "Error converting value to float")
+				return nil, err
+			}
+			return floatValue, nil
+		case float64:
+			return val, nil
+		case int:
+			return float64(val), nil
+		case int32:
+			return float64(val), nil
+		case int64:
+			return float64(val), nil
+		}
+		return nil, errors.Errorf("Expected a float value, got %v", value)
+
+	case "date":
+		loc, err := v.location()
+		if err != nil {
+			return nil, err
+		}
+		w, err := ParseTimeWindow(value, loc, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if !w.IsInstant() {
+			return nil, errors.Errorf("Date-window %v cannot be used with this operator", value)
+		}
+		return w.Start.Unix(), nil
+	}
+
+	return nil, errors.Errorf("Unknown Type %s", v.Type)
 }
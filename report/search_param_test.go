@@ -0,0 +1,144 @@
+package report
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSearchParamCondition(t *testing.T) {
+	tests := []struct {
+		name    string
+		param   string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:  "equal",
+			param: `{"Field": "name", "Type": "string", "Op": "eq", "Value": "Mango"}`,
+			want:  map[string]interface{}{"$eq": "Mango"},
+		},
+		{
+			name:  "zero value",
+			param: `{"Field": "upc", "Type": "int", "Op": "ne", "Value": 0}`,
+			want:  map[string]interface{}{"$ne": int64(0)},
+		},
+		{
+			name:  "number as a string",
+			param: `{"Field": "upc", "Type": "int", "Op": "gte", "Value": "12"}`,
+			want:  map[string]interface{}{"$gte": int64(12)},
+		},
+		{
+			name:  "float",
+			param: `{"Field": "price", "Type": "float", "Op": "lt", "Value": 2.5}`,
+			want:  map[string]interface{}{"$lt": 2.5},
+		},
+		{
+			name:  "in",
+			param: `{"Field": "upc", "Type": "int", "Op": "in", "Values": [1, "2"]}`,
+			want:  map[string]interface{}{"$in": []interface{}{int64(1), int64(2)}},
+		},
+		{
+			name:  "between",
+			param: `{"Field": "price", "Type": "float", "Op": "between", "Values": [1, 2]}`,
+			want:  map[string]interface{}{"$gte": 1.0, "$lte": 2.0},
+		},
+		{
+			name:  "exists",
+			param: `{"Field": "lot", "Type": "string", "Op": "exists"}`,
+			want:  map[string]interface{}{"$exists": true},
+		},
+		{
+			name:  "not exists",
+			param: `{"Field": "lot", "Type": "string", "Op": "exists", "Value": false}`,
+			want:  map[string]interface{}{"$exists": false},
+		},
+		{
+			name:  "prefix is escaped",
+			param: `{"Field": "name", "Type": "string", "Op": "prefix", "Value": "Man.go"}`,
+			want:  map[string]interface{}{"$regex": `^Man\.go`},
+		},
+		{
+			name:  "equal without an operator",
+			param: `{"Field": "name", "Type": "string", "Equal": "Mango"}`,
+			want:  map[string]interface{}{"$eq": "Mango"},
+		},
+		{
+			name:  "limits without an operator",
+			param: `{"Field": "price", "Type": "float", "LowerLimit": 1, "UpperLimit": 3}`,
+			want:  map[string]interface{}{"$gt": 1.0, "$lt": 3.0},
+		},
+		{
+			name:  "date instant",
+			param: `{"Field": "timestamp", "Type": "date", "Op": "eq", "Value": 1539820800}`,
+			want:  map[string]interface{}{"$eq": int64(1539820800)},
+		},
+		{
+			name:  "date window",
+			param: `{"Field": "timestamp", "Type": "date", "Op": "eq", "Value": "2018-10-18"}`,
+			want:  map[string]interface{}{"$gte": int64(1539820800), "$lt": int64(1539907200)},
+		},
+		{
+			name:  "after a date window",
+			param: `{"Field": "timestamp", "Type": "date", "Op": "gt", "Value": "2018-10-18"}`,
+			want:  map[string]interface{}{"$gte": int64(1539907200)},
+		},
+		{
+			name:  "date window in a time-zone",
+			param: `{"Field": "timestamp", "Type": "date", "Op": "lte", "Value": "2018-10-18", "TimeZone": "America/Toronto"}`,
+			want:  map[string]interface{}{"$lt": int64(1539921600)},
+		},
+		{
+			name:    "missing value",
+			param:   `{"Field": "upc", "Type": "int", "Op": "gt"}`,
+			wantErr: true,
+		},
+		{
+			name:    "fractional int",
+			param:   `{"Field": "upc", "Type": "int", "Op": "eq", "Value": 1.5}`,
+			wantErr: true,
+		},
+		{
+			name:    "between with one value",
+			param:   `{"Field": "price", "Type": "float", "Op": "between", "Values": [1]}`,
+			wantErr: true,
+		},
+		{
+			name:    "prefix of a number",
+			param:   `{"Field": "upc", "Type": "int", "Op": "prefix", "Value": "1"}`,
+			wantErr: true,
+		},
+		{
+			name:    "no value without an operator",
+			param:   `{"Field": "name", "Type": "string"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown operator",
+			param:   `{"Field": "name", "Type": "string", "Op": "like", "Value": "x"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown time-zone",
+			param:   `{"Field": "timestamp", "Type": "date", "Op": "eq", "Value": "today", "TimeZone": "Mars/Base"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		param := SearchParam{}
+		err := json.Unmarshal([]byte(test.param), &param)
+		if err != nil {
+			t.Errorf("%s: Unmarshal: %v", test.name, err)
+			continue
+		}
+		got, err := param.condition()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package report
+
+import (
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/pkg/errors"
+)
+
+// ShelfLifeModel describes how fast a product spoils.
+// LifeHours is the shelf-life when stored at RefTemp (°C).
+// Spoilage is Q10 times faster for every 10°C above RefTemp (and slower
+// below it), and each ppm of ethylene above the product's threshold
+// adds EthyleneFactor to the rate of spoilage.
+type ShelfLifeModel struct {
+	RefTemp        float64 `json:"ref_temp"`
+	LifeHours      float64 `json:"life_hours"`
+	Q10            float64 `json:"q10"`
+	EthyleneFactor float64 `json:"ethylene_factor"`
+}
+
+// ShelfLifeModels are the ShelfLifeModels for each product-name.
+var ShelfLifeModels = map[string]ShelfLifeModel{
+	"Banana":       {RefTemp: 13, LifeHours: 21 * 24, Q10: 2.5, EthyleneFactor: 0.05},
+	"Orange":       {RefTemp: 5, LifeHours: 56 * 24, Q10: 2, EthyleneFactor: 0.01},
+	"Apple":        {RefTemp: 0, LifeHours: 90 * 24, Q10: 2.5, EthyleneFactor: 0.005},
+	"Mango":        {RefTemp: 12, LifeHours: 21 * 24, Q10: 2.5, EthyleneFactor: 0.03},
+	"Strawberry":   {RefTemp: 0, LifeHours: 7 * 24, Q10: 3, EthyleneFactor: 0.05},
+	"Tomato":       {RefTemp: 12, LifeHours: 14 * 24, Q10: 2.5, EthyleneFactor: 0.03},
+	"Lettuce":      {RefTemp: 0, LifeHours: 21 * 24, Q10: 3, EthyleneFactor: 0.1},
+	"Pear":         {RefTemp: -1, LifeHours: 60 * 24, Q10: 2.5, EthyleneFactor: 0.01},
+	"Grapes":       {RefTemp: 0, LifeHours: 42 * 24, Q10: 3, EthyleneFactor: 0.02},
+	"Sweet Pepper": {RefTemp: 8, LifeHours: 21 * 24, Q10: 2, EthyleneFactor: 0.03},
+}
+
+// ShelfLifeModelFor returns the ShelfLifeModel for the product-name,
+// which is matched case-insensitively.
+func ShelfLifeModelFor(name string) (*ShelfLifeModel, bool) {
+	for prodName, m := range ShelfLifeModels {
+		if strings.EqualFold(prodName, strings.TrimSpace(name)) {
+			model := m
+			return &model, true
+		}
+	}
+	return nil, false
+}
+
+// ShelfLife is the predicted shelf-life of an inventory-item, based on
+// the temperature and ethylene it was exposed to since DateArrived.
+// ExpiryDeltaHours is PredictedSpoilage minus ExpiryDate, so it is
+// negative if the item is predicted to spoil before its ExpiryDate.
+// EthyleneDose is in ppm-hours above the product's ethylene threshold.
+type ShelfLife struct {
+	ItemID            string  `json:"item_id"`
+	Name              string  `json:"name"`
+	Lot               string  `json:"lot,omitempty"`
+	DateArrived       int64   `json:"date_arrived"`
+	ExpiryDate        int64   `json:"expiry_date,omitempty"`
+	PredictedSpoilage int64   `json:"predicted_spoilage"`
+	RemainingLifePct  float64 `json:"remaining_life_pct"`
+	ExpiryDeltaHours  float64 `json:"expiry_delta_hours,omitempty"`
+	MeanTemp          float64 `json:"mean_temp"`
+	EthyleneDose      float64 `json:"ethylene_dose"`
+	Readings          int     `json:"readings"`
+}
+
+// spoilageRate is the fraction of the shelf-life used per hour
+// at the temperature and ethylene-level.
+func (m *ShelfLifeModel) spoilageRate(temp float64, ethyleneExcess float64) float64 {
+	rate := math.Pow(m.Q10, (temp-m.RefTemp)/10) / m.LifeHours
+	return rate * (1 + m.EthyleneFactor*ethyleneExcess)
+}
+
+// ShelfLifeFields are the Inventory fields PredictShelfLife needs,
+// besides the IDs which are always searched.
+var ShelfLifeFields = []string{"name", "lot", "date_arrived", "expiry_date"}
+
+// PredictShelfLife integrates the rate of spoilage of the item over its
+// metrics (in ascending order of time) from DateArrived until now.
+// Each reading is assumed to hold until the next one, and the item is
+// assumed to be stored at the RefTemp until its first reading.
+// Returns false if there is no ShelfLifeModel for the product.
+func PredictShelfLife(inv Inventory, metrics []Metric, now time.Time) (*ShelfLife, bool) {
+	model, ok := ShelfLifeModelFor(inv.Name)
+	if !ok {
+		return nil, false
+	}
+	ethyleneLimit := 0.0
+	if thresholds, ok := ThresholdsFor(inv.Name); ok {
+		ethyleneLimit = thresholds.Ethylene.Max
+	}
+
+	start := inv.DateArrived
+	if start == 0 && len(metrics) > 0 {
+		start = metrics[0].Timestamp
+	}
+	end := now.Unix()
+
+	sl := &ShelfLife{
+		ItemID:      inv.ItemID.String(),
+		Name:        inv.Name,
+		Lot:         inv.Lot,
+		DateArrived: inv.DateArrived,
+		ExpiryDate:  inv.ExpiryDate,
+	}
+
+	temp := model.RefTemp
+	ethyleneExcess := 0.0
+	used := 0.0
+	spoiledAt := int64(0)
+	tempHours := 0.0
+	hours := 0.0
+
+	// expose adds the spoilage from the current conditions until the time
+	expose := func(from, until int64) {
+		if until <= from {
+			return
+		}
+		dt := float64(until-from) / 3600
+		rate := model.spoilageRate(temp, ethyleneExcess)
+		if spoiledAt == 0 && used+rate*dt >= 1 {
+			spoiledAt = from + int64((1-used)/rate*3600)
+		}
+		used += rate * dt
+		tempHours += temp * dt
+		hours += dt
+		sl.EthyleneDose += ethyleneExcess * dt
+	}
+
+	t := start
+	for _, m := range metrics {
+		if m.Timestamp < start || m.Timestamp > end {
+			continue
+		}
+		expose(t, m.Timestamp)
+		t = m.Timestamp
+
+		// The previous reading holds for missing readings
+		if tempIn, ok := m.Reading("temp_in"); ok {
+			temp = tempIn
+		}
+		if eth, ok := m.Reading("ethylene"); ok {
+			ethyleneExcess = math.Max(eth-ethyleneLimit, 0)
+		}
+		sl.Readings++
+	}
+	expose(t, end)
+
+	if spoiledAt == 0 {
+		// The rest of the shelf-life is used at the latest rate
+		remaining := (1 - used) / model.spoilageRate(temp, ethyleneExcess)
+		spoiledAt = end + int64(remaining*3600)
+	}
+	sl.PredictedSpoilage = spoiledAt
+	sl.RemainingLifePct = math.Max(1-used, 0) * 100
+	if hours > 0 {
+		sl.MeanTemp = tempHours / hours
+	}
+	if inv.ExpiryDate != 0 {
+		sl.ExpiryDeltaHours = float64(spoiledAt-inv.ExpiryDate) / 3600
+	}
+	return sl, true
+}
+
+// ItemMetrics returns the temperature and ethylene readings of the
+// inventory-items, whose readings corrected by the Calibrator match the
+// metric query-tree (if set), in ascending order of time, by ItemID.
+// The stored readings are returned, along with the device and time which
+// select their calibration.
+func (db *DB) ItemMetrics(searchInv []Inventory, metric *QueryNode, cal *Calibrator) (map[string][]Metric, error) {
+	ids := []string{}
+	for _, v := range searchInv {
+		ids = append(ids, v.ItemID.String())
+	}
+	findParams, err := metricJoinFilter(ids, metric, cal)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling metric query - ItemMetrics")
+		log.Println(err)
+		return nil, err
+	}
+
+	findResults, err := db.collection.Find(
+		findParams,
+		findopt.Sort(bson.NewDocument(
+			bson.EC.Int32("timestamp", 1),
+			bson.EC.Int32("_id", 1),
+		)),
+		findopt.Projection(projection(
+			[]string{"item_id", "device_id", "timestamp", "temp_in", "ethylene"},
+		)),
+	)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching metrics - ItemMetrics")
+		log.Println(err)
+		return nil, err
+	}
+
+	metrics := map[string][]Metric{}
+	for _, v := range findResults {
+		m := v.(*Metric)
+		itemID := m.ItemID.String()
+		metrics[itemID] = append(metrics[itemID], *m)
+	}
+	return metrics, nil
+}
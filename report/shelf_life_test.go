@@ -0,0 +1,120 @@
+package report
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPredictShelfLife(t *testing.T) {
+	const (
+		arrived = int64(1540000000)
+		hour    = int64(3600)
+		// lifeHours is the shelf-life of bananas at their RefTemp
+		lifeHours = 21 * 24
+	)
+	reading := func(timestamp int64, channel string, value float64) Metric {
+		m := Metric{Timestamp: timestamp}
+		m.SetReading(channel, value)
+		return m
+	}
+	banana := Inventory{Name: "Banana", DateArrived: arrived, ExpiryDate: arrived + lifeHours*hour}
+	// A reading 10°C above the RefTemp spoils bananas Q10 times faster
+	warmHours := lifeHours / 2.5
+
+	tests := []struct {
+		name    string
+		inv     Inventory
+		metrics []Metric
+		hours   int64
+		// want are the predicted spoilage (in hours after arrival),
+		// the remaining shelf-life and the mean temperature
+		wantSpoilage, wantRemaining, wantMeanTemp float64
+		wantDose                                  float64
+	}{
+		{
+			name:          "at the reference temperature",
+			inv:           banana,
+			hours:         126,
+			wantSpoilage:  lifeHours,
+			wantRemaining: 75,
+			wantMeanTemp:  13,
+		},
+		{
+			name:          "warm",
+			inv:           banana,
+			metrics:       []Metric{reading(arrived, "temp_in", 23)},
+			hours:         100,
+			wantSpoilage:  warmHours,
+			wantRemaining: (1 - 100/warmHours) * 100,
+			wantMeanTemp:  23,
+		},
+		{
+			name:          "spoiled",
+			inv:           banana,
+			metrics:       []Metric{reading(arrived, "temp_in", 23)},
+			hours:         300,
+			wantSpoilage:  warmHours,
+			wantRemaining: 0,
+			wantMeanTemp:  23,
+		},
+		{
+			name:          "warm after arrival",
+			inv:           banana,
+			metrics:       []Metric{reading(arrived+50*hour, "temp_in", 23)},
+			hours:         100,
+			wantSpoilage:  50 + (lifeHours-50)/2.5,
+			wantRemaining: (1 - 50.0/lifeHours - 50/warmHours) * 100,
+			wantMeanTemp:  18,
+		},
+		{
+			name:          "zero reading",
+			inv:           banana,
+			metrics:       []Metric{reading(arrived, "temp_in", 0)},
+			hours:         1,
+			wantSpoilage:  lifeHours * math.Pow(2.5, 1.3),
+			wantRemaining: (1 - 1/(lifeHours*math.Pow(2.5, 1.3))) * 100,
+			wantMeanTemp:  0,
+		},
+		{
+			name:          "ethylene above the threshold",
+			inv:           banana,
+			metrics:       []Metric{reading(arrived, "ethylene", 30)},
+			hours:         1,
+			wantSpoilage:  lifeHours / 2,
+			wantRemaining: (1 - 2.0/lifeHours) * 100,
+			wantMeanTemp:  13,
+			wantDose:      20,
+		},
+	}
+
+	for _, test := range tests {
+		now := time.Unix(arrived+test.hours*hour, 0)
+		sl, ok := PredictShelfLife(test.inv, test.metrics, now)
+		if !ok {
+			t.Errorf("%s: got no prediction", test.name)
+			continue
+		}
+		spoilage := float64(sl.PredictedSpoilage-arrived) / float64(hour)
+		if math.Abs(spoilage-test.wantSpoilage) > 0.01 {
+			t.Errorf("%s: got spoilage after %v hours, want %v", test.name, spoilage, test.wantSpoilage)
+		}
+		if math.Abs(sl.RemainingLifePct-test.wantRemaining) > 1e-6 {
+			t.Errorf("%s: got %v%% remaining, want %v%%", test.name, sl.RemainingLifePct, test.wantRemaining)
+		}
+		if math.Abs(sl.MeanTemp-test.wantMeanTemp) > 1e-9 || math.Abs(sl.EthyleneDose-test.wantDose) > 1e-9 {
+			t.Errorf(
+				"%s: got mean temperature %v and dose %v, want %v and %v",
+				test.name, sl.MeanTemp, sl.EthyleneDose, test.wantMeanTemp, test.wantDose,
+			)
+		}
+		wantDelta := test.wantSpoilage - lifeHours
+		if math.Abs(sl.ExpiryDeltaHours-wantDelta) > 0.01 {
+			t.Errorf("%s: got expiry delta %v hours, want %v", test.name, sl.ExpiryDeltaHours, wantDelta)
+		}
+	}
+
+	if _, ok := PredictShelfLife(Inventory{Name: "Durian"}, nil, time.Unix(arrived, 0)); ok {
+		t.Errorf("product without a model: got a prediction")
+	}
+}
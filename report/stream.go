@@ -0,0 +1,311 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// Stream event-types.
+const (
+	StreamMetric  = "metric"
+	StreamWarning = "warning"
+)
+
+const (
+	// DefaultStreamHistory is the number of events kept for replays.
+	DefaultStreamHistory = 10000
+	// streamQueueSize is the number of events queued for a subscriber.
+	// Subscribers which fall further behind are dropped, and can resume
+	// from their last event.
+	streamQueueSize = 256
+)
+
+// StreamEvent is a Metric or Warning published to the Stream.
+// Data is its JSON, and the IDs are used to filter it.
+type StreamEvent struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Data       json.RawMessage `json:"data"`
+	DeviceID   string          `json:"-"`
+	ItemID     string          `json:"-"`
+	CustomerID string          `json:"-"`
+
+	seq uint64
+}
+
+// StreamFilter selects the events of a subscriber. Each of the set fields
+// must match the event, with any of the IDs in a list. Types is both
+// metrics and warnings if empty.
+type StreamFilter struct {
+	DeviceIDs  []string `json:"device_ids,omitempty"`
+	ItemIDs    []string `json:"item_ids,omitempty"`
+	CustomerID string   `json:"customer_id,omitempty"`
+	Types      []string `json:"types,omitempty"`
+}
+
+// StreamFilterFromQuery reads the StreamFilter from the URL-query, such as:
+//  ?device_id=<id>&device_id=<id>&customer_id=<id>&type=warning
+func StreamFilterFromQuery(values url.Values) (*StreamFilter, error) {
+	f := &StreamFilter{
+		DeviceIDs:  values["device_id"],
+		ItemIDs:    values["item_id"],
+		CustomerID: values.Get("customer_id"),
+		Types:      values["type"],
+	}
+	if verrs := f.validate(); len(verrs) > 0 {
+		return nil, verrs
+	}
+	return f, nil
+}
+
+// validate returns the problems with the StreamFilter.
+func (f *StreamFilter) validate() ValidationErrors {
+	verrs := ValidationErrors{}
+	checkIDs := func(path string, ids []string) {
+		for i, id := range ids {
+			if _, err := uuuid.FromString(id); err != nil {
+				verrs = append(verrs, ValidationError{
+					Path:    fmt.Sprintf("%s[%d]", path, i),
+					Message: fmt.Sprintf("Invalid UUID %s", id),
+				})
+			}
+		}
+	}
+	checkIDs("device_id", f.DeviceIDs)
+	checkIDs("item_id", f.ItemIDs)
+	if f.CustomerID != "" {
+		checkIDs("customer_id", []string{f.CustomerID})
+	}
+
+	for i, t := range f.Types {
+		if t != StreamMetric && t != StreamWarning {
+			verrs = append(verrs, ValidationError{
+				Path: fmt.Sprintf("type[%d]", i),
+				Message: fmt.Sprintf(
+					"Invalid type %s, expected %s or %s", t, StreamMetric, StreamWarning,
+				),
+			})
+		}
+	}
+	return verrs
+}
+
+// Matches returns true if the event passes the filter.
+func (f *StreamFilter) Matches(e *StreamEvent) bool {
+	contains := func(list []string, v string) bool {
+		if len(list) == 0 {
+			return true
+		}
+		for _, item := range list {
+			if strings.EqualFold(item, v) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if f == nil {
+		return true
+	}
+	if f.CustomerID != "" && !strings.EqualFold(f.CustomerID, e.CustomerID) {
+		return false
+	}
+	return contains(f.Types, e.Type) &&
+		contains(f.DeviceIDs, e.DeviceID) &&
+		contains(f.ItemIDs, e.ItemID)
+}
+
+// MetricEvents creates the StreamEvents of the metrics. The customer of
+// each metric is read from the inventory of its item.
+func MetricEvents(metrics []Metric, inventory []Inventory) ([]StreamEvent, error) {
+	customers := map[string]string{}
+	for _, inv := range inventory {
+		customers[inv.ItemID.String()] = inv.RsCustomerID.String()
+	}
+
+	events := []StreamEvent{}
+	for i := range metrics {
+		m := &metrics[i]
+		data, err := json.Marshal(m)
+		if err != nil {
+			err = errors.Wrap(err, "Error marshalling metric - MetricEvents")
+			return nil, err
+		}
+		events = append(events, StreamEvent{
+			Type:       StreamMetric,
+			Data:       data,
+			DeviceID:   m.DeviceID.String(),
+			ItemID:     m.ItemID.String(),
+			CustomerID: customers[m.ItemID.String()],
+		})
+	}
+	return events, nil
+}
+
+// WarningEvents creates the StreamEvents of the warnings.
+func WarningEvents(warnings []Warning) ([]StreamEvent, error) {
+	events := []StreamEvent{}
+	for i := range warnings {
+		w := &warnings[i]
+		data, err := json.Marshal(w)
+		if err != nil {
+			err = errors.Wrap(err, "Error marshalling warning - WarningEvents")
+			return nil, err
+		}
+		events = append(events, StreamEvent{
+			Type:       StreamWarning,
+			Data:       data,
+			DeviceID:   w.DeviceID.String(),
+			ItemID:     w.ItemID.String(),
+			CustomerID: w.RsCustomerID.String(),
+		})
+	}
+	return events, nil
+}
+
+// Stream fans out the published events to its subscribers, and keeps the
+// latest events so that reconnecting subscribers can replay the events
+// they missed. Publishing never blocks on slow subscribers.
+//
+// Event IDs are "<epoch>-<sequence>", where the epoch is the start of the
+// Stream, so that IDs from before a restart are not replayed from.
+type Stream struct {
+	mu          sync.Mutex
+	epoch       string
+	seq         uint64
+	history     []StreamEvent
+	historySize int
+	subscribers map[*Subscription]bool
+}
+
+// NewStream creates a Stream which keeps the last historySize events.
+func NewStream(historySize int) *Stream {
+	if historySize <= 0 {
+		historySize = DefaultStreamHistory
+	}
+	return &Stream{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		historySize: historySize,
+		subscribers: map[*Subscription]bool{},
+	}
+}
+
+// Subscription receives the events matching its Filter on Events.
+// Events is closed if the subscriber is dropped for falling behind,
+// or when the Subscription is closed.
+type Subscription struct {
+	Filter *StreamFilter
+	Events <-chan StreamEvent
+
+	events chan StreamEvent
+	stream *Stream
+}
+
+// Close ends the Subscription.
+func (sub *Subscription) Close() {
+	sub.stream.mu.Lock()
+	defer sub.stream.mu.Unlock()
+	sub.stream.remove(sub)
+}
+
+// remove closes the subscription. The lock must be held.
+func (s *Stream) remove(sub *Subscription) {
+	if s.subscribers[sub] {
+		delete(s.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// parseEventID returns the sequence of the event-ID,
+// or false if it is not from this Stream.
+func (s *Stream) parseEventID(id string) (uint64, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || parts[0] != s.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || seq > s.seq {
+		return 0, false
+	}
+	return seq, true
+}
+
+// Subscribe adds a subscriber with the filter. If lastEventID is set,
+// the matching events after it are returned for replay. Complete is false
+// if some of those events are no longer kept (or the ID is unknown), in
+// which case the subscriber should reload its data.
+func (s *Stream) Subscribe(
+	filter *StreamFilter,
+	lastEventID string,
+) (sub *Subscription, replay []StreamEvent, complete bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make(chan StreamEvent, streamQueueSize)
+	sub = &Subscription{
+		Filter: filter,
+		Events: events,
+		events: events,
+		stream: s,
+	}
+	s.subscribers[sub] = true
+
+	replay = []StreamEvent{}
+	if lastEventID == "" {
+		return sub, replay, true
+	}
+	seq, ok := s.parseEventID(lastEventID)
+	if !ok {
+		return sub, replay, false
+	}
+
+	complete = len(s.history) == 0 || s.history[0].seq <= seq+1
+	for _, e := range s.history {
+		if e.seq > seq && filter.Matches(&e) {
+			replay = append(replay, e)
+		}
+	}
+	return sub, replay, complete
+}
+
+// Publish assigns the IDs of the events, and sends them to the matching
+// subscribers. Subscribers whose queue is full are dropped.
+func (s *Stream) Publish(events []StreamEvent) {
+	if s == nil || len(events) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range events {
+		s.seq++
+		e.seq = s.seq
+		e.ID = fmt.Sprintf("%s-%d", s.epoch, s.seq)
+
+		s.history = append(s.history, e)
+		if len(s.history) >= 2*s.historySize {
+			// Trimmed in chunks, and copied so that the dropped events
+			// can be collected
+			s.history = append([]StreamEvent{}, s.history[len(s.history)-s.historySize:]...)
+		}
+
+		for sub := range s.subscribers {
+			if !sub.Filter.Matches(&e) {
+				continue
+			}
+			select {
+			case sub.events <- e:
+			default:
+				s.remove(sub)
+			}
+		}
+	}
+}
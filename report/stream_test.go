@@ -0,0 +1,109 @@
+package report
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// streamEvents returns events of the device, alternating between
+// metrics and warnings.
+func streamEvents(n int, deviceID string) []StreamEvent {
+	events := []StreamEvent{}
+	for i := 0; i < n; i++ {
+		e := StreamEvent{Type: StreamMetric, DeviceID: deviceID}
+		if i%2 == 1 {
+			e.Type = StreamWarning
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestStreamSubscribe(t *testing.T) {
+	const device = "6ba7b811-9dad-11d1-80b4-00c04fd430c8"
+
+	stream := NewStream(10)
+	stream.Publish(streamEvents(5, device))
+	// A stream which only kept the last events
+	trimmed := NewStream(2)
+	trimmed.Publish(streamEvents(4, device))
+
+	id := func(s *Stream, seq int) string {
+		return fmt.Sprintf("%s-%d", s.epoch, seq)
+	}
+
+	tests := []struct {
+		name        string
+		stream      *Stream
+		filter      *StreamFilter
+		lastEventID string
+		// want are the sequences of the replayed events
+		want     []uint64
+		complete bool
+	}{
+		{"no last event", stream, nil, "", []uint64{}, true},
+		{"after an event", stream, nil, id(stream, 2), []uint64{3, 4, 5}, true},
+		{"after the last event", stream, nil, id(stream, 5), []uint64{}, true},
+		{"filtered", stream, &StreamFilter{Types: []string{StreamWarning}}, id(stream, 1), []uint64{2, 4}, true},
+		{"other device", stream, &StreamFilter{DeviceIDs: []string{"x"}}, id(stream, 1), []uint64{}, true},
+		{"other epoch", stream, nil, "x-1", []uint64{}, false},
+		{"future event", stream, nil, id(stream, 6), []uint64{}, false},
+		{"invalid event", stream, nil, "x", []uint64{}, false},
+		{"events no longer kept", trimmed, nil, id(trimmed, 1), []uint64{3, 4}, false},
+		{"kept events", trimmed, nil, id(trimmed, 2), []uint64{3, 4}, true},
+	}
+
+	for _, test := range tests {
+		sub, replay, complete := test.stream.Subscribe(test.filter, test.lastEventID)
+		got := []uint64{}
+		for _, e := range replay {
+			got = append(got, e.seq)
+		}
+		if !reflect.DeepEqual(got, test.want) || complete != test.complete {
+			t.Errorf(
+				"%s: got replay %v and complete %t, want %v and %t",
+				test.name, got, complete, test.want, test.complete,
+			)
+		}
+		sub.Close()
+	}
+}
+
+func TestStreamPublish(t *testing.T) {
+	const device = "6ba7b811-9dad-11d1-80b4-00c04fd430c8"
+
+	tests := []struct {
+		name    string
+		filter  *StreamFilter
+		publish int
+		// want is the number of events received, and whether the
+		// subscriber is still subscribed
+		want       int
+		subscribed bool
+	}{
+		{"all events", nil, 4, 4, true},
+		{"filtered", &StreamFilter{Types: []string{StreamMetric}}, 4, 2, true},
+		{"queue full", nil, streamQueueSize + 1, streamQueueSize, false},
+	}
+
+	for _, test := range tests {
+		stream := NewStream(10)
+		sub, _, _ := stream.Subscribe(test.filter, "")
+		stream.Publish(streamEvents(test.publish, device))
+
+		got := 0
+		for len(sub.Events) > 0 {
+			<-sub.Events
+			got++
+		}
+		subscribed := stream.subscribers[sub]
+		if got != test.want || subscribed != test.subscribed {
+			t.Errorf(
+				"%s: got %d events and subscribed %t, want %d and %t",
+				test.name, got, subscribed, test.want, test.subscribed,
+			)
+		}
+		sub.Close()
+	}
+}
@@ -0,0 +1,274 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// TextSearchFields are the Inventory fields searched by a TextSearch.
+var TextSearchFields = []string{"name", "origin", "lot"}
+
+// minWordSimilarity is how similar a word must be to a query-word to match it.
+const minWordSimilarity = 0.7
+
+// TextSearch is a case-insensitive and typo-tolerant search over the text
+// fields of Inventory, such as "sweet peppers" or "Strawbery".
+// Fields defaults to all TextSearchFields.
+// Results are ranked by their Score (0 to 1), and the results
+// scoring less than MinScore are dropped.
+type TextSearch struct {
+	Query    string   `json:"query"`
+	Fields   []string `json:"fields,omitempty"`
+	MinScore float64  `json:"min_score,omitempty"`
+}
+
+func (t *TextSearch) fields() []string {
+	if len(t.Fields) == 0 {
+		return TextSearchFields
+	}
+	return t.Fields
+}
+
+// textWords splits the text into lower-case words.
+func textWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// levenshtein is the number of single-character edits between a and b.
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// wordSimilarity is 1 for equal words, and decreases with the edit-distance
+// between the words. A query-word which is a prefix of the word, such as
+// "straw" for "strawberry", is also a close match.
+func wordSimilarity(queryWord, word string) float64 {
+	if queryWord == word {
+		return 1
+	}
+	q := []rune(queryWord)
+	w := []rune(word)
+	maxLen := len(q)
+	if len(w) > maxLen {
+		maxLen = len(w)
+	}
+	sim := 1 - float64(levenshtein(q, w))/float64(maxLen)
+	if len(q) >= 3 && strings.HasPrefix(word, queryWord) && sim < 0.9 {
+		sim = 0.9
+	}
+	return sim
+}
+
+// bestWordSimilarity is the similarity of the closest word to the query-word.
+func bestWordSimilarity(queryWord string, words []string) float64 {
+	best := 0.0
+	for _, w := range words {
+		sim := wordSimilarity(queryWord, w)
+		if sim > best {
+			best = sim
+		}
+	}
+	return best
+}
+
+// textScore is the average similarity of the query-words to their
+// closest words in the texts, rounded to 3 decimals.
+func textScore(queryWords []string, texts ...string) float64 {
+	if len(queryWords) == 0 {
+		return 0
+	}
+	words := []string{}
+	for _, t := range texts {
+		words = append(words, textWords(t)...)
+	}
+
+	total := 0.0
+	for _, qw := range queryWords {
+		total += bestWordSimilarity(qw, words)
+	}
+	return math.Round(total/float64(len(queryWords))*1000) / 1000
+}
+
+// isTextMatch returns true if any query-word closely matches a word in the text.
+func isTextMatch(queryWords []string, text string) bool {
+	words := textWords(text)
+	for _, qw := range queryWords {
+		if bestWordSimilarity(qw, words) >= minWordSimilarity {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns the problems with the TextSearch.
+func (t *TextSearch) validate(path string) ValidationErrors {
+	verrs := ValidationErrors{}
+	if len(textWords(t.Query)) == 0 {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".query",
+			Message: "Query must contain at least one word",
+		})
+	}
+	for i, f := range t.Fields {
+		isTextField := false
+		for _, tf := range TextSearchFields {
+			if f == tf {
+				isTextField = true
+				break
+			}
+		}
+		if !isTextField {
+			verrs = append(verrs, ValidationError{
+				Path:  fmt.Sprintf("%s.fields[%d]", path, i),
+				Field: f,
+				Message: fmt.Sprintf(
+					"Field %s cannot be text-searched, expected one of: %s",
+					f, strings.Join(TextSearchFields, ", "),
+				),
+			})
+		}
+	}
+	if t.MinScore < 0 || t.MinScore > 1 {
+		verrs = append(verrs, ValidationError{
+			Path:    path + ".min_score",
+			Message: "MinScore must be between 0 and 1",
+		})
+	}
+	return verrs
+}
+
+// textFilter creates the filter matching the documents having a text-field
+// which closely matches a query-word. The candidate values are the distinct
+// values of the text-fields among the documents matching the filter,
+// which are far fewer than the documents themselves.
+// If no values match, the filter matches no documents.
+func (db *DB) textFilter(text *TextSearch, filter map[string]interface{}) (map[string]interface{}, error) {
+	timeout := time.Duration(db.collection.Connection.Timeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	queryWords := textWords(text.Query)
+	or := []interface{}{}
+	for _, field := range text.fields() {
+		values, err := db.collection.Collection().Distinct(ctx, field, filter)
+		if err != nil {
+			err = errors.Wrapf(err, "Error fetching distinct values of %s - textFilter", field)
+			log.Println(err)
+			return nil, err
+		}
+
+		matched := []interface{}{}
+		for _, v := range values {
+			s, ok := v.(string)
+			if ok && isTextMatch(queryWords, s) {
+				matched = append(matched, s)
+			}
+		}
+		if len(matched) > 0 {
+			or = append(or, map[string]interface{}{
+				field: map[string]interface{}{
+					"$in": matched,
+				},
+			})
+		}
+	}
+
+	if len(or) == 0 {
+		return map[string]interface{}{
+			"_id": map[string]interface{}{
+				"$in": []interface{}{},
+			},
+		}, nil
+	}
+	return map[string]interface{}{
+		"$or": or,
+	}, nil
+}
+
+// rankInventory sets the Score of each Inventory, drops the ones scoring
+// less than MinScore, and sorts the rest by descending Score.
+func rankInventory(inventory []Inventory, text *TextSearch) []Inventory {
+	queryWords := textWords(text.Query)
+	ranked := []Inventory{}
+	for _, inv := range inventory {
+		texts := []string{}
+		for _, f := range text.fields() {
+			if s, ok := bsonFieldValue(inv, f).(string); ok {
+				texts = append(texts, s)
+			}
+		}
+		inv.Score = textScore(queryWords, texts...)
+		if inv.Score >= text.MinScore {
+			ranked = append(ranked, inv)
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score > ranked[j].Score
+	})
+	return ranked
+}
+
+// rankedPage returns the page of ranked Inventory after the cursor.
+// Ranked results are paginated by their offset, since their
+// order is not known to the DB.
+func rankedPage(ranked []Inventory, page *PageParams) ([]Inventory, *PageResult, error) {
+	offset, err := page.cursorOffset()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := &PageResult{
+		Total: int64(len(ranked)),
+	}
+	if offset >= int64(len(ranked)) {
+		return []Inventory{}, result, nil
+	}
+
+	end := offset + page.size()
+	if end < int64(len(ranked)) {
+		result.NextCursor, err = offsetCursor(end)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		end = int64(len(ranked))
+	}
+	return ranked[offset:end], result, nil
+}
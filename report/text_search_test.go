@@ -0,0 +1,86 @@
+package report
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTextScore(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		texts []string
+		want  float64
+	}{
+		{"exact", "banana", []string{"Banana"}, 1},
+		{"typo", "strawbery", []string{"Strawberry"}, 0.9},
+		{"prefix", "straw", []string{"Strawberry"}, 0.9},
+		{"several words", "sweet peppers", []string{"Sweet Peppers"}, 1},
+		{"one of the words", "red kiwi", []string{"Kiwi"}, 0.5},
+		{"any of the texts", "ontario", []string{"Banana", "Ontario"}, 1},
+		{"no texts", "banana", nil, 0},
+		{"no query-words", "", []string{"Banana"}, 0},
+	}
+
+	for _, test := range tests {
+		if got := textScore(textWords(test.query), test.texts...); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRankedPage(t *testing.T) {
+	ranked := []Inventory{}
+	for i := 0; i < 5; i++ {
+		ranked = append(ranked, Inventory{Name: fmt.Sprintf("item %d", i)})
+	}
+	cursor := func(offset int64) string {
+		c, _ := offsetCursor(offset)
+		return c
+	}
+
+	tests := []struct {
+		name string
+		page *PageParams
+		// want are the offsets of the first result and the next page
+		want, wantNext int64
+		wantLen        int
+	}{
+		{"first page", &PageParams{Size: 2}, 0, 2, 2},
+		{"middle page", &PageParams{Size: 2, Cursor: cursor(2)}, 2, 4, 2},
+		{"last page", &PageParams{Size: 2, Cursor: cursor(4)}, 4, -1, 1},
+		{"exactly the last page", &PageParams{Size: 5}, 0, -1, 5},
+		{"at the end", &PageParams{Size: 2, Cursor: cursor(5)}, 0, -1, 0},
+		{"past the end", &PageParams{Size: 2, Cursor: cursor(9)}, 0, -1, 0},
+	}
+
+	for _, test := range tests {
+		page, result, err := rankedPage(ranked, test.page)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if len(page) != test.wantLen || result.Total != 5 {
+			t.Errorf("%s: got %d of %d results, want %d of 5", test.name, len(page), result.Total, test.wantLen)
+			continue
+		}
+		if len(page) > 0 && page[0].Name != ranked[test.want].Name {
+			t.Errorf("%s: got first result %s, want %s", test.name, page[0].Name, ranked[test.want].Name)
+		}
+		if test.wantNext < 0 {
+			if result.NextCursor != "" {
+				t.Errorf("%s: got next cursor %q, want none", test.name, result.NextCursor)
+			}
+			continue
+		}
+		if result.NextCursor != cursor(test.wantNext) {
+			t.Errorf("%s: got next cursor %q, want offset %d", test.name, result.NextCursor, test.wantNext)
+		}
+	}
+
+	// A cursor of a keyset page is not for ranked results
+	keyset, _ := encodeCursor(&pageCursor{ID: "5bc8a0000000000000000001"})
+	if _, _, err := rankedPage(ranked, &PageParams{Cursor: keyset}); err == nil {
+		t.Errorf("keyset cursor: got no error")
+	}
+}
@@ -0,0 +1,185 @@
+package report
+
+import (
+	"math"
+	"strings"
+)
+
+// Warning severities, by how far the reading is outside of its range.
+const (
+	SeverityLow    = "low"
+	SeverityMedium = "medium"
+	SeverityHigh   = "high"
+)
+
+// ClimateRange is the ideal range of a sensor-channel.
+type ClimateRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// ProductThresholds are the ideal storage-ranges of a product.
+// TempIn is in °C, Humidity in %RH, and Ethylene and CarbonDi in ppm.
+type ProductThresholds struct {
+	TempIn   ClimateRange `json:"temp_in"`
+	Humidity ClimateRange `json:"humidity"`
+	Ethylene ClimateRange `json:"ethylene"`
+	CarbonDi ClimateRange `json:"carbon_di"`
+}
+
+// Thresholds are the ProductThresholds for each product-name.
+var Thresholds = map[string]ProductThresholds{
+	"Banana": {
+		TempIn:   ClimateRange{Min: 13, Max: 15},
+		Humidity: ClimateRange{Min: 85, Max: 95},
+		Ethylene: ClimateRange{Min: 0, Max: 10},
+		CarbonDi: ClimateRange{Min: 0, Max: 5000},
+	},
+	"Orange": {
+		TempIn:   ClimateRange{Min: 3, Max: 9},
+		Humidity: ClimateRange{Min: 85, Max: 90},
+		Ethylene: ClimateRange{Min: 0, Max: 50},
+		CarbonDi: ClimateRange{Min: 0, Max: 5000},
+	},
+	"Apple": {
+		TempIn:   ClimateRange{Min: 0, Max: 4},
+		Humidity: ClimateRange{Min: 90, Max: 95},
+		Ethylene: ClimateRange{Min: 0, Max: 100},
+		CarbonDi: ClimateRange{Min: 0, Max: 5000},
+	},
+	"Mango": {
+		TempIn:   ClimateRange{Min: 10, Max: 13},
+		Humidity: ClimateRange{Min: 85, Max: 95},
+		Ethylene: ClimateRange{Min: 0, Max: 50},
+		CarbonDi: ClimateRange{Min: 0, Max: 5000},
+	},
+	"Strawberry": {
+		TempIn:   ClimateRange{Min: 0, Max: 2},
+		Humidity: ClimateRange{Min: 90, Max: 95},
+		Ethylene: ClimateRange{Min: 0, Max: 10},
+		CarbonDi: ClimateRange{Min: 0, Max: 15000},
+	},
+	"Tomato": {
+		TempIn:   ClimateRange{Min: 10, Max: 13},
+		Humidity: ClimateRange{Min: 85, Max: 95},
+		Ethylene: ClimateRange{Min: 0, Max: 50},
+		CarbonDi: ClimateRange{Min: 0, Max: 5000},
+	},
+	"Lettuce": {
+		TempIn:   ClimateRange{Min: 0, Max: 2},
+		Humidity: ClimateRange{Min: 95, Max: 100},
+		Ethylene: ClimateRange{Min: 0, Max: 1},
+		CarbonDi: ClimateRange{Min: 0, Max: 5000},
+	},
+	"Pear": {
+		TempIn:   ClimateRange{Min: -1, Max: 2},
+		Humidity: ClimateRange{Min: 90, Max: 95},
+		Ethylene: ClimateRange{Min: 0, Max: 100},
+		CarbonDi: ClimateRange{Min: 0, Max: 5000},
+	},
+	"Grapes": {
+		TempIn:   ClimateRange{Min: -1, Max: 1},
+		Humidity: ClimateRange{Min: 90, Max: 95},
+		Ethylene: ClimateRange{Min: 0, Max: 10},
+		CarbonDi: ClimateRange{Min: 0, Max: 5000},
+	},
+	"Sweet Pepper": {
+		TempIn:   ClimateRange{Min: 7, Max: 10},
+		Humidity: ClimateRange{Min: 90, Max: 95},
+		Ethylene: ClimateRange{Min: 0, Max: 10},
+		CarbonDi: ClimateRange{Min: 0, Max: 5000},
+	},
+}
+
+// ThresholdsFor returns the ProductThresholds for the product-name,
+// which is matched case-insensitively.
+func ThresholdsFor(name string) (*ProductThresholds, bool) {
+	for prodName, t := range Thresholds {
+		if strings.EqualFold(prodName, strings.TrimSpace(name)) {
+			thresholds := t
+			return &thresholds, true
+		}
+	}
+	return nil, false
+}
+
+// ranges maps the Metric channels to their ranges.
+func (t *ProductThresholds) ranges() map[string]ClimateRange {
+	return map[string]ClimateRange{
+		"temp_in":   t.TempIn,
+		"humidity":  t.Humidity,
+		"ethylene":  t.Ethylene,
+		"carbon_di": t.CarbonDi,
+	}
+}
+
+// severity is based on how far the value is outside of the range,
+// relative to the width of the range.
+func severity(excess float64, r ClimateRange) string {
+	width := math.Max(r.Max-r.Min, 1)
+	switch ratio := excess / width; {
+	case ratio < 0.25:
+		return SeverityLow
+	case ratio < 1:
+		return SeverityMedium
+	}
+	return SeverityHigh
+}
+
+// metricReadings maps the Metric channels to their readings.
+// Missing readings are not in the map.
+func metricReadings(m Metric) map[string]float64 {
+	readings := map[string]float64{}
+	for _, channel := range RollupChannels {
+		if value, ok := m.Reading(channel); ok {
+			readings[channel] = value
+		}
+	}
+	return readings
+}
+
+// evaluateMetric checks the readings of the Metric against the
+// ProductThresholds of the Inventory it belongs to, and returns
+// a Warning for each reading outside of its range.
+// No warnings are returned for products without thresholds, or for
+// missing readings.
+func evaluateMetric(metric Metric, inv Inventory) []Warning {
+	thresholds, ok := ThresholdsFor(inv.Name)
+	if !ok {
+		return nil
+	}
+
+	readings := metricReadings(metric)
+	warnings := []Warning{}
+	for _, channel := range RollupChannels {
+		r := thresholds.ranges()[channel]
+		value, ok := readings[channel]
+		if !ok {
+			continue
+		}
+
+		warning := Warning{
+			ItemID:       metric.ItemID,
+			DeviceID:     metric.DeviceID,
+			RsCustomerID: inv.RsCustomerID,
+			ProdName:     inv.Name,
+			Channel:      channel,
+			Value:        value,
+			Timestamp:    metric.Timestamp,
+		}
+		switch {
+		case value < r.Min:
+			warning.Limit = r.Min
+			warning.LimitType = "min"
+			warning.Severity = severity(r.Min-value, r)
+		case value > r.Max:
+			warning.Limit = r.Max
+			warning.LimitType = "max"
+			warning.Severity = severity(value-r.Max, r)
+		default:
+			continue
+		}
+		warnings = append(warnings, warning)
+	}
+	return warnings
+}
@@ -0,0 +1,90 @@
+package report
+
+import "testing"
+
+func TestEvaluateMetric(t *testing.T) {
+	banana := Inventory{Name: "Banana"}
+	// A zero reading, which is set as a reading and not left missing
+	frozen := Metric{Humidity: 90}
+	frozen.SetReading("temp_in", 0)
+
+	tests := []struct {
+		name   string
+		metric Metric
+		inv    Inventory
+		// want maps the channels of the warnings to their limit-type
+		want map[string]string
+	}{
+		{
+			name:   "within thresholds",
+			metric: Metric{TempIn: 14, Humidity: 90, Ethylene: 5, CarbonDi: 400},
+			inv:    banana,
+			want:   map[string]string{},
+		},
+		{
+			name:   "above and below thresholds",
+			metric: Metric{TempIn: 20, Humidity: 50},
+			inv:    banana,
+			want:   map[string]string{"temp_in": "max", "humidity": "min"},
+		},
+		{
+			name:   "zero reading",
+			metric: frozen,
+			inv:    banana,
+			want:   map[string]string{"temp_in": "min"},
+		},
+		{
+			name:   "missing readings",
+			metric: Metric{Ethylene: 5},
+			inv:    banana,
+			want:   map[string]string{},
+		},
+		{
+			name:   "product-name is case-insensitive",
+			metric: Metric{TempIn: 20},
+			inv:    Inventory{Name: " banana "},
+			want:   map[string]string{"temp_in": "max"},
+		},
+		{
+			name:   "product without thresholds",
+			metric: Metric{TempIn: 100},
+			inv:    Inventory{Name: "Durian"},
+			want:   map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		warnings := evaluateMetric(test.metric, test.inv)
+		if len(warnings) != len(test.want) {
+			t.Errorf("%s: got %d warnings, want %d", test.name, len(warnings), len(test.want))
+			continue
+		}
+		for _, w := range warnings {
+			if test.want[w.Channel] != w.LimitType {
+				t.Errorf(
+					"%s: got %s %s warning, want %q",
+					test.name, w.Channel, w.LimitType, test.want[w.Channel],
+				)
+			}
+		}
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	r := ClimateRange{Min: 10, Max: 14}
+	tests := []struct {
+		excess float64
+		want   string
+	}{
+		{0.5, SeverityLow},
+		{1, SeverityMedium},
+		{3.9, SeverityMedium},
+		{4, SeverityHigh},
+	}
+
+	for _, test := range tests {
+		if got := severity(test.excess, r); got != test.want {
+			t.Errorf("severity(%v) = %s, want %s", test.excess, got, test.want)
+		}
+	}
+}
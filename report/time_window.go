@@ -0,0 +1,129 @@
+package report
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeWindow is a half-open time-range [Start, End).
+// An instant (such as an RFC3339 timestamp) has equal Start and End.
+type TimeWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// IsInstant returns true if the TimeWindow represents a single point in time.
+func (w *TimeWindow) IsInstant() bool {
+	return w.Start.Equal(w.End)
+}
+
+// relativeWindowRegex matches windows such as "last_7d" or "next_48h".
+var relativeWindowRegex = regexp.MustCompile(`^(last|next)_(\d+)(m|h|d|w)$`)
+
+// ParseTimeWindow parses a date-value into a TimeWindow.
+// Supported formats are:
+//  RFC3339 timestamps: "2018-10-18T15:04:05Z" (instant)
+//  Unix-seconds:       1539875045 (instant)
+//  Calendar dates:     "2018-10-18" (that whole day in loc)
+//  Relative windows:   "last_7d", "next_48h", "last_30m", "next_2w"
+//  Named windows:      "today", "yesterday", "tomorrow", "this_week",
+//                      "last_week", "next_week", "this_month",
+//                      "last_month", "next_month"
+// Weeks start on Monday. Calendar dates and named windows use loc,
+// which defaults to UTC if nil.
+func ParseTimeWindow(value interface{}, loc *time.Location, now time.Time) (*TimeWindow, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+
+	switch val := value.(type) {
+	case float64:
+		t := time.Unix(int64(val), 0)
+		return &TimeWindow{Start: t, End: t}, nil
+	case int64:
+		t := time.Unix(val, 0)
+		return &TimeWindow{Start: t, End: t}, nil
+	case int32:
+		t := time.Unix(int64(val), 0)
+		return &TimeWindow{Start: t, End: t}, nil
+	case int:
+		t := time.Unix(int64(val), 0)
+		return &TimeWindow{Start: t, End: t}, nil
+	case string:
+		return parseTimeWindowString(strings.TrimSpace(val), loc, now)
+	}
+	return nil, errors.Errorf("Expected a date value, got %v", value)
+}
+
+func parseTimeWindowString(value string, loc *time.Location, now time.Time) (*TimeWindow, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return &TimeWindow{Start: t, End: t}, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return &TimeWindow{Start: t, End: t.AddDate(0, 0, 1)}, nil
+	}
+
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		t := time.Unix(unix, 0)
+		return &TimeWindow{Start: t, End: t}, nil
+	}
+
+	if match := relativeWindowRegex.FindStringSubmatch(value); match != nil {
+		count, err := strconv.Atoi(match[2])
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing relative time-window")
+			return nil, err
+		}
+
+		var offset time.Duration
+		switch match[3] {
+		case "m":
+			offset = time.Duration(count) * time.Minute
+		case "h":
+			offset = time.Duration(count) * time.Hour
+		case "d":
+			offset = time.Duration(count) * 24 * time.Hour
+		case "w":
+			offset = time.Duration(count) * 7 * 24 * time.Hour
+		}
+
+		if match[1] == "last" {
+			return &TimeWindow{Start: now.Add(-offset), End: now}, nil
+		}
+		return &TimeWindow{Start: now, End: now.Add(offset)}, nil
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	// time.Weekday starts from Sunday, our weeks start from Monday
+	weekStart := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+
+	switch value {
+	case "today":
+		return &TimeWindow{Start: today, End: today.AddDate(0, 0, 1)}, nil
+	case "yesterday":
+		return &TimeWindow{Start: today.AddDate(0, 0, -1), End: today}, nil
+	case "tomorrow":
+		return &TimeWindow{Start: today.AddDate(0, 0, 1), End: today.AddDate(0, 0, 2)}, nil
+	case "this_week":
+		return &TimeWindow{Start: weekStart, End: weekStart.AddDate(0, 0, 7)}, nil
+	case "last_week":
+		return &TimeWindow{Start: weekStart.AddDate(0, 0, -7), End: weekStart}, nil
+	case "next_week":
+		return &TimeWindow{Start: weekStart.AddDate(0, 0, 7), End: weekStart.AddDate(0, 0, 14)}, nil
+	case "this_month":
+		return &TimeWindow{Start: monthStart, End: monthStart.AddDate(0, 1, 0)}, nil
+	case "last_month":
+		return &TimeWindow{Start: monthStart.AddDate(0, -1, 0), End: monthStart}, nil
+	case "next_month":
+		return &TimeWindow{Start: monthStart.AddDate(0, 1, 0), End: monthStart.AddDate(0, 2, 0)}, nil
+	}
+
+	return nil, errors.Errorf("Unable to parse date value %s", value)
+}
@@ -0,0 +1,76 @@
+package report
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatalf("LoadLocation: %v", err)
+	}
+	// Thursday 2018-10-18 15:00 UTC
+	now := time.Date(2018, 10, 18, 15, 0, 0, 0, time.UTC)
+	day := func(year int, month time.Month, d int, loc *time.Location) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, loc)
+	}
+
+	tests := []struct {
+		name       string
+		value      interface{}
+		loc        *time.Location
+		start, end time.Time
+		wantErr    bool
+	}{
+		{name: "unix seconds", value: 1539875045.0, start: time.Unix(1539875045, 0), end: time.Unix(1539875045, 0)},
+		{name: "unix seconds string", value: "1539875045", start: time.Unix(1539875045, 0), end: time.Unix(1539875045, 0)},
+		{
+			name:  "rfc3339",
+			value: "2018-10-18T15:04:05Z",
+			start: time.Date(2018, 10, 18, 15, 4, 5, 0, time.UTC),
+			end:   time.Date(2018, 10, 18, 15, 4, 5, 0, time.UTC),
+		},
+		{name: "calendar date", value: "2018-10-18", start: day(2018, 10, 18, time.UTC), end: day(2018, 10, 19, time.UTC)},
+		{
+			name:  "calendar date in a time-zone",
+			value: "2018-10-18",
+			loc:   toronto,
+			start: day(2018, 10, 18, toronto),
+			end:   day(2018, 10, 19, toronto),
+		},
+		{name: "last days", value: "last_7d", start: now.AddDate(0, 0, -7), end: now},
+		{name: "next hours", value: " next_48h ", start: now, end: now.Add(48 * time.Hour)},
+		{name: "last minutes", value: "last_30m", start: now.Add(-30 * time.Minute), end: now},
+		{name: "today", value: "today", start: day(2018, 10, 18, time.UTC), end: day(2018, 10, 19, time.UTC)},
+		{
+			name:  "today in a time-zone",
+			value: "today",
+			loc:   toronto,
+			start: day(2018, 10, 18, toronto),
+			end:   day(2018, 10, 19, toronto),
+		},
+		{name: "yesterday", value: "yesterday", start: day(2018, 10, 17, time.UTC), end: day(2018, 10, 18, time.UTC)},
+		{name: "weeks start on monday", value: "this_week", start: day(2018, 10, 15, time.UTC), end: day(2018, 10, 22, time.UTC)},
+		{name: "last week", value: "last_week", start: day(2018, 10, 8, time.UTC), end: day(2018, 10, 15, time.UTC)},
+		{name: "this month", value: "this_month", start: day(2018, 10, 1, time.UTC), end: day(2018, 11, 1, time.UTC)},
+		{name: "next month", value: "next_month", start: day(2018, 11, 1, time.UTC), end: day(2018, 12, 1, time.UTC)},
+		{name: "unknown window", value: "last_year", wantErr: true},
+		{name: "unknown unit", value: "last_7y", wantErr: true},
+		{name: "not a date", value: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		w, err := ParseTimeWindow(test.value, test.loc, now)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !w.Start.Equal(test.start) || !w.End.Equal(test.end) {
+			t.Errorf("%s: got %v to %v, want %v to %v", test.name, w.Start, w.End, test.start, test.end)
+		}
+	}
+}
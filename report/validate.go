@@ -0,0 +1,214 @@
+package report
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError describes a problem with a part of the SearchQuery.
+// Path locates the problem in the request-body, such as "inventory.and[0].or[1]".
+type ValidationError struct {
+	Path    string `json:"path"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors are all the problems found in a SearchQuery.
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	msgs := []string{}
+	for _, e := range v {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", e.Path, e.Message))
+	}
+	return "Invalid search query: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the SearchQuery against the schemas of Inventory, Metric
+// and Device, so that invalid queries are rejected before reaching the DB.
+// The sort-fields of the page depend on the report, and are checked by
+// ValidateSort.
+// Returns nil if the SearchQuery is valid.
+func (q *SearchQuery) Validate() ValidationErrors {
+	verrs := ValidationErrors{}
+
+	verrs = append(verrs, validateNode(q.Inventory, "inventory", inventoryFields)...)
+	verrs = append(verrs, validateNode(q.Metric, "metric", metricFields)...)
+	verrs = append(verrs, validateNode(q.Device, "device", deviceFields)...)
+	verrs = append(verrs, validateNode(q.Warning, "warning", warningFields)...)
+	verrs = append(verrs, validateNode(q.Anomaly, "anomaly", anomalyFields)...)
+
+	if q.Text != nil {
+		verrs = append(verrs, q.Text.validate("text")...)
+	}
+
+	verrs = append(verrs, validateUnits(q.Units, "units")...)
+
+	if q.Fields != nil {
+		verrs = append(verrs, validateFieldList(q.Fields.Inventory, "fields.inventory", inventoryFields)...)
+		verrs = append(verrs, validateFieldList(q.Fields.Metric, "fields.metric", metricFields)...)
+		verrs = append(verrs, validateFieldList(q.Fields.Device, "fields.device", deviceFields)...)
+		verrs = append(verrs, validateFieldList(q.Fields.Warning, "fields.warning", warningFields)...)
+		verrs = append(verrs, validateFieldList(q.Fields.Anomaly, "fields.anomaly", anomalyFields)...)
+	}
+
+	if q.Page != nil {
+		if q.Page.Size < 0 {
+			verrs = append(verrs, ValidationError{
+				Path:    "page.size",
+				Message: "Page size cannot be negative",
+			})
+		}
+		if q.Text != nil && len(q.Page.Sort) > 0 {
+			verrs = append(verrs, ValidationError{
+				Path:    "page.sort",
+				Message: "Results of a text search are sorted by score",
+			})
+		}
+		if q.Page.Cursor != "" {
+			var err error
+			if q.Text != nil {
+				_, err = q.Page.cursorOffset()
+			} else {
+				_, err = q.Page.cursorFilter()
+			}
+			if err != nil {
+				verrs = append(verrs, ValidationError{
+					Path:    "page.cursor",
+					Message: err.Error(),
+				})
+			}
+		}
+	}
+
+	if len(verrs) == 0 {
+		return nil
+	}
+	return verrs
+}
+
+// ValidateSort checks the sort-fields of the page against the schema of
+// the entity paged by the report ("inventory", "metric", "device",
+// "warning" or "anomaly"). The results of the reports which are not paged
+// have no entity, and cannot be sorted.
+// Returns nil if the sort-fields are valid.
+func (q *SearchQuery) ValidateSort(entity string) ValidationErrors {
+	if q.Page == nil || len(q.Page.Sort) == 0 {
+		return nil
+	}
+	fields, ok := pagedFields[entity]
+	if !ok {
+		return ValidationErrors{
+			ValidationError{
+				Path:    "page.sort",
+				Message: "Results of this report cannot be sorted",
+			},
+		}
+	}
+
+	verrs := ValidationErrors{}
+	for i, sf := range q.Page.Sort {
+		if _, ok := fields[sf.Field]; !ok && sf.Field != "_id" {
+			verrs = append(verrs, ValidationError{
+				Path:    fmt.Sprintf("page.sort[%d]", i),
+				Field:   sf.Field,
+				Message: fmt.Sprintf("Unknown %s field %s", entity, sf.Field),
+			})
+		}
+	}
+	if len(verrs) == 0 {
+		return nil
+	}
+	return verrs
+}
+
+func validateNode(node *QueryNode, path string, fields map[string][]string) ValidationErrors {
+	if node == nil {
+		return nil
+	}
+
+	verrs := ValidationErrors{}
+	if node.isLeaf() {
+		if node.Field == "" && node.Type == "" {
+			return nil
+		}
+		return validateParam(node.SearchParam, path, fields)
+	}
+
+	if node.Field != "" || node.Type != "" {
+		verrs = append(verrs, ValidationError{
+			Path:    path,
+			Field:   node.Field,
+			Message: "A node cannot have both a condition and and/or/not groups",
+		})
+	}
+	for i, n := range node.And {
+		verrs = append(verrs, validateNode(n, fmt.Sprintf("%s.and[%d]", path, i), fields)...)
+	}
+	for i, n := range node.Or {
+		verrs = append(verrs, validateNode(n, fmt.Sprintf("%s.or[%d]", path, i), fields)...)
+	}
+	verrs = append(verrs, validateNode(node.Not, path+".not", fields)...)
+	return verrs
+}
+
+func validateParam(p SearchParam, path string, fields map[string][]string) ValidationErrors {
+	verrs := ValidationErrors{}
+	addErr := func(msg string) {
+		verrs = append(verrs, ValidationError{
+			Path:    path,
+			Field:   p.Field,
+			Message: msg,
+		})
+	}
+
+	if p.Field == "" {
+		addErr("Field is required")
+	}
+	if p.Type == "" {
+		addErr("Type is required")
+	}
+	if len(verrs) > 0 {
+		return verrs
+	}
+
+	types, ok := fields[p.Field]
+	if !ok {
+		addErr(fmt.Sprintf("Unknown field %s", p.Field))
+		return verrs
+	}
+	isValidType := false
+	for _, t := range types {
+		if t == p.Type {
+			isValidType = true
+			break
+		}
+	}
+	if !isValidType {
+		addErr(fmt.Sprintf(
+			"Type %s cannot be used with field %s, expected one of: %s",
+			p.Type, p.Field, strings.Join(types, ", "),
+		))
+		return verrs
+	}
+
+	_, err := p.condition()
+	if err != nil {
+		addErr(err.Error())
+	}
+	return verrs
+}
+
+func validateFieldList(list []string, path string, fields map[string][]string) ValidationErrors {
+	verrs := ValidationErrors{}
+	for i, f := range list {
+		if _, ok := fields[f]; !ok && f != "_id" {
+			verrs = append(verrs, ValidationError{
+				Path:    fmt.Sprintf("%s[%d]", path, i),
+				Field:   f,
+				Message: fmt.Sprintf("Unknown field %s", f),
+			})
+		}
+	}
+	return verrs
+}
@@ -0,0 +1,51 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateSort(t *testing.T) {
+	sortBy := func(fields ...string) *SearchQuery {
+		page := &PageParams{}
+		for _, f := range fields {
+			page.Sort = append(page.Sort, SortField{Field: f})
+		}
+		return &SearchQuery{Page: page}
+	}
+
+	tests := []struct {
+		name   string
+		query  *SearchQuery
+		entity string
+		// want are the paths of the validation errors
+		want []string
+	}{
+		{"inventory field", sortBy("name", "_id"), "inventory", nil},
+		{"metric field", sortBy("timestamp", "temp_in"), "metric", nil},
+		{"field of another entity", sortBy("temp_in"), "inventory", []string{"page.sort[0]"}},
+		{"unknown field", sortBy("name", "x"), "device", []string{"page.sort[0]", "page.sort[1]"}},
+		{"warning field", sortBy("severity"), "warning", nil},
+		{"anomaly field", sortBy("method"), "anomaly", nil},
+		{"report without pages", sortBy("name"), "", []string{"page.sort"}},
+		{"no sort", sortBy(), "", nil},
+		{"no page", &SearchQuery{}, "metric", nil},
+	}
+
+	for _, test := range tests {
+		verrs := test.query.ValidateSort(test.entity)
+		if test.want == nil {
+			if verrs != nil {
+				t.Errorf("%s: got errors %v, want none", test.name, verrs)
+			}
+			continue
+		}
+		got := []string{}
+		for _, e := range verrs {
+			got = append(got, e.Path)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got errors at %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package report
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/TerrexTech/uuuid"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/pkg/errors"
+)
+
+// WarningThreshold is the WarningType of warnings for readings
+// outside of the ProductThresholds.
+const WarningThreshold = "threshold"
+
+// Warning is created when a Metric reading is outside of the ideal range
+// for the product. Value is the offending reading, and Limit is the
+// "min" or "max" (LimitType) of the range which it crossed.
+// Timestamp is the time of the reading.
+type Warning struct {
+	ID           objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	WarningID    uuuid.UUID        `bson:"warning_id,omitempty" json:"warning_id,omitempty"`
+	WarningType  string            `bson:"warning_type,omitempty" json:"warning_type,omitempty"`
+	ItemID       uuuid.UUID        `bson:"item_id,omitempty" json:"item_id,omitempty"`
+	DeviceID     uuuid.UUID        `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	RsCustomerID uuuid.UUID        `bson:"rs_customer_id,omitempty" json:"rs_customer_id,omitempty"`
+	ProdName     string            `bson:"prod_name,omitempty" json:"prod_name,omitempty"`
+	Channel      string            `bson:"channel,omitempty" json:"channel,omitempty"`
+	Severity     string            `bson:"severity,omitempty" json:"severity,omitempty"`
+	Value        float64           `bson:"value" json:"value"`
+	Limit        float64           `bson:"limit" json:"limit"`
+	LimitType    string            `bson:"limit_type,omitempty" json:"limit_type,omitempty"`
+	Timestamp    int64             `bson:"timestamp,omitempty" json:"timestamp,omitempty"`
+	CreatedAt    int64             `bson:"created_at,omitempty" json:"created_at,omitempty"`
+
+	// selectedFields are the fields serialized by MarshalJSON, all if empty
+	selectedFields []string
+}
+
+type marshalWarning struct {
+	ID           objectid.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	WarningID    string            `bson:"warning_id,omitempty" json:"warning_id,omitempty"`
+	WarningType  string            `bson:"warning_type,omitempty" json:"warning_type,omitempty"`
+	ItemID       string            `bson:"item_id,omitempty" json:"item_id,omitempty"`
+	DeviceID     string            `bson:"device_id,omitempty" json:"device_id,omitempty"`
+	RsCustomerID string            `bson:"rs_customer_id,omitempty" json:"rs_customer_id,omitempty"`
+	ProdName     string            `bson:"prod_name,omitempty" json:"prod_name,omitempty"`
+	Channel      string            `bson:"channel,omitempty" json:"channel,omitempty"`
+	Severity     string            `bson:"severity,omitempty" json:"severity,omitempty"`
+	Value        float64           `bson:"value" json:"value"`
+	Limit        float64           `bson:"limit" json:"limit"`
+	LimitType    string            `bson:"limit_type,omitempty" json:"limit_type,omitempty"`
+	Timestamp    int64             `bson:"timestamp,omitempty" json:"timestamp,omitempty"`
+	CreatedAt    int64             `bson:"created_at,omitempty" json:"created_at,omitempty"`
+}
+
+func (w *Warning) toMarshal() *marshalWarning {
+	mw := &marshalWarning{
+		ID:          w.ID,
+		WarningType: w.WarningType,
+		ProdName:    w.ProdName,
+		Channel:     w.Channel,
+		Severity:    w.Severity,
+		Value:       w.Value,
+		Limit:       w.Limit,
+		LimitType:   w.LimitType,
+		Timestamp:   w.Timestamp,
+		CreatedAt:   w.CreatedAt,
+	}
+
+	if w.WarningID.String() != (uuuid.UUID{}).String() {
+		mw.WarningID = w.WarningID.String()
+	}
+	if w.ItemID.String() != (uuuid.UUID{}).String() {
+		mw.ItemID = w.ItemID.String()
+	}
+	if w.DeviceID.String() != (uuuid.UUID{}).String() {
+		mw.DeviceID = w.DeviceID.String()
+	}
+	if w.RsCustomerID.String() != (uuuid.UUID{}).String() {
+		mw.RsCustomerID = w.RsCustomerID.String()
+	}
+	return mw
+}
+
+func (w Warning) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(w.toMarshal())
+}
+
+func (w *Warning) MarshalJSON() ([]byte, error) {
+	out, err := json.Marshal(w.toMarshal())
+	if err != nil {
+		return nil, err
+	}
+	return selectJSONFields(out, w.selectedFields)
+}
+
+func (w *Warning) UnmarshalBSON(in []byte) error {
+	mw := &marshalWarning{}
+	err := bson.Unmarshal(in, mw)
+	if err != nil {
+		err = errors.Wrap(err, "Unmarshal Error")
+		return err
+	}
+
+	w.ID = mw.ID
+	w.WarningType = mw.WarningType
+	w.ProdName = mw.ProdName
+	w.Channel = mw.Channel
+	w.Severity = mw.Severity
+	w.Value = mw.Value
+	w.Limit = mw.Limit
+	w.LimitType = mw.LimitType
+	w.Timestamp = mw.Timestamp
+	w.CreatedAt = mw.CreatedAt
+
+	if mw.WarningID != "" {
+		w.WarningID, err = uuuid.FromString(mw.WarningID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing WarningID for warning")
+			return err
+		}
+	}
+	if mw.ItemID != "" {
+		w.ItemID, err = uuuid.FromString(mw.ItemID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing ItemID for warning")
+			return err
+		}
+	}
+	if mw.DeviceID != "" {
+		w.DeviceID, err = uuuid.FromString(mw.DeviceID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing DeviceID for warning")
+			return err
+		}
+	}
+	if mw.RsCustomerID != "" {
+		w.RsCustomerID, err = uuuid.FromString(mw.RsCustomerID)
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing RsCustomerID for warning")
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertWarnings generates the WarningIDs of the warnings, and inserts them.
+func (db *DB) InsertWarnings(warnings []Warning) ([]Warning, error) {
+	now := time.Now().Unix()
+	docs := []interface{}{}
+	for i := range warnings {
+		warningID, err := uuuid.NewV4()
+		if err != nil {
+			err = errors.Wrap(err, "Unable to generate WarningID - InsertWarnings")
+			log.Println(err)
+			return nil, err
+		}
+		warnings[i].WarningID = warningID
+		warnings[i].CreatedAt = now
+		docs = append(docs, warnings[i])
+	}
+
+	err := db.insertMany(docs)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to insert Warnings - InsertWarnings")
+		log.Println(err)
+		return nil, err
+	}
+	return warnings, nil
+}
+
+// CreateWarnings evaluates the metrics against the ProductThresholds of
+// their inventory-items, and stores a Warning for each reading outside
+// of its range (see thresholdWarnings).
+func (db *DB) CreateWarnings(metrics []Metric, inventory []Inventory) ([]Warning, error) {
+	return db.InsertWarnings(thresholdWarnings(metrics, inventory))
+}
+
+// thresholdWarnings returns the threshold warnings of the metrics, for
+// the readings outside the ranges of the ProductThresholds of their
+// inventory-items. Metrics whose item is not in inventory are skipped.
+func thresholdWarnings(metrics []Metric, inventory []Inventory) []Warning {
+	invByItem := map[string]Inventory{}
+	for _, inv := range inventory {
+		invByItem[inv.ItemID.String()] = inv
+	}
+
+	warnings := []Warning{}
+	for _, m := range metrics {
+		inv, ok := invByItem[m.ItemID.String()]
+		if !ok {
+			continue
+		}
+		for _, w := range evaluateMetric(m, inv) {
+			w.WarningType = WarningThreshold
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings
+}
+
+// warnFindQuery compiles the query-tree in SearchQuery.Warning into the
+// findQuery of WarnAdvSearch. The warnings are restricted to the items of
+// searchInv, unless it is nil.
+func warnFindQuery(searchInv []Inventory, search *SearchQuery) (*findQuery, error) {
+	var node *QueryNode
+	var page *PageParams
+	var fields []string
+	if search != nil {
+		node = search.Warning
+		page = search.Page
+		if search.Fields != nil {
+			fields = search.Fields.Warning
+		}
+	}
+
+	var filter map[string]interface{}
+	var err error
+	if searchInv == nil {
+		filter, err = node.Filter()
+	} else {
+		ids := []string{}
+		for _, v := range searchInv {
+			ids = append(ids, v.ItemID.String())
+		}
+		filter, err = joinFilter("item_id", ids, node)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &findQuery{
+		filter: filter,
+		page:   page,
+		proj:   projection(fields),
+	}, nil
+}
+
+// WarnAdvSearch searches the warnings matching the query-tree in
+// SearchQuery.Warning. The warnings are restricted to the items of
+// searchInv, unless it is nil.
+func (db *DB) WarnAdvSearch(searchInv []Inventory, search *SearchQuery) ([]Warning, *PageResult, error) {
+	var page *PageParams
+	var fields []string
+	if search != nil {
+		page = search.Page
+		if search.Fields != nil {
+			fields = search.Fields.Warning
+		}
+	}
+
+	q, err := warnFindQuery(searchInv, search)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling warning query - WarnAdvSearch")
+		log.Println(err)
+		return nil, nil, err
+	}
+
+	findResults, pageResult, err := db.findPage(q)
+	if err != nil {
+		err = errors.Wrap(err, "Error while fetching results from warnings.")
+		log.Println(err)
+		return nil, nil, err
+	}
+
+	//length
+	if len(findResults) == 0 && !page.continues() {
+		msg := "No results found - WarnAdvSearch"
+		return nil, nil, errors.New(msg)
+	}
+
+	warnings := []Warning{}
+	for _, v := range findResults {
+		result := v.(*Warning)
+		result.selectedFields = fields
+		warnings = append(warnings, *result)
+	}
+	return warnings, pageResult, nil
+}
+
+// WarnExplain explains the search which WarnAdvSearch would run.
+func (db *DB) WarnExplain(searchInv []Inventory, search *SearchQuery) (*Explanation, error) {
+	q, err := warnFindQuery(searchInv, search)
+	if err != nil {
+		err = errors.Wrap(err, "Error compiling warning query - WarnExplain")
+		log.Println(err)
+		return nil, err
+	}
+
+	explanation, err := db.explainFind(q)
+	if err != nil {
+		err = errors.Wrap(err, "Error explaining warning search - WarnExplain")
+		return nil, err
+	}
+	return explanation, nil
+}
@@ -0,0 +1,115 @@
+package report
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/TerrexTech/uuuid"
+)
+
+func TestThresholdWarnings(t *testing.T) {
+	banana, _ := uuuid.FromString("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+	lettuce, _ := uuuid.FromString("6ba7b812-9dad-11d1-80b4-00c04fd430c8")
+	unknown, _ := uuuid.FromString("6ba7b813-9dad-11d1-80b4-00c04fd430c8")
+	inventory := []Inventory{
+		{ItemID: banana, Name: "Banana"},
+		{ItemID: lettuce, Name: "Lettuce"},
+	}
+
+	tests := []struct {
+		name    string
+		metrics []Metric
+		// want are the product-names and channels of the warnings
+		want []string
+	}{
+		{
+			name: "readings outside the ranges",
+			metrics: []Metric{
+				{ItemID: banana, TempIn: 20, Humidity: 90},
+				{ItemID: lettuce, TempIn: 20, Humidity: 95},
+			},
+			want: []string{"Banana temp_in", "Lettuce temp_in"},
+		},
+		{
+			name:    "readings within the ranges",
+			metrics: []Metric{{ItemID: banana, TempIn: 14, Humidity: 90}},
+			want:    []string{},
+		},
+		{
+			name:    "item not in the inventory",
+			metrics: []Metric{{ItemID: unknown, TempIn: 100}},
+			want:    []string{},
+		},
+	}
+
+	for _, test := range tests {
+		got := []string{}
+		for _, w := range thresholdWarnings(test.metrics, inventory) {
+			got = append(got, w.ProdName+" "+w.Channel)
+			if w.WarningType != WarningThreshold {
+				t.Errorf("%s: got warning-type %q, want %q", test.name, w.WarningType, WarningThreshold)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got warnings %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWarnFindQuery(t *testing.T) {
+	itemID, _ := uuuid.FromString("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+	high := &QueryNode{
+		SearchParam: SearchParam{Field: "severity", Type: "string", Op: OpEqual, Value: SeverityHigh},
+	}
+	highFilter := map[string]interface{}{"severity": map[string]interface{}{"$eq": SeverityHigh}}
+	page := &PageParams{Size: 10}
+
+	tests := []struct {
+		name      string
+		searchInv []Inventory
+		search    *SearchQuery
+		want      *findQuery
+	}{
+		{
+			name:   "all warnings",
+			search: &SearchQuery{Warning: high, Page: page},
+			want:   &findQuery{filter: highFilter, page: page},
+		},
+		{
+			name:      "warnings of the items",
+			searchInv: []Inventory{{ItemID: itemID}},
+			search: &SearchQuery{
+				Warning: high,
+				Fields:  &FieldSet{Warning: []string{"severity"}},
+			},
+			want: &findQuery{
+				filter: map[string]interface{}{
+					"$and": []interface{}{
+						map[string]interface{}{"item_id": map[string]interface{}{"$in": []interface{}{itemID.String()}}},
+						highFilter,
+					},
+				},
+				proj: map[string]interface{}{"severity": 1},
+			},
+		},
+		{
+			name:      "no items",
+			searchInv: []Inventory{},
+			search:    nil,
+			want: &findQuery{
+				filter: map[string]interface{}{"item_id": map[string]interface{}{"$in": []interface{}{}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := warnFindQuery(test.searchInv, test.search)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, *got, *test.want)
+		}
+	}
+}
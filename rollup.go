@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/pkg/errors"
+)
+
+// MetricRollup groups the metrics of the matching inventory by device or
+// item into time-buckets, with the statistics of each sensor-channel.
+// The request-body is a RollupQuery with its "rollup" set, such as:
+//  {"inventory": [...], "metric": [...], "rollup": {"group_by": "device", "interval": "hourly"}}
+func (env *Env) MetricRollup(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	query := &report.RollupQuery{}
+	if !env.readReportQuery(w, r, query, "") {
+		return
+	}
+	if query.Rollup == nil {
+		writeValidationErrors(w, report.ValidationErrors{
+			report.ValidationError{
+				Path:    "rollup",
+				Message: "rollup is required",
+			},
+		})
+		return
+	}
+	if query.Explain {
+		writeExplainUnsupported(w)
+		return
+	}
+
+	invQuery := query.SearchQuery
+	invQuery.Page = nil
+
+	invSearchResult, _, err := env.Inventorydb.InvAdvSearch(&invQuery)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the search Inventory - MetricRollup")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rollupQuery, rawQuery, err := env.splitSearch(&query.SearchQuery)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to select the metrics - MetricRollup")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	cal, err := env.calibrator(inventoryDevices(invSearchResult), query.Units)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the calibrations - MetricRollup")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	buckets, err := env.Metricdb.MetRollup(invSearchResult, &report.RollupQuery{
+		SearchQuery: *rawQuery,
+		Rollup:      query.Rollup,
+	}, cal)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to rollup metrics - MetricRollup")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// The statistics of the rollups are combined with those of
+	// the raw metrics from the raw retention onward
+	if rollupQuery != nil {
+		rollupBuckets, err := env.MetricRollupdb.CompactedRollup(invSearchResult, &report.RollupQuery{
+			SearchQuery: *rollupQuery,
+			Rollup:      query.Rollup,
+		}, cal)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to rollup metric rollups - MetricRollup")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		buckets = report.MergeRollupBuckets(rollupBuckets, buckets)
+	}
+
+	rollupByte, err := json.Marshal(buckets)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal rollup - MetricRollup")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(rollupByte)
+}
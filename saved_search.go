@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/TerrexTech/uuuid"
+	"github.com/pkg/errors"
+)
+
+// SavedSearch manages the saved searches of a customer:
+//  GET    ?rs_customer_id=<id>                lists the saved searches
+//  POST   {rs_customer_id, name, query, ...}  creates a saved search
+//  PUT    {search_id, rs_customer_id, ...}    updates a saved search
+//  DELETE ?search_id=<id>&rs_customer_id=<id> deletes a saved search
+// PUT only updates the name, description and query which are sent.
+// A saved search is run by sending its search_id as "saved_search_id",
+// with its "rs_customer_id", to any of the report endpoints.
+func (env *Env) SavedSearch(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	var result interface{}
+
+	switch r.Method {
+	case "GET":
+		customerID, err := uuuid.FromString(r.URL.Query().Get("rs_customer_id"))
+		if err != nil {
+			err = errors.Wrap(err, "Invalid rs_customer_id - SavedSearch")
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		searches, err := env.SavedSearchdb.SavedSearches(customerID)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to list saved searches - SavedSearch")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		result = searches
+
+	case "POST", "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the request body")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		search := &report.SavedSearch{}
+		err = json.Unmarshal(body, search)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to unmarshal - SavedSearch")
+			log.Println(err)
+			writeValidationErrors(w, report.ValidationErrors{
+				report.ValidationError{
+					Message: err.Error(),
+				},
+			})
+			return
+		}
+
+		if search.RsCustomerID.String() == (uuuid.UUID{}).String() {
+			writeValidationErrors(w, report.ValidationErrors{
+				report.ValidationError{
+					Path:    "rs_customer_id",
+					Message: "rs_customer_id is required",
+				},
+			})
+			return
+		}
+		if search.Query != nil {
+			// Nested saved searches are not supported
+			search.Query.SavedSearchID = ""
+			search.Query.RsCustomerID = ""
+			verrs := search.Query.Validate()
+			if verrs != nil {
+				writeValidationErrors(w, verrs)
+				return
+			}
+		}
+
+		if r.Method == "POST" {
+			result, err = env.SavedSearchdb.SaveSearch(search)
+			if err != nil {
+				err = errors.Wrap(err, "Unable to store saved search - SavedSearch")
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			break
+		}
+
+		// Only the fields sent are updated
+		sent := map[string]json.RawMessage{}
+		err = json.Unmarshal(body, &sent)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to unmarshal fields - SavedSearch")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fields := []string{}
+		for field := range sent {
+			fields = append(fields, field)
+		}
+
+		updated, err := env.SavedSearchdb.UpdateSavedSearch(search, fields)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to update saved search - SavedSearch")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if updated == nil {
+			log.Println("No saved search found for customer - SavedSearch")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		result = updated
+
+	case "DELETE":
+		searchID, err := uuuid.FromString(r.URL.Query().Get("search_id"))
+		if err != nil {
+			err = errors.Wrap(err, "Invalid search_id - SavedSearch")
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		customerID, err := uuuid.FromString(r.URL.Query().Get("rs_customer_id"))
+		if err != nil {
+			err = errors.Wrap(err, "Invalid rs_customer_id - SavedSearch")
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		err = env.SavedSearchdb.DeleteSavedSearch(searchID, customerID)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to delete saved search - SavedSearch")
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	resultByte, err := json.Marshal(result)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal saved search results - SavedSearch")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(resultByte)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/pkg/errors"
+)
+
+// ShelfLifeReport predicts the shelf-life of the matching inventory-items
+// from the temperature and ethylene recorded in their metrics, and compares
+// it with their ExpiryDate. Items of products without a ShelfLifeModel
+// are left out of "ShelfLife".
+func (env *Env) ShelfLifeReport(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	query, ok := env.readSearchQuery(w, r, "inventory")
+	if !ok {
+		return
+	}
+	if query.Explain {
+		writeExplainUnsupported(w)
+		return
+	}
+
+	// The prediction needs the name and dates of the items, which are
+	// searched along with the requested fields
+	invQuery := *query
+	if query.Fields != nil && len(query.Fields.Inventory) > 0 {
+		fields := *query.Fields
+		fields.Inventory = append(
+			append([]string{}, query.Fields.Inventory...), report.ShelfLifeFields...,
+		)
+		invQuery.Fields = &fields
+	}
+
+	invSearchResult, pageResult, err := env.Inventorydb.InvAdvSearch(&invQuery)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the search Inventory - ShelfLifeReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if invQuery.Fields != query.Fields {
+		for i := range invSearchResult {
+			invSearchResult[i].SelectFields(query.Fields.Inventory)
+		}
+	}
+
+	now := time.Now()
+
+	cal, err := env.calibrator(inventoryDevices(invSearchResult), query.Units)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the calibrations - ShelfLifeReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Items which arrived before the raw retention are read from the
+	// rollups, and from the raw metrics from the raw retention onward
+	rollupQuery, rawQuery := env.splitItems(invSearchResult, query.Metric)
+	metrics, err := env.Metricdb.ItemMetrics(invSearchResult, rawQuery, cal)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to read the item metrics - ShelfLifeReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if rollupQuery != nil {
+		rollupMetrics, err := env.MetricRollupdb.ItemMetrics(invSearchResult, rollupQuery, cal)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the item metric rollups - ShelfLifeReport")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// The rollups are before the raw metrics
+		for itemID, itemMetrics := range metrics {
+			rollupMetrics[itemID] = append(rollupMetrics[itemID], itemMetrics...)
+		}
+		metrics = rollupMetrics
+	}
+
+	// The metrics are filtered in the requested units, and the
+	// models are in the canonical units
+	canonical := cal.WithUnits(nil)
+	for _, itemMetrics := range metrics {
+		canonical.Apply(itemMetrics)
+	}
+
+	shelfLife := []report.ShelfLife{}
+	for _, inv := range invSearchResult {
+		sl, ok := report.PredictShelfLife(inv, metrics[inv.ItemID.String()], now)
+		if ok {
+			shelfLife = append(shelfLife, *sl)
+		}
+	}
+
+	respObject := ReportResponse{
+		Inventory: invSearchResult,
+		ShelfLife: shelfLife,
+	}
+
+	var resp interface{} = &respObject
+	if pageResult != nil {
+		resp = &PagedResponse{
+			Total:      pageResult.Total,
+			NextCursor: pageResult.NextCursor,
+			Items:      respObject,
+		}
+	}
+
+	shelfLifeByte, err := json.Marshal(resp)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal ShelfLife results - ShelfLifeReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(shelfLifeByte)
+}
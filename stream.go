@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/pkg/errors"
+)
+
+// Control-events sent on the streams, besides the metrics and warnings.
+const (
+	// streamReset is sent when the events since the Last-Event-ID are no
+	// longer kept, so the client should reload its data (e.g. from
+	// /met-report) before using the new events.
+	streamReset = "reset"
+	// streamLagged is sent before closing the stream of a client which
+	// did not keep up. It can reconnect with its Last-Event-ID.
+	streamLagged = "lagged"
+)
+
+// streamKeepAlive is how often an idle stream is written to.
+const streamKeepAlive = 15 * time.Second
+
+// publishStream sends the new metrics and warnings to the subscribers
+// of the Stream. The inventory gives the customers of the metrics.
+func (env *Env) publishStream(metrics []report.Metric, inventory []report.Inventory, warnings []report.Warning) {
+	if env.Stream == nil {
+		return
+	}
+
+	metricEvents, err := report.MetricEvents(metrics, inventory)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to create metric events - publishStream")
+		log.Println(err)
+	}
+	warningEvents, err := report.WarningEvents(warnings)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to create warning events - publishStream")
+		log.Println(err)
+	}
+	env.Stream.Publish(append(metricEvents, warningEvents...))
+}
+
+// StreamEvents streams new metrics and warnings as they are stored, over
+// Server-Sent Events, or over a WebSocket if the request is an upgrade.
+// The filter is in the URL-query (see report.StreamFilterFromQuery):
+//  GET /stream?device_id=<id>&type=warning
+// Clients resume after their last event with the "Last-Event-ID" header,
+// or the "last_event_id" query-parameter for WebSockets. Clients which
+// fall behind get a "lagged" event and are disconnected, so they can
+// resume from their last event.
+func (env *Env) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Last-Event-ID")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := report.StreamFilterFromQuery(r.URL.Query())
+	if err != nil {
+		if verrs, ok := err.(report.ValidationErrors); ok {
+			writeValidationErrors(w, verrs)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	if isWebSocketUpgrade(r) {
+		env.streamWebSocket(w, r, filter, lastEventID)
+		return
+	}
+	env.streamSSE(w, r, filter, lastEventID)
+}
+
+// writeSSE writes the event in the text/event-stream format.
+func writeSSE(w io.Writer, e report.StreamEvent) error {
+	data := []byte(e.Data)
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
+	if e.ID != "" {
+		fmt.Fprintf(w, "id: %s\n", e.ID)
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return err
+}
+
+func (env *Env) streamSSE(w http.ResponseWriter, r *http.Request, filter *report.StreamFilter, lastEventID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Streaming is not supported by the connection - streamSSE")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sub, replay, complete := env.Stream.Subscribe(filter, lastEventID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		writeSSE(w, report.StreamEvent{Type: streamReset})
+	}
+	for _, e := range replay {
+		if err := writeSSE(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.Events:
+			if !ok {
+				// Only closed here if the client fell behind
+				writeSSE(w, report.StreamEvent{Type: streamLagged})
+				flusher.Flush()
+				return
+			}
+			if err := writeSSE(w, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (env *Env) streamWebSocket(w http.ResponseWriter, r *http.Request, filter *report.StreamFilter, lastEventID string) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to upgrade to WebSocket - streamWebSocket")
+		log.Println(err)
+		return
+	}
+
+	sub, replay, complete := env.Stream.Subscribe(filter, lastEventID)
+	defer sub.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		ws.readLoop()
+		close(closed)
+	}()
+
+	send := func(e report.StreamEvent) error {
+		msg, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return ws.WriteText(msg)
+	}
+
+	if !complete {
+		send(report.StreamEvent{Type: streamReset})
+	}
+	for _, e := range replay {
+		if err := send(e); err != nil {
+			ws.conn.Close()
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.Events:
+			if !ok {
+				// Only closed here if the client fell behind,
+				// 1013 is "Try Again Later"
+				send(report.StreamEvent{Type: streamLagged})
+				ws.Close(1013)
+				return
+			}
+			if err := send(e); err != nil {
+				ws.conn.Close()
+				return
+			}
+		case <-keepAlive.C:
+			if err := ws.Ping(); err != nil {
+				ws.conn.Close()
+				return
+			}
+		case <-closed:
+			ws.conn.Close()
+			return
+		}
+	}
+}
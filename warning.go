@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/TerrexTech/go-agg-reports/report"
+	"github.com/pkg/errors"
+)
+
+// isInventorySearched returns true if the query restricts the inventory.
+func isInventorySearched(query *report.SearchQuery) bool {
+	return query.Inventory != nil || query.Text != nil
+}
+
+// WarningReport searches the warnings created for metric readings outside
+// of the ideal ranges of their products, using the query-tree in "warning".
+// If the inventory is also searched, only the warnings for the matching
+// inventory-items are returned.
+func (env *Env) WarningReport(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers",
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+	}
+	// Stop here if its Preflighted OPTIONS request
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	query, ok := env.readSearchQuery(w, r, "warning")
+	if !ok {
+		return
+	}
+	if query.Explain {
+		env.writeExplanation(w, query, "warning")
+		return
+	}
+
+	var invSearchResult []report.Inventory
+	if isInventorySearched(query) {
+		// The page applies to the report's results, so all matching
+		// inventory is fetched.
+		invQuery := *query
+		invQuery.Page = nil
+
+		var err error
+		invSearchResult, _, err = env.Inventorydb.InvAdvSearch(&invQuery)
+		if err != nil {
+			err = errors.Wrap(err, "Unable to read the search Inventory - WarningReport")
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	warningResult, pageResult, err := env.Warningdb.WarnAdvSearch(invSearchResult, query)
+	if err != nil {
+		err = errors.Wrap(err, "Did not get warning query result - WarningReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	respObject := ReportResponse{
+		Inventory: invSearchResult,
+		Warning:   warningResult,
+	}
+
+	var resp interface{} = &respObject
+	if pageResult != nil {
+		resp = &PagedResponse{
+			Total:      pageResult.Total,
+			NextCursor: pageResult.NextCursor,
+			Items:      respObject,
+		}
+	}
+
+	warningByte, err := json.Marshal(resp)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to marshal Warning results - WarningReport")
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(warningByte)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The subset of the WebSocket protocol (RFC 6455) needed to push events:
+// text-messages to the client, and answering pings and close-frames.
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	// wsGUID is appended to the client-key for the accept-key.
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// wsMaxFrame is the largest frame read from clients,
+	// which only send control-frames.
+	wsMaxFrame = 4096
+	// wsWriteTimeout is how long a write to a client may block.
+	wsWriteTimeout = 10 * time.Second
+)
+
+// wsConn is a server-side WebSocket connection.
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	// writeMu serializes the frames of the reader and writer
+	writeMu sync.Mutex
+}
+
+// isWebSocketUpgrade returns true if the request asks for a WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// upgradeWebSocket completes the WebSocket handshake, and takes over
+// the connection of the request.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, errors.New("Invalid WebSocket handshake")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, errors.New("Connection does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		err = errors.Wrap(err, "Unable to hijack connection")
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + wsGUID))
+	accept := base64.StdEncoding.EncodeToString(hash[:])
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		err = errors.Wrap(err, "Unable to write handshake")
+		return nil, err
+	}
+
+	return &wsConn{
+		conn: conn,
+		rw:   rw,
+	}, nil
+}
+
+// writeFrame writes an unmasked frame with the payload.
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	length := len(payload)
+	switch {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	ws.rw.Write(header)
+	ws.rw.Write(payload)
+	return ws.rw.Flush()
+}
+
+// WriteText sends a text-message.
+func (ws *wsConn) WriteText(payload []byte) error {
+	return ws.writeFrame(wsOpText, payload)
+}
+
+// Ping sends a ping, to keep the connection open through proxies.
+func (ws *wsConn) Ping() error {
+	return ws.writeFrame(wsOpPing, nil)
+}
+
+// readFrame reads a masked client-frame.
+func (ws *wsConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(ws.rw, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(ws.rw, ext); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(ws.rw, ext); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if !masked {
+		return 0, nil, errors.New("Client frame is not masked")
+	}
+	if length > wsMaxFrame {
+		return 0, nil, errors.New("Client frame is too large")
+	}
+
+	mask := make([]byte, 4)
+	if _, err = io.ReadFull(ws.rw, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(ws.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readLoop answers the control-frames of the client, and ignores its
+// messages. It returns when the client closes the connection.
+func (ws *wsConn) readLoop() {
+	for {
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsOpPing:
+			ws.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			ws.writeFrame(wsOpClose, payload)
+			return
+		}
+	}
+}
+
+// Close sends a close-frame with the status-code and closes the connection.
+func (ws *wsConn) Close(code uint16) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	ws.writeFrame(wsOpClose, payload)
+	return ws.conn.Close()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// clientFrame returns the masked frame of a client with the payload.
+func clientFrame(opcode byte, payload []byte, masked bool) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode}
+
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	if masked {
+		frame = append(frame, mask...)
+	}
+	for i, b := range payload {
+		if masked {
+			b ^= mask[i%4]
+		}
+		frame = append(frame, b)
+	}
+	return frame
+}
+
+func TestWsReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   []byte
+		opcode  byte
+		payload []byte
+		wantErr bool
+	}{
+		{"ping", clientFrame(wsOpPing, []byte("hi"), true), wsOpPing, []byte("hi"), false},
+		{"empty close", clientFrame(wsOpClose, nil, true), wsOpClose, []byte{}, false},
+		{"16-bit length", clientFrame(wsOpText, bytes.Repeat([]byte("a"), 300), true), wsOpText, bytes.Repeat([]byte("a"), 300), false},
+		{"unmasked", clientFrame(wsOpText, []byte("hi"), false), 0, nil, true},
+		{"too large", clientFrame(wsOpText, make([]byte, wsMaxFrame+1), true), 0, nil, true},
+		{"64-bit length", clientFrame(wsOpText, make([]byte, 0x10000), true), 0, nil, true},
+		{"truncated", clientFrame(wsOpText, []byte("hello"), true)[:8], 0, nil, true},
+	}
+
+	for _, test := range tests {
+		ws := &wsConn{
+			rw: bufio.NewReadWriter(bufio.NewReader(bytes.NewReader(test.frame)), nil),
+		}
+		opcode, payload, err := ws.readFrame()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %t", test.name, err, test.wantErr)
+			continue
+		}
+		if opcode != test.opcode || !bytes.Equal(payload, test.payload) {
+			t.Errorf("%s: got opcode %x with %d bytes, want %x with %d", test.name, opcode, len(payload), test.opcode, len(test.payload))
+		}
+	}
+}
+
+func TestWsWriteFrame(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		header []byte
+	}{
+		{"empty", 0, []byte{0x81, 0}},
+		{"7-bit length", 125, []byte{0x81, 125}},
+		{"16-bit length", 126, []byte{0x81, 126, 0, 126}},
+		{"largest 16-bit length", 0xFFFF, []byte{0x81, 126, 0xFF, 0xFF}},
+		{"64-bit length", 0x10000, []byte{0x81, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+
+	for _, test := range tests {
+		server, client := net.Pipe()
+		ws := &wsConn{
+			conn: server,
+			rw:   bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)),
+		}
+		payload := bytes.Repeat([]byte("a"), test.length)
+		go func() {
+			ws.WriteText(payload)
+			server.Close()
+		}()
+
+		frame, err := ioutil.ReadAll(client)
+		client.Close()
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		want := append(append([]byte{}, test.header...), payload...)
+		if !bytes.Equal(frame, want) {
+			t.Errorf("%s: got frame of %d bytes with header %x, want %d bytes with header %x",
+				test.name, len(frame), frame[:len(test.header)], len(want), test.header)
+		}
+	}
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		ws.WriteText([]byte("hello"))
+		ws.Close(1000)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		headers string
+		status  int
+	}{
+		{
+			name:    "handshake",
+			headers: "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n",
+			status:  http.StatusSwitchingProtocols,
+		},
+		{
+			name:    "missing key",
+			headers: "Sec-WebSocket-Version: 13\r\n",
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "unsupported version",
+			headers: "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 8\r\n",
+			status:  http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+		if err != nil {
+			t.Fatalf("%s: Dial: %v", test.name, err)
+		}
+		conn.Write([]byte(
+			"GET /stream HTTP/1.1\r\nHost: localhost\r\n" +
+				"Upgrade: websocket\r\nConnection: Upgrade\r\n" + test.headers + "\r\n",
+		))
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Errorf("%s: ReadResponse: %v", test.name, err)
+			conn.Close()
+			continue
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, resp.StatusCode, test.status)
+		}
+		if test.status != http.StatusSwitchingProtocols {
+			conn.Close()
+			continue
+		}
+
+		// The accept-key of the example in RFC 6455
+		if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Errorf("%s: got Sec-WebSocket-Accept %s", test.name, accept)
+		}
+		frames, _ := ioutil.ReadAll(reader)
+		want := append([]byte{0x81, 5}, "hello"...)
+		want = append(want, 0x88, 2, 0x03, 0xE8)
+		if !bytes.Equal(frames, want) {
+			t.Errorf("%s: got frames %x, want %x", test.name, frames, want)
+		}
+		conn.Close()
+	}
+}